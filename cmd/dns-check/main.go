@@ -0,0 +1,348 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nixwiz/http-checks/internal/buildinfo"
+	"github.com/nixwiz/http-checks/internal/exitstatus"
+	"github.com/nixwiz/http-checks/internal/httpclient"
+	"github.com/nixwiz/http-checks/internal/logging"
+	"github.com/nixwiz/http-checks/internal/overrides"
+	"github.com/nixwiz/http-checks/internal/selfmetrics"
+	corev2 "github.com/sensu/sensu-go/api/core/v2"
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+)
+
+// Config represents the check plugin config.
+type Config struct {
+	sensu.PluginConfig
+	Name                 string
+	RecordType           string
+	Resolver             string
+	ExpectedAnswers      []string
+	MinAnswers           int
+	Timeout              int
+	Warning              string
+	Critical             string
+	OutputInMilliseconds bool
+	Source               httpclient.SourceConfig
+	Log                  logging.Config
+	Overrides            overrides.Config
+	Status               exitstatus.Config
+	Metrics              selfmetrics.Config
+}
+
+var (
+	warning, critical time.Duration
+
+	plugin = Config{
+		PluginConfig: sensu.PluginConfig{
+			Name:     "dns-check",
+			Short:    "DNS Resolution Check",
+			Keyspace: "sensu.io/plugins/dns-check/config",
+		},
+	}
+
+	options = []*sensu.PluginConfigOption{
+		{
+			Path:      "name",
+			Env:       "CHECK_NAME",
+			Argument:  "name",
+			Shorthand: "n",
+			Default:   "",
+			Usage:     "Name to resolve",
+			Value:     &plugin.Name,
+		},
+		{
+			Path:      "type",
+			Env:       "",
+			Argument:  "type",
+			Shorthand: "r",
+			Default:   "A",
+			Usage:     "Record type to resolve, one of A, AAAA, CNAME, MX, NS, PTR, SRV, TXT",
+			Value:     &plugin.RecordType,
+		},
+		{
+			Path:      "resolver",
+			Env:       "",
+			Argument:  "resolver",
+			Shorthand: "s",
+			Default:   "",
+			Usage:     "Resolver to query in host[:port] form, if not provided the system resolver is used",
+			Value:     &plugin.Resolver,
+		},
+		{
+			Path:      "expected-answer",
+			Env:       "",
+			Argument:  "expected-answer",
+			Shorthand: "e",
+			Default:   []string{},
+			Usage:     "Answer(s) that must be present in the response",
+			Value:     &plugin.ExpectedAnswers,
+		},
+		{
+			Path:      "min-answers",
+			Env:       "",
+			Argument:  "min-answers",
+			Shorthand: "m",
+			Default:   1,
+			Usage:     "Minimum number of answers expected",
+			Value:     &plugin.MinAnswers,
+		},
+		{
+			Path:      "timeout",
+			Env:       "",
+			Argument:  "timeout",
+			Shorthand: "T",
+			Default:   15,
+			Usage:     "Query timeout in seconds",
+			Value:     &plugin.Timeout,
+		},
+		{
+			Path:      "warning",
+			Env:       "",
+			Argument:  "warning",
+			Shorthand: "w",
+			Default:   "500ms",
+			Usage:     "Warning threshold, can be expressed as seconds or milliseconds (1s = 1000ms)",
+			Value:     &plugin.Warning,
+		},
+		{
+			Path:      "critical",
+			Env:       "",
+			Argument:  "critical",
+			Shorthand: "c",
+			Default:   "1s",
+			Usage:     "Critical threshold, can be expressed as seconds or milliseconds (1s = 1000ms)",
+			Value:     &plugin.Critical,
+		},
+		{
+			Path:      "output-in-ms",
+			Env:       "",
+			Argument:  "output-in-ms",
+			Shorthand: "",
+			Default:   false,
+			Usage:     "Provide output in milliseconds (default false, display in seconds)",
+			Value:     &plugin.OutputInMilliseconds,
+		},
+	}
+)
+
+func main() {
+	options = append(options, plugin.Source.Options()...)
+	options = append(options, plugin.Log.Options()...)
+	options = append(options, plugin.Overrides.Options()...)
+	options = append(options, plugin.Status.Options()...)
+	options = append(options, plugin.Metrics.Options()...)
+	buildinfo.Handle(plugin.PluginConfig.Name, options, os.Args[1:])
+	exitstatus.ParseFlags(plugin.PluginConfig.Name, options, os.Args[1:])
+	check := sensu.NewGoCheck(&plugin.PluginConfig, options, plugin.Status.Wrap(plugin.PluginConfig.Name, checkArgs), plugin.Metrics.Wrap(plugin.PluginConfig.Name, plugin.Status.Wrap(plugin.PluginConfig.Name, executeCheck)), overrides.Requested(os.Args[1:]))
+	check.Execute()
+}
+
+func checkArgs(event *corev2.Event) (int, error) {
+	if err := plugin.Log.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+
+	var err error
+
+	if len(plugin.Name) == 0 {
+		return sensu.CheckStateUnknown, fmt.Errorf("--name or CHECK_NAME environment variable is required")
+	}
+	plugin.RecordType = strings.ToUpper(plugin.RecordType)
+	switch plugin.RecordType {
+	case "A", "AAAA", "CNAME", "MX", "NS", "PTR", "SRV", "TXT":
+	default:
+		return sensu.CheckStateUnknown, fmt.Errorf("--type %q is not a supported record type", plugin.RecordType)
+	}
+	if plugin.MinAnswers < 0 {
+		return sensu.CheckStateUnknown, fmt.Errorf("--min-answers must be 0 or greater")
+	}
+	warning, err = time.ParseDuration(plugin.Warning)
+	if err != nil {
+		return sensu.CheckStateUnknown, fmt.Errorf("--warning %q is not a valid duration: %v", plugin.Warning, err)
+	}
+	critical, err = time.ParseDuration(plugin.Critical)
+	if err != nil {
+		return sensu.CheckStateUnknown, fmt.Errorf("--critical %q is not a valid duration: %v", plugin.Critical, err)
+	}
+
+	if err := plugin.Source.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+
+	return sensu.CheckStateOK, nil
+}
+
+func executeCheck(event *corev2.Event) (int, error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(plugin.Timeout)*time.Second)
+	defer cancel()
+
+	resolver := plugin.Resolver
+	if len(resolver) == 0 {
+		resolver = "system"
+	}
+	logging.Debug("dns lookup", "name", plugin.Name, "type", plugin.RecordType, "resolver", resolver)
+	start := time.Now()
+	selfmetrics.AddDNSLookup()
+	answers, err := lookup(ctx, newResolver(), plugin.RecordType, plugin.Name)
+	duration := time.Since(start)
+	logging.Debug("dns lookup done", "answers", strings.Join(answers, ","), "error", err, "elapsed", duration)
+
+	var output, perfdata string
+	if plugin.OutputInMilliseconds {
+		output = fmt.Sprintf("%dms", duration.Milliseconds())
+		perfdata = fmt.Sprintf("resolution_duration=%d, answers=%d", duration.Milliseconds(), len(answers))
+	} else {
+		output = fmt.Sprintf("%0.6fs", duration.Seconds())
+		perfdata = fmt.Sprintf("resolution_duration=%0.6f, answers=%d", duration.Seconds(), len(answers))
+	}
+
+	if err != nil {
+		selfmetrics.AddError(httpclient.Classify(err))
+		fmt.Fprintf(selfmetrics.Stdout, "%s CRITICAL: %s lookup of %s failed: %v | %s\n", plugin.PluginConfig.Name, plugin.RecordType, plugin.Name, err, perfdata)
+		return sensu.CheckStateCritical, nil
+	}
+
+	if len(answers) < plugin.MinAnswers {
+		fmt.Fprintf(selfmetrics.Stdout, "%s CRITICAL: %d %s answers for %s, expected at least %d | %s\n", plugin.PluginConfig.Name, len(answers), plugin.RecordType, plugin.Name, plugin.MinAnswers, perfdata)
+		return sensu.CheckStateCritical, nil
+	}
+
+	missing := missingAnswers(answers, plugin.ExpectedAnswers)
+	if len(missing) > 0 {
+		fmt.Fprintf(selfmetrics.Stdout, "%s CRITICAL: %s lookup of %s did not return %s (got %s) | %s\n", plugin.PluginConfig.Name, plugin.RecordType, plugin.Name, strings.Join(missing, ", "), strings.Join(answers, ", "), perfdata)
+		return sensu.CheckStateCritical, nil
+	}
+
+	summary := fmt.Sprintf("%d %s answers for %s in %s (%s)", len(answers), plugin.RecordType, plugin.Name, output, strings.Join(answers, ", "))
+	switch {
+	case duration > critical:
+		fmt.Fprintf(selfmetrics.Stdout, "%s CRITICAL: %s | %s\n", plugin.PluginConfig.Name, summary, perfdata)
+		return sensu.CheckStateCritical, nil
+	case duration > warning:
+		fmt.Fprintf(selfmetrics.Stdout, "%s WARNING: %s | %s\n", plugin.PluginConfig.Name, summary, perfdata)
+		return sensu.CheckStateWarning, nil
+	}
+
+	fmt.Fprintf(selfmetrics.Stdout, "%s OK: %s | %s\n", plugin.PluginConfig.Name, summary, perfdata)
+	return sensu.CheckStateOK, nil
+}
+
+// newResolver returns a resolver that queries --resolver if provided,
+// otherwise the system resolver. With a source address the pure Go resolver
+// is used, so its queries are sent from that address too.
+func newResolver() *net.Resolver {
+	if len(plugin.Resolver) == 0 {
+		if plugin.Source.LocalAddr("udp") == nil {
+			return net.DefaultResolver
+		}
+		return &net.Resolver{
+			PreferGo: true,
+			Dial:     plugin.Source.DialContext,
+		}
+	}
+	address := plugin.Resolver
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, "53")
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return plugin.Source.DialContext(ctx, network, address)
+		},
+	}
+}
+
+// lookup resolves name for the given record type, returning the answers as
+// sorted strings.
+func lookup(ctx context.Context, resolver *net.Resolver, recordType, name string) ([]string, error) {
+	answers := []string{}
+	switch recordType {
+	case "A", "AAAA":
+		// Only the queried record type is looked up, an A lookup is not
+		// failed by an AAAA query timing out or the other way around.
+		network := "ip4"
+		if recordType == "AAAA" {
+			network = "ip6"
+		}
+		ips, err := resolver.LookupIP(ctx, network, name)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range ips {
+			answers = append(answers, ip.String())
+		}
+	case "CNAME":
+		cname, err := resolver.LookupCNAME(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		answers = append(answers, cname)
+	case "MX":
+		records, err := resolver.LookupMX(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		for _, mx := range records {
+			answers = append(answers, fmt.Sprintf("%d %s", mx.Pref, mx.Host))
+		}
+	case "NS":
+		records, err := resolver.LookupNS(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		for _, ns := range records {
+			answers = append(answers, ns.Host)
+		}
+	case "PTR":
+		names, err := resolver.LookupAddr(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		answers = append(answers, names...)
+	case "SRV":
+		_, records, err := resolver.LookupSRV(ctx, "", "", name)
+		if err != nil {
+			return nil, err
+		}
+		for _, srv := range records {
+			answers = append(answers, fmt.Sprintf("%d %d %d %s", srv.Priority, srv.Weight, srv.Port, srv.Target))
+		}
+	case "TXT":
+		records, err := resolver.LookupTXT(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		answers = append(answers, records...)
+	}
+	sort.Strings(answers)
+	return answers, nil
+}
+
+// missingAnswers returns the expected answers not found in answers. Names are
+// compared case insensitively and without regard to a trailing dot.
+func missingAnswers(answers, expected []string) []string {
+	missing := []string{}
+	for _, e := range expected {
+		found := false
+		for _, a := range answers {
+			if strings.EqualFold(strings.TrimSuffix(a, "."), strings.TrimSuffix(e, ".")) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, e)
+		}
+	}
+	return missing
+}
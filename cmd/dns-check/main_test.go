@@ -0,0 +1,170 @@
+package main
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+
+	corev2 "github.com/sensu/sensu-go/api/core/v2"
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestMain(t *testing.T) {
+}
+
+// aaaaQueries counts the AAAA queries answered by serveDNS.
+var aaaaQueries int64
+
+// serveDNS answers A queries for www.example.com. with 192.0.2.1 and
+// 192.0.2.2, other queries for it without answers and every other query with
+// NXDOMAIN.
+func serveDNS(t *testing.T) net.PacketConn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var msg dnsmessage.Message
+			if err := msg.Unpack(buf[:n]); err != nil || len(msg.Questions) == 0 {
+				continue
+			}
+			q := msg.Questions[0]
+			if q.Type == dnsmessage.TypeAAAA {
+				atomic.AddInt64(&aaaaQueries, 1)
+			}
+			msg.Header.Response = true
+			msg.Header.Authoritative = true
+			if q.Name.String() != "www.example.com." {
+				msg.Header.RCode = dnsmessage.RCodeNameError
+			} else if q.Type == dnsmessage.TypeA {
+				for _, ip := range [][4]byte{{192, 0, 2, 1}, {192, 0, 2, 2}} {
+					msg.Answers = append(msg.Answers, dnsmessage.Resource{
+						Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+						Body:   &dnsmessage.AResource{A: ip},
+					})
+				}
+			}
+			packed, err := msg.Pack()
+			if err != nil {
+				continue
+			}
+			_, _ = conn.WriteTo(packed, addr)
+		}
+	}()
+	return conn
+}
+
+func TestExecuteCheck(t *testing.T) {
+
+	conn := serveDNS(t)
+	defer conn.Close()
+
+	testCases := []struct {
+		status     int
+		name       string
+		expected   []string
+		minAnswers int
+	}{
+		{sensu.CheckStateOK, "www.example.com", nil, 1},
+		{sensu.CheckStateOK, "www.example.com", []string{"192.0.2.2"}, 2},
+		{sensu.CheckStateCritical, "www.example.com", []string{"192.0.2.3"}, 1},
+		{sensu.CheckStateCritical, "www.example.com", nil, 3},
+		{sensu.CheckStateCritical, "missing.example.com", nil, 1},
+	}
+
+	for _, tc := range testCases {
+		event := corev2.FixtureEvent("entity1", "check")
+		assert := assert.New(t)
+
+		plugin.Name = tc.name
+		plugin.RecordType = "a"
+		plugin.Resolver = conn.LocalAddr().String()
+		plugin.ExpectedAnswers = tc.expected
+		plugin.MinAnswers = tc.minAnswers
+		plugin.Timeout = 5
+		plugin.Warning = "1s"
+		plugin.Critical = "2s"
+		status, err := checkArgs(event)
+		assert.NoError(err)
+		assert.Equal(sensu.CheckStateOK, status)
+		status, err = executeCheck(event)
+		assert.NoError(err)
+		assert.Equal(tc.status, status)
+	}
+
+	// A lookups do not query AAAA records.
+	assert.Equal(t, int64(0), atomic.LoadInt64(&aaaaQueries))
+	plugin.RecordType = "AAAA"
+	plugin.ExpectedAnswers = nil
+	plugin.MinAnswers = 1
+	status, err := checkArgs(corev2.FixtureEvent("entity1", "check"))
+	require.NoError(t, err)
+	assert.Equal(t, sensu.CheckStateOK, status)
+	status, err = executeCheck(corev2.FixtureEvent("entity1", "check"))
+	assert.NoError(t, err)
+	assert.Equal(t, sensu.CheckStateCritical, status)
+	assert.True(t, atomic.LoadInt64(&aaaaQueries) > 0)
+
+	plugin.Warning = "1"
+	_, err = checkArgs(corev2.FixtureEvent("entity1", "check"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `--warning "1" is not a valid duration`)
+	plugin.Warning = "1s"
+
+	plugin.RecordType = "SOA"
+	status, err = checkArgs(corev2.FixtureEvent("entity1", "check"))
+	assert.Error(t, err)
+	assert.Equal(t, sensu.CheckStateUnknown, status)
+}
+
+func TestExecuteCheckSourceIP(t *testing.T) {
+	assert := assert.New(t)
+	event := corev2.FixtureEvent("entity1", "check")
+
+	conn := serveDNS(t)
+	defer conn.Close()
+
+	plugin.Name = "www.example.com"
+	plugin.RecordType = "a"
+	plugin.Resolver = conn.LocalAddr().String()
+	plugin.ExpectedAnswers = nil
+	plugin.MinAnswers = 1
+	plugin.Timeout = 5
+	plugin.Warning = "1s"
+	plugin.Critical = "2s"
+	plugin.Source.IP = "127.0.0.1"
+	status, err := checkArgs(event)
+	assert.NoError(err)
+	assert.Equal(sensu.CheckStateOK, status)
+	status, err = executeCheck(event)
+	assert.NoError(err)
+	assert.Equal(sensu.CheckStateOK, status)
+
+	// The resolver cannot be reached from an IPv6 source address.
+	plugin.Source.IP = "::1"
+	status, err = checkArgs(event)
+	assert.NoError(err)
+	assert.Equal(sensu.CheckStateOK, status)
+	status, err = executeCheck(event)
+	assert.NoError(err)
+	assert.Equal(sensu.CheckStateCritical, status)
+
+	plugin.Source.IP = "not-an-ip"
+	status, err = checkArgs(event)
+	assert.Error(err)
+	assert.Equal(sensu.CheckStateUnknown, status)
+	plugin.Source.IP = ""
+}
+
+func TestMissingAnswers(t *testing.T) {
+	assert := assert.New(t)
+	assert.Empty(missingAnswers([]string{"mail.example.com."}, []string{"MAIL.example.com"}))
+	assert.Equal([]string{"b"}, missingAnswers([]string{"a"}, []string{"a", "b"}))
+}
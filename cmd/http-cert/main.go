@@ -0,0 +1,511 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/nixwiz/http-checks/internal/buildinfo"
+	"github.com/nixwiz/http-checks/internal/exitstatus"
+	"github.com/nixwiz/http-checks/internal/httpclient"
+	"github.com/nixwiz/http-checks/internal/logging"
+	"github.com/nixwiz/http-checks/internal/overrides"
+	"github.com/nixwiz/http-checks/internal/selfmetrics"
+	corev2 "github.com/sensu/sensu-go/api/core/v2"
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+)
+
+// Config represents the check plugin config.
+type Config struct {
+	sensu.PluginConfig
+	URL                          string
+	TrustedCAFile                string
+	UseSystemCAsPlus             bool
+	InsecureSkipVerify           bool
+	Timeout                      int
+	ServerName                   string
+	TLSOnly                      bool
+	Warning                      int
+	Critical                     int
+	MinRSAKeySize                int
+	MinECDSAKeySize              int
+	ForbiddenSignatureAlgorithms []string
+	MTLSKeyFile                  string
+	MTLSCertFile                 string
+	Proxy                        httpclient.ProxyConfig
+	Transport                    httpclient.TransportConfig
+	Source                       httpclient.SourceConfig
+	Resolver                     httpclient.ResolverConfig
+	URLParsing                   httpclient.URLConfig
+	CRL                          httpclient.CRLConfig
+	Record                       httpclient.RecordConfig
+	Log                          logging.Config
+	Overrides                    overrides.Config
+	Status                       exitstatus.Config
+	Metrics                      selfmetrics.Config
+}
+
+var (
+	tlsConfig tls.Config
+
+	plugin = Config{
+		PluginConfig: sensu.PluginConfig{
+			Name:     "http-cert",
+			Short:    "HTTP TLS Certificate Check",
+			Keyspace: "sensu.io/plugins/http-cert/config",
+		},
+	}
+
+	options = []*sensu.PluginConfigOption{
+		{
+			Path:      "url",
+			Env:       "CHECK_URL",
+			Argument:  "url",
+			Shorthand: "u",
+			Default:   "https://localhost:443/",
+			Usage:     "URL to test",
+			Value:     &plugin.URL,
+		},
+		{
+			Path:      "insecure-skip-verify",
+			Env:       "",
+			Argument:  "insecure-skip-verify",
+			Shorthand: "i",
+			Default:   false,
+			Usage:     "Skip certificate chain and hostname verification, only check expiry and policy (not recommended!)",
+			Value:     &plugin.InsecureSkipVerify,
+		},
+		{
+			Path:      "trusted-ca-file",
+			Env:       "",
+			Argument:  "trusted-ca-file",
+			Shorthand: "t",
+			Default:   "",
+			Usage:     "TLS CA certificate bundle in PEM format, or a directory of them",
+			Value:     &plugin.TrustedCAFile,
+		},
+		{
+			Path:      "use-system-cas-plus",
+			Env:       "",
+			Argument:  "use-system-cas-plus",
+			Shorthand: "",
+			Default:   false,
+			Usage:     "Add the CA certificates from --trusted-ca-file to the system trust store rather than replacing it",
+			Value:     &plugin.UseSystemCAsPlus,
+		},
+		{
+			Path:      "timeout",
+			Env:       "",
+			Argument:  "timeout",
+			Shorthand: "T",
+			Default:   15,
+			Usage:     "Request timeout in seconds",
+			Value:     &plugin.Timeout,
+		},
+		{
+			Path:      "servername",
+			Env:       "",
+			Argument:  "servername",
+			Shorthand: "s",
+			Default:   "",
+			Usage:     "Server name to use for SNI and hostname verification (defaults to the host in --url)",
+			Value:     &plugin.ServerName,
+		},
+		{
+			Path:      "tls-only",
+			Env:       "",
+			Argument:  "tls-only",
+			Shorthand: "",
+			Default:   false,
+			Usage:     "Only perform the TLS handshake, do not issue an HTTP request",
+			Value:     &plugin.TLSOnly,
+		},
+		{
+			Path:      "warning",
+			Env:       "",
+			Argument:  "warning",
+			Shorthand: "w",
+			Default:   30,
+			Usage:     "Warning threshold, in days remaining before a certificate expires",
+			Value:     &plugin.Warning,
+		},
+		{
+			Path:      "critical",
+			Env:       "",
+			Argument:  "critical",
+			Shorthand: "c",
+			Default:   14,
+			Usage:     "Critical threshold, in days remaining before a certificate expires",
+			Value:     &plugin.Critical,
+		},
+		{
+			Path:      "min-rsa-key-size",
+			Env:       "",
+			Argument:  "min-rsa-key-size",
+			Shorthand: "",
+			Default:   2048,
+			Usage:     "Minimum RSA key size in bits, smaller keys result in a warning",
+			Value:     &plugin.MinRSAKeySize,
+		},
+		{
+			Path:      "min-ecdsa-key-size",
+			Env:       "",
+			Argument:  "min-ecdsa-key-size",
+			Shorthand: "",
+			Default:   256,
+			Usage:     "Minimum ECDSA key size in bits, smaller keys result in a warning",
+			Value:     &plugin.MinECDSAKeySize,
+		},
+		{
+			Path:      "forbidden-signature-algorithms",
+			Env:       "",
+			Argument:  "forbidden-signature-algorithms",
+			Shorthand: "",
+			Default:   []string{"MD2-RSA", "MD5-RSA", "SHA1-RSA", "DSA-SHA1", "ECDSA-SHA1"},
+			Usage:     "Signature algorithms that result in a critical status if used by a non-root certificate",
+			Value:     &plugin.ForbiddenSignatureAlgorithms,
+		},
+		{
+			Path:      "mtls-key-file",
+			Env:       "",
+			Argument:  "mtls-key-file",
+			Shorthand: "K",
+			Default:   "",
+			Usage:     "Key file for mutual TLS auth in PEM format",
+			Value:     &plugin.MTLSKeyFile,
+		},
+		{
+			Path:      "mtls-cert-file",
+			Env:       "",
+			Argument:  "mtls-cert-file",
+			Shorthand: "C",
+			Default:   "",
+			Usage:     "Certificate file for mutual TLS auth in PEM format",
+			Value:     &plugin.MTLSCertFile,
+		},
+	}
+)
+
+func main() {
+	options = append(options, plugin.Proxy.Options()...)
+	options = append(options, plugin.Transport.Options()...)
+	options = append(options, plugin.Source.Options()...)
+	options = append(options, plugin.Resolver.Options()...)
+	options = append(options, plugin.URLParsing.Options()...)
+	options = append(options, plugin.CRL.Options()...)
+	options = append(options, plugin.Record.Options()...)
+	options = append(options, plugin.Log.Options()...)
+	options = append(options, plugin.Overrides.Options()...)
+	options = append(options, plugin.Status.Options()...)
+	options = append(options, plugin.Metrics.Options()...)
+	buildinfo.Handle(plugin.PluginConfig.Name, options, os.Args[1:])
+	exitstatus.ParseFlags(plugin.PluginConfig.Name, options, os.Args[1:])
+	check := sensu.NewGoCheck(&plugin.PluginConfig, options, plugin.Status.Wrap(plugin.PluginConfig.Name, checkArgs), plugin.Record.Wrap(plugin.PluginConfig.Name, plugin.Metrics.Wrap(plugin.PluginConfig.Name, plugin.Status.Wrap(plugin.PluginConfig.Name, executeCheck))), overrides.Requested(os.Args[1:]))
+	check.Execute()
+}
+
+func checkArgs(event *corev2.Event) (int, error) {
+	if err := plugin.Log.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	if err := plugin.URLParsing.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+
+	if len(plugin.URL) == 0 {
+		return sensu.CheckStateUnknown, fmt.Errorf("--url or CHECK_URL environment variable is required")
+	}
+	checkURL, err := httpclient.ParseURL("--url", plugin.URL)
+	if err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	plugin.URL = checkURL.String()
+	if plugin.Critical < 0 || plugin.Warning < 0 {
+		return sensu.CheckStateUnknown, fmt.Errorf("--warning and --critical must be 0 or greater")
+	}
+	if plugin.Critical > plugin.Warning {
+		return sensu.CheckStateUnknown, fmt.Errorf("--critical (%d) must not be greater than --warning (%d)", plugin.Critical, plugin.Warning)
+	}
+
+	tlsConfig.RootCAs = nil
+	if len(plugin.TrustedCAFile) > 0 {
+		caCertPool, err := httpclient.LoadCACerts(plugin.TrustedCAFile, plugin.UseSystemCAsPlus)
+		if err != nil {
+			return sensu.CheckStateUnknown, fmt.Errorf("Error loading specified CA file: %v", err)
+		}
+		tlsConfig.RootCAs = caCertPool
+	}
+
+	if (len(plugin.MTLSKeyFile) > 0 && len(plugin.MTLSCertFile) == 0) || (len(plugin.MTLSCertFile) > 0 && len(plugin.MTLSKeyFile) == 0) {
+		return sensu.CheckStateUnknown, fmt.Errorf("mTLS auth requires both --mtls-key-file and --mtls-cert-file")
+	}
+	if len(plugin.MTLSKeyFile) > 0 && len(plugin.MTLSCertFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(plugin.MTLSCertFile, plugin.MTLSKeyFile)
+		if err != nil {
+			return sensu.CheckStateUnknown, fmt.Errorf("Failed to load mTLS key pair %s/%s: %v", plugin.MTLSCertFile, plugin.MTLSKeyFile, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if plugin.TLSOnly && (len(plugin.Proxy.URL) > 0 || plugin.Proxy.FromEnv) {
+		return sensu.CheckStateUnknown, fmt.Errorf("--tls-only does not support proxies")
+	}
+	if err := plugin.Proxy.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	if err := plugin.Transport.Validate(&plugin.Proxy); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	if err := plugin.Source.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	if err := plugin.Resolver.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+
+	if err := plugin.Record.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+
+	return sensu.CheckStateOK, nil
+}
+
+func executeCheck(event *corev2.Event) (int, error) {
+
+	checkURL, err := url.Parse(plugin.URL)
+	if err != nil {
+		fmt.Fprintf(selfmetrics.Stdout, "%s UNKNOWN: url parse error: %s\n", plugin.PluginConfig.Name, err)
+		return sensu.CheckStateUnknown, nil
+	}
+	if checkURL.Scheme != "https" {
+		fmt.Fprintf(selfmetrics.Stdout, "%s UNKNOWN: %s is not an https URL\n", plugin.PluginConfig.Name, plugin.URL)
+		return sensu.CheckStateUnknown, nil
+	}
+
+	serverName := plugin.ServerName
+	if len(serverName) == 0 {
+		serverName = checkURL.Hostname()
+	}
+
+	// Verification is performed after the handshake so that expiry and
+	// policy details can be reported even when the chain does not verify.
+	clientTLSConfig := tlsConfig.Clone()
+	clientTLSConfig.ServerName = serverName
+	clientTLSConfig.InsecureSkipVerify = true
+
+	state, err := connectionState(checkURL, clientTLSConfig)
+	if err != nil {
+		fmt.Fprintf(selfmetrics.Stdout, "%s CRITICAL: %v\n", plugin.PluginConfig.Name, err)
+		return sensu.CheckStateCritical, nil
+	}
+	if len(state.PeerCertificates) == 0 {
+		fmt.Fprintf(selfmetrics.Stdout, "%s CRITICAL: no certificates presented by %s\n", plugin.PluginConfig.Name, checkURL.Host)
+		return sensu.CheckStateCritical, nil
+	}
+
+	status, messages := evaluateCertificates(state.PeerCertificates, serverName, time.Now())
+	if plugin.CRL.Enabled() {
+		// The CRLs are fetched without the client certificate of
+		// --mtls-cert-file, as any client would.
+		client := httpclient.New(&tls.Config{RootCAs: tlsConfig.RootCAs}, time.Duration(plugin.Timeout)*time.Second, true, plugin.Proxy.Configure, plugin.Source.Configure, plugin.Resolver.Configure)
+		if problems := plugin.CRL.Problems(client, state.PeerCertificates, tlsConfig.RootCAs, time.Now()); len(problems) > 0 {
+			status = sensu.CheckStateCritical
+			messages = append(messages, problems...)
+		}
+	}
+
+	leaf := state.PeerCertificates[0]
+	summary := fmt.Sprintf("certificate for %s expires in %d days (%s)", serverName, daysRemaining(leaf, time.Now()), leaf.NotAfter.UTC().Format(time.RFC3339))
+	if len(messages) > 0 {
+		summary = strings.Join(messages, ", ")
+	}
+
+	fmt.Fprintf(selfmetrics.Stdout, "%s %s: %s | %s\n", plugin.PluginConfig.Name, stateName(status), summary, perfData(state.PeerCertificates, time.Now()))
+	return status, nil
+}
+
+// connectionState returns the TLS connection state for checkURL, either from
+// a bare TLS handshake or from an HTTP request.
+func connectionState(checkURL *url.URL, config *tls.Config) (*tls.ConnectionState, error) {
+	timeout := time.Duration(plugin.Timeout) * time.Second
+
+	if plugin.TLSOnly {
+		address := checkURL.Host
+		if len(checkURL.Port()) == 0 {
+			address = net.JoinHostPort(checkURL.Hostname(), "443")
+		}
+		// The dialer and TLS handshake timeout of the client the check uses
+		// otherwise, so that --source-ip, --resolver, --connect-timeout and
+		// --tls-timeout apply.
+		transport := httpclient.NewTransport(config, plugin.Source.Configure, plugin.Resolver.Configure, plugin.Transport.Configure)
+		ctx := context.Background()
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		if len(config.ServerName) == 0 {
+			config = config.Clone()
+			config.ServerName = checkURL.Hostname()
+		}
+		logging.Debug("tls handshake", "address", address, "server_name", config.ServerName)
+		start := time.Now()
+		state, err := handshake(ctx, transport, address, config)
+		logging.Debug("tls handshake done", "address", address, "error", err, "elapsed", time.Since(start))
+		if err != nil {
+			return nil, fmt.Errorf("TLS handshake error: %s", httpclient.Describe(err))
+		}
+		return state, nil
+	}
+
+	client := httpclient.New(config, timeout, false, plugin.Proxy.Configure, plugin.Source.Configure, plugin.Resolver.Configure, plugin.Transport.Configure)
+	resp, err := client.Get(checkURL.String())
+	if err != nil {
+		return nil, fmt.Errorf("request error: %s", httpclient.Describe(err))
+	}
+	defer resp.Body.Close()
+	if resp.TLS == nil {
+		return nil, fmt.Errorf("no TLS connection state for %s", checkURL)
+	}
+	return resp.TLS, nil
+}
+
+// handshake connects to address with the dialer of transport and returns the
+// state of a TLS handshake with config over the connection, within the TLS
+// handshake timeout of transport and the deadline of ctx.
+func handshake(ctx context.Context, transport *http.Transport, address string, config *tls.Config) (*tls.ConnectionState, error) {
+	conn, err := transport.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	deadline, ok := ctx.Deadline()
+	if transport.TLSHandshakeTimeout > 0 {
+		if handshakeDeadline := time.Now().Add(transport.TLSHandshakeTimeout); !ok || handshakeDeadline.Before(deadline) {
+			deadline, ok = handshakeDeadline, true
+		}
+	}
+	if ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, err
+	}
+	state := tlsConn.ConnectionState()
+	return &state, nil
+}
+
+// evaluateCertificates checks the presented chain for validity, expiry and
+// policy, returning the resulting state and a message for each problem found.
+func evaluateCertificates(certs []*x509.Certificate, serverName string, now time.Time) (int, []string) {
+	status := sensu.CheckStateOK
+	messages := []string{}
+	problem := func(state int, format string, a ...interface{}) {
+		if state > status {
+			status = state
+		}
+		messages = append(messages, fmt.Sprintf(format, a...))
+	}
+
+	if !plugin.InsecureSkipVerify {
+		intermediates := x509.NewCertPool()
+		for _, cert := range certs[1:] {
+			intermediates.AddCert(cert)
+		}
+		_, err := certs[0].Verify(x509.VerifyOptions{
+			DNSName:       serverName,
+			Roots:         tlsConfig.RootCAs,
+			Intermediates: intermediates,
+			CurrentTime:   now,
+		})
+		if err != nil {
+			problem(sensu.CheckStateCritical, "verification failed: %v", err)
+		}
+	}
+
+	for i, cert := range certs {
+		name := certName(i, cert)
+		days := daysRemaining(cert, now)
+		switch {
+		case now.After(cert.NotAfter):
+			problem(sensu.CheckStateCritical, "%s expired on %s", name, cert.NotAfter.UTC().Format(time.RFC3339))
+		case now.Before(cert.NotBefore):
+			problem(sensu.CheckStateCritical, "%s is not valid before %s", name, cert.NotBefore.UTC().Format(time.RFC3339))
+		case days < plugin.Critical:
+			problem(sensu.CheckStateCritical, "%s expires in %d days", name, days)
+		case days < plugin.Warning:
+			problem(sensu.CheckStateWarning, "%s expires in %d days", name, days)
+		}
+
+		switch key := cert.PublicKey.(type) {
+		case *rsa.PublicKey:
+			if size := key.N.BitLen(); size < plugin.MinRSAKeySize {
+				problem(sensu.CheckStateWarning, "%s has a %d bit RSA key", name, size)
+			}
+		case *ecdsa.PublicKey:
+			if size := key.Params().BitSize; size < plugin.MinECDSAKeySize {
+				problem(sensu.CheckStateWarning, "%s has a %d bit ECDSA key", name, size)
+			}
+		}
+
+		// The signature on a self-signed root is not relied upon
+		if isSelfSigned(cert) && i > 0 {
+			continue
+		}
+		for _, algorithm := range plugin.ForbiddenSignatureAlgorithms {
+			if strings.EqualFold(cert.SignatureAlgorithm.String(), algorithm) {
+				problem(sensu.CheckStateCritical, "%s is signed with %s", name, cert.SignatureAlgorithm)
+			}
+		}
+	}
+
+	return status, messages
+}
+
+func certName(index int, cert *x509.Certificate) string {
+	if index == 0 {
+		return fmt.Sprintf("leaf certificate %q", cert.Subject.CommonName)
+	}
+	if isSelfSigned(cert) {
+		return fmt.Sprintf("root certificate %q", cert.Subject.CommonName)
+	}
+	return fmt.Sprintf("intermediate certificate %q", cert.Subject.CommonName)
+}
+
+func isSelfSigned(cert *x509.Certificate) bool {
+	return cert.Subject.String() == cert.Issuer.String() && cert.CheckSignatureFrom(cert) == nil
+}
+
+func daysRemaining(cert *x509.Certificate, now time.Time) int {
+	return int(cert.NotAfter.Sub(now).Hours() / 24)
+}
+
+func perfData(certs []*x509.Certificate, now time.Time) string {
+	perfdata := []string{fmt.Sprintf("leaf_days_remaining=%d", daysRemaining(certs[0], now))}
+	for i, cert := range certs[1:] {
+		perfdata = append(perfdata, fmt.Sprintf("intermediate_%d_days_remaining=%d", i+1, daysRemaining(cert, now)))
+	}
+	return strings.Join(perfdata, ", ")
+}
+
+func stateName(status int) string {
+	switch status {
+	case sensu.CheckStateOK:
+		return "OK"
+	case sensu.CheckStateWarning:
+		return "WARNING"
+	case sensu.CheckStateCritical:
+		return "CRITICAL"
+	}
+	return "UNKNOWN"
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	corev2 "github.com/sensu/sensu-go/api/core/v2"
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMain(t *testing.T) {
+}
+
+func newCertificate(t *testing.T, template, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	if parent == nil {
+		parent = template
+		parentKey = key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return cert, key
+}
+
+func newChain(t *testing.T, leafExpiry time.Duration) (*x509.Certificate, tls.Certificate) {
+	ca, caKey := newCertificate(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	leaf, leafKey := newCertificate(t, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(leafExpiry),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, caKey)
+	return ca, tls.Certificate{
+		Certificate: [][]byte{leaf.Raw, ca.Raw},
+		PrivateKey:  leafKey,
+		Leaf:        leaf,
+	}
+}
+
+func TestExecuteCheck(t *testing.T) {
+
+	plugin.Warning = 30
+	plugin.Critical = 14
+	plugin.MinECDSAKeySize = 256
+
+	testCases := []struct {
+		status     int
+		leafExpiry time.Duration
+		trustCA    bool
+		tlsOnly    bool
+	}{
+		{sensu.CheckStateOK, 90 * 24 * time.Hour, true, false},
+		{sensu.CheckStateOK, 90 * 24 * time.Hour, true, true},
+		{sensu.CheckStateWarning, 20 * 24 * time.Hour, true, false},
+		{sensu.CheckStateCritical, 5 * 24 * time.Hour, true, true},
+		{sensu.CheckStateCritical, 90 * 24 * time.Hour, false, false},
+	}
+
+	for _, tc := range testCases {
+		event := corev2.FixtureEvent("entity1", "check")
+		assert := assert.New(t)
+
+		ca, cert := newChain(t, tc.leafExpiry)
+		test := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}))
+		test.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+		test.StartTLS()
+
+		plugin.URL = test.URL
+		plugin.TLSOnly = tc.tlsOnly
+		status, err := checkArgs(event)
+		assert.NoError(err)
+		assert.Equal(sensu.CheckStateOK, status)
+		if tc.trustCA {
+			tlsConfig.RootCAs = x509.NewCertPool()
+			tlsConfig.RootCAs.AddCert(ca)
+		}
+		status, err = executeCheck(event)
+		assert.NoError(err)
+		assert.Equal(tc.status, status)
+		test.Close()
+	}
+}
+
+func TestTLSOnlyTimeout(t *testing.T) {
+	assert := assert.New(t)
+	event := corev2.FixtureEvent("entity1", "check")
+
+	// A listener that accepts connections but never completes a handshake.
+	silent, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer silent.Close()
+	go func() {
+		for {
+			conn, err := silent.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	plugin.URL = "https://" + silent.Addr().String()
+	plugin.TLSOnly = true
+	plugin.Timeout = 10
+	plugin.Transport.TLSTimeout = "100ms"
+	defer func() {
+		plugin.TLSOnly = false
+		plugin.Transport.TLSTimeout = ""
+	}()
+	status, err := checkArgs(event)
+	require.NoError(t, err)
+	assert.Equal(sensu.CheckStateOK, status)
+	start := time.Now()
+	status, err = executeCheck(event)
+	assert.NoError(err)
+	assert.Equal(sensu.CheckStateCritical, status)
+	assert.True(time.Since(start) < 5*time.Second, "--tls-timeout applies")
+}
+
+func TestEvaluateCertificates(t *testing.T) {
+	assert := assert.New(t)
+
+	plugin.Warning = 30
+	plugin.Critical = 14
+	plugin.MinECDSAKeySize = 256
+	plugin.ForbiddenSignatureAlgorithms = []string{"SHA1-RSA", "ECDSA-SHA1"}
+
+	ca, cert := newChain(t, 90*24*time.Hour)
+	tlsConfig.RootCAs = x509.NewCertPool()
+	tlsConfig.RootCAs.AddCert(ca)
+	chain := []*x509.Certificate{cert.Leaf, ca}
+
+	status, messages := evaluateCertificates(chain, "localhost", time.Now())
+	assert.Equal(sensu.CheckStateOK, status)
+	assert.Empty(messages)
+
+	status, messages = evaluateCertificates(chain, "other.example.com", time.Now())
+	assert.Equal(sensu.CheckStateCritical, status)
+	assert.Len(messages, 1)
+
+	plugin.MinECDSAKeySize = 384
+	status, messages = evaluateCertificates(chain, "localhost", time.Now())
+	assert.Equal(sensu.CheckStateWarning, status)
+	assert.Len(messages, 2)
+	plugin.MinECDSAKeySize = 256
+
+	status, _ = evaluateCertificates(chain, "localhost", time.Now().Add(100*24*time.Hour))
+	assert.Equal(sensu.CheckStateCritical, status)
+
+	assert.Equal("leaf_days_remaining=89, intermediate_1_days_remaining=364", perfData(chain, time.Now()))
+}
@@ -5,37 +5,124 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
 	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"mime"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 
-	corev2 "github.com/sensu/sensu-go/api/core/v2"
+	"github.com/nixwiz/http-checks/internal/auth"
+	"github.com/nixwiz/http-checks/internal/buildinfo"
+	"github.com/nixwiz/http-checks/internal/exitstatus"
+	"github.com/nixwiz/http-checks/internal/httpclient"
+	"github.com/nixwiz/http-checks/internal/logging"
+	"github.com/nixwiz/http-checks/internal/overrides"
+	"github.com/nixwiz/http-checks/internal/selfmetrics"
 	"github.com/sensu/sensu-go/types"
 	"github.com/sensu/sensu-plugin-sdk/sensu"
 )
 
+// stateEntry is the state persisted in the state file between runs.
+type stateEntry struct {
+	URL      string    `json:"url"`
+	Failures int       `json:"failures"`
+	Since    time.Time `json:"since"`
+}
+
 // Config represents the check plugin config.
 type Config struct {
 	sensu.PluginConfig
 	URL                string
+	URLFile            string
+	Concurrency        int
 	SearchString       string
 	ResponseCode       []string
 	TrustedCAFile      string
+	UseSystemCAsPlus   bool
 	InsecureSkipVerify bool
 	RedirectOK         bool
 	Timeout            int
 	Headers            []string
+	HeadersFile        httpclient.HeadersFileConfig
 	MTLSKeyFile        string
 	MTLSCertFile       string
+	ExpectContentType  string
+	ExpectValidJSON    bool
+	ExpectCharset      string
+	ExpectLanguage     string
+	ValidateUTF8       bool
+	ExpectETag         string
+	Expect304WithETag  bool
+	ExpectCookies      []string
+	CookieSecure       bool
+	CookieHTTPOnly     bool
+	CookieSameSite     string
+	CookieMaxAge       string
+	ExpectChunked      bool
+	ExpectContentLen   bool
+	ExpectRedirects    string
+	RespectRetryAfter  bool
+	MaxRetryAfter      string
+	ReadLimit          int64
+	StateFile          string
+	RequiredFailures   int
+	SecurityProbe      bool
+	Auth               auth.Config
+	HMAC               auth.HMACConfig
+	Proxy              httpclient.ProxyConfig
+	Transport          httpclient.TransportConfig
+	Source             httpclient.SourceConfig
+	Resolver           httpclient.ResolverConfig
+	URLParsing         httpclient.URLConfig
+	Guard              httpclient.GuardConfig
+	Upload             httpclient.UploadConfig
+	CRL                httpclient.CRLConfig
+	Record             httpclient.RecordConfig
+	Log                logging.Config
+	Overrides          overrides.Config
+	Status             exitstatus.Config
+	Metrics            selfmetrics.Config
 }
 
 var (
-	tlsConfig tls.Config
+	tlsConfig         tls.Config
+	contentTypeRegexp *regexp.Regexp
+	etagRegexp        *regexp.Regexp
+	cookieExpects     []cookieExpect
+	// expectRedirects is -1 if not set.
+	expectRedirects = -1
+	// cookieMinAge and cookieMaxAge are 0 if not set.
+	cookieMinAge, cookieMaxAge time.Duration
+	maxRetryAfter              time.Duration
+	// urls are the URLs of --url-file, checked instead of --url if set.
+	urls []string
+
+	// severity orders the statuses of the URLs of --url-file, the worst of
+	// them is the status of the check.
+	severity = map[int]int{
+		sensu.CheckStateOK:       0,
+		sensu.CheckStateWarning:  1,
+		sensu.CheckStateUnknown:  2,
+		sensu.CheckStateCritical: 3,
+	}
+	// maxFailedOutput is the number of failed URLs listed in the output.
+	maxFailedOutput = 10
 
 	plugin = Config{
 		PluginConfig: sensu.PluginConfig{
@@ -55,6 +142,24 @@ var (
 			Usage:     "URL to test",
 			Value:     &plugin.URL,
 		},
+		{
+			Path:      "url-file",
+			Env:       "",
+			Argument:  "url-file",
+			Shorthand: "",
+			Default:   "",
+			Usage:     "File of URLs to check instead of --url, one per line (lines starting with # are comments), the check reports the worst status of them",
+			Value:     &plugin.URLFile,
+		},
+		{
+			Path:      "concurrency",
+			Env:       "",
+			Argument:  "concurrency",
+			Shorthand: "",
+			Default:   1,
+			Usage:     "Number of URLs of --url-file to check concurrently",
+			Value:     &plugin.Concurrency,
+		},
 		{
 			Path:      "search-string",
 			Env:       "CHECK_SEARCH_STRING",
@@ -88,9 +193,18 @@ var (
 			Argument:  "trusted-ca-file",
 			Shorthand: "t",
 			Default:   "",
-			Usage:     "TLS CA certificate bundle in PEM format",
+			Usage:     "TLS CA certificate bundle in PEM format, or a directory of them",
 			Value:     &plugin.TrustedCAFile,
 		},
+		{
+			Path:      "use-system-cas-plus",
+			Env:       "",
+			Argument:  "use-system-cas-plus",
+			Shorthand: "",
+			Default:   false,
+			Usage:     "Add the CA certificates from --trusted-ca-file to the system trust store rather than replacing it",
+			Value:     &plugin.UseSystemCAsPlus,
+		},
 		{
 			Path:      "redirect-ok",
 			Env:       "",
@@ -136,23 +250,242 @@ var (
 			Usage:     "Certificate file for mutual TLS auth in PEM format",
 			Value:     &plugin.MTLSCertFile,
 		},
+		{
+			Path:      "expect-content-type",
+			Env:       "",
+			Argument:  "expect-content-type",
+			Shorthand: "",
+			Default:   "",
+			Usage:     "Regular expression the Content-Type header of the response must match (e.g. ^application/json)",
+			Value:     &plugin.ExpectContentType,
+		},
+		{
+			Path:      "expect-valid-json",
+			Env:       "",
+			Argument:  "expect-valid-json",
+			Shorthand: "",
+			Default:   false,
+			Usage:     "Require the response body to be well-formed JSON",
+			Value:     &plugin.ExpectValidJSON,
+		},
+		{
+			Path:      "expect-charset",
+			Env:       "",
+			Argument:  "expect-charset",
+			Shorthand: "",
+			Default:   "",
+			Usage:     "Charset the Content-Type header of the response must declare (e.g. utf-8)",
+			Value:     &plugin.ExpectCharset,
+		},
+		{
+			Path:      "expect-content-language",
+			Env:       "",
+			Argument:  "expect-content-language",
+			Shorthand: "",
+			Default:   "",
+			Usage:     "Language the Content-Language header of the response must list, a language (e.g. de) also matches its regional variants (e.g. de-CH)",
+			Value:     &plugin.ExpectLanguage,
+		},
+		{
+			Path:      "validate-utf8",
+			Env:       "",
+			Argument:  "validate-utf8",
+			Shorthand: "",
+			Default:   false,
+			Usage:     "Require the response body to be valid UTF-8",
+			Value:     &plugin.ValidateUTF8,
+		},
+		{
+			Path:      "expect-etag",
+			Env:       "",
+			Argument:  "expect-etag",
+			Shorthand: "",
+			Default:   "",
+			Usage:     "Regular expression the ETag header of the response must match (e.g. ^\"v42-)",
+			Value:     &plugin.ExpectETag,
+		},
+		{
+			Path:      "expect-304-with-etag",
+			Env:       "",
+			Argument:  "expect-304-with-etag",
+			Shorthand: "",
+			Default:   false,
+			Usage:     "Repeat the request with the ETag of the response in If-None-Match and expect 304 Not Modified",
+			Value:     &plugin.Expect304WithETag,
+		},
+		{
+			Path:      "expect-cookie",
+			Env:       "",
+			Argument:  "expect-cookie",
+			Shorthand: "",
+			Default:   []string{},
+			Usage:     "Cookie(s) the response must set, as name or name=value-regex (e.g. session=^[0-9a-f]{32}$)",
+			Value:     &plugin.ExpectCookies,
+		},
+		{
+			Path:      "expect-cookie-secure",
+			Env:       "",
+			Argument:  "expect-cookie-secure",
+			Shorthand: "",
+			Default:   false,
+			Usage:     "Require the Secure attribute on the cookies of --expect-cookie, or on all cookies set by the response without it",
+			Value:     &plugin.CookieSecure,
+		},
+		{
+			Path:      "expect-cookie-httponly",
+			Env:       "",
+			Argument:  "expect-cookie-httponly",
+			Shorthand: "",
+			Default:   false,
+			Usage:     "Require the HttpOnly attribute on the cookies of --expect-cookie, or on all cookies set by the response without it",
+			Value:     &plugin.CookieHTTPOnly,
+		},
+		{
+			Path:      "expect-cookie-samesite",
+			Env:       "",
+			Argument:  "expect-cookie-samesite",
+			Shorthand: "",
+			Default:   "",
+			Usage:     "Required SameSite attribute of the cookies of --expect-cookie, or of all cookies set by the response without it, one of Strict, Lax and None",
+			Value:     &plugin.CookieSameSite,
+		},
+		{
+			Path:      "expect-cookie-max-age",
+			Env:       "",
+			Argument:  "expect-cookie-max-age",
+			Shorthand: "",
+			Default:   "",
+			Usage:     "Bounds of the lifetime (Max-Age or Expires) of the cookies of --expect-cookie, or of all cookies set by the response without it, as min:max with either optional (e.g. :24h)",
+			Value:     &plugin.CookieMaxAge,
+		},
+		{
+			Path:      "expect-chunked",
+			Env:       "",
+			Argument:  "expect-chunked",
+			Shorthand: "",
+			Default:   false,
+			Usage:     "Require the response to be streamed, with chunked transfer encoding in HTTP/1.1 and without Content-Length in HTTP/2",
+			Value:     &plugin.ExpectChunked,
+		},
+		{
+			Path:      "expect-content-length",
+			Env:       "",
+			Argument:  "expect-content-length",
+			Shorthand: "",
+			Default:   false,
+			Usage:     "Require the response to have a Content-Length header rather than be streamed",
+			Value:     &plugin.ExpectContentLen,
+		},
+		{
+			Path:      "expect-redirect-count",
+			Env:       "",
+			Argument:  "expect-redirect-count",
+			Shorthand: "",
+			Default:   "",
+			Usage:     "Number of redirects that must be followed to reach the final response, requires --redirect-ok",
+			Value:     &plugin.ExpectRedirects,
+		},
+		{
+			Path:      "respect-retry-after",
+			Env:       "",
+			Argument:  "respect-retry-after",
+			Shorthand: "",
+			Default:   false,
+			Usage:     "Report a 503 with a Retry-After header within --max-retry-after as WARNING in maintenance rather than CRITICAL",
+			Value:     &plugin.RespectRetryAfter,
+		},
+		{
+			Path:      "max-retry-after",
+			Env:       "",
+			Argument:  "max-retry-after",
+			Shorthand: "",
+			Default:   "1h",
+			Usage:     "Longest Retry-After of a 503 considered maintenance with --respect-retry-after",
+			Value:     &plugin.MaxRetryAfter,
+		},
+		{
+			Path:      "read-limit",
+			Env:       "",
+			Argument:  "read-limit",
+			Shorthand: "",
+			Default:   int64(0),
+			Usage:     "Maximum number of bytes of the response body to read, 0 for no limit",
+			Value:     &plugin.ReadLimit,
+		},
+		{
+			Path:      "state-file",
+			Env:       "",
+			Argument:  "state-file",
+			Shorthand: "",
+			Default:   "",
+			Usage:     "File to keep the number of consecutive failures in between runs, required by --required-failures",
+			Value:     &plugin.StateFile,
+		},
+		{
+			Path:      "required-failures",
+			Env:       "",
+			Argument:  "required-failures",
+			Shorthand: "",
+			Default:   1,
+			Usage:     "Number of consecutive failing runs before reporting CRITICAL, failures before that are reported as WARNING (0 and 1 report CRITICAL right away)",
+			Value:     &plugin.RequiredFailures,
+		},
+		{
+			Path:      "security-probe",
+			Env:       "",
+			Argument:  "security-probe",
+			Shorthand: "",
+			Default:   false,
+			Usage:     "Instead of the normal check, send malformed requests to --url and report WARNING if the responses indicate request smuggling susceptibility",
+			Value:     &plugin.SecurityProbe,
+		},
 	}
 )
 
 func main() {
-	check := sensu.NewGoCheck(&plugin.PluginConfig, options, checkArgs, executeCheck, false)
+	options = append(options, plugin.Auth.Options()...)
+	options = append(options, plugin.HMAC.Options()...)
+	options = append(options, plugin.Proxy.Options()...)
+	options = append(options, plugin.Transport.Options()...)
+	options = append(options, plugin.Source.Options()...)
+	options = append(options, plugin.Resolver.Options()...)
+	options = append(options, plugin.URLParsing.Options()...)
+	options = append(options, plugin.Guard.Options()...)
+	options = append(options, plugin.Upload.Options()...)
+	options = append(options, plugin.HeadersFile.Options()...)
+	options = append(options, plugin.CRL.Options()...)
+	options = append(options, plugin.Record.Options()...)
+	options = append(options, plugin.Log.Options()...)
+	options = append(options, plugin.Overrides.Options()...)
+	options = append(options, plugin.Status.Options()...)
+	options = append(options, plugin.Metrics.Options()...)
+	buildinfo.Handle(plugin.PluginConfig.Name, options, os.Args[1:])
+	exitstatus.ParseFlags(plugin.PluginConfig.Name, options, os.Args[1:])
+	check := sensu.NewGoCheck(&plugin.PluginConfig, options, plugin.Status.Wrap(plugin.PluginConfig.Name, checkArgs), plugin.Record.Wrap(plugin.PluginConfig.Name, plugin.Metrics.Wrap(plugin.PluginConfig.Name, plugin.Status.Wrap(plugin.PluginConfig.Name, executeCheck))), overrides.Requested(os.Args[1:]))
 	check.Execute()
 }
 
 func checkArgs(event *types.Event) (int, error) {
+	if err := plugin.Log.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	if err := plugin.URLParsing.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+
 	if len(plugin.URL) == 0 {
-		return sensu.CheckStateWarning, fmt.Errorf("--url or CHECK_URL environment variable is required")
+		return sensu.CheckStateUnknown, fmt.Errorf("--url or CHECK_URL environment variable is required")
+	}
+	headers, err := plugin.HeadersFile.Headers(event)
+	if err != nil {
+		return sensu.CheckStateUnknown, err
 	}
+	plugin.Headers = append(headers, plugin.Headers...)
 	if len(plugin.Headers) > 0 {
 		for _, header := range plugin.Headers {
 			headerSplit := strings.SplitN(header, ":", 2)
 			if len(headerSplit) != 2 {
-				return sensu.CheckStateWarning, fmt.Errorf("--header %q value malformed should be \"Header-Name: Header Value\"", header)
+				return sensu.CheckStateUnknown, fmt.Errorf("--header %q value malformed should be \"Header-Name: Header Value\"", header)
 			}
 		}
 	}
@@ -161,56 +494,217 @@ func checkArgs(event *types.Event) (int, error) {
 		for _, code := range plugin.ResponseCode {
 			_, err := strconv.Atoi(code)
 			if err != nil {
-				return sensu.CheckStateCritical, fmt.Errorf("--response-code %q value malformed, should be a valid http response code ", code)
+				return sensu.CheckStateUnknown, fmt.Errorf("--response-code %q value malformed, should be a valid http response code ", code)
+			}
+		}
+	}
+
+	if plugin.RequiredFailures < 0 {
+		return sensu.CheckStateUnknown, fmt.Errorf("--required-failures must be 0 or greater")
+	}
+	if plugin.RequiredFailures > 1 && len(plugin.StateFile) == 0 {
+		return sensu.CheckStateUnknown, fmt.Errorf("--required-failures requires --state-file")
+	}
+
+	if plugin.ReadLimit < 0 {
+		return sensu.CheckStateUnknown, fmt.Errorf("--read-limit must be 0 or greater")
+	}
+	if len(plugin.URLFile) > 0 {
+		if plugin.Concurrency < 1 {
+			return sensu.CheckStateUnknown, fmt.Errorf("--concurrency must be 1 or greater")
+		}
+		if len(plugin.StateFile) > 0 || plugin.SecurityProbe {
+			return sensu.CheckStateUnknown, fmt.Errorf("--url-file cannot be combined with --state-file or --security-probe")
+		}
+	}
+	expectRedirects = -1
+	if len(plugin.ExpectRedirects) > 0 {
+		n, err := strconv.Atoi(plugin.ExpectRedirects)
+		if err != nil || n < 0 {
+			return sensu.CheckStateUnknown, fmt.Errorf("--expect-redirect-count %q must be 0 or greater", plugin.ExpectRedirects)
+		}
+		if !plugin.RedirectOK {
+			return sensu.CheckStateUnknown, fmt.Errorf("--expect-redirect-count requires --redirect-ok")
+		}
+		expectRedirects = n
+	}
+	maxRetryAfter = 0
+	if plugin.RespectRetryAfter {
+		var err error
+		if maxRetryAfter, err = time.ParseDuration(plugin.MaxRetryAfter); err != nil || maxRetryAfter <= 0 {
+			return sensu.CheckStateUnknown, fmt.Errorf("--max-retry-after %q must be a positive duration, e.g. 30m", plugin.MaxRetryAfter)
+		}
+	}
+	if plugin.ExpectChunked && plugin.ExpectContentLen {
+		return sensu.CheckStateUnknown, fmt.Errorf("--expect-chunked and --expect-content-length are mutually exclusive")
+	}
+
+	contentTypeRegexp = nil
+	if len(plugin.ExpectContentType) > 0 {
+		re, err := regexp.Compile(plugin.ExpectContentType)
+		if err != nil {
+			return sensu.CheckStateUnknown, fmt.Errorf("--expect-content-type %q is not a valid regular expression: %v", plugin.ExpectContentType, err)
+		}
+		contentTypeRegexp = re
+	}
+	if plugin.ValidateUTF8 && len(plugin.ExpectCharset) > 0 && normalizeCharset(plugin.ExpectCharset) != "utf8" {
+		return sensu.CheckStateUnknown, fmt.Errorf("--validate-utf8 cannot be combined with --expect-charset %s", plugin.ExpectCharset)
+	}
+	etagRegexp = nil
+	if len(plugin.ExpectETag) > 0 {
+		re, err := regexp.Compile(plugin.ExpectETag)
+		if err != nil {
+			return sensu.CheckStateUnknown, fmt.Errorf("--expect-etag %q is not a valid regular expression: %v", plugin.ExpectETag, err)
+		}
+		etagRegexp = re
+	}
+	cookieExpects = nil
+	for _, expect := range plugin.ExpectCookies {
+		split := strings.SplitN(expect, "=", 2)
+		c := cookieExpect{name: strings.TrimSpace(split[0])}
+		if len(c.name) == 0 {
+			return sensu.CheckStateUnknown, fmt.Errorf("--expect-cookie %q has no cookie name, should be \"name\" or \"name=value-regex\"", expect)
+		}
+		if len(split) == 2 {
+			re, err := regexp.Compile(split[1])
+			if err != nil {
+				return sensu.CheckStateUnknown, fmt.Errorf("--expect-cookie %q is not a valid regular expression: %v", expect, err)
+			}
+			c.value = re
+		}
+		cookieExpects = append(cookieExpects, c)
+	}
+	switch strings.ToLower(plugin.CookieSameSite) {
+	case "", "strict", "lax", "none":
+	default:
+		return sensu.CheckStateUnknown, fmt.Errorf("--expect-cookie-samesite %q must be one of Strict, Lax and None", plugin.CookieSameSite)
+	}
+	cookieMinAge, cookieMaxAge = 0, 0
+	if len(plugin.CookieMaxAge) > 0 {
+		bounds := strings.SplitN(plugin.CookieMaxAge, ":", 2)
+		if len(bounds) != 2 || len(bounds[0])+len(bounds[1]) == 0 {
+			return sensu.CheckStateUnknown, fmt.Errorf("--expect-cookie-max-age %q malformed, should be \"min:max\", e.g. \"1h:24h\" or \":24h\"", plugin.CookieMaxAge)
+		}
+		var err error
+		if len(bounds[0]) > 0 {
+			if cookieMinAge, err = time.ParseDuration(bounds[0]); err != nil {
+				return sensu.CheckStateUnknown, fmt.Errorf("--expect-cookie-max-age: %v", err)
+			}
+		}
+		if len(bounds[1]) > 0 {
+			if cookieMaxAge, err = time.ParseDuration(bounds[1]); err != nil {
+				return sensu.CheckStateUnknown, fmt.Errorf("--expect-cookie-max-age: %v", err)
+			}
+			if cookieMaxAge < cookieMinAge {
+				return sensu.CheckStateUnknown, fmt.Errorf("--expect-cookie-max-age %q has a maximum below its minimum", plugin.CookieMaxAge)
 			}
 		}
 	}
 
 	if len(plugin.TrustedCAFile) > 0 {
-		caCertPool, err := corev2.LoadCACerts(plugin.TrustedCAFile)
+		caCertPool, err := httpclient.LoadCACerts(plugin.TrustedCAFile, plugin.UseSystemCAsPlus)
 		if err != nil {
-			return sensu.CheckStateWarning, fmt.Errorf("Error loading specified CA file")
+			return sensu.CheckStateUnknown, fmt.Errorf("Error loading specified CA file: %v", err)
 		}
 		tlsConfig.RootCAs = caCertPool
 	}
 	tlsConfig.InsecureSkipVerify = plugin.InsecureSkipVerify
 
 	if (len(plugin.MTLSKeyFile) > 0 && len(plugin.MTLSCertFile) == 0) || (len(plugin.MTLSCertFile) > 0 && len(plugin.MTLSKeyFile) == 0) {
-		return sensu.CheckStateWarning, fmt.Errorf("mTLS auth requires both --mtls-key-file and --mtls-cert-file")
+		return sensu.CheckStateUnknown, fmt.Errorf("mTLS auth requires both --mtls-key-file and --mtls-cert-file")
 	}
 	if len(plugin.MTLSKeyFile) > 0 && len(plugin.MTLSCertFile) > 0 {
 		cert, err := tls.LoadX509KeyPair(plugin.MTLSCertFile, plugin.MTLSKeyFile)
 		if err != nil {
-			return sensu.CheckStateWarning, fmt.Errorf("Failed to load mTLS key pair %s/%s: %v", plugin.MTLSCertFile, plugin.MTLSKeyFile, err)
+			return sensu.CheckStateUnknown, fmt.Errorf("Failed to load mTLS key pair %s/%s: %v", plugin.MTLSCertFile, plugin.MTLSKeyFile, err)
 		}
 		tlsConfig.Certificates = []tls.Certificate{cert}
 	}
 
+	if err := plugin.Auth.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	if err := plugin.HMAC.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	checkURL, err := httpclient.ParseURL("--url", plugin.URL)
+	if err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	if err := plugin.Auth.FromURL("--url", checkURL); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	plugin.URL = checkURL.String()
+	urls = nil
+	if len(plugin.URLFile) > 0 {
+		if urls, err = readURLFile(plugin.URLFile); err != nil {
+			return sensu.CheckStateUnknown, err
+		}
+	}
+
+	if err := plugin.Proxy.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	if err := plugin.Transport.Validate(&plugin.Proxy); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	if err := plugin.Source.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	if err := plugin.Resolver.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+
+	plugin.Guard.Resolver = &plugin.Resolver
+	if err := plugin.Guard.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+
+	if err := plugin.Upload.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	if plugin.Upload.Enabled() && (plugin.SecurityProbe || plugin.Expect304WithETag) {
+		return sensu.CheckStateUnknown, fmt.Errorf("--upload-file cannot be combined with --security-probe or --expect-304-with-etag")
+	}
+
+	if err := plugin.Record.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+
 	return sensu.CheckStateOK, nil
 }
 
 func executeCheck(event *types.Event) (int, error) {
+	return dampen(selfmetrics.Stdout, checkTargets)
+}
+
+// checkTargets checks --url, or the URLs of --url-file, writing the output to
+// w.
+func checkTargets(w io.Writer) (int, error) {
+	client := httpclient.New(&tlsConfig, time.Duration(plugin.Timeout)*time.Second, plugin.RedirectOK, plugin.Proxy.Configure, plugin.Source.Configure, plugin.Resolver.Configure, plugin.Guard.Configure, plugin.Transport.Configure)
+	client.Transport = plugin.HMAC.RoundTripper(plugin.Auth.RoundTripper(client.Transport))
 
-	client := http.DefaultClient
-	client.Transport = http.DefaultTransport
-	client.Timeout = time.Duration(plugin.Timeout) * time.Second
-	if !plugin.RedirectOK {
-		client.CheckRedirect = func(req *http.Request, via []*http.Request) error { return http.ErrUseLastResponse }
+	if len(urls) > 0 {
+		return checkURLs(w, client, urls), nil
 	}
+	return checkOne(w, client, plugin.URL)
+}
 
-	checkURL, err := url.Parse(plugin.URL)
+// checkOne checks target with client, writing the output line to w.
+func checkOne(w io.Writer, client *http.Client, target string) (int, error) {
+	u, err := url.Parse(target)
 	if err != nil {
-		fmt.Printf("url parse error: %s\n", err)
-		return sensu.CheckStateCritical, nil
+		fmt.Fprintf(w, "%s UNKNOWN: url parse error: %s\n", plugin.PluginConfig.Name, err)
+		return sensu.CheckStateUnknown, nil
 	}
-	if checkURL.Scheme == "https" {
-		client.Transport.(*http.Transport).TLSClientConfig = &tlsConfig
+	if plugin.SecurityProbe {
+		return securityProbe(w, u)
 	}
 
-	req, err := http.NewRequest("GET", plugin.URL, nil)
+	req, err := http.NewRequest("GET", target, nil)
 	if err != nil {
-		fmt.Printf("request creation error: %s\n", err)
-		return sensu.CheckStateCritical, nil
+		fmt.Fprintf(w, "%s UNKNOWN: request creation error: %s\n", plugin.PluginConfig.Name, err)
+		return sensu.CheckStateUnknown, nil
 	}
 
 	if len(plugin.Headers) > 0 {
@@ -225,58 +719,200 @@ func executeCheck(event *types.Event) (int, error) {
 			req.Header.Set(headerKey, headerValue)
 		}
 	}
+	// The transport removes the Content-Length of the responses it
+	// decompresses, so they are decompressed here instead when the framing
+	// of the response is checked.
+	checkFraming := plugin.ExpectChunked || plugin.ExpectContentLen
+	if checkFraming && len(req.Header.Get("Accept-Encoding")) == 0 {
+		req.Header.Set("Accept-Encoding", "gzip")
+	}
+	if plugin.Upload.Enabled() {
+		var upload *httpclient.Upload
+		if req, upload, err = plugin.Upload.Prepare(req); err != nil {
+			fmt.Fprintf(w, "%s UNKNOWN: %s\n", plugin.PluginConfig.Name, err)
+			return sensu.CheckStateUnknown, nil
+		}
+		// The upload is added to the output line once it is known.
+		var output bytes.Buffer
+		out := w
+		w = &output
+		defer func() {
+			fmt.Fprint(out, withUpload(output.String(), upload))
+		}()
+	}
 
 	resp, err := client.Do(req)
 	if err != nil {
-		fmt.Printf("request error: %s\n", err)
+		fmt.Fprintf(w, "%s CRITICAL: %s\n", plugin.PluginConfig.Name, httpclient.Describe(err))
 		return sensu.CheckStateCritical, nil
 	}
 
 	defer resp.Body.Close()
+	if plugin.CRL.Enabled() {
+		if resp.TLS == nil {
+			fmt.Fprintf(w, "%s CRITICAL: --check-crl requires an https URL, %s is not\n", plugin.PluginConfig.Name, resp.Request.URL)
+			return sensu.CheckStateCritical, nil
+		}
+		crlClient := httpclient.New(&tls.Config{RootCAs: tlsConfig.RootCAs}, time.Duration(plugin.Timeout)*time.Second, true, plugin.Proxy.Configure, plugin.Source.Configure, plugin.Resolver.Configure, plugin.Guard.Configure)
+		if problems := plugin.CRL.Problems(crlClient, resp.TLS.PeerCertificates, tlsConfig.RootCAs, time.Now()); len(problems) > 0 {
+			fmt.Fprintf(w, "%s CRITICAL: %s\n", plugin.PluginConfig.Name, strings.Join(problems, ", "))
+			return sensu.CheckStateCritical, nil
+		}
+	}
+	if plugin.RespectRetryAfter && resp.StatusCode == http.StatusServiceUnavailable && !contains(expectedCodes(), resp.StatusCode) {
+		if retryAfter, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok && retryAfter <= maxRetryAfter {
+			fmt.Fprintf(w, "%s WARNING: in maintenance, HTTP Status %v with Retry-After %s for %s\n", plugin.PluginConfig.Name, resp.StatusCode, retryAfter, target)
+			return sensu.CheckStateWarning, nil
+		} else if ok {
+			fmt.Fprintf(w, "%s CRITICAL: HTTP Status %v for %s, Retry-After %s exceeds --max-retry-after %s\n", plugin.PluginConfig.Name, resp.StatusCode, target, retryAfter, maxRetryAfter)
+			return sensu.CheckStateCritical, nil
+		}
+	}
+	if expectRedirects >= 0 {
+		if chain := redirectChain(resp); len(chain)-1 != expectRedirects {
+			fmt.Fprintf(w, "%s CRITICAL: %d redirect(s) instead of %d: %s\n", plugin.PluginConfig.Name, len(chain)-1, expectRedirects, strings.Join(chain, " -> "))
+			return sensu.CheckStateCritical, nil
+		}
+	}
+	if checkFraming {
+		if problem := checkFramingOf(resp); len(problem) > 0 {
+			fmt.Fprintf(w, "%s CRITICAL: %s at %s\n", plugin.PluginConfig.Name, problem, resp.Request.URL)
+			return sensu.CheckStateCritical, nil
+		}
+		if strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") && req.Header.Get("Accept-Encoding") == "gzip" {
+			body, err := gzip.NewReader(resp.Body)
+			if err != nil {
+				fmt.Fprintf(w, "%s CRITICAL: reading response body: %s\n", plugin.PluginConfig.Name, httpclient.Describe(err))
+				return sensu.CheckStateCritical, nil
+			}
+			resp.Body = body
+		}
+	}
+	// Printed after the check output line.
+	defer fmt.Fprintf(w, "Protocol: %s\n", resp.Proto)
 
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		fmt.Printf("response body read error: %s\n", err)
+	if contentTypeRegexp != nil && !contentTypeRegexp.MatchString(resp.Header.Get("Content-Type")) {
+		fmt.Fprintf(w, "%s CRITICAL: Content-Type %q does not match %q at %s\n", plugin.PluginConfig.Name, resp.Header.Get("Content-Type"), plugin.ExpectContentType, resp.Request.URL)
 		return sensu.CheckStateCritical, nil
 	}
 
+	if len(plugin.ExpectCharset) > 0 {
+		charset := contentCharset(resp.Header.Get("Content-Type"))
+		if len(charset) == 0 {
+			fmt.Fprintf(w, "%s CRITICAL: Content-Type %q declares no charset, expected %s at %s\n", plugin.PluginConfig.Name, resp.Header.Get("Content-Type"), plugin.ExpectCharset, resp.Request.URL)
+			return sensu.CheckStateCritical, nil
+		}
+		if normalizeCharset(charset) != normalizeCharset(plugin.ExpectCharset) {
+			fmt.Fprintf(w, "%s CRITICAL: charset %s instead of %s at %s\n", plugin.PluginConfig.Name, charset, plugin.ExpectCharset, resp.Request.URL)
+			return sensu.CheckStateCritical, nil
+		}
+	}
+	if languages := resp.Header["Content-Language"]; len(plugin.ExpectLanguage) > 0 && !hasLanguage(languages, plugin.ExpectLanguage) {
+		if len(languages) == 0 {
+			fmt.Fprintf(w, "%s CRITICAL: no Content-Language header, expected %s at %s\n", plugin.PluginConfig.Name, plugin.ExpectLanguage, resp.Request.URL)
+		} else {
+			fmt.Fprintf(w, "%s CRITICAL: Content-Language %s does not include %s at %s\n", plugin.PluginConfig.Name, strings.Join(languages, ", "), plugin.ExpectLanguage, resp.Request.URL)
+		}
+		return sensu.CheckStateCritical, nil
+	}
+
+	etag := resp.Header.Get("ETag")
+	if etagRegexp != nil && !etagRegexp.MatchString(etag) {
+		if len(etag) == 0 {
+			fmt.Fprintf(w, "%s CRITICAL: no ETag header, expected one matching %q at %s\n", plugin.PluginConfig.Name, plugin.ExpectETag, resp.Request.URL)
+		} else {
+			fmt.Fprintf(w, "%s CRITICAL: ETag %s does not match %q at %s\n", plugin.PluginConfig.Name, etag, plugin.ExpectETag, resp.Request.URL)
+		}
+		return sensu.CheckStateCritical, nil
+	}
+	if problems := checkCookies(resp.Cookies(), time.Now()); len(problems) > 0 {
+		fmt.Fprintf(w, "%s CRITICAL: %s at %s\n", plugin.PluginConfig.Name, strings.Join(problems, ", "), resp.Request.URL)
+		return sensu.CheckStateCritical, nil
+	}
+	if plugin.Expect304WithETag {
+		if len(etag) == 0 {
+			fmt.Fprintf(w, "%s CRITICAL: no ETag header to send a conditional request with at %s\n", plugin.PluginConfig.Name, resp.Request.URL)
+			return sensu.CheckStateCritical, nil
+		}
+		status, err := conditionalStatus(client, resp.Request, etag)
+		if err != nil {
+			fmt.Fprintf(w, "%s CRITICAL: conditional request: %s\n", plugin.PluginConfig.Name, httpclient.Describe(err))
+			return sensu.CheckStateCritical, nil
+		}
+		if status != http.StatusNotModified {
+			fmt.Fprintf(w, "%s CRITICAL: conditional request with If-None-Match: %s returned HTTP Status %d instead of 304 at %s\n", plugin.PluginConfig.Name, etag, status, resp.Request.URL)
+			return sensu.CheckStateCritical, nil
+		}
+	}
+
+	// The body is only read as far as needed: as a whole to validate it as
+	// JSON or UTF-8, otherwise until the search string is found.
+	var found, truncated bool
+	if plugin.ExpectValidJSON || plugin.ValidateUTF8 {
+		body, err := readBody(resp.Body, plugin.ReadLimit)
+		if err == errReadLimit {
+			fmt.Fprintf(w, "%s CRITICAL: response body exceeds --read-limit of %d bytes at %s\n", plugin.PluginConfig.Name, plugin.ReadLimit, resp.Request.URL)
+			return sensu.CheckStateCritical, nil
+		}
+		if err != nil {
+			fmt.Fprintf(w, "%s CRITICAL: reading response body: %s\n", plugin.PluginConfig.Name, httpclient.Describe(err))
+			return sensu.CheckStateCritical, nil
+		}
+		if plugin.ValidateUTF8 {
+			if offset := invalidUTF8(body); offset >= 0 {
+				fmt.Fprintf(w, "%s CRITICAL: response body is not valid UTF-8, invalid byte sequence at offset %d at %s\n", plugin.PluginConfig.Name, offset, resp.Request.URL)
+				return sensu.CheckStateCritical, nil
+			}
+		}
+		if plugin.ExpectValidJSON && !json.Valid(body) {
+			fmt.Fprintf(w, "%s CRITICAL: response body is not valid JSON at %s\n", plugin.PluginConfig.Name, resp.Request.URL)
+			return sensu.CheckStateCritical, nil
+		}
+		found = bytes.Contains(body, []byte(plugin.SearchString))
+	} else if len(plugin.SearchString) > 0 {
+		found, truncated, err = searchBody(resp.Body, []byte(plugin.SearchString), plugin.ReadLimit)
+		if err != nil {
+			fmt.Fprintf(w, "%s CRITICAL: reading response body: %s\n", plugin.PluginConfig.Name, httpclient.Describe(err))
+			return sensu.CheckStateCritical, nil
+		}
+	}
+
 	if len(plugin.SearchString) > 0 {
-		if strings.Contains(string(body), plugin.SearchString) {
-			fmt.Printf("%s OK: found \"%s\" at %s\n", plugin.PluginConfig.Name, plugin.SearchString, resp.Request.URL)
+		if found {
+			fmt.Fprintf(w, "%s OK: found \"%s\" at %s\n", plugin.PluginConfig.Name, plugin.SearchString, resp.Request.URL)
 			return sensu.CheckStateOK, nil
 		}
-		fmt.Printf("%s CRITICAL: \"%s\" not found at %s\n", plugin.PluginConfig.Name, plugin.SearchString, resp.Request.URL)
+		if truncated {
+			fmt.Fprintf(w, "%s CRITICAL: \"%s\" not found in the first %d bytes at %s\n", plugin.PluginConfig.Name, plugin.SearchString, plugin.ReadLimit, resp.Request.URL)
+			return sensu.CheckStateCritical, nil
+		}
+		fmt.Fprintf(w, "%s CRITICAL: \"%s\" not found at %s\n", plugin.PluginConfig.Name, plugin.SearchString, resp.Request.URL)
 		return sensu.CheckStateCritical, nil
 	}
 
 	// check for response code
 	if len(plugin.ResponseCode) > 0 {
 
-		ExpectedCodes := make([]int, len(plugin.ResponseCode))
-		for i, s := range plugin.ResponseCode {
-			ExpectedCodes[i], _ = strconv.Atoi(s)
-		}
-
-		found := contains(ExpectedCodes, resp.StatusCode)
+		found := contains(expectedCodes(), resp.StatusCode)
 
 		if found {
-			fmt.Printf("%s OK: HTTP Status %v for %s\n", plugin.PluginConfig.Name, resp.StatusCode, resp.Request.URL)
+			fmt.Fprintf(w, "%s OK: HTTP Status %v for %s\n", plugin.PluginConfig.Name, resp.StatusCode, resp.Request.URL)
 			return sensu.CheckStateOK, nil
 		} else {
-			fmt.Printf("%s CRITICAL: HTTP Status %v for %s. Expected %s\n", plugin.PluginConfig.Name, resp.StatusCode, plugin.URL, plugin.ResponseCode)
+			fmt.Fprintf(w, "%s CRITICAL: HTTP Status %v for %s. Expected %s\n", plugin.PluginConfig.Name, resp.StatusCode, target, plugin.ResponseCode)
 			return sensu.CheckStateCritical, nil
 		}
 	}
 
 	switch {
 	case resp.StatusCode >= http.StatusBadRequest:
-		fmt.Printf("%s CRITICAL: HTTP Status %v for %s\n", plugin.PluginConfig.Name, resp.StatusCode, plugin.URL)
+		fmt.Fprintf(w, "%s CRITICAL: HTTP Status %v for %s\n", plugin.PluginConfig.Name, resp.StatusCode, target)
 		return sensu.CheckStateCritical, nil
 	// resp.StatusCode will ultimately be 200 for successful redirects
 	// so instead we check to see if the current URL matches the requested
 	// URL
-	case resp.Request.URL.String() != plugin.URL && plugin.RedirectOK:
-		fmt.Printf("%s OK: HTTP Status %v for %s (redirect from %s)\n", plugin.PluginConfig.Name, resp.StatusCode, resp.Request.URL, plugin.URL)
+	case resp.Request.URL.String() != target && plugin.RedirectOK:
+		fmt.Fprintf(w, "%s OK: HTTP Status %v for %s (redirect from %s)\n", plugin.PluginConfig.Name, resp.StatusCode, resp.Request.URL, target)
 		return sensu.CheckStateOK, nil
 	// But, if we've disabled redirects, this should work
 	case resp.StatusCode >= http.StatusMultipleChoices:
@@ -285,17 +921,143 @@ func executeCheck(event *types.Event) (int, error) {
 		if len(redirectURL) > 0 {
 			extra = fmt.Sprintf(" (redirects to %s)", redirectURL)
 		}
-		fmt.Printf("%s WARNING: HTTP Status %v for %s %s\n", plugin.PluginConfig.Name, resp.StatusCode, plugin.URL, extra)
+		fmt.Fprintf(w, "%s WARNING: HTTP Status %v for %s %s\n", plugin.PluginConfig.Name, resp.StatusCode, target, extra)
 		return sensu.CheckStateWarning, nil
 	case resp.StatusCode == -1:
-		fmt.Printf("%s UNKNOWN: HTTP Status %v for %s\n", plugin.PluginConfig.Name, resp.StatusCode, plugin.URL)
+		fmt.Fprintf(w, "%s UNKNOWN: HTTP Status %v for %s\n", plugin.PluginConfig.Name, resp.StatusCode, target)
 		return sensu.CheckStateUnknown, nil
 	default:
-		fmt.Printf("%s OK: HTTP Status %v for %s\n", plugin.PluginConfig.Name, resp.StatusCode, plugin.URL)
+		fmt.Fprintf(w, "%s OK: HTTP Status %v for %s\n", plugin.PluginConfig.Name, resp.StatusCode, target)
 		return sensu.CheckStateOK, nil
 	}
 }
 
+// checkURLs checks the URLs of --url-file with client, --concurrency at a
+// time, and reports the worst status of them. The output line summarizes the
+// URLs that failed, followed by the output line of each URL in file order,
+// written to w.
+func checkURLs(w io.Writer, client *http.Client, urls []string) int {
+	outputs := make([]bytes.Buffer, len(urls))
+	statuses := make([]int, len(urls))
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < plugin.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range indexes {
+				status, err := checkOne(&outputs[idx], client, urls[idx])
+				if err != nil {
+					fmt.Fprintf(&outputs[idx], "%s UNKNOWN: %v\n", plugin.PluginConfig.Name, err)
+					status = sensu.CheckStateUnknown
+				}
+				statuses[idx] = status
+			}
+		}()
+	}
+	for i := range urls {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	status := sensu.CheckStateOK
+	failed := []string{}
+	for i, s := range statuses {
+		if s != sensu.CheckStateOK {
+			failed = append(failed, urls[i])
+		}
+		if severity[s] > severity[status] {
+			status = s
+		}
+	}
+	summary := fmt.Sprintf("%d of %d URLs failed", len(failed), len(urls))
+	if len(failed) > maxFailedOutput {
+		failed = append(failed[:maxFailedOutput:maxFailedOutput], fmt.Sprintf("and %d more", len(failed)-maxFailedOutput))
+	}
+	if len(failed) > 0 {
+		summary = fmt.Sprintf("%s: %s", summary, strings.Join(failed, ", "))
+	}
+	fmt.Fprintf(w, "%s %s: %s | urls_checked=%d, urls_failed=%d\n", plugin.PluginConfig.Name, stateName(status), summary, len(urls), len(failed))
+	for i := range outputs {
+		fmt.Fprint(w, outputs[i].String())
+	}
+	return status
+}
+
+// stateName returns the name of status for output.
+func stateName(status int) string {
+	switch status {
+	case sensu.CheckStateOK:
+		return "OK"
+	case sensu.CheckStateWarning:
+		return "WARNING"
+	case sensu.CheckStateCritical:
+		return "CRITICAL"
+	}
+	return "UNKNOWN"
+}
+
+// readURLFile reads the URLs of path, one per line. Empty lines and lines
+// starting with # are skipped.
+func readURLFile(path string) ([]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading --url-file: %v", err)
+	}
+	urls := []string{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		flag := fmt.Sprintf("--url-file %s line %d", path, n)
+		u, err := httpclient.ParseURL(flag, line)
+		if err != nil {
+			return nil, err
+		}
+		if err := plugin.Auth.FromURL(flag, u); err != nil {
+			return nil, err
+		}
+		urls = append(urls, u.String())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Error reading --url-file: %v", err)
+	}
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("--url-file %s has no URLs", path)
+	}
+	return urls, nil
+}
+
+// expectedCodes returns the status codes of --response-code.
+func expectedCodes() []int {
+	codes := make([]int, len(plugin.ResponseCode))
+	for i, s := range plugin.ResponseCode {
+		codes[i], _ = strconv.Atoi(s)
+	}
+	return codes
+}
+
+// parseRetryAfter returns the delay of a Retry-After header value, given in
+// seconds or as an HTTP date, a date in the past being no delay. ok is false
+// if value is empty or invalid.
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if seconds, err := strconv.ParseInt(value, 10, 32); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	date, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	if delay := date.Sub(now).Round(time.Second); delay > 0 {
+		return delay, true
+	}
+	return 0, true
+}
+
 func contains(s []int, val int) bool {
 	for _, v := range s {
 		if v == val {
@@ -304,3 +1066,494 @@ func contains(s []int, val int) bool {
 	}
 	return false
 }
+
+// dampen calls check and writes its output to w. With a state file it counts
+// the consecutive CRITICAL results of check, until there are
+// --required-failures of them CRITICAL is reported as WARNING, so that
+// targets which flap at the network layer do not alert on every blip.
+func dampen(w io.Writer, check func(io.Writer) (int, error)) (int, error) {
+	if len(plugin.StateFile) == 0 {
+		return check(w)
+	}
+	var buf bytes.Buffer
+	status, err := check(&buf)
+	output := buf.String()
+
+	state := loadState(plugin.StateFile, plugin.URL)
+	if status == sensu.CheckStateCritical && err == nil {
+		if state.Failures == 0 {
+			state.Since = time.Now().UTC()
+		}
+		state.Failures++
+		if state.Failures < plugin.RequiredFailures {
+			status = sensu.CheckStateWarning
+			output = softenOutput(output, fmt.Sprintf("(failure %d of %d before CRITICAL, failing since %s)", state.Failures, plugin.RequiredFailures, state.Since.Format(time.RFC3339)))
+		}
+	} else if status != sensu.CheckStateUnknown {
+		state.Failures = 0
+		state.Since = time.Time{}
+	}
+	if err := saveState(plugin.StateFile, state); err != nil {
+		logging.Warn("failed to write state file", "file", plugin.StateFile, "error", err)
+	}
+	fmt.Fprint(w, output)
+	return status, err
+}
+
+// softenOutput reports the CRITICAL output line of the check as WARNING,
+// with note added before any perfdata.
+func softenOutput(output, note string) string {
+	lines := strings.SplitN(output, "\n", 2)
+	line := strings.Replace(lines[0], plugin.PluginConfig.Name+" CRITICAL:", plugin.PluginConfig.Name+" WARNING:", 1)
+	if i := strings.Index(line, " | "); i >= 0 {
+		line = line[:i] + " " + note + line[i:]
+	} else {
+		line += " " + note
+	}
+	lines[0] = line
+	return strings.Join(lines, "\n")
+}
+
+// contentCharset returns the charset parameter of contentType, "" if it has
+// none or cannot be parsed.
+func contentCharset(contentType string) string {
+	_, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	return params["charset"]
+}
+
+// normalizeCharset returns charset in lower case without separators, so that
+// spellings like UTF-8, utf8 and utf_8 compare equal.
+func normalizeCharset(charset string) string {
+	return strings.NewReplacer("-", "", "_", "").Replace(strings.ToLower(strings.TrimSpace(charset)))
+}
+
+// hasLanguage returns whether the Content-Language header values list
+// language, or a regional variant of it (de-CH for de).
+func hasLanguage(values []string, language string) bool {
+	for _, value := range values {
+		for _, tag := range strings.Split(value, ",") {
+			tag = strings.TrimSpace(tag)
+			if strings.EqualFold(tag, language) || (len(tag) > len(language) && strings.EqualFold(tag[:len(language)+1], language+"-")) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// invalidUTF8 returns the offset of the first invalid UTF-8 sequence of body,
+// or -1 if it is valid UTF-8.
+func invalidUTF8(body []byte) int {
+	for offset := 0; offset < len(body); {
+		r, size := utf8.DecodeRune(body[offset:])
+		if r == utf8.RuneError && size == 1 {
+			return offset
+		}
+		offset += size
+	}
+	return -1
+}
+
+// withUpload adds the description of upload to the output line of the check,
+// before any perfdata, and its metrics to the perfdata.
+func withUpload(output string, upload *httpclient.Upload) string {
+	lines := strings.SplitN(output, "\n", 2)
+	line := lines[0]
+	if i := strings.Index(line, " | "); i >= 0 {
+		line = line[:i] + ", " + upload.Output() + line[i:] + ", " + upload.Perfdata()
+	} else {
+		line += ", " + upload.Output() + " | " + upload.Perfdata()
+	}
+	lines[0] = line
+	return strings.Join(lines, "\n")
+}
+
+// loadState reads the state of checkURL from path, a missing or unreadable
+// state file, or one for another URL, is an empty state.
+func loadState(path, checkURL string) stateEntry {
+	empty := stateEntry{URL: checkURL}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return empty
+	}
+	var entry stateEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		logging.Warn("ignoring invalid state file", "file", path, "error", err)
+		return empty
+	}
+	if entry.URL != checkURL {
+		return empty
+	}
+	return entry
+}
+
+// saveState writes the state to path.
+func saveState(path string, entry stateEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0600)
+}
+
+// errReadLimit is returned by readBody for bodies larger than the limit.
+var errReadLimit = errors.New("read limit exceeded")
+
+// readBody reads all of body, or returns errReadLimit if limit is not 0 and
+// body is longer than limit bytes.
+func readBody(body io.Reader, limit int64) ([]byte, error) {
+	if limit == 0 {
+		return ioutil.ReadAll(body)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(body, limit+1))
+	if err == nil && int64(len(data)) > limit {
+		err = errReadLimit
+	}
+	return data, err
+}
+
+// searchBody reads body until search is found, keeping only a window of it
+// in memory, and reports whether it was found. If limit is not 0 no more than
+// limit bytes are read, truncated reports whether body is longer than that.
+func searchBody(body io.Reader, search []byte, limit int64) (found bool, truncated bool, err error) {
+	r := body
+	if limit > 0 {
+		r = io.LimitReader(body, limit)
+	}
+	// The window keeps the end of the previous chunk, for matches that span
+	// two chunks.
+	keep := len(search) - 1
+	window := make([]byte, keep+32*1024)
+	n := 0
+	var read int64
+	for {
+		m, readErr := r.Read(window[n:])
+		n += m
+		read += int64(m)
+		if bytes.Contains(window[:n], search) {
+			return true, false, nil
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return false, false, readErr
+		}
+		if n > keep {
+			copy(window, window[n-keep:n])
+			n = keep
+		}
+	}
+	if limit > 0 && read == limit {
+		var next [1]byte
+		m, _ := io.ReadFull(body, next[:])
+		truncated = m > 0
+	}
+	return false, truncated, nil
+}
+
+// conditionalStatus repeats req, the request of a response with the given
+// ETag, with an If-None-Match header for it and returns the status code.
+func conditionalStatus(client *http.Client, req *http.Request, etag string) (int, error) {
+	conditional := req.Clone(req.Context())
+	conditional.Header.Set("If-None-Match", etag)
+	resp, err := client.Do(conditional)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+// redirectChain returns the URLs requested to get resp, from the first to
+// that of resp, one more than the number of redirects followed.
+func redirectChain(resp *http.Response) []string {
+	chain := []string{resp.Request.URL.String()}
+	for req := resp.Request; req.Response != nil; req = req.Response.Request {
+		chain = append([]string{req.Response.Request.URL.String()}, chain...)
+	}
+	return chain
+}
+
+// checkFramingOf returns how the framing of resp differs from that required
+// by --expect-chunked or --expect-content-length, or "" if it does not.
+// HTTP/2 and later have no chunked transfer encoding, every response is
+// streamed in frames, with or without a Content-Length.
+func checkFramingOf(resp *http.Response) string {
+	chunked := len(resp.TransferEncoding) > 0 && resp.TransferEncoding[0] == "chunked"
+	hasLength := len(resp.Header.Get("Content-Length")) > 0
+	switch {
+	case plugin.ExpectChunked && resp.ProtoMajor == 1 && !chunked:
+		if hasLength {
+			return fmt.Sprintf("response is not chunked, it has Content-Length %s", resp.Header.Get("Content-Length"))
+		}
+		return fmt.Sprintf("response is not chunked (%s)", resp.Proto)
+	case plugin.ExpectChunked && resp.ProtoMajor > 1 && hasLength:
+		return fmt.Sprintf("response is not streamed, it has Content-Length %s", resp.Header.Get("Content-Length"))
+	case plugin.ExpectContentLen && !hasLength:
+		if chunked {
+			return "response has no Content-Length, it is chunked"
+		}
+		return "response has no Content-Length"
+	}
+	return ""
+}
+
+// cookieExpect is a cookie of --expect-cookie.
+type cookieExpect struct {
+	name  string
+	value *regexp.Regexp
+}
+
+// checkCookies returns the problems with the cookies set by a response: the
+// cookies of --expect-cookie that are missing or do not match, and the
+// cookies that lack the attributes required by the --expect-cookie-* flags.
+// The attributes are checked on the cookies of --expect-cookie if given, on
+// all the cookies otherwise.
+func checkCookies(cookies []*http.Cookie, now time.Time) []string {
+	problems := []string{}
+	checked := cookies
+	if len(cookieExpects) > 0 {
+		checked = nil
+		for _, expect := range cookieExpects {
+			var found *http.Cookie
+			for _, cookie := range cookies {
+				if cookie.Name == expect.name {
+					found = cookie
+				}
+			}
+			switch {
+			case found == nil:
+				problems = append(problems, fmt.Sprintf("no cookie %s set", expect.name))
+			case expect.value != nil && !expect.value.MatchString(found.Value):
+				problems = append(problems, fmt.Sprintf("cookie %s value does not match %q", expect.name, expect.value))
+			default:
+				checked = append(checked, found)
+			}
+		}
+	}
+	for _, cookie := range checked {
+		if plugin.CookieSecure && !cookie.Secure {
+			problems = append(problems, fmt.Sprintf("cookie %s is not Secure", cookie.Name))
+		}
+		if plugin.CookieHTTPOnly && !cookie.HttpOnly {
+			problems = append(problems, fmt.Sprintf("cookie %s is not HttpOnly", cookie.Name))
+		}
+		if len(plugin.CookieSameSite) > 0 && !strings.EqualFold(sameSite(cookie), plugin.CookieSameSite) {
+			problems = append(problems, fmt.Sprintf("cookie %s has SameSite %s instead of %s", cookie.Name, sameSite(cookie), plugin.CookieSameSite))
+		}
+		if cookieMinAge == 0 && cookieMaxAge == 0 {
+			continue
+		}
+		// Max-Age takes precedence over Expires, a cookie with neither lasts
+		// for the browser session, which is within any maximum.
+		if cookie.MaxAge == 0 && cookie.Expires.IsZero() {
+			if cookieMinAge > 0 {
+				problems = append(problems, fmt.Sprintf("cookie %s is a session cookie, expected a lifetime of at least %s", cookie.Name, cookieMinAge))
+			}
+			continue
+		}
+		age := time.Duration(cookie.MaxAge) * time.Second
+		if cookie.MaxAge == 0 {
+			age = cookie.Expires.Sub(now).Truncate(time.Second)
+		}
+		if age < cookieMinAge {
+			problems = append(problems, fmt.Sprintf("cookie %s lifetime %s is below %s", cookie.Name, age, cookieMinAge))
+		}
+		if cookieMaxAge > 0 && age > cookieMaxAge {
+			problems = append(problems, fmt.Sprintf("cookie %s lifetime %s exceeds %s", cookie.Name, age, cookieMaxAge))
+		}
+	}
+	return problems
+}
+
+// sameSite returns the SameSite attribute of cookie as it is written in a
+// Set-Cookie header, or "unset".
+func sameSite(cookie *http.Cookie) string {
+	switch cookie.SameSite {
+	case http.SameSiteStrictMode:
+		return "Strict"
+	case http.SameSiteLaxMode:
+		return "Lax"
+	case http.SameSiteNoneMode:
+		return "None"
+	}
+	return "unset"
+}
+
+// probeTimeout is how long a security probe waits for a response. A server
+// that keeps waiting for the rest of a request body is what indicates that
+// the front proxy and backend disagree on the length of a request.
+var probeTimeout = 5 * time.Second
+
+// probeHeaderSize is the size of the oversized header probe, larger than any
+// front proxy should accept.
+const probeHeaderSize = 128 * 1024
+
+// probe is a malformed request and how to judge the response to it.
+type probe struct {
+	name string
+	// request is the raw request, with the placeholders {path} and {host}.
+	request string
+	// susceptible returns why the response to request indicates
+	// susceptibility, or "" if it does not. resp is nil if the server did not
+	// respond before probeTimeout.
+	susceptible func(resp *http.Response) string
+}
+
+func probes() []probe {
+	// A server that keeps waiting for more body has framed the request
+	// differently than the front proxy.
+	hangs := func(resp *http.Response) string {
+		if resp == nil {
+			return fmt.Sprintf("no response within %s, the request body length is ambiguous", probeTimeout)
+		}
+		return ""
+	}
+	// RFC 7230 requires these to be rejected with 400 Bad Request.
+	rejected := func(resp *http.Response) string {
+		if resp == nil {
+			return fmt.Sprintf("no response within %s", probeTimeout)
+		}
+		if resp.StatusCode != http.StatusBadRequest {
+			return fmt.Sprintf("accepted with %d", resp.StatusCode)
+		}
+		return ""
+	}
+	return []probe{
+		{
+			name:        "CL.TE",
+			request:     "POST {path} HTTP/1.1\r\nHost: {host}\r\nContent-Type: application/x-www-form-urlencoded\r\nContent-Length: 4\r\nTransfer-Encoding: chunked\r\nConnection: close\r\n\r\n1\r\nZ\r\nQ",
+			susceptible: hangs,
+		},
+		{
+			name:        "TE.CL",
+			request:     "POST {path} HTTP/1.1\r\nHost: {host}\r\nContent-Type: application/x-www-form-urlencoded\r\nContent-Length: 6\r\nTransfer-Encoding: chunked\r\nConnection: close\r\n\r\n0\r\n\r\nX",
+			susceptible: hangs,
+		},
+		{
+			name:        "TE whitespace",
+			request:     "POST {path} HTTP/1.1\r\nHost: {host}\r\nContent-Length: 5\r\nTransfer-Encoding : chunked\r\nConnection: close\r\n\r\n0\r\n\r\n",
+			susceptible: rejected,
+		},
+		{
+			name:        "duplicate CL",
+			request:     "POST {path} HTTP/1.1\r\nHost: {host}\r\nContent-Length: 0\r\nContent-Length: 5\r\nConnection: close\r\n\r\nhello",
+			susceptible: rejected,
+		},
+		{
+			name:    "oversized header",
+			request: "GET {path} HTTP/1.1\r\nHost: {host}\r\nX-Probe: " + strings.Repeat("a", probeHeaderSize) + "\r\nConnection: close\r\n\r\n",
+			susceptible: func(resp *http.Response) string {
+				if resp != nil && resp.StatusCode < http.StatusBadRequest {
+					return fmt.Sprintf("%d KiB header accepted with %d", probeHeaderSize/1024, resp.StatusCode)
+				}
+				return ""
+			},
+		},
+	}
+}
+
+// securityProbe sends the probes to u in parallel, each on its own
+// connection, bypassing any proxy, and writes the output line to w.
+func securityProbe(w io.Writer, u *url.URL) (int, error) {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		fmt.Fprintf(w, "%s UNKNOWN: --security-probe requires an http or https URL\n", plugin.PluginConfig.Name)
+		return sensu.CheckStateUnknown, nil
+	}
+	probes := probes()
+	results := make([]string, len(probes))
+	errs := make([]error, len(probes))
+	var wg sync.WaitGroup
+	for i := range probes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], errs[i] = sendProbe(u, probes[i])
+		}(i)
+	}
+	wg.Wait()
+
+	var findings []string
+	for i, p := range probes {
+		if errs[i] != nil {
+			fmt.Fprintf(w, "%s CRITICAL: %s probe: %s\n", plugin.PluginConfig.Name, p.name, httpclient.Describe(errs[i]))
+			return sensu.CheckStateCritical, nil
+		}
+		if len(results[i]) > 0 {
+			findings = append(findings, fmt.Sprintf("%s: %s", p.name, results[i]))
+		}
+	}
+	if len(findings) > 0 {
+		fmt.Fprintf(w, "%s WARNING: %d of %d security probes indicate request smuggling susceptibility at %s: %s\n", plugin.PluginConfig.Name, len(findings), len(probes), u, strings.Join(findings, "; "))
+		return sensu.CheckStateWarning, nil
+	}
+	fmt.Fprintf(w, "%s OK: %d security probes passed at %s\n", plugin.PluginConfig.Name, len(probes), u)
+	return sensu.CheckStateOK, nil
+}
+
+// sendProbe sends p to u and returns why the response indicates
+// susceptibility, or "" if it does not. An error is returned only if the
+// server could not be reached at all, a server closing the connection on a
+// malformed request rejected it.
+func sendProbe(u *url.URL, p probe) (string, error) {
+	address := u.Host
+	if len(u.Port()) == 0 {
+		port := "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+		address = net.JoinHostPort(u.Hostname(), port)
+	}
+	ctx := context.Background()
+	if plugin.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(plugin.Timeout)*time.Second)
+		defer cancel()
+	}
+	// The dialer of the client of the check, so that the probes connect from
+	// --source-address, resolve with --resolver and are refused private
+	// network addresses with --deny-private-networks.
+	dial := httpclient.NewTransport(nil, plugin.Source.Configure, plugin.Resolver.Configure, plugin.Guard.Configure).DialContext
+	conn, err := dial(ctx, "tcp", address)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if u.Scheme == "https" {
+		config := tlsConfig.Clone()
+		if len(config.ServerName) == 0 {
+			config.ServerName = u.Hostname()
+		}
+		config.NextProtos = []string{"http/1.1"}
+		tlsConn := tls.Client(conn, config)
+		if deadline, ok := ctx.Deadline(); ok {
+			_ = tlsConn.SetDeadline(deadline)
+		}
+		if err := tlsConn.Handshake(); err != nil {
+			return "", err
+		}
+		conn = tlsConn
+	}
+
+	path := u.RequestURI()
+	request := strings.NewReplacer("{path}", path, "{host}", u.Host).Replace(p.request)
+	_ = conn.SetDeadline(time.Now().Add(probeTimeout))
+	if _, err := io.WriteString(conn, request); err != nil {
+		// The server may close the connection on the oversized header before
+		// all of it is written.
+		return "", nil
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return p.susceptible(nil), nil
+		}
+		return "", nil
+	}
+	resp.Body.Close()
+	return p.susceptible(resp), nil
+}
@@ -1,11 +1,27 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/nixwiz/http-checks/internal/auth"
 	corev2 "github.com/sensu/sensu-go/api/core/v2"
 	"github.com/sensu/sensu-plugin-sdk/sensu"
 	"github.com/stretchr/testify/assert"
@@ -106,3 +122,1113 @@ func TestExecuteCheck(t *testing.T) {
 	assert.NoError(err)
 	assert.Equal(sensu.CheckStateOK, status)
 }
+
+func TestDefaultClientUntouched(t *testing.T) {
+	assert := assert.New(t)
+	event := corev2.FixtureEvent("entity1", "check")
+
+	var test = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(`{"status": "SUCCESS"}`))
+	}))
+	defer test.Close()
+
+	plugin.URL = test.URL
+	plugin.Headers = nil
+	plugin.Timeout = 15
+	plugin.InsecureSkipVerify = true
+	plugin.SearchString = ""
+	plugin.RedirectOK = false
+	plugin.ResponseCode = nil
+	status, err := checkArgs(event)
+	assert.NoError(err)
+	assert.Equal(sensu.CheckStateOK, status)
+	status, err = executeCheck(event)
+	assert.NoError(err)
+	assert.Equal(sensu.CheckStateOK, status)
+	plugin.InsecureSkipVerify = false
+
+	// The check must use its own client and transport
+	// httptest.Server.Close may initialise the default TLS config itself, so
+	// only check that ours was not installed.
+	if defaultTLS := http.DefaultTransport.(*http.Transport).TLSClientConfig; defaultTLS != nil {
+		assert.False(defaultTLS.InsecureSkipVerify)
+	}
+	assert.Nil(http.DefaultClient.Transport)
+	assert.Nil(http.DefaultClient.CheckRedirect)
+	assert.Zero(http.DefaultClient.Timeout)
+}
+
+func TestExecuteCheckConnectionError(t *testing.T) {
+	assert := assert.New(t)
+	event := corev2.FixtureEvent("entity1", "check")
+
+	var test = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	plugin.URL = test.URL
+	test.Close()
+	plugin.Headers = nil
+	plugin.SearchString = ""
+	plugin.InsecureSkipVerify = false
+	status, err := checkArgs(event)
+	assert.NoError(err)
+	assert.Equal(sensu.CheckStateOK, status)
+	// Transport errors are reported as CRITICAL without an error, so the
+	// usage text is never printed.
+	status, err = executeCheck(event)
+	assert.NoError(err)
+	assert.Equal(sensu.CheckStateCritical, status)
+}
+
+func TestExecuteCheckAuth(t *testing.T) {
+	assert := assert.New(t)
+	event := corev2.FixtureEvent("entity1", "check")
+	os.Setenv("TEST_HTTP_CHECK_TOKEN", "t0ken")
+	defer os.Unsetenv("TEST_HTTP_CHECK_TOKEN")
+
+	var test = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer t0ken" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer test.Close()
+
+	plugin.URL = test.URL
+	plugin.Headers = nil
+	plugin.SearchString = ""
+	plugin.Auth = auth.Config{Type: auth.TypeBearer, TokenEnv: "TEST_HTTP_CHECK_MISSING"}
+	status, err := checkArgs(event)
+	assert.Error(err)
+	assert.Equal(sensu.CheckStateUnknown, status)
+
+	plugin.Auth.TokenEnv = "TEST_HTTP_CHECK_TOKEN"
+	status, err = checkArgs(event)
+	assert.NoError(err)
+	assert.Equal(sensu.CheckStateOK, status)
+	status, err = executeCheck(event)
+	assert.NoError(err)
+	assert.Equal(sensu.CheckStateOK, status)
+	plugin.Auth = auth.Config{}
+}
+
+func TestExecuteCheckHMAC(t *testing.T) {
+	assert := assert.New(t)
+	event := corev2.FixtureEvent("entity1", "check")
+	os.Setenv("TEST_HTTP_CHECK_HMAC_SECRET", "s3cret")
+	defer os.Unsetenv("TEST_HTTP_CHECK_HMAC_SECRET")
+
+	var test = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mac := hmac.New(sha256.New, []byte("s3cret"))
+		mac.Write([]byte(r.Method + "\n" + r.URL.Path + "\n"))
+		if r.Header.Get("X-Signature") != hex.EncodeToString(mac.Sum(nil)) {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer test.Close()
+
+	plugin.URL = test.URL + "/status"
+	plugin.Headers = nil
+	plugin.SearchString = ""
+	plugin.HMAC = auth.HMACConfig{Header: "X-Signature", SecretEnv: "TEST_HTTP_CHECK_HMAC_SECRET"}
+	defer func() { plugin.HMAC = auth.HMACConfig{} }()
+	status, err := checkArgs(event)
+	assert.NoError(err)
+	assert.Equal(sensu.CheckStateOK, status)
+	status, err = executeCheck(event)
+	assert.NoError(err)
+	assert.Equal(sensu.CheckStateOK, status)
+
+	plugin.HMAC.Header = "X-Other-Signature"
+	status, err = checkArgs(event)
+	assert.NoError(err)
+	assert.Equal(sensu.CheckStateOK, status)
+	status, err = executeCheck(event)
+	assert.NoError(err)
+	assert.Equal(sensu.CheckStateCritical, status)
+}
+
+func TestExecuteCheckURLCredentials(t *testing.T) {
+	assert := assert.New(t)
+	event := corev2.FixtureEvent("entity1", "check")
+
+	var test = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, ok := r.BasicAuth(); !ok || user != "sensu" || password != "s3cret" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer test.Close()
+
+	plugin.URL = " " + strings.Replace(test.URL, "http://", "sensu:s3cret@", 1) + "\n"
+	plugin.Headers = nil
+	plugin.SearchString = ""
+	plugin.Auth = auth.Config{}
+	status, err := checkArgs(event)
+	assert.NoError(err)
+	assert.Equal(sensu.CheckStateOK, status)
+	assert.Equal(test.URL, plugin.URL)
+
+	stdout := os.Stdout
+	r, w, err := os.Pipe()
+	require.NoError(t, err)
+	os.Stdout = w
+	status, err = executeCheck(event)
+	w.Close()
+	os.Stdout = stdout
+	output, _ := ioutil.ReadAll(r)
+	assert.NoError(err)
+	assert.Equal(sensu.CheckStateOK, status)
+	assert.NotContains(string(output), "s3cret")
+
+	plugin.URL = "http://sensu:s3cret@[::1"
+	status, err = checkArgs(event)
+	assert.Error(err)
+	assert.Equal(sensu.CheckStateUnknown, status)
+	plugin.URL = "http://sensu:s3cret@::1/"
+	_, err = checkArgs(event)
+	assert.EqualError(err, `--url "http://sensu:REDACTED@::1/" has an IPv6 address that is not in brackets, use http://[::1]/`)
+	plugin.Auth = auth.Config{}
+}
+
+func TestExecuteCheckContentType(t *testing.T) {
+	assert := assert.New(t)
+	event := corev2.FixtureEvent("entity1", "check")
+
+	var test = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/json" {
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			_, _ = w.Write([]byte(`{"status": "SUCCESS"}`))
+			return
+		}
+		// A proxy error page served with a 200.
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte("<html><body>Bad Gateway</body></html>"))
+	}))
+	defer test.Close()
+
+	testCases := []struct {
+		status      int
+		path        string
+		contentType string
+		validJSON   bool
+	}{
+		{sensu.CheckStateOK, "/json", "^application/json", false},
+		{sensu.CheckStateOK, "/json", "", true},
+		{sensu.CheckStateOK, "/json", "^application/json", true},
+		{sensu.CheckStateCritical, "/html", "^application/json", false},
+		{sensu.CheckStateCritical, "/html", "", true},
+		{sensu.CheckStateOK, "/html", "", false},
+	}
+
+	plugin.Headers = nil
+	plugin.SearchString = ""
+	plugin.ResponseCode = nil
+	plugin.RedirectOK = false
+	plugin.InsecureSkipVerify = false
+	for _, tc := range testCases {
+		plugin.URL = test.URL + tc.path
+		plugin.ExpectContentType = tc.contentType
+		plugin.ExpectValidJSON = tc.validJSON
+		status, err := checkArgs(event)
+		assert.NoError(err)
+		assert.Equal(sensu.CheckStateOK, status)
+		status, err = executeCheck(event)
+		assert.NoError(err)
+		assert.Equal(tc.status, status, "%s %q %v", tc.path, tc.contentType, tc.validJSON)
+	}
+
+	plugin.ExpectContentType = "application/(json"
+	status, err := checkArgs(event)
+	assert.Error(err)
+	assert.Equal(sensu.CheckStateUnknown, status)
+	plugin.ExpectContentType = ""
+	plugin.ExpectValidJSON = false
+}
+
+func TestExecuteCheckCharset(t *testing.T) {
+	assert := assert.New(t)
+	event := corev2.FixtureEvent("entity1", "check")
+
+	var test = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/de":
+			w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+			w.Header().Set("Content-Language", "de-CH, fr-CH")
+			_, _ = w.Write([]byte("<p>Grüezi</p>"))
+		case "/latin1":
+			// The mojibake of a Latin-1 page served as UTF-8.
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			_, _ = w.Write([]byte("<p>Gr\xfcezi</p>"))
+		default:
+			w.Header().Set("Content-Type", "text/html")
+			_, _ = w.Write([]byte("<p>Hello</p>"))
+		}
+	}))
+	defer test.Close()
+
+	testCases := []struct {
+		status   int
+		path     string
+		charset  string
+		language string
+		utf8     bool
+		output   string
+	}{
+		{sensu.CheckStateOK, "/de", "utf-8", "de", true, "OK"},
+		{sensu.CheckStateOK, "/de", "utf8", "fr-ch", false, "OK"},
+		{sensu.CheckStateCritical, "/de", "iso-8859-1", "", false, "charset UTF-8 instead of iso-8859-1"},
+		{sensu.CheckStateCritical, "/de", "", "it", false, "Content-Language de-CH, fr-CH does not include it"},
+		{sensu.CheckStateCritical, "/latin1", "utf-8", "", true, "invalid byte sequence at offset 5"},
+		{sensu.CheckStateOK, "/latin1", "utf-8", "", false, "OK"},
+		{sensu.CheckStateCritical, "/en", "utf-8", "", false, "declares no charset"},
+		{sensu.CheckStateCritical, "/en", "", "en", false, "no Content-Language header"},
+		{sensu.CheckStateOK, "/en", "", "", true, "OK"},
+	}
+
+	plugin.Headers = nil
+	plugin.SearchString = ""
+	plugin.ResponseCode = nil
+	plugin.RedirectOK = false
+	defer func() {
+		plugin.ExpectCharset, plugin.ExpectLanguage, plugin.ValidateUTF8 = "", "", false
+	}()
+	for _, tc := range testCases {
+		plugin.URL = test.URL + tc.path
+		plugin.ExpectCharset, plugin.ExpectLanguage, plugin.ValidateUTF8 = tc.charset, tc.language, tc.utf8
+		status, err := checkArgs(event)
+		assert.NoError(err)
+		assert.Equal(sensu.CheckStateOK, status)
+		var output bytes.Buffer
+		status, err = checkTargets(&output)
+		assert.NoError(err)
+		assert.Equal(tc.status, status, tc)
+		assert.Contains(output.String(), tc.output, tc)
+	}
+
+	plugin.ExpectCharset, plugin.ValidateUTF8 = "iso-8859-1", true
+	_, err := checkArgs(event)
+	assert.Error(err)
+}
+
+func TestExecuteCheckETag(t *testing.T) {
+	assert := assert.New(t)
+	event := corev2.FixtureEvent("entity1", "check")
+
+	var test = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/cached":
+			w.Header().Set("ETag", `"v42-abc"`)
+			if r.Header.Get("If-None-Match") == `"v42-abc"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		case "/uncached":
+			// Ignores conditional requests.
+			w.Header().Set("ETag", `W/"v41-def"`)
+		}
+		_, _ = w.Write([]byte("content"))
+	}))
+	defer test.Close()
+
+	testCases := []struct {
+		status    int
+		path      string
+		etag      string
+		expect304 bool
+	}{
+		{sensu.CheckStateOK, "/cached", `^"v42-`, false},
+		{sensu.CheckStateOK, "/cached", "", true},
+		{sensu.CheckStateOK, "/cached", `^"v42-`, true},
+		{sensu.CheckStateCritical, "/uncached", `^"v42-`, false},
+		{sensu.CheckStateCritical, "/uncached", "", true},
+		{sensu.CheckStateCritical, "/none", ".", false},
+		{sensu.CheckStateCritical, "/none", "", true},
+		{sensu.CheckStateOK, "/none", "", false},
+	}
+
+	plugin.Headers = nil
+	plugin.SearchString = ""
+	plugin.ResponseCode = nil
+	plugin.RedirectOK = false
+	for _, tc := range testCases {
+		plugin.URL = test.URL + tc.path
+		plugin.ExpectETag = tc.etag
+		plugin.Expect304WithETag = tc.expect304
+		status, err := checkArgs(event)
+		assert.NoError(err)
+		assert.Equal(sensu.CheckStateOK, status)
+		status, err = executeCheck(event)
+		assert.NoError(err)
+		assert.Equal(tc.status, status, "%s %q %v", tc.path, tc.etag, tc.expect304)
+	}
+
+	plugin.ExpectETag = "(v42"
+	status, err := checkArgs(event)
+	assert.Error(err)
+	assert.Equal(sensu.CheckStateUnknown, status)
+	plugin.ExpectETag = ""
+	plugin.Expect304WithETag = false
+}
+
+func TestExecuteCheckCookies(t *testing.T) {
+	assert := assert.New(t)
+	event := corev2.FixtureEvent("entity1", "check")
+
+	var test = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Set-Cookie", "session=0123456789abcdef; Path=/; Max-Age=3600; Secure; HttpOnly; SameSite=Lax")
+		w.Header().Add("Set-Cookie", "theme=dark; Path=/")
+	}))
+	defer test.Close()
+
+	testCases := []struct {
+		status   int
+		cookies  []string
+		secure   bool
+		httpOnly bool
+		sameSite string
+		maxAge   string
+	}{
+		{sensu.CheckStateOK, []string{"session"}, true, true, "lax", ":24h"},
+		{sensu.CheckStateOK, []string{"session=^[0-9a-f]{16}$", "theme"}, false, false, "", ""},
+		{sensu.CheckStateCritical, []string{"session=^[0-9]+$"}, false, false, "", ""},
+		{sensu.CheckStateCritical, []string{"csrf"}, false, false, "", ""},
+		{sensu.CheckStateCritical, nil, true, false, "", ""},
+		{sensu.CheckStateCritical, []string{"session"}, false, false, "Strict", ""},
+		{sensu.CheckStateCritical, []string{"session"}, false, false, "", "2h:"},
+		{sensu.CheckStateCritical, []string{"theme"}, false, false, "", "1m:"},
+	}
+
+	plugin.URL = test.URL
+	plugin.Headers = nil
+	plugin.SearchString = ""
+	plugin.ResponseCode = nil
+	defer func() {
+		plugin.ExpectCookies, plugin.CookieSecure, plugin.CookieHTTPOnly, plugin.CookieSameSite, plugin.CookieMaxAge = nil, false, false, "", ""
+		_, _ = checkArgs(event)
+	}()
+	for _, tc := range testCases {
+		plugin.ExpectCookies = tc.cookies
+		plugin.CookieSecure = tc.secure
+		plugin.CookieHTTPOnly = tc.httpOnly
+		plugin.CookieSameSite = tc.sameSite
+		plugin.CookieMaxAge = tc.maxAge
+		status, err := checkArgs(event)
+		assert.NoError(err)
+		assert.Equal(sensu.CheckStateOK, status)
+		status, err = executeCheck(event)
+		assert.NoError(err)
+		assert.Equal(tc.status, status, tc)
+	}
+
+	for _, invalid := range []struct {
+		cookies          []string
+		sameSite, maxAge string
+	}{
+		{[]string{"=x"}, "", ""},
+		{[]string{"session=("}, "", ""},
+		{nil, "sometimes", ""},
+		{nil, "", "24h"},
+		{nil, "", "2h:1h"},
+	} {
+		plugin.ExpectCookies = invalid.cookies
+		plugin.CookieSameSite = invalid.sameSite
+		plugin.CookieMaxAge = invalid.maxAge
+		status, err := checkArgs(event)
+		assert.Error(err, invalid)
+		assert.Equal(sensu.CheckStateUnknown, status)
+	}
+}
+
+func TestCheckCookies(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	cookieExpects, cookieMinAge, cookieMaxAge = nil, time.Hour, 24*time.Hour
+	defer func() { cookieMinAge, cookieMaxAge = 0, 0 }()
+
+	problems := checkCookies([]*http.Cookie{
+		{Name: "a", Expires: now.Add(2 * time.Hour)},
+		{Name: "b", Expires: now.Add(48 * time.Hour)},
+		{Name: "c", MaxAge: 7200, Expires: now.Add(48 * time.Hour)},
+		{Name: "d"},
+		{Name: "e", MaxAge: -1},
+	}, now)
+	assert.Equal([]string{
+		"cookie b lifetime 48h0m0s exceeds 24h0m0s",
+		"cookie d is a session cookie, expected a lifetime of at least 1h0m0s",
+		"cookie e lifetime -1s is below 1h0m0s",
+	}, problems)
+}
+
+func TestExecuteCheckFraming(t *testing.T) {
+	assert := assert.New(t)
+	event := corev2.FixtureEvent("entity1", "check")
+
+	var test = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/stream":
+			_, _ = w.Write([]byte("event 1\n"))
+			w.(http.Flusher).Flush()
+			_, _ = w.Write([]byte("event 2\n"))
+		case "/buffered":
+			w.Header().Set("Content-Length", "9")
+			_, _ = w.Write([]byte("buffered\n"))
+		case "/gzip":
+			var body bytes.Buffer
+			zw := gzip.NewWriter(&body)
+			_, _ = zw.Write([]byte("compressed\n"))
+			zw.Close()
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Header().Set("Content-Length", strconv.Itoa(body.Len()))
+			_, _ = w.Write(body.Bytes())
+		}
+	}))
+	defer test.Close()
+
+	testCases := []struct {
+		path          string
+		chunked       bool
+		contentLength bool
+		search        string
+		status        int
+	}{
+		{"/stream", true, false, "", sensu.CheckStateOK},
+		{"/stream", false, true, "", sensu.CheckStateCritical},
+		{"/buffered", false, true, "", sensu.CheckStateOK},
+		{"/buffered", true, false, "", sensu.CheckStateCritical},
+		{"/gzip", false, true, "compressed", sensu.CheckStateOK},
+		{"/gzip", true, false, "", sensu.CheckStateCritical},
+	}
+	plugin.Headers = nil
+	plugin.ResponseCode = nil
+	defer func() {
+		plugin.ExpectChunked, plugin.ExpectContentLen, plugin.SearchString = false, false, ""
+	}()
+	for _, tc := range testCases {
+		plugin.URL = test.URL + tc.path
+		plugin.ExpectChunked = tc.chunked
+		plugin.ExpectContentLen = tc.contentLength
+		plugin.SearchString = tc.search
+		status, err := checkArgs(event)
+		assert.NoError(err)
+		assert.Equal(sensu.CheckStateOK, status)
+		status, err = executeCheck(event)
+		assert.NoError(err)
+		assert.Equal(tc.status, status, tc)
+	}
+
+	plugin.ExpectChunked, plugin.ExpectContentLen = true, true
+	status, err := checkArgs(event)
+	assert.Error(err)
+	assert.Equal(sensu.CheckStateUnknown, status)
+
+	// HTTP/2 has no chunked transfer encoding.
+	plugin.ExpectContentLen = false
+	resp := &http.Response{ProtoMajor: 2, Header: http.Header{}}
+	assert.Equal("", checkFramingOf(resp))
+	resp.Header.Set("Content-Length", "9")
+	assert.Equal("response is not streamed, it has Content-Length 9", checkFramingOf(resp))
+}
+
+func TestExecuteCheckRedirectCount(t *testing.T) {
+	assert := assert.New(t)
+	event := corev2.FixtureEvent("entity1", "check")
+
+	var test = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/old":
+			http.Redirect(w, r, "/new", http.StatusMovedPermanently)
+		case "/new":
+			http.Redirect(w, r, "/final", http.StatusFound)
+		}
+	}))
+	defer test.Close()
+
+	testCases := []struct {
+		path      string
+		redirects string
+		status    int
+	}{
+		{"/final", "0", sensu.CheckStateOK},
+		{"/new", "1", sensu.CheckStateOK},
+		{"/old", "2", sensu.CheckStateOK},
+		{"/old", "1", sensu.CheckStateCritical},
+		{"/final", "1", sensu.CheckStateCritical},
+	}
+	plugin.Headers = nil
+	plugin.SearchString = ""
+	plugin.ResponseCode = nil
+	plugin.RedirectOK = true
+	defer func() {
+		plugin.RedirectOK, plugin.ExpectRedirects = false, ""
+		expectRedirects = -1
+	}()
+	for _, tc := range testCases {
+		plugin.URL = test.URL + tc.path
+		plugin.ExpectRedirects = tc.redirects
+		status, err := checkArgs(event)
+		assert.NoError(err)
+		assert.Equal(sensu.CheckStateOK, status)
+		status, err = executeCheck(event)
+		assert.NoError(err)
+		assert.Equal(tc.status, status, tc)
+	}
+
+	resp := &http.Response{Request: &http.Request{URL: &url.URL{Scheme: "https", Host: "example.com", Path: "/"}}}
+	resp.Request.Response = &http.Response{Request: &http.Request{URL: &url.URL{Scheme: "http", Host: "example.com", Path: "/"}}}
+	assert.Equal([]string{"http://example.com/", "https://example.com/"}, redirectChain(resp))
+
+	plugin.ExpectRedirects = "-1"
+	_, err := checkArgs(event)
+	assert.Error(err)
+	plugin.ExpectRedirects = "1"
+	plugin.RedirectOK = false
+	_, err = checkArgs(event)
+	assert.Error(err)
+}
+
+func TestSearchBody(t *testing.T) {
+	assert := assert.New(t)
+	// The match spans two chunks of the window.
+	body := strings.Repeat("x", 32*1024-3) + "needle" + strings.Repeat("y", 100)
+
+	found, truncated, err := searchBody(strings.NewReader(body), []byte("needle"), 0)
+	assert.NoError(err)
+	assert.True(found)
+	assert.False(truncated)
+	found, truncated, err = searchBody(strings.NewReader(body), []byte("haystack"), 0)
+	assert.NoError(err)
+	assert.False(found)
+	assert.False(truncated)
+	found, truncated, err = searchBody(strings.NewReader(body), []byte("needle"), 1024)
+	assert.NoError(err)
+	assert.False(found)
+	assert.True(truncated)
+	found, truncated, err = searchBody(strings.NewReader(body), []byte("haystack"), int64(len(body)))
+	assert.NoError(err)
+	assert.False(found)
+	assert.False(truncated)
+
+	data, err := readBody(strings.NewReader(body), int64(len(body)))
+	assert.NoError(err)
+	assert.Equal(body, string(data))
+	_, err = readBody(strings.NewReader(body), 1024)
+	assert.Equal(errReadLimit, err)
+}
+
+func TestExecuteCheckStreaming(t *testing.T) {
+	assert := assert.New(t)
+	event := corev2.FixtureEvent("entity1", "check")
+
+	// An endless body, the check has to stop reading on its own.
+	var test = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("header ready "))
+		chunk := []byte(strings.Repeat("data ", 1024))
+		for {
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+		}
+	}))
+	defer test.Close()
+
+	plugin.URL = test.URL
+	plugin.Headers = nil
+	plugin.ResponseCode = nil
+	plugin.InsecureSkipVerify = false
+	plugin.SearchString = "ready"
+	plugin.ReadLimit = 0
+	status, err := checkArgs(event)
+	assert.NoError(err)
+	assert.Equal(sensu.CheckStateOK, status)
+	status, err = executeCheck(event)
+	assert.NoError(err)
+	assert.Equal(sensu.CheckStateOK, status)
+
+	plugin.SearchString = "done"
+	plugin.ReadLimit = 1024 * 1024
+	status, err = executeCheck(event)
+	assert.NoError(err)
+	assert.Equal(sensu.CheckStateCritical, status)
+
+	plugin.ReadLimit = -1
+	status, err = checkArgs(event)
+	assert.Error(err)
+	assert.Equal(sensu.CheckStateUnknown, status)
+	plugin.ReadLimit = 0
+	plugin.SearchString = ""
+}
+
+func TestRequiredFailures(t *testing.T) {
+	assert := assert.New(t)
+	event := corev2.FixtureEvent("entity1", "check")
+	dir, err := ioutil.TempDir("", "http-check-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	up := true
+	var test = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !up {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer test.Close()
+
+	plugin.URL = test.URL
+	plugin.Headers = nil
+	plugin.SearchString = ""
+	plugin.ResponseCode = nil
+	plugin.RedirectOK = false
+	plugin.InsecureSkipVerify = false
+	plugin.RequiredFailures = 3
+	plugin.StateFile = ""
+	defer func() {
+		plugin.RequiredFailures = 1
+		plugin.StateFile = ""
+	}()
+	status, err := checkArgs(event)
+	assert.Error(err)
+	assert.Equal(sensu.CheckStateUnknown, status)
+
+	plugin.StateFile = filepath.Join(dir, "state.json")
+	status, err = checkArgs(event)
+	assert.NoError(err)
+	assert.Equal(sensu.CheckStateOK, status)
+
+	check := executeCheck
+	up = false
+	for _, expected := range []int{sensu.CheckStateWarning, sensu.CheckStateWarning, sensu.CheckStateCritical, sensu.CheckStateCritical} {
+		status, err = check(event)
+		assert.NoError(err)
+		assert.Equal(expected, status)
+	}
+	assert.Equal(4, loadState(plugin.StateFile, plugin.URL).Failures)
+
+	up = true
+	status, err = check(event)
+	assert.NoError(err)
+	assert.Equal(sensu.CheckStateOK, status)
+	assert.Equal(0, loadState(plugin.StateFile, plugin.URL).Failures)
+	up = false
+	status, err = check(event)
+	assert.NoError(err)
+	assert.Equal(sensu.CheckStateWarning, status)
+
+	// The state of another URL does not count.
+	assert.Equal(0, loadState(plugin.StateFile, "http://example.com").Failures)
+
+	plugin.PluginConfig.Name = "http-check"
+	assert.Equal("http-check WARNING: HTTP Status 502 (failure 1 of 3) | a=1\nmore\n",
+		softenOutput("http-check CRITICAL: HTTP Status 502 | a=1\nmore\n", "(failure 1 of 3)"))
+}
+
+func TestExecuteCheckHTTPVersion(t *testing.T) {
+	assert := assert.New(t)
+	event := corev2.FixtureEvent("entity1", "check")
+
+	var test = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			w.WriteHeader(http.StatusHTTPVersionNotSupported)
+		}
+	}))
+	test.EnableHTTP2 = true
+	test.StartTLS()
+	defer test.Close()
+
+	plugin.URL = test.URL
+	plugin.Headers = nil
+	plugin.SearchString = ""
+	plugin.InsecureSkipVerify = true
+	plugin.Transport.HTTPVersion = "3"
+	status, err := checkArgs(event)
+	assert.Error(err)
+	assert.Equal(sensu.CheckStateUnknown, status)
+
+	plugin.Transport.HTTPVersion = "2"
+	status, err = checkArgs(event)
+	assert.NoError(err)
+	assert.Equal(sensu.CheckStateOK, status)
+	status, err = executeCheck(event)
+	assert.NoError(err)
+	assert.Equal(sensu.CheckStateOK, status)
+
+	plugin.Transport.HTTPVersion = "1.1"
+	status, err = checkArgs(event)
+	assert.NoError(err)
+	assert.Equal(sensu.CheckStateOK, status)
+	status, err = executeCheck(event)
+	assert.NoError(err)
+	assert.Equal(sensu.CheckStateCritical, status)
+	plugin.Transport.HTTPVersion = ""
+	plugin.InsecureSkipVerify = false
+}
+
+// TestAnnotationOverrides runs the check in a subprocess, as overrides are
+// applied by the plugin SDK before checkArgs and executeCheck are called.
+func TestAnnotationOverrides(t *testing.T) {
+	if args := os.Getenv("TEST_HTTP_CHECK_ARGS"); len(args) > 0 {
+		os.Args = append([]string{"http-check"}, strings.Split(args, " ")...)
+		main()
+		return
+	}
+
+	var test = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Tenant") != "blue" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusTeapot)
+		_, _ = w.Write([]byte("short and stout"))
+	}))
+	defer test.Close()
+
+	run := func(annotations map[string]string, checkAnnotations map[string]string) int {
+		// The event is not built from corev2 types, their custom marshalers
+		// depend on json-iterator.
+		event := map[string]interface{}{
+			"timestamp": time.Now().Unix(),
+			"entity": map[string]interface{}{
+				"entity_class": "proxy",
+				"metadata":     map[string]interface{}{"name": "entity1", "namespace": "default", "annotations": annotations},
+			},
+			"check": map[string]interface{}{
+				"interval": 60,
+				"metadata": map[string]interface{}{"name": "check", "namespace": "default", "annotations": checkAnnotations},
+			},
+		}
+		eventJSON, err := json.Marshal(event)
+		require.NoError(t, err)
+
+		cmd := exec.Command(os.Args[0], "-test.run=TestAnnotationOverrides")
+		cmd.Env = append(os.Environ(), "TEST_HTTP_CHECK_ARGS=--url "+test.URL+" --search-string tall --event-stdin")
+		cmd.Stdin = bytes.NewReader(eventJSON)
+		err = cmd.Run()
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return exitErr.ExitCode()
+		}
+		require.NoError(t, err)
+		return 0
+	}
+
+	keyspace := "sensu.io/plugins/http-check/config/"
+	assert.Equal(t, sensu.CheckStateCritical, run(nil, nil))
+	assert.Equal(t, sensu.CheckStateOK, run(map[string]string{
+		keyspace + "header":        `["X-Tenant: blue"]`,
+		keyspace + "response-code": `["418"]`,
+		keyspace + "search-string": "stout",
+	}, nil))
+	// Check annotations take precedence over entity annotations.
+	assert.Equal(t, sensu.CheckStateCritical, run(map[string]string{
+		keyspace + "header":        `["X-Tenant: blue"]`,
+		keyspace + "response-code": `["418"]`,
+		keyspace + "search-string": "stout",
+	}, map[string]string{
+		keyspace + "search-string": "grande",
+	}))
+	// Shared options are overridable too.
+	assert.Equal(t, sensu.CheckStateUnknown, run(map[string]string{
+		keyspace + "header":    `["X-Tenant: blue"]`,
+		keyspace + "auth-type": "kerberos",
+	}, nil))
+}
+
+func TestSecurityProbe(t *testing.T) {
+	assert := assert.New(t)
+	defer func(timeout time.Duration) { probeTimeout = timeout }(probeTimeout)
+	probeTimeout = 300 * time.Millisecond
+
+	// rawServer answers every request with response, or not at all if it
+	// is empty.
+	rawServer := func(response string) net.Listener {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					defer conn.Close()
+					buf := make([]byte, 4096)
+					if _, err := conn.Read(buf); err != nil || len(response) == 0 {
+						_, _ = io.Copy(ioutil.Discard, conn)
+						return
+					}
+					_, _ = io.WriteString(conn, response)
+					_, _ = io.Copy(ioutil.Discard, conn)
+				}()
+			}
+		}()
+		return listener
+	}
+
+	plugin.SecurityProbe = true
+	plugin.Timeout = 5
+	defer func() { plugin.SecurityProbe = false }()
+	run := func(listener net.Listener) (int, string) {
+		plugin.URL = "http://" + listener.Addr().String() + "/"
+		var output bytes.Buffer
+		status, _ := checkTargets(&output)
+		return status, output.String()
+	}
+
+	rejecting := rawServer("HTTP/1.1 400 Bad Request\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+	defer rejecting.Close()
+	status, output := run(rejecting)
+	assert.Equal(sensu.CheckStateOK, status, output)
+	assert.Contains(output, "5 security probes passed")
+
+	hanging := rawServer("")
+	defer hanging.Close()
+	status, output = run(hanging)
+	assert.Equal(sensu.CheckStateWarning, status)
+	assert.Contains(output, "4 of 5 security probes")
+	assert.Contains(output, "CL.TE: no response within 300ms")
+	assert.Contains(output, "TE.CL: no response within 300ms")
+
+	accepting := rawServer("HTTP/1.1 200 OK\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+	defer accepting.Close()
+	status, output = run(accepting)
+	assert.Equal(sensu.CheckStateWarning, status)
+	assert.Contains(output, "3 of 5 security probes")
+	assert.Contains(output, "duplicate CL: accepted with 200")
+	assert.Contains(output, "oversized header: 128 KiB header accepted with 200")
+
+	closed := rawServer("")
+	closed.Close()
+	status, output = run(closed)
+	assert.Equal(sensu.CheckStateCritical, status)
+	assert.Contains(output, "probe:")
+
+	// The probes are refused private network addresses too.
+	plugin.Guard.DenyPrivateNetworks = true
+	defer func() { plugin.Guard.DenyPrivateNetworks = false }()
+	status, output = run(rejecting)
+	assert.Equal(sensu.CheckStateCritical, status)
+	assert.Contains(output, "refusing to connect to private network address 127.0.0.1")
+}
+
+func TestExecuteCheckRetryAfter(t *testing.T) {
+	assert := assert.New(t)
+	event := corev2.FixtureEvent("entity1", "check")
+
+	var retryAfter string
+	var test = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(retryAfter) > 0 {
+			w.Header().Set("Retry-After", retryAfter)
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer test.Close()
+
+	testCases := []struct {
+		retryAfter string
+		respect    bool
+		status     int
+	}{
+		{"120", false, sensu.CheckStateCritical},
+		{"120", true, sensu.CheckStateWarning},
+		{time.Now().Add(30 * time.Minute).UTC().Format(http.TimeFormat), true, sensu.CheckStateWarning},
+		{time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat), true, sensu.CheckStateWarning},
+		{"7200", true, sensu.CheckStateCritical},
+		{"", true, sensu.CheckStateCritical},
+		{"soon", true, sensu.CheckStateCritical},
+	}
+	plugin.URL = test.URL
+	plugin.Headers = nil
+	plugin.SearchString = ""
+	plugin.ResponseCode = nil
+	plugin.MaxRetryAfter = "1h"
+	defer func() {
+		plugin.RespectRetryAfter, plugin.MaxRetryAfter = false, ""
+		maxRetryAfter = 0
+	}()
+	for _, tc := range testCases {
+		retryAfter = tc.retryAfter
+		plugin.RespectRetryAfter = tc.respect
+		status, err := checkArgs(event)
+		assert.NoError(err)
+		assert.Equal(sensu.CheckStateOK, status)
+		status, err = executeCheck(event)
+		assert.NoError(err)
+		assert.Equal(tc.status, status, tc)
+	}
+
+	plugin.MaxRetryAfter = "forever"
+	_, err := checkArgs(event)
+	assert.Error(err)
+}
+
+func TestExecuteCheckURLFile(t *testing.T) {
+	assert := assert.New(t)
+	event := corev2.FixtureEvent("entity1", "check")
+
+	var test = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/down":
+			w.WriteHeader(http.StatusInternalServerError)
+		case "/moved":
+			w.WriteHeader(http.StatusMovedPermanently)
+		}
+	}))
+	defer test.Close()
+
+	dir, err := ioutil.TempDir("", "http-check-urls")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	plugin.URL = test.URL
+	plugin.URLFile = filepath.Join(dir, "urls.txt")
+	plugin.Headers = nil
+	plugin.SearchString = ""
+	plugin.ResponseCode = nil
+	plugin.RedirectOK = false
+	defer func() {
+		plugin.URLFile = ""
+		plugin.Concurrency = 0
+		urls = nil
+	}()
+
+	testCases := []struct {
+		paths       []string
+		concurrency int
+		status      int
+		failed      string
+	}{
+		{[]string{"/a", "/b"}, 1, sensu.CheckStateOK, "0 of 2 URLs failed"},
+		{[]string{"/a", "/moved", "/b"}, 2, sensu.CheckStateWarning, "1 of 3 URLs failed: " + test.URL + "/moved"},
+		{[]string{"/down", "/moved", "/a", "/b"}, 4, sensu.CheckStateCritical, "2 of 4 URLs failed: " + test.URL + "/down, " + test.URL + "/moved"},
+	}
+	for _, tc := range testCases {
+		lines := []string{"# checked by http-check", ""}
+		for _, path := range tc.paths {
+			lines = append(lines, "  "+test.URL+path)
+		}
+		require.NoError(t, ioutil.WriteFile(plugin.URLFile, []byte(strings.Join(lines, "\n")), 0644))
+		plugin.Concurrency = tc.concurrency
+		status, err := checkArgs(event)
+		assert.NoError(err)
+		assert.Equal(sensu.CheckStateOK, status)
+		var buf bytes.Buffer
+		status, err = checkTargets(&buf)
+		require.NoError(t, err)
+		output := buf.String()
+		assert.Equal(tc.status, status, tc.paths)
+		var outputLines []string
+		for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+			if !strings.HasPrefix(line, "Protocol: ") {
+				outputLines = append(outputLines, line)
+			}
+		}
+		require.Len(t, outputLines, len(tc.paths)+1)
+		assert.Contains(outputLines[0], tc.failed)
+		for i, path := range tc.paths {
+			assert.Contains(outputLines[i+1], test.URL+path)
+		}
+	}
+
+	for _, content := range []string{"# nothing\n", "http://[::1\n"} {
+		require.NoError(t, ioutil.WriteFile(plugin.URLFile, []byte(content), 0644))
+		_, err = checkArgs(event)
+		assert.Error(err, content)
+	}
+	plugin.Concurrency = 0
+	_, err = checkArgs(event)
+	assert.Error(err)
+}
+
+func TestExecuteCheckDenyPrivateNetworks(t *testing.T) {
+	assert := assert.New(t)
+	event := corev2.FixtureEvent("entity1", "check")
+
+	var test = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer test.Close()
+
+	dir, err := ioutil.TempDir("", "http-check-urls")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	plugin.URL = test.URL
+	plugin.URLFile = filepath.Join(dir, "urls.txt")
+	plugin.Headers = nil
+	plugin.SearchString = ""
+	plugin.ResponseCode = nil
+	plugin.Guard.DenyPrivateNetworks = true
+	defer func() {
+		plugin.URLFile = ""
+		plugin.Concurrency = 0
+		plugin.Guard.DenyPrivateNetworks, plugin.Guard.AllowHostPatterns = false, nil
+		urls = nil
+	}()
+	require.NoError(t, ioutil.WriteFile(plugin.URLFile, []byte(test.URL+"/a\nhttp://169.254.169.254/latest/meta-data/\n"), 0644))
+	plugin.Concurrency = 2
+
+	for _, tc := range []struct {
+		allow  []string
+		failed string
+	}{
+		{nil, "2 of 2 URLs failed"},
+		{[]string{"127.0.0.0/8"}, "1 of 2 URLs failed: http://169.254.169.254/latest/meta-data/"},
+	} {
+		plugin.Guard.AllowHostPatterns = tc.allow
+		_, err = checkArgs(event)
+		require.NoError(t, err)
+		var output bytes.Buffer
+		status, err := checkTargets(&output)
+		require.NoError(t, err)
+		assert.Equal(sensu.CheckStateCritical, status)
+		assert.Contains(output.String(), tc.failed)
+		assert.Contains(output.String(), "refusing to connect to private network address 169.254.169.254")
+	}
+
+	plugin.Guard.DenyPrivateNetworks = false
+	_, err = checkArgs(event)
+	assert.Error(err, "--allow-host-pattern requires --deny-private-networks")
+}
+
+func TestExecuteCheckUpload(t *testing.T) {
+	assert := assert.New(t)
+	event := corev2.FixtureEvent("entity1", "check")
+
+	var test = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > 1024 {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		_, _ = io.Copy(ioutil.Discard, r.Body)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer test.Close()
+
+	dir, err := ioutil.TempDir("", "http-check-upload")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	plugin.URL = test.URL
+	plugin.Headers = nil
+	plugin.SearchString = ""
+	plugin.ResponseCode = nil
+	plugin.Upload.File = filepath.Join(dir, "upload.bin")
+	plugin.Upload.ExpectContinue = true
+	defer func() {
+		plugin.Upload.File = ""
+		plugin.Upload.ExpectContinue = false
+	}()
+
+	for _, tc := range []struct {
+		size   int
+		status int
+		output string
+	}{
+		{1024, sensu.CheckStateOK, `^http-check OK: HTTP Status 201 for .*, uploaded 1024 bytes at [0-9.]+ MB/s, 100 Continue after [0-9.]+s \| upload_bytes=1024, upload_duration=[0-9.]+, upload_throughput=[0-9]+, continue_duration=[0-9.]+\nProtocol: HTTP/1\.1\n$`},
+		{4096, sensu.CheckStateCritical, `^http-check CRITICAL: HTTP Status 413 for .*, uploaded 0 of 4096 bytes, no 100 Continue \| upload_bytes=0, .*, continue_duration=-1\.000000\nProtocol: HTTP/1\.1\n$`},
+	} {
+		require.NoError(t, ioutil.WriteFile(plugin.Upload.File, bytes.Repeat([]byte("x"), tc.size), 0644))
+		_, err = checkArgs(event)
+		require.NoError(t, err)
+		var output bytes.Buffer
+		status, err := checkTargets(&output)
+		require.NoError(t, err)
+		assert.Equal(tc.status, status)
+		assert.Regexp(tc.output, output.String())
+	}
+
+	plugin.Upload.File = ""
+	_, err = checkArgs(event)
+	assert.Error(err, "--expect-100-continue requires --upload-file")
+}
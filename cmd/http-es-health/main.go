@@ -0,0 +1,403 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/nixwiz/http-checks/internal/buildinfo"
+	"github.com/nixwiz/http-checks/internal/exitstatus"
+	"github.com/nixwiz/http-checks/internal/httpclient"
+	"github.com/nixwiz/http-checks/internal/logging"
+	"github.com/nixwiz/http-checks/internal/overrides"
+	"github.com/nixwiz/http-checks/internal/secret"
+	"github.com/nixwiz/http-checks/internal/selfmetrics"
+	corev2 "github.com/sensu/sensu-go/api/core/v2"
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+)
+
+// Config represents the check plugin config.
+type Config struct {
+	sensu.PluginConfig
+	URL                string
+	Index              string
+	Username           string
+	Password           string
+	APIKey             string
+	PasswordFile       string
+	APIKeyFile         string
+	TrustedCAFile      string
+	UseSystemCAsPlus   bool
+	InsecureSkipVerify bool
+	Timeout            int
+	Headers            []string
+	HeadersFile        httpclient.HeadersFileConfig
+	MTLSKeyFile        string
+	MTLSCertFile       string
+	Proxy              httpclient.ProxyConfig
+	Transport          httpclient.TransportConfig
+	Source             httpclient.SourceConfig
+	Resolver           httpclient.ResolverConfig
+	URLParsing         httpclient.URLConfig
+	Record             httpclient.RecordConfig
+	Log                logging.Config
+	Overrides          overrides.Config
+	Status             exitstatus.Config
+	Metrics            selfmetrics.Config
+}
+
+// clusterHealth is the response of the _cluster/health API, which is the same
+// for Elasticsearch and OpenSearch.
+type clusterHealth struct {
+	ClusterName          string  `json:"cluster_name"`
+	Status               string  `json:"status"`
+	TimedOut             bool    `json:"timed_out"`
+	NumberOfNodes        int     `json:"number_of_nodes"`
+	NumberOfDataNodes    int     `json:"number_of_data_nodes"`
+	ActivePrimaryShards  int     `json:"active_primary_shards"`
+	ActiveShards         int     `json:"active_shards"`
+	RelocatingShards     int     `json:"relocating_shards"`
+	InitializingShards   int     `json:"initializing_shards"`
+	UnassignedShards     int     `json:"unassigned_shards"`
+	NumberOfPendingTasks int     `json:"number_of_pending_tasks"`
+	ActiveShardsPercent  float64 `json:"active_shards_percent_as_number"`
+}
+
+var (
+	tlsConfig tls.Config
+
+	plugin = Config{
+		PluginConfig: sensu.PluginConfig{
+			Name:     "http-es-health",
+			Short:    "Elasticsearch/OpenSearch Cluster Health Check",
+			Keyspace: "sensu.io/plugins/http-es-health/config",
+		},
+	}
+
+	options = []*sensu.PluginConfigOption{
+		{
+			Path:      "url",
+			Env:       "CHECK_URL",
+			Argument:  "url",
+			Shorthand: "u",
+			Default:   "http://localhost:9200",
+			Usage:     "Base URL of the cluster",
+			Value:     &plugin.URL,
+		},
+		{
+			Path:      "index",
+			Env:       "",
+			Argument:  "index",
+			Shorthand: "x",
+			Default:   "",
+			Usage:     "Limit the health check to this index (or comma separated list of indices)",
+			Value:     &plugin.Index,
+		},
+		{
+			Path:      "username",
+			Env:       "CHECK_USERNAME",
+			Argument:  "username",
+			Shorthand: "U",
+			Default:   "",
+			Usage:     "Username for HTTP Basic auth",
+			Value:     &plugin.Username,
+		},
+		{
+			Path:      "password",
+			Env:       "CHECK_PASSWORD",
+			Argument:  "password",
+			Shorthand: "P",
+			Default:   "",
+			Secret:    true,
+			Usage:     "Password for HTTP Basic auth",
+			Value:     &plugin.Password,
+		},
+		{
+			Path:      "api-key",
+			Env:       "CHECK_API_KEY",
+			Argument:  "api-key",
+			Shorthand: "",
+			Default:   "",
+			Secret:    true,
+			Usage:     "Base64 encoded API key, sent as an Authorization: ApiKey header",
+			Value:     &plugin.APIKey,
+		},
+		{
+			Path:      "password-file",
+			Env:       "",
+			Argument:  "password-file",
+			Shorthand: "",
+			Default:   "",
+			Usage:     "File holding the password for HTTP Basic auth, instead of --password",
+			Value:     &plugin.PasswordFile,
+		},
+		{
+			Path:      "api-key-file",
+			Env:       "",
+			Argument:  "api-key-file",
+			Shorthand: "",
+			Default:   "",
+			Usage:     "File holding the base64 encoded API key, instead of --api-key",
+			Value:     &plugin.APIKeyFile,
+		},
+		{
+			Path:      "insecure-skip-verify",
+			Env:       "",
+			Argument:  "insecure-skip-verify",
+			Shorthand: "i",
+			Default:   false,
+			Usage:     "Skip TLS certificate verification (not recommended!)",
+			Value:     &plugin.InsecureSkipVerify,
+		},
+		{
+			Path:      "trusted-ca-file",
+			Env:       "",
+			Argument:  "trusted-ca-file",
+			Shorthand: "t",
+			Default:   "",
+			Usage:     "TLS CA certificate bundle in PEM format, or a directory of them",
+			Value:     &plugin.TrustedCAFile,
+		},
+		{
+			Path:      "use-system-cas-plus",
+			Env:       "",
+			Argument:  "use-system-cas-plus",
+			Shorthand: "",
+			Default:   false,
+			Usage:     "Add the CA certificates from --trusted-ca-file to the system trust store rather than replacing it",
+			Value:     &plugin.UseSystemCAsPlus,
+		},
+		{
+			Path:      "timeout",
+			Env:       "",
+			Argument:  "timeout",
+			Shorthand: "T",
+			Default:   15,
+			Usage:     "Request timeout in seconds",
+			Value:     &plugin.Timeout,
+		},
+		{
+			Path:      "header",
+			Env:       "",
+			Argument:  "header",
+			Shorthand: "H",
+			Default:   []string{},
+			Usage:     "Additional header(s) to send in check request",
+			Value:     &plugin.Headers,
+		},
+		{
+			Path:      "mtls-key-file",
+			Env:       "",
+			Argument:  "mtls-key-file",
+			Shorthand: "K",
+			Default:   "",
+			Usage:     "Key file for mutual TLS auth in PEM format",
+			Value:     &plugin.MTLSKeyFile,
+		},
+		{
+			Path:      "mtls-cert-file",
+			Env:       "",
+			Argument:  "mtls-cert-file",
+			Shorthand: "C",
+			Default:   "",
+			Usage:     "Certificate file for mutual TLS auth in PEM format",
+			Value:     &plugin.MTLSCertFile,
+		},
+	}
+)
+
+func main() {
+	options = append(options, plugin.Proxy.Options()...)
+	options = append(options, plugin.Transport.Options()...)
+	options = append(options, plugin.Source.Options()...)
+	options = append(options, plugin.Resolver.Options()...)
+	options = append(options, plugin.URLParsing.Options()...)
+	options = append(options, plugin.HeadersFile.Options()...)
+	options = append(options, plugin.Record.Options()...)
+	options = append(options, plugin.Log.Options()...)
+	options = append(options, plugin.Overrides.Options()...)
+	options = append(options, plugin.Status.Options()...)
+	options = append(options, plugin.Metrics.Options()...)
+	buildinfo.Handle(plugin.PluginConfig.Name, options, os.Args[1:])
+	exitstatus.ParseFlags(plugin.PluginConfig.Name, options, os.Args[1:])
+	check := sensu.NewGoCheck(&plugin.PluginConfig, options, plugin.Status.Wrap(plugin.PluginConfig.Name, checkArgs), plugin.Record.Wrap(plugin.PluginConfig.Name, plugin.Metrics.Wrap(plugin.PluginConfig.Name, plugin.Status.Wrap(plugin.PluginConfig.Name, executeCheck))), overrides.Requested(os.Args[1:]))
+	check.Execute()
+}
+
+func checkArgs(event *corev2.Event) (int, error) {
+	if err := plugin.Log.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	if err := plugin.URLParsing.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+
+	if len(plugin.URL) == 0 {
+		return sensu.CheckStateUnknown, fmt.Errorf("--url or CHECK_URL environment variable is required")
+	}
+	checkURL, err := httpclient.ParseURL("--url", plugin.URL)
+	if err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	plugin.URL = checkURL.String()
+	if len(plugin.PasswordFile) > 0 {
+		if len(plugin.Password) > 0 {
+			return sensu.CheckStateUnknown, fmt.Errorf("--password and --password-file are mutually exclusive")
+		}
+		password, err := secret.ReadFile(plugin.PasswordFile)
+		if err != nil {
+			return sensu.CheckStateUnknown, fmt.Errorf("--password-file: %v", err)
+		}
+		plugin.Password = password
+	}
+	if len(plugin.APIKeyFile) > 0 {
+		if len(plugin.APIKey) > 0 {
+			return sensu.CheckStateUnknown, fmt.Errorf("--api-key and --api-key-file are mutually exclusive")
+		}
+		apiKey, err := secret.ReadFile(plugin.APIKeyFile)
+		if err != nil {
+			return sensu.CheckStateUnknown, fmt.Errorf("--api-key-file: %v", err)
+		}
+		plugin.APIKey = apiKey
+	}
+	if len(plugin.Password) > 0 && len(plugin.Username) == 0 {
+		return sensu.CheckStateUnknown, fmt.Errorf("--password requires --username")
+	}
+	if len(plugin.Username) > 0 && len(plugin.APIKey) > 0 {
+		return sensu.CheckStateUnknown, fmt.Errorf("--username and --api-key are mutually exclusive")
+	}
+	headers, err := plugin.HeadersFile.Headers(event)
+	if err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	plugin.Headers = append(headers, plugin.Headers...)
+	if len(plugin.Headers) > 0 {
+		for _, header := range plugin.Headers {
+			headerSplit := strings.SplitN(header, ":", 2)
+			if len(headerSplit) != 2 {
+				return sensu.CheckStateUnknown, fmt.Errorf("--header %q value malformed should be \"Header-Name: Header Value\"", header)
+			}
+		}
+	}
+	if len(plugin.TrustedCAFile) > 0 {
+		caCertPool, err := httpclient.LoadCACerts(plugin.TrustedCAFile, plugin.UseSystemCAsPlus)
+		if err != nil {
+			return sensu.CheckStateUnknown, fmt.Errorf("Error loading specified CA file: %v", err)
+		}
+		tlsConfig.RootCAs = caCertPool
+	}
+	tlsConfig.InsecureSkipVerify = plugin.InsecureSkipVerify
+
+	if (len(plugin.MTLSKeyFile) > 0 && len(plugin.MTLSCertFile) == 0) || (len(plugin.MTLSCertFile) > 0 && len(plugin.MTLSKeyFile) == 0) {
+		return sensu.CheckStateUnknown, fmt.Errorf("mTLS auth requires both --mtls-key-file and --mtls-cert-file")
+	}
+	if len(plugin.MTLSKeyFile) > 0 && len(plugin.MTLSCertFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(plugin.MTLSCertFile, plugin.MTLSKeyFile)
+		if err != nil {
+			return sensu.CheckStateUnknown, fmt.Errorf("Failed to load mTLS key pair %s/%s: %v", plugin.MTLSCertFile, plugin.MTLSKeyFile, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if err := plugin.Proxy.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	if err := plugin.Transport.Validate(&plugin.Proxy); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	if err := plugin.Source.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	if err := plugin.Resolver.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+
+	if err := plugin.Record.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+
+	return sensu.CheckStateOK, nil
+}
+
+func executeCheck(event *corev2.Event) (int, error) {
+
+	client := httpclient.New(&tlsConfig, time.Duration(plugin.Timeout)*time.Second, true, plugin.Proxy.Configure, plugin.Source.Configure, plugin.Resolver.Configure, plugin.Transport.Configure)
+
+	healthURL := strings.TrimSuffix(plugin.URL, "/") + "/_cluster/health"
+	if len(plugin.Index) > 0 {
+		healthURL = healthURL + "/" + url.PathEscape(plugin.Index)
+	}
+
+	req, err := http.NewRequest("GET", healthURL, nil)
+	if err != nil {
+		fmt.Fprintf(selfmetrics.Stdout, "%s UNKNOWN: request creation error: %s\n", plugin.PluginConfig.Name, err)
+		return sensu.CheckStateUnknown, nil
+	}
+	req.Header.Set("Accept", "application/json")
+	if len(plugin.Username) > 0 {
+		req.SetBasicAuth(plugin.Username, plugin.Password)
+	}
+	if len(plugin.APIKey) > 0 {
+		req.Header.Set("Authorization", "ApiKey "+plugin.APIKey)
+	}
+	for _, header := range plugin.Headers {
+		headerSplit := strings.SplitN(header, ":", 2)
+		headerKey := strings.TrimSpace(headerSplit[0])
+		headerValue := strings.TrimSpace(headerSplit[1])
+		if strings.EqualFold(headerKey, "host") {
+			req.Host = headerValue
+			continue
+		}
+		req.Header.Set(headerKey, headerValue)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		fmt.Fprintf(selfmetrics.Stdout, "%s CRITICAL: %s\n", plugin.PluginConfig.Name, httpclient.Describe(err))
+		return sensu.CheckStateCritical, nil
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		fmt.Fprintf(selfmetrics.Stdout, "%s CRITICAL: reading response body: %s\n", plugin.PluginConfig.Name, httpclient.Describe(err))
+		return sensu.CheckStateCritical, nil
+	}
+
+	// A red cluster (or a missing index) is reported with a 408 or 503 status
+	// along with the health document, so the status is only checked if the
+	// body cannot be decoded.
+	var health clusterHealth
+	if err := json.Unmarshal(body, &health); err != nil || len(health.Status) == 0 {
+		fmt.Fprintf(selfmetrics.Stdout, "%s CRITICAL: HTTP Status %v for %s\n", plugin.PluginConfig.Name, resp.StatusCode, healthURL)
+		return sensu.CheckStateCritical, nil
+	}
+
+	perfdata := fmt.Sprintf("number_of_nodes=%d, number_of_data_nodes=%d, active_primary_shards=%d, active_shards=%d, relocating_shards=%d, initializing_shards=%d, unassigned_shards=%d, number_of_pending_tasks=%d, active_shards_percent=%0.2f",
+		health.NumberOfNodes, health.NumberOfDataNodes, health.ActivePrimaryShards, health.ActiveShards, health.RelocatingShards, health.InitializingShards, health.UnassignedShards, health.NumberOfPendingTasks, health.ActiveShardsPercent)
+	summary := fmt.Sprintf("cluster %s is %s", health.ClusterName, health.Status)
+	if len(plugin.Index) > 0 {
+		summary = fmt.Sprintf("index %s in %s", plugin.Index, summary)
+	}
+	if health.TimedOut {
+		summary = summary + " (health request timed out)"
+	}
+
+	switch health.Status {
+	case "green":
+		fmt.Fprintf(selfmetrics.Stdout, "%s OK: %s | %s\n", plugin.PluginConfig.Name, summary, perfdata)
+		return sensu.CheckStateOK, nil
+	case "yellow":
+		fmt.Fprintf(selfmetrics.Stdout, "%s WARNING: %s | %s\n", plugin.PluginConfig.Name, summary, perfdata)
+		return sensu.CheckStateWarning, nil
+	}
+
+	fmt.Fprintf(selfmetrics.Stdout, "%s CRITICAL: %s | %s\n", plugin.PluginConfig.Name, summary, perfdata)
+	return sensu.CheckStateCritical, nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	corev2 "github.com/sensu/sensu-go/api/core/v2"
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMain(t *testing.T) {
+}
+
+func TestExecuteCheck(t *testing.T) {
+
+	health := `{"cluster_name": "logs", "status": "%s", "timed_out": false, "number_of_nodes": 3, "number_of_data_nodes": 3,
+		"active_primary_shards": 10, "active_shards": 20, "relocating_shards": 0, "initializing_shards": 0, "unassigned_shards": %d,
+		"number_of_pending_tasks": 0, "active_shards_percent_as_number": 100.0}`
+
+	testCases := []struct {
+		returnStatus int
+		httpStatus   int
+		response     string
+		index        string
+		username     string
+		apiKey       string
+	}{
+		{sensu.CheckStateOK, http.StatusOK, fmt.Sprintf(health, "green", 0), "", "", ""},
+		{sensu.CheckStateWarning, http.StatusOK, fmt.Sprintf(health, "yellow", 10), "logs-2021", "sensu", ""},
+		{sensu.CheckStateCritical, http.StatusRequestTimeout, fmt.Sprintf(health, "red", 20), "", "", "a2V5OnNlY3JldA=="},
+		{sensu.CheckStateCritical, http.StatusUnauthorized, `{"error": {"type": "security_exception"}, "status": 401}`, "", "", ""},
+		{sensu.CheckStateCritical, http.StatusBadGateway, "bad gateway", "", "", ""},
+	}
+
+	for _, tc := range testCases {
+		assert := assert.New(t)
+		event := corev2.FixtureEvent("entity1", "check")
+
+		var test = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			expectedPath := "/_cluster/health"
+			if len(tc.index) > 0 {
+				expectedPath = expectedPath + "/" + tc.index
+			}
+			assert.Equal(expectedPath, r.URL.Path)
+			username, password, ok := r.BasicAuth()
+			assert.Equal(len(tc.username) > 0, ok)
+			if ok {
+				assert.Equal(tc.username, username)
+				assert.Equal("s3cret", password)
+			}
+			if len(tc.apiKey) > 0 {
+				assert.Equal("ApiKey "+tc.apiKey, r.Header.Get("Authorization"))
+			}
+			w.WriteHeader(tc.httpStatus)
+			_, _ = w.Write([]byte(tc.response))
+		}))
+		plugin.URL = test.URL + "/"
+		plugin.Index = tc.index
+		plugin.Username = tc.username
+		plugin.Password = ""
+		if len(tc.username) > 0 {
+			plugin.Password = "s3cret"
+		}
+		plugin.APIKey = tc.apiKey
+		status, err := checkArgs(event)
+		assert.NoError(err)
+		assert.Equal(sensu.CheckStateOK, status)
+		status, err = executeCheck(event)
+		assert.NoError(err)
+		assert.Equal(tc.returnStatus, status)
+		test.Close()
+	}
+}
+
+func TestCheckArgs(t *testing.T) {
+	assert := assert.New(t)
+	event := corev2.FixtureEvent("entity1", "check")
+
+	plugin.URL = "http://localhost:9200"
+	plugin.Username = ""
+	plugin.Password = "s3cret"
+	plugin.APIKey = ""
+	status, err := checkArgs(event)
+	assert.Error(err)
+	assert.Equal(sensu.CheckStateUnknown, status)
+
+	plugin.Username = "sensu"
+	plugin.APIKey = "a2V5OnNlY3JldA=="
+	status, err = checkArgs(event)
+	assert.Error(err)
+	assert.Equal(sensu.CheckStateUnknown, status)
+	plugin.Username, plugin.Password, plugin.APIKey = "", "", ""
+
+	dir, err := ioutil.TempDir("", "http-es-health")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	plugin.APIKeyFile = filepath.Join(dir, "api-key")
+	require.NoError(t, ioutil.WriteFile(plugin.APIKeyFile, []byte("a2V5OnNlY3JldA==\n"), 0600))
+	status, err = checkArgs(event)
+	assert.NoError(err)
+	assert.Equal(sensu.CheckStateOK, status)
+	assert.Equal("a2V5OnNlY3JldA==", plugin.APIKey)
+
+	// The key is not accepted from a file readable by others.
+	plugin.APIKey = ""
+	require.NoError(t, os.Chmod(plugin.APIKeyFile, 0644))
+	status, err = checkArgs(event)
+	assert.Error(err)
+	assert.Equal(sensu.CheckStateUnknown, status)
+	plugin.APIKey, plugin.APIKeyFile = "", ""
+}
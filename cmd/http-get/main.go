@@ -5,14 +5,32 @@
 package main
 
 import (
+	"bytes"
 	"crypto/tls"
+	"encoding/csv"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
 	"strings"
+	"sync"
+	"text/template"
 	"time"
 
+	"github.com/itchyny/gojq"
+	"github.com/nixwiz/http-checks/internal/auth"
+	"github.com/nixwiz/http-checks/internal/buildinfo"
+	"github.com/nixwiz/http-checks/internal/exitstatus"
+	"github.com/nixwiz/http-checks/internal/httpclient"
+	"github.com/nixwiz/http-checks/internal/logging"
+	"github.com/nixwiz/http-checks/internal/overrides"
+	"github.com/nixwiz/http-checks/internal/selfmetrics"
 	corev2 "github.com/sensu/sensu-go/api/core/v2"
 	"github.com/sensu/sensu-plugin-sdk/sensu"
 )
@@ -20,17 +38,81 @@ import (
 // Config represents the check plugin config.
 type Config struct {
 	sensu.PluginConfig
-	URL                string
+	URLs               []string
 	TrustedCAFile      string
+	UseSystemCAsPlus   bool
 	InsecureSkipVerify bool
 	Timeout            int
 	Headers            []string
+	HeadersFile        httpclient.HeadersFileConfig
 	MTLSKeyFile        string
 	MTLSCertFile       string
+	Method             string
+	PostData           string
+	BodyFile           string
+	ContentType        string
+	Query              string
+	CacheFile          string
+	PrintCached        bool
+	OutputTemplate     string
+	FallbackURLs       []string
+	Retries            int
+	OutputFile         string
+	Append             bool
+	SourceLabel        string
+	MaxAge             string
+	Auth               auth.Config
+	Proxy              httpclient.ProxyConfig
+	Transport          httpclient.TransportConfig
+	Source             httpclient.SourceConfig
+	Resolver           httpclient.ResolverConfig
+	URLParsing         httpclient.URLConfig
+	Guard              httpclient.GuardConfig
+	Record             httpclient.RecordConfig
+	Log                logging.Config
+	Overrides          overrides.Config
+	Status             exitstatus.Config
+	Metrics            selfmetrics.Config
+}
+
+// cacheEntry is the state persisted in the cache file between runs.
+type cacheEntry struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+	Body         []byte `json:"body,omitempty"`
+}
+
+// templateData is the data made available to --output-template.
+type templateData struct {
+	URL        string
+	Status     string
+	StatusCode int
+	Headers    http.Header
+	Body       string
+	JSON       interface{}
+	Duration   time.Duration
 }
 
 var (
-	tlsConfig tls.Config
+	tlsConfig   tls.Config
+	requestBody []byte
+	queryCode   *gojq.Code
+	outputTmpl  *template.Template
+	// maxAge is 0 if not set.
+	maxAge time.Duration
+	// urlArgs are the values of --url given on the command line.
+	urlArgs []string
+
+	// fileSchemes are the schemes fetched in addition to http and https,
+	// see httpclient.RegisterFileSchemes.
+	fileSchemes = []string{"ftp", "ftps", "file"}
+
+	// retryDelay is the delay before the first retry of a request, doubled
+	// for each retry after it up to maxRetryDelay. They are replaced in
+	// tests.
+	retryDelay    = time.Second
+	maxRetryDelay = 10 * time.Second
 
 	plugin = Config{
 		PluginConfig: sensu.PluginConfig{
@@ -46,9 +128,9 @@ var (
 			Env:       "CHECK_URL",
 			Argument:  "url",
 			Shorthand: "u",
-			Default:   "http://localhost:80/",
-			Usage:     "URL to get",
-			Value:     &plugin.URL,
+			Default:   []string{"http://localhost:80/"},
+			Usage:     "URL(s) to get, http, https, ftp, ftps or file, several are fetched concurrently and their output concatenated",
+			Value:     &plugin.URLs,
 		},
 		{
 			Path:      "insecure-skip-verify",
@@ -65,9 +147,18 @@ var (
 			Argument:  "trusted-ca-file",
 			Shorthand: "t",
 			Default:   "",
-			Usage:     "TLS CA certificate bundle in PEM format",
+			Usage:     "TLS CA certificate bundle in PEM format, or a directory of them",
 			Value:     &plugin.TrustedCAFile,
 		},
+		{
+			Path:      "use-system-cas-plus",
+			Env:       "",
+			Argument:  "use-system-cas-plus",
+			Shorthand: "",
+			Default:   false,
+			Usage:     "Add the CA certificates from --trusted-ca-file to the system trust store rather than replacing it",
+			Value:     &plugin.UseSystemCAsPlus,
+		},
 		{
 			Path:      "timeout",
 			Env:       "",
@@ -104,69 +195,687 @@ var (
 			Usage:     "Certificate file for mutual TLS auth in PEM format",
 			Value:     &plugin.MTLSCertFile,
 		},
+		{
+			Path:      "method",
+			Env:       "",
+			Argument:  "method",
+			Shorthand: "m",
+			Default:   "",
+			Usage:     "HTTP method to use (defaults to GET, or POST if a request body is provided)",
+			Value:     &plugin.Method,
+		},
+		{
+			Path:      "post-data",
+			Env:       "",
+			Argument:  "post-data",
+			Shorthand: "d",
+			Default:   "",
+			Usage:     "Data to send as the request body",
+			Value:     &plugin.PostData,
+		},
+		{
+			Path:      "body-file",
+			Env:       "",
+			Argument:  "body-file",
+			Shorthand: "",
+			Default:   "",
+			Usage:     "File containing data to send as the request body",
+			Value:     &plugin.BodyFile,
+		},
+		{
+			Path:      "content-type",
+			Env:       "",
+			Argument:  "content-type",
+			Shorthand: "",
+			Default:   "",
+			Usage:     "Content-Type header to send with the request body",
+			Value:     &plugin.ContentType,
+		},
+		{
+			Path:      "query",
+			Env:       "",
+			Argument:  "query",
+			Shorthand: "q",
+			Default:   "",
+			Usage:     "Query written in jq format to extract from a JSON response, output in place of the full body",
+			Value:     &plugin.Query,
+		},
+		{
+			Path:      "cache-file",
+			Env:       "",
+			Argument:  "cache-file",
+			Shorthand: "",
+			Default:   "",
+			Usage:     "File used to store ETag/Last-Modified between runs in order to send conditional requests",
+			Value:     &plugin.CacheFile,
+		},
+		{
+			Path:      "print-cached",
+			Env:       "",
+			Argument:  "print-cached",
+			Shorthand: "",
+			Default:   false,
+			Usage:     "Print the cached response body when the server responds with 304 Not Modified (requires --cache-file)",
+			Value:     &plugin.PrintCached,
+		},
+		{
+			Path:      "output-template",
+			Env:       "",
+			Argument:  "output-template",
+			Shorthand: "",
+			Default:   "",
+			Usage:     "Go text/template used to render the output, in place of the full body",
+			Value:     &plugin.OutputTemplate,
+		},
+		{
+			Path:      "fallback-url",
+			Env:       "",
+			Argument:  "fallback-url",
+			Shorthand: "",
+			Default:   []string{},
+			Usage:     "Fallback URL(s) to try in order if the request to --url fails",
+			Value:     &plugin.FallbackURLs,
+		},
+		{
+			Path:      "retries",
+			Env:       "",
+			Argument:  "retries",
+			Shorthand: "",
+			Default:   0,
+			Usage:     "Number of times to retry a failed request to each URL before moving on, with a delay of 1s doubled for each retry",
+			Value:     &plugin.Retries,
+		},
+		{
+			Path:      "output-file",
+			Env:       "",
+			Argument:  "output-file",
+			Shorthand: "o",
+			Default:   "",
+			Usage:     "Write the output to this file instead of stdout, and print a short summary",
+			Value:     &plugin.OutputFile,
+		},
+		{
+			Path:      "append",
+			Env:       "",
+			Argument:  "append",
+			Shorthand: "",
+			Default:   false,
+			Usage:     "Append to --output-file instead of replacing it",
+			Value:     &plugin.Append,
+		},
+		{
+			Path:      "source-label",
+			Env:       "",
+			Argument:  "source-label",
+			Shorthand: "",
+			Default:   "",
+			Usage:     "Label to add to the Prometheus metrics of each --url, with the host:port of the URL as its value",
+			Value:     &plugin.SourceLabel,
+		},
+		{
+			Path:      "max-age",
+			Env:       "",
+			Argument:  "max-age",
+			Shorthand: "",
+			Default:   "",
+			Usage:     "Maximum age of the Last-Modified time of each response (e.g. 1h), to check that a feed or file is still updated",
+			Value:     &plugin.MaxAge,
+		},
 	}
 )
 
 func main() {
-	check := sensu.NewGoCheck(&plugin.PluginConfig, options, checkArgs, executeCheck, false)
+	options = append(options, plugin.Auth.Options()...)
+	options = append(options, plugin.Proxy.Options()...)
+	options = append(options, plugin.Transport.Options()...)
+	options = append(options, plugin.Source.Options()...)
+	options = append(options, plugin.Resolver.Options()...)
+	options = append(options, plugin.URLParsing.Options()...)
+	options = append(options, plugin.Guard.Options()...)
+	options = append(options, plugin.HeadersFile.Options()...)
+	options = append(options, plugin.Record.Options()...)
+	options = append(options, plugin.Log.Options()...)
+	options = append(options, plugin.Overrides.Options()...)
+	options = append(options, plugin.Status.Options()...)
+	options = append(options, plugin.Metrics.Options()...)
+	buildinfo.Handle(plugin.PluginConfig.Name, options, os.Args[1:])
+	exitstatus.ParseFlags(plugin.PluginConfig.Name, options, os.Args[1:])
+	urlArgs = urlFlags(os.Args[1:])
+	check := sensu.NewGoCheck(&plugin.PluginConfig, options, plugin.Status.Wrap(plugin.PluginConfig.Name, checkArgs), plugin.Record.Wrap(plugin.PluginConfig.Name, plugin.Metrics.Wrap(plugin.PluginConfig.Name, plugin.Status.Wrap(plugin.PluginConfig.Name, executeCheck))), overrides.Requested(os.Args[1:]))
 	check.Execute()
 }
 
 func checkArgs(event *corev2.Event) (int, error) {
-	if len(plugin.URL) == 0 {
-		return sensu.CheckStateWarning, fmt.Errorf("--url or CHECK_URL environment variable is required")
+	if err := plugin.Log.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	if err := plugin.URLParsing.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+
+	plugin.URLs = commandLineURLs(plugin.URLs, urlArgs)
+	if len(plugin.URLs) == 0 {
+		return sensu.CheckStateUnknown, fmt.Errorf("--url or CHECK_URL environment variable is required")
 	}
+	if len(plugin.URLs) > 1 {
+		if len(plugin.FallbackURLs) > 0 {
+			return sensu.CheckStateUnknown, fmt.Errorf("--fallback-url requires a single --url")
+		}
+		if len(plugin.CacheFile) > 0 {
+			return sensu.CheckStateUnknown, fmt.Errorf("--cache-file requires a single --url")
+		}
+	}
+	maxAge = 0
+	if len(plugin.MaxAge) > 0 {
+		var err error
+		if maxAge, err = time.ParseDuration(plugin.MaxAge); err != nil || maxAge <= 0 {
+			return sensu.CheckStateUnknown, fmt.Errorf("--max-age %q is not a valid duration greater than 0", plugin.MaxAge)
+		}
+	}
+	headers, err := plugin.HeadersFile.Headers(event)
+	if err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	plugin.Headers = append(headers, plugin.Headers...)
 	if len(plugin.Headers) > 0 {
 		for _, header := range plugin.Headers {
 			headerSplit := strings.SplitN(header, ":", 2)
 			if len(headerSplit) != 2 {
-				return sensu.CheckStateWarning, fmt.Errorf("--header %q value malformed should be \"Header-Name: Header Value\"", header)
+				return sensu.CheckStateUnknown, fmt.Errorf("--header %q value malformed should be \"Header-Name: Header Value\"", header)
 			}
 		}
 	}
 	if len(plugin.TrustedCAFile) > 0 {
-		caCertPool, err := corev2.LoadCACerts(plugin.TrustedCAFile)
+		caCertPool, err := httpclient.LoadCACerts(plugin.TrustedCAFile, plugin.UseSystemCAsPlus)
 		if err != nil {
-			return sensu.CheckStateWarning, fmt.Errorf("Error loading specified CA file")
+			return sensu.CheckStateUnknown, fmt.Errorf("Error loading specified CA file: %v", err)
 		}
 		tlsConfig.RootCAs = caCertPool
 	}
 	tlsConfig.InsecureSkipVerify = plugin.InsecureSkipVerify
 
 	if (len(plugin.MTLSKeyFile) > 0 && len(plugin.MTLSCertFile) == 0) || (len(plugin.MTLSCertFile) > 0 && len(plugin.MTLSKeyFile) == 0) {
-		return sensu.CheckStateWarning, fmt.Errorf("mTLS auth requires both --mtls-key-file and --mtls-cert-file")
+		return sensu.CheckStateUnknown, fmt.Errorf("mTLS auth requires both --mtls-key-file and --mtls-cert-file")
 	}
 	if len(plugin.MTLSKeyFile) > 0 && len(plugin.MTLSCertFile) > 0 {
 		cert, err := tls.LoadX509KeyPair(plugin.MTLSCertFile, plugin.MTLSKeyFile)
 		if err != nil {
-			return sensu.CheckStateWarning, fmt.Errorf("Failed to load mTLS key pair %s/%s: %v", plugin.MTLSCertFile, plugin.MTLSKeyFile, err)
+			return sensu.CheckStateUnknown, fmt.Errorf("Failed to load mTLS key pair %s/%s: %v", plugin.MTLSCertFile, plugin.MTLSKeyFile, err)
 		}
 		tlsConfig.Certificates = []tls.Certificate{cert}
 	}
 
+	if len(plugin.PostData) > 0 && len(plugin.BodyFile) > 0 {
+		return sensu.CheckStateUnknown, fmt.Errorf("--post-data and --body-file are mutually exclusive")
+	}
+	requestBody = nil
+	if len(plugin.PostData) > 0 {
+		requestBody = []byte(plugin.PostData)
+	}
+	if len(plugin.BodyFile) > 0 {
+		data, err := ioutil.ReadFile(plugin.BodyFile)
+		if err != nil {
+			return sensu.CheckStateUnknown, fmt.Errorf("Failed to read body file %s: %v", plugin.BodyFile, err)
+		}
+		requestBody = data
+	}
+	plugin.Method = strings.ToUpper(strings.TrimSpace(plugin.Method))
+
+	if plugin.Retries < 0 {
+		return sensu.CheckStateUnknown, fmt.Errorf("--retries must be 0 or greater")
+	}
+
+	if plugin.Append && len(plugin.OutputFile) == 0 {
+		return sensu.CheckStateUnknown, fmt.Errorf("--append requires --output-file")
+	}
+
+	if plugin.PrintCached && len(plugin.CacheFile) == 0 {
+		return sensu.CheckStateUnknown, fmt.Errorf("--print-cached requires --cache-file")
+	}
+
+	queryCode = nil
+	if len(plugin.Query) > 0 {
+		query, err := gojq.Parse(plugin.Query)
+		if err != nil {
+			return sensu.CheckStateUnknown, fmt.Errorf("Failed to parse query %q, error: %v", plugin.Query, err)
+		}
+		queryCode, err = gojq.Compile(query)
+		if err != nil {
+			return sensu.CheckStateUnknown, fmt.Errorf("Failed to compile query %q, error: %v", plugin.Query, err)
+		}
+	}
+
+	outputTmpl = nil
+	if len(plugin.OutputTemplate) > 0 {
+		if len(plugin.Query) > 0 {
+			return sensu.CheckStateUnknown, fmt.Errorf("--query and --output-template are mutually exclusive")
+		}
+		tmpl, err := template.New("output").Parse(plugin.OutputTemplate)
+		if err != nil {
+			return sensu.CheckStateUnknown, fmt.Errorf("Failed to parse output template: %v", err)
+		}
+		outputTmpl = tmpl
+	}
+
+	if err := plugin.Auth.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	for i, source := range plugin.URLs {
+		u, err := httpclient.ParseURL("--url", source, fileSchemes...)
+		if err != nil {
+			return sensu.CheckStateUnknown, err
+		}
+		if err := plugin.Auth.FromURL("--url", u); err != nil {
+			return sensu.CheckStateUnknown, err
+		}
+		plugin.URLs[i] = u.String()
+	}
+	for i, fallback := range plugin.FallbackURLs {
+		u, err := httpclient.ParseURL("--fallback-url", fallback, fileSchemes...)
+		if err != nil {
+			return sensu.CheckStateUnknown, err
+		}
+		if err := plugin.Auth.FromURL("--fallback-url", u); err != nil {
+			return sensu.CheckStateUnknown, err
+		}
+		plugin.FallbackURLs[i] = u.String()
+	}
+
+	if err := plugin.Proxy.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	if err := plugin.Transport.Validate(&plugin.Proxy); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	if err := plugin.Source.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	if err := plugin.Resolver.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+
+	plugin.Guard.Resolver = &plugin.Resolver
+	if err := plugin.Guard.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+
+	if err := plugin.Record.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+
 	return sensu.CheckStateOK, nil
 }
 
 func executeCheck(event *corev2.Event) (int, error) {
 
-	client := http.DefaultClient
-	client.Transport = http.DefaultTransport
-	client.Timeout = time.Duration(plugin.Timeout) * time.Second
+	client := httpclient.New(&tlsConfig, time.Duration(plugin.Timeout)*time.Second, true, plugin.Proxy.Configure, plugin.Source.Configure, plugin.Resolver.Configure, plugin.Guard.Configure, httpclient.RegisterFileSchemes, plugin.Transport.Configure)
+	client.Transport = plugin.Auth.RoundTripper(client.Transport)
 
-	checkURL, err := url.Parse(plugin.URL)
-	if err != nil {
-		fmt.Printf("url parse error: %s\n", err)
+	// Fallback URLs only apply to a single --url, several are fetched
+	// concurrently.
+	sources := [][]string{append([]string{plugin.URLs[0]}, plugin.FallbackURLs...)}
+	if len(plugin.URLs) > 1 {
+		sources = nil
+		for _, source := range plugin.URLs {
+			sources = append(sources, []string{source})
+		}
+	}
+	results := make([]*fetchResult, len(sources))
+	errs := make([]error, len(sources))
+	var wg sync.WaitGroup
+	for i := range sources {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], errs[i] = fetchAny(client, sources[i])
+		}(i)
+	}
+	wg.Wait()
+	var failures []string
+	for _, err := range errs {
+		if err != nil {
+			failures = append(failures, err.Error())
+		}
+	}
+	if maxAge > 0 {
+		for _, result := range results {
+			if result != nil {
+				if stale := checkAge(result, time.Now()); len(stale) > 0 {
+					failures = append(failures, stale)
+				}
+			}
+		}
+	}
+	if len(failures) > 0 {
+		fmt.Fprintf(selfmetrics.Stdout, "%s CRITICAL: %s\n", plugin.PluginConfig.Name, strings.Join(failures, "; "))
 		return sensu.CheckStateCritical, nil
 	}
-	if checkURL.Scheme == "https" {
-		client.Transport.(*http.Transport).TLSClientConfig = &tlsConfig
+
+	if len(results) > 1 {
+		return writeResults(results)
+	}
+	result := results[0]
+
+	if result.notModified && !plugin.PrintCached {
+		if len(plugin.OutputFile) > 0 {
+			fmt.Fprintf(selfmetrics.Stdout, "%s OK: %s not modified, %s left unchanged%s\n", plugin.PluginConfig.Name, result.source, plugin.OutputFile, fallbackNote(result, ", "))
+		}
+		return sensu.CheckStateOK, nil
 	}
 
-	req, err := http.NewRequest("GET", plugin.URL, nil)
+	if len(plugin.OutputFile) > 0 && result.resp.StatusCode >= http.StatusBadRequest {
+		fmt.Fprintf(selfmetrics.Stdout, "%s CRITICAL: HTTP Status %v for %s, %s not written\n", plugin.PluginConfig.Name, result.resp.StatusCode, result.source, plugin.OutputFile)
+		return sensu.CheckStateCritical, nil
+	}
+
+	output, err := renderOutput(result)
 	if err != nil {
-		fmt.Printf("request creation error: %s\n", err)
+		fmt.Fprintf(selfmetrics.Stdout, "%s CRITICAL: %s\n", plugin.PluginConfig.Name, err)
 		return sensu.CheckStateCritical, nil
 	}
+	if len(plugin.SourceLabel) > 0 {
+		output = labelMetrics(output, plugin.SourceLabel, result.resp.Request.URL.Host, map[string]bool{})
+	}
+
+	if len(plugin.OutputFile) > 0 {
+		if err := writeOutputFile(plugin.OutputFile, output, plugin.Append); err != nil {
+			fmt.Fprintf(selfmetrics.Stdout, "%s UNKNOWN: failed to write %s: %v\n", plugin.PluginConfig.Name, plugin.OutputFile, err)
+			return sensu.CheckStateUnknown, nil
+		}
+		fmt.Fprintf(selfmetrics.Stdout, "%s OK: wrote %d bytes from %s to %s%s\n", plugin.PluginConfig.Name, len(output), result.source, plugin.OutputFile, fallbackNote(result, ", "))
+		return sensu.CheckStateOK, nil
+	}
+
+	fmt.Fprintf(selfmetrics.Stdout, "%s", output)
+	if note := fallbackNote(result, ""); len(note) > 0 {
+		// As a comment of the Prometheus text exposition format, which
+		// most fetched output is.
+		if len(output) > 0 && !strings.HasSuffix(output, "\n") {
+			fmt.Fprintln(selfmetrics.Stdout)
+		}
+		fmt.Fprintf(selfmetrics.Stdout, "# %s: %s\n", plugin.PluginConfig.Name, note)
+	}
+
+	return sensu.CheckStateOK, nil
+}
+
+// fetchAny fetches the first of sources that succeeds, retrying each
+// --retries times with a growing delay, and returns the last error if none
+// does.
+func fetchAny(client *http.Client, sources []string) (*fetchResult, error) {
+	var lastErr error
+	for _, source := range sources {
+		// The error of the source before, nil for the first.
+		fallbackReason := lastErr
+		delay := retryDelay
+		for attempt := 0; attempt <= plugin.Retries; attempt++ {
+			if attempt > 0 {
+				selfmetrics.AddRetry()
+				time.Sleep(delay)
+				if delay *= 2; delay > maxRetryDelay {
+					delay = maxRetryDelay
+				}
+			}
+			result, err := fetch(client, source)
+			if err == nil {
+				if fallbackReason != nil {
+					result.fallbackReason = fallbackReason.Error()
+				}
+				return result, nil
+			}
+			lastErr = fmt.Errorf("%s: %s", source, httpclient.Describe(err))
+			logging.Info("request failed", "url", source, "attempt", attempt+1, "retries", plugin.Retries, "error", httpclient.Describe(err))
+		}
+	}
+	return nil, lastErr
+}
+
+// writeResults outputs the concatenated results of several --url, in the
+// order given.
+func writeResults(results []*fetchResult) (int, error) {
+	var output strings.Builder
+	seen := map[string]bool{}
+	for _, result := range results {
+		if len(plugin.OutputFile) > 0 && result.resp.StatusCode >= http.StatusBadRequest {
+			fmt.Fprintf(selfmetrics.Stdout, "%s CRITICAL: HTTP Status %v for %s, %s not written\n", plugin.PluginConfig.Name, result.resp.StatusCode, result.source, plugin.OutputFile)
+			return sensu.CheckStateCritical, nil
+		}
+		rendered, err := renderOutput(result)
+		if err != nil {
+			fmt.Fprintf(selfmetrics.Stdout, "%s CRITICAL: %s: %s\n", plugin.PluginConfig.Name, result.source, err)
+			return sensu.CheckStateCritical, nil
+		}
+		if len(plugin.SourceLabel) > 0 {
+			rendered = labelMetrics(rendered, plugin.SourceLabel, result.resp.Request.URL.Host, seen)
+		}
+		output.WriteString(rendered)
+		if len(rendered) > 0 && !strings.HasSuffix(rendered, "\n") {
+			output.WriteString("\n")
+		}
+	}
+
+	if len(plugin.OutputFile) > 0 {
+		if err := writeOutputFile(plugin.OutputFile, output.String(), plugin.Append); err != nil {
+			fmt.Fprintf(selfmetrics.Stdout, "%s UNKNOWN: failed to write %s: %v\n", plugin.PluginConfig.Name, plugin.OutputFile, err)
+			return sensu.CheckStateUnknown, nil
+		}
+		fmt.Fprintf(selfmetrics.Stdout, "%s OK: wrote %d bytes from %d URLs to %s\n", plugin.PluginConfig.Name, output.Len(), len(results), plugin.OutputFile)
+		return sensu.CheckStateOK, nil
+	}
+
+	fmt.Fprintf(selfmetrics.Stdout, "%s", output.String())
+	return sensu.CheckStateOK, nil
+}
+
+// urlFlags returns the values of --url in args as given. The plugin SDK
+// parses --url as a comma separated list, splitting URLs with commas in them.
+func urlFlags(args []string) []string {
+	var urls []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--":
+			return urls
+		case arg == "--url" || arg == "-u":
+			if i+1 < len(args) {
+				i++
+				urls = append(urls, args[i])
+			}
+		case strings.HasPrefix(arg, "--url="):
+			urls = append(urls, strings.TrimPrefix(arg, "--url="))
+		case strings.HasPrefix(arg, "-u") && !strings.HasPrefix(arg, "--"):
+			urls = append(urls, strings.TrimPrefix(strings.TrimPrefix(arg, "-u"), "="))
+		}
+	}
+	return urls
+}
+
+// commandLineURLs returns args, the --url values given on the command line,
+// if urls is what the plugin SDK parsed them into, and urls otherwise, e.g.
+// when set by an annotation. Empty URLs are dropped.
+func commandLineURLs(urls, args []string) []string {
+	var split []string
+	for _, arg := range args {
+		values, err := csv.NewReader(strings.NewReader(arg)).Read()
+		if err != nil {
+			split = nil
+			break
+		}
+		split = append(split, values...)
+	}
+	if len(args) > 0 && reflect.DeepEqual(urls, split) {
+		urls = args
+	}
+	var nonEmpty []string
+	for _, u := range urls {
+		if len(u) > 0 {
+			nonEmpty = append(nonEmpty, u)
+		}
+	}
+	return nonEmpty
+}
+
+// labelMetrics adds the label name="value" to every sample of the Prometheus
+// text exposition in output. HELP and TYPE lines of metrics in seen are
+// dropped, as they may be given only once per metric in concatenated output.
+func labelMetrics(output, name, value string, seen map[string]bool) string {
+	label := name + "=" + strconv.Quote(value)
+	lines := strings.SplitAfter(output, "\n")
+	var labeled strings.Builder
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case len(trimmed) == 0:
+		case strings.HasPrefix(trimmed, "#"):
+			fields := strings.Fields(trimmed)
+			if len(fields) >= 3 && (fields[1] == "HELP" || fields[1] == "TYPE") {
+				key := fields[1] + " " + fields[2]
+				if seen[key] {
+					continue
+				}
+				seen[key] = true
+			}
+		default:
+			end := strings.IndexAny(line, "{ \t")
+			switch {
+			case end < 0:
+			case line[end] == '{' && strings.HasPrefix(line[end+1:], "}"):
+				line = line[:end+1] + label + line[end+1:]
+			case line[end] == '{':
+				line = line[:end+1] + label + "," + line[end+1:]
+			default:
+				line = line[:end] + "{" + label + "}" + line[end:]
+			}
+		}
+		labeled.WriteString(line)
+	}
+	return labeled.String()
+}
+
+// renderOutput returns the output for a fetch, either the body itself or
+// the result of --output-template or --query.
+func renderOutput(result *fetchResult) (string, error) {
+	resp := result.resp
+	body := result.body
+
+	if outputTmpl != nil {
+		data := templateData{
+			URL:        resp.Request.URL.String(),
+			Status:     resp.Status,
+			StatusCode: resp.StatusCode,
+			Headers:    resp.Header,
+			Body:       string(body),
+			Duration:   result.duration,
+		}
+		// JSON is left nil for bodies that are not valid JSON
+		_ = json.Unmarshal(body, &data.JSON)
+		var output strings.Builder
+		if err := outputTmpl.Execute(&output, data); err != nil {
+			return "", fmt.Errorf("output template error: %s", err)
+		}
+		return output.String(), nil
+	}
+
+	if queryCode != nil {
+		output, err := queryBody(body)
+		if err != nil {
+			return "", fmt.Errorf("query error: %s", err)
+		}
+		return output, nil
+	}
+
+	return string(body), nil
+}
+
+// writeOutputFile writes output to path. Unless appending, the output is
+// written to a temporary file in the same directory and renamed into place
+// so readers never see a partially written file.
+func writeOutputFile(path, output string, appendOutput bool) error {
+	if appendOutput {
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		if _, err := f.WriteString(output); err != nil {
+			_ = f.Close()
+			return err
+		}
+		return f.Close()
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(output); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// fetchResult holds the outcome of a successful fetch from a single source.
+type fetchResult struct {
+	source      string
+	resp        *http.Response
+	body        []byte
+	notModified bool
+	duration    time.Duration
+	// lastModified is the Last-Modified header of the response, or of the
+	// cached response if not modified.
+	lastModified string
+	// fallbackReason is the error of the URL tried before source if it is a
+	// fallback URL, empty if it is --url.
+	fallbackReason string
+}
+
+// fallbackNote returns prefix followed by a note that result was fetched from
+// a fallback URL and why, or an empty string if it was fetched from --url.
+func fallbackNote(result *fetchResult, prefix string) string {
+	if len(result.fallbackReason) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%sfetched from fallback %s after %s", prefix, result.source, result.fallbackReason)
+}
+
+// fetch performs the configured request against source. Transport errors and
+// server errors (5xx) are returned as errors so the caller can retry or move
+// on to a fallback URL.
+func fetch(client *http.Client, source string) (*fetchResult, error) {
+	_, err := url.Parse(source)
+	if err != nil {
+		return nil, fmt.Errorf("url parse error: %v", err)
+	}
+
+	method := plugin.Method
+	if len(method) == 0 {
+		method = http.MethodGet
+		if requestBody != nil {
+			method = http.MethodPost
+		}
+	}
+
+	var reqBody io.Reader
+	if requestBody != nil {
+		reqBody = bytes.NewReader(requestBody)
+	}
+
+	req, err := http.NewRequest(method, source, reqBody)
+	if err != nil {
+		return nil, fmt.Errorf("request creation error: %v", err)
+	}
+
+	if len(plugin.ContentType) > 0 {
+		req.Header.Set("Content-Type", plugin.ContentType)
+	}
 
 	if len(plugin.Headers) > 0 {
 		for _, header := range plugin.Headers {
@@ -181,21 +890,155 @@ func executeCheck(event *corev2.Event) (int, error) {
 		}
 	}
 
+	// Only the responses of --url are cached, those of a fallback URL would
+	// replace its entry.
+	cached := len(plugin.CacheFile) > 0 && source == plugin.URLs[0]
+	var cache *cacheEntry
+	if cached {
+		cache = loadCache(plugin.CacheFile, source)
+		if cache != nil {
+			if len(cache.ETag) > 0 {
+				req.Header.Set("If-None-Match", cache.ETag)
+			}
+			if len(cache.LastModified) > 0 {
+				req.Header.Set("If-Modified-Since", cache.LastModified)
+			}
+		}
+	}
+
+	start := time.Now()
 	resp, err := client.Do(req)
 	if err != nil {
-		fmt.Printf("request error: %s\n", err)
-		return sensu.CheckStateCritical, nil
+		return nil, err
 	}
 
 	defer resp.Body.Close()
 
-	body, err := ioutil.ReadAll(resp.Body)
+	result := &fetchResult{
+		source: source,
+		resp:   resp,
+	}
+
+	result.lastModified = resp.Header.Get("Last-Modified")
+	if resp.StatusCode == http.StatusNotModified && cache != nil {
+		result.notModified = true
+		result.body = cache.Body
+		if len(result.lastModified) == 0 {
+			result.lastModified = cache.LastModified
+		}
+		result.duration = time.Since(start)
+		return result, nil
+	}
+
+	result.body, err = ioutil.ReadAll(resp.Body)
 	if err != nil {
-		fmt.Printf("read response body error: %s\n", err)
-		return sensu.CheckStateCritical, nil
+		return nil, fmt.Errorf("read response body error: %v", err)
 	}
+	result.duration = time.Since(start)
 
-	fmt.Printf("%s", string(body))
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return nil, fmt.Errorf("HTTP Status %v", resp.StatusCode)
+	}
 
-	return sensu.CheckStateOK, nil
+	if cached && resp.StatusCode >= http.StatusOK && resp.StatusCode < http.StatusMultipleChoices {
+		entry := cacheEntry{
+			URL:          source,
+			ETag:         resp.Header.Get("ETag"),
+			LastModified: resp.Header.Get("Last-Modified"),
+		}
+		if plugin.PrintCached {
+			entry.Body = result.body
+		}
+		if err := saveCache(plugin.CacheFile, entry); err != nil {
+			return nil, fmt.Errorf("cache file write error: %v", err)
+		}
+	}
+
+	return result, nil
+}
+
+// checkAge returns why result is older than --max-age at now, or an empty
+// string if it is not.
+func checkAge(result *fetchResult, now time.Time) string {
+	if len(result.lastModified) == 0 {
+		return fmt.Sprintf("%s: no Last-Modified to check --max-age %s against", result.source, maxAge)
+	}
+	modified, err := http.ParseTime(result.lastModified)
+	if err != nil {
+		return fmt.Sprintf("%s: invalid Last-Modified %q", result.source, result.lastModified)
+	}
+	if age := now.Sub(modified); age > maxAge {
+		return fmt.Sprintf("%s last modified %s ago, older than %s", result.source, age.Truncate(time.Second), maxAge)
+	}
+	return ""
+}
+
+// loadCache returns the cache entry stored in path if it is usable for a
+// conditional request against checkURL, otherwise it returns nil.
+func loadCache(path, checkURL string) *cacheEntry {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	var entry cacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil
+	}
+	if entry.URL != checkURL || (len(entry.ETag) == 0 && len(entry.LastModified) == 0) {
+		return nil
+	}
+	// Without a stored body there is nothing to print on a 304
+	if plugin.PrintCached && entry.Body == nil {
+		return nil
+	}
+	return &entry
+}
+
+// saveCache writes the cache entry to path, or removes any existing cache
+// if the response carried no validators.
+func saveCache(path string, entry cacheEntry) error {
+	if len(entry.ETag) == 0 && len(entry.LastModified) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0600)
+}
+
+// queryBody runs the compiled query against the JSON body and returns each
+// result on its own line. Strings are output raw, all other values are
+// re-serialized as JSON.
+func queryBody(body []byte) (string, error) {
+	var jsonBody interface{}
+	if err := json.Unmarshal(body, &jsonBody); err != nil {
+		return "", fmt.Errorf("could not unmarshal response body into JSON: %v", err)
+	}
+
+	var output strings.Builder
+	iter := queryCode.Run(jsonBody)
+	for {
+		v, ok := iter.Next()
+		if !ok {
+			break
+		}
+		if err, ok := v.(error); ok {
+			return "", err
+		}
+		if str, ok := v.(string); ok {
+			output.WriteString(str)
+		} else {
+			b, err := json.Marshal(v)
+			if err != nil {
+				return "", err
+			}
+			output.Write(b)
+		}
+		output.WriteString("\n")
+	}
+	return output.String(), nil
 }
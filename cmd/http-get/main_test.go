@@ -0,0 +1,577 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	corev2 "github.com/sensu/sensu-go/api/core/v2"
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMain(t *testing.T) {
+}
+
+func TestExecuteCheck(t *testing.T) {
+
+	testCases := []struct {
+		method         string
+		postData       string
+		contentType    string
+		expectedMethod string
+	}{
+		{"", "", "", "GET"},
+		{"", "{\"query\": \"{ health }\"}", "application/json", "POST"},
+		{"put", "data", "text/plain", "PUT"},
+		{"DELETE", "", "", "DELETE"},
+	}
+
+	for _, tc := range testCases {
+		event := corev2.FixtureEvent("entity1", "check")
+		assert := assert.New(t)
+
+		var test = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(tc.expectedMethod, r.Method)
+			assert.Equal(tc.contentType, r.Header.Get("Content-Type"))
+			body, _ := ioutil.ReadAll(r.Body)
+			assert.Equal(tc.postData, string(body))
+			w.WriteHeader(http.StatusOK)
+			_, _ = w.Write([]byte("metric 1"))
+		}))
+		_, err := url.ParseRequestURI(test.URL)
+		require.NoError(t, err)
+		plugin.URLs = []string{test.URL}
+		plugin.Method = tc.method
+		plugin.PostData = tc.postData
+		plugin.ContentType = tc.contentType
+		status, err := checkArgs(event)
+		assert.NoError(err)
+		assert.Equal(sensu.CheckStateOK, status)
+		status, err = executeCheck(event)
+		assert.NoError(err)
+		assert.Equal(sensu.CheckStateOK, status)
+	}
+}
+
+func TestCheckArgs(t *testing.T) {
+	assert := assert.New(t)
+	event := corev2.FixtureEvent("entity1", "check")
+
+	bodyFile, err := ioutil.TempFile("", "http-get-body")
+	require.NoError(t, err)
+	defer os.Remove(bodyFile.Name())
+	_, _ = bodyFile.WriteString("{\"size\": 0}")
+	_ = bodyFile.Close()
+
+	plugin.URLs = []string{"http://localhost:80/"}
+	plugin.PostData = ""
+	plugin.BodyFile = bodyFile.Name()
+	status, err := checkArgs(event)
+	assert.NoError(err)
+	assert.Equal(sensu.CheckStateOK, status)
+	assert.Equal("{\"size\": 0}", string(requestBody))
+
+	plugin.PostData = "data"
+	status, err = checkArgs(event)
+	assert.Error(err)
+	assert.Equal(sensu.CheckStateUnknown, status)
+
+	plugin.PostData = ""
+	plugin.BodyFile = bodyFile.Name() + ".missing"
+	status, err = checkArgs(event)
+	assert.Error(err)
+	assert.Equal(sensu.CheckStateUnknown, status)
+	plugin.BodyFile = ""
+}
+
+func TestQuery(t *testing.T) {
+	assert := assert.New(t)
+	event := corev2.FixtureEvent("entity1", "check")
+
+	testJSON := []byte(`{"name": "api", "stats": {"requests": 10, "errors": 1}, "tags": ["a", "b"]}`)
+
+	testCases := []struct {
+		query  string
+		output string
+	}{
+		{".name", "api\n"},
+		{".stats.requests", "10\n"},
+		{".stats", "{\"errors\":1,\"requests\":10}\n"},
+		{".tags[]", "a\nb\n"},
+	}
+
+	for _, tc := range testCases {
+		plugin.URLs = []string{"http://localhost:80/"}
+		plugin.Query = tc.query
+		status, err := checkArgs(event)
+		assert.NoError(err)
+		assert.Equal(sensu.CheckStateOK, status)
+		output, err := queryBody(testJSON)
+		assert.NoError(err)
+		assert.Equal(tc.output, output)
+	}
+
+	_, err := queryBody([]byte("not json"))
+	assert.Error(err)
+
+	var test = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("not json"))
+	}))
+	defer test.Close()
+	plugin.URLs = []string{test.URL}
+	plugin.Query = ".name"
+	status, err := checkArgs(event)
+	require.NoError(t, err)
+	status, output := runCheck(t, event)
+	assert.Equal(sensu.CheckStateCritical, status)
+	assert.Regexp(`^http-get CRITICAL: query error: .*\n$`, output)
+
+	plugin.Query = ".["
+	status, err = checkArgs(event)
+	assert.Error(err)
+	assert.Equal(sensu.CheckStateUnknown, status)
+	plugin.Query = ""
+}
+
+// runCheck runs executeCheck with event and returns its status and what it
+// printed.
+func runCheck(t *testing.T, event *corev2.Event) (int, string) {
+	stdout := os.Stdout
+	defer func() { os.Stdout = stdout }()
+	r, w, err := os.Pipe()
+	require.NoError(t, err)
+	os.Stdout = w
+	status, err := executeCheck(event)
+	w.Close()
+	require.NoError(t, err)
+	output, _ := ioutil.ReadAll(r)
+	return status, string(output)
+}
+
+func TestCacheFile(t *testing.T) {
+	assert := assert.New(t)
+	event := corev2.FixtureEvent("entity1", "check")
+
+	cacheDir, err := ioutil.TempDir("", "http-get-cache")
+	require.NoError(t, err)
+	defer os.RemoveAll(cacheDir)
+	cacheFile := filepath.Join(cacheDir, "cache.json")
+
+	requests := 0
+	var test = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("If-None-Match") == "\"v1\"" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		assert.Equal(1, requests)
+		w.Header().Set("ETag", "\"v1\"")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("metric 1"))
+	}))
+	plugin.URLs = []string{test.URL}
+	plugin.CacheFile = cacheFile
+	plugin.PrintCached = true
+	status, err := checkArgs(event)
+	assert.NoError(err)
+	assert.Equal(sensu.CheckStateOK, status)
+
+	for i := 0; i < 2; i++ {
+		status, err = executeCheck(event)
+		assert.NoError(err)
+		assert.Equal(sensu.CheckStateOK, status)
+	}
+	assert.Equal(2, requests)
+
+	cache := loadCache(cacheFile, test.URL)
+	require.NotNil(t, cache)
+	assert.Equal("\"v1\"", cache.ETag)
+	assert.Equal("metric 1", string(cache.Body))
+	assert.Nil(loadCache(cacheFile, test.URL+"/other"))
+
+	plugin.CacheFile = ""
+	status, err = checkArgs(event)
+	assert.Error(err)
+	assert.Equal(sensu.CheckStateUnknown, status)
+	plugin.PrintCached = false
+}
+
+func TestOutputTemplate(t *testing.T) {
+	assert := assert.New(t)
+	event := corev2.FixtureEvent("entity1", "check")
+
+	var test = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Version", "1.2.3")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(`{"queue": {"depth": 42}}`))
+	}))
+	plugin.URLs = []string{test.URL}
+	plugin.OutputTemplate = `queue_depth{version="{{ .Headers.Get "X-Version" }}"} {{ .JSON.queue.depth }}`
+	status, err := checkArgs(event)
+	assert.NoError(err)
+	assert.Equal(sensu.CheckStateOK, status)
+	status, err = executeCheck(event)
+	assert.NoError(err)
+	assert.Equal(sensu.CheckStateOK, status)
+
+	var output strings.Builder
+	err = outputTmpl.Execute(&output, templateData{
+		Headers: http.Header{"X-Version": []string{"1.2.3"}},
+		JSON:    map[string]interface{}{"queue": map[string]interface{}{"depth": 42}},
+	})
+	assert.NoError(err)
+	assert.Equal(`queue_depth{version="1.2.3"} 42`, output.String())
+
+	plugin.Query = ".queue"
+	status, err = checkArgs(event)
+	assert.Error(err)
+	assert.Equal(sensu.CheckStateUnknown, status)
+	plugin.Query = ""
+
+	plugin.OutputTemplate = "{{ .Body"
+	status, err = checkArgs(event)
+	assert.Error(err)
+	assert.Equal(sensu.CheckStateUnknown, status)
+	plugin.OutputTemplate = ""
+}
+
+func TestFallbackURL(t *testing.T) {
+	assert := assert.New(t)
+	event := corev2.FixtureEvent("entity1", "check")
+
+	primaryRequests := 0
+	var primary = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		primaryRequests++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	fallbackRequests := 0
+	var fallback = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fallbackRequests++
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("metric 1"))
+	}))
+
+	defer func(delay, max time.Duration) { retryDelay, maxRetryDelay = delay, max }(retryDelay, maxRetryDelay)
+	retryDelay, maxRetryDelay = 20*time.Millisecond, 30*time.Millisecond
+
+	cacheDir, err := ioutil.TempDir("", "http-get-fallback")
+	require.NoError(t, err)
+	defer os.RemoveAll(cacheDir)
+	plugin.URLs = []string{primary.URL}
+	plugin.FallbackURLs = []string{fallback.URL}
+	plugin.Retries = 2
+	plugin.CacheFile = filepath.Join(cacheDir, "cache.json")
+	defer func() { plugin.CacheFile = "" }()
+	require.NoError(t, saveCache(plugin.CacheFile, cacheEntry{URL: primary.URL, ETag: "\"v1\""}))
+	status, err := checkArgs(event)
+	assert.NoError(err)
+	assert.Equal(sensu.CheckStateOK, status)
+
+	stdout := os.Stdout
+	r, w, err := os.Pipe()
+	require.NoError(t, err)
+	os.Stdout = w
+	start := time.Now()
+	status, err = executeCheck(event)
+	elapsed := time.Since(start)
+	w.Close()
+	os.Stdout = stdout
+	output, _ := ioutil.ReadAll(r)
+	assert.NoError(err)
+	assert.Equal(sensu.CheckStateOK, status)
+	assert.Equal(3, primaryRequests)
+	assert.Equal(1, fallbackRequests)
+	// The retries are delayed by 20ms, then 30ms.
+	assert.True(elapsed >= 50*time.Millisecond, elapsed)
+	assert.Equal("metric 1\n# http-get: fetched from fallback "+fallback.URL+" after "+primary.URL+": HTTP Status 503\n", string(output))
+	// The response of the fallback URL does not replace the cache entry of
+	// --url.
+	assert.NotNil(loadCache(plugin.CacheFile, primary.URL))
+	plugin.CacheFile = ""
+
+	plugin.FallbackURLs = []string{}
+	plugin.Retries = 0
+	status, err = executeCheck(event)
+	assert.NoError(err)
+	assert.Equal(sensu.CheckStateCritical, status)
+	assert.Equal(4, primaryRequests)
+
+	plugin.Retries = -1
+	status, err = checkArgs(event)
+	assert.Error(err)
+	assert.Equal(sensu.CheckStateUnknown, status)
+	plugin.Retries = 0
+}
+
+func TestOutputFile(t *testing.T) {
+	assert := assert.New(t)
+	event := corev2.FixtureEvent("entity1", "check")
+
+	outputDir, err := ioutil.TempDir("", "http-get-output")
+	require.NoError(t, err)
+	defer os.RemoveAll(outputDir)
+	outputFile := filepath.Join(outputDir, "artifact.txt")
+
+	httpStatus := http.StatusOK
+	var test = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(httpStatus)
+		_, _ = w.Write([]byte("line\n"))
+	}))
+	plugin.URLs = []string{test.URL}
+	plugin.OutputFile = outputFile
+	status, err := checkArgs(event)
+	assert.NoError(err)
+	assert.Equal(sensu.CheckStateOK, status)
+
+	for i := 0; i < 2; i++ {
+		status, err = executeCheck(event)
+		assert.NoError(err)
+		assert.Equal(sensu.CheckStateOK, status)
+	}
+	data, err := ioutil.ReadFile(outputFile)
+	require.NoError(t, err)
+	assert.Equal("line\n", string(data))
+
+	plugin.Append = true
+	status, err = executeCheck(event)
+	assert.NoError(err)
+	assert.Equal(sensu.CheckStateOK, status)
+	data, err = ioutil.ReadFile(outputFile)
+	require.NoError(t, err)
+	assert.Equal("line\nline\n", string(data))
+
+	httpStatus = http.StatusNotFound
+	status, err = executeCheck(event)
+	assert.NoError(err)
+	assert.Equal(sensu.CheckStateCritical, status)
+	data, err = ioutil.ReadFile(outputFile)
+	require.NoError(t, err)
+	assert.Equal("line\nline\n", string(data))
+
+	files, err := ioutil.ReadDir(outputDir)
+	require.NoError(t, err)
+	assert.Equal(1, len(files))
+
+	plugin.OutputFile = ""
+	status, err = checkArgs(event)
+	assert.Error(err)
+	assert.Equal(sensu.CheckStateUnknown, status)
+	plugin.Append = false
+}
+
+func TestMultipleURLs(t *testing.T) {
+	assert := assert.New(t)
+	event := corev2.FixtureEvent("entity1", "check")
+
+	outputDir, err := ioutil.TempDir("", "http-get-output")
+	require.NoError(t, err)
+	defer os.RemoveAll(outputDir)
+	outputFile := filepath.Join(outputDir, "metrics.txt")
+
+	exporter := func(metrics string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(200 * time.Millisecond)
+			_, _ = w.Write([]byte(metrics))
+		}))
+	}
+	first := exporter("# HELP up Up.\n# TYPE up gauge\nup 1\n")
+	defer first.Close()
+	second := exporter("# HELP up Up.\n# TYPE up gauge\nup{job=\"app\"} 0")
+	defer second.Close()
+
+	plugin.URLs = []string{first.URL, second.URL}
+	plugin.OutputFile = outputFile
+	defer func() {
+		plugin.OutputFile = ""
+		plugin.SourceLabel = ""
+	}()
+	status, err := checkArgs(event)
+	assert.NoError(err)
+	assert.Equal(sensu.CheckStateOK, status)
+	start := time.Now()
+	status, err = executeCheck(event)
+	assert.NoError(err)
+	assert.Equal(sensu.CheckStateOK, status)
+	assert.True(time.Since(start) < 400*time.Millisecond, "URLs are fetched concurrently")
+	data, err := ioutil.ReadFile(outputFile)
+	require.NoError(t, err)
+	assert.Equal("# HELP up Up.\n# TYPE up gauge\nup 1\n# HELP up Up.\n# TYPE up gauge\nup{job=\"app\"} 0\n", string(data))
+
+	plugin.SourceLabel = "instance"
+	status, err = executeCheck(event)
+	assert.NoError(err)
+	assert.Equal(sensu.CheckStateOK, status)
+	data, err = ioutil.ReadFile(outputFile)
+	require.NoError(t, err)
+	firstHost := strings.TrimPrefix(first.URL, "http://")
+	secondHost := strings.TrimPrefix(second.URL, "http://")
+	assert.Equal("# HELP up Up.\n# TYPE up gauge\nup{instance=\""+firstHost+"\"} 1\nup{instance=\""+secondHost+"\",job=\"app\"} 0\n", string(data))
+
+	// Output of a URL that cannot be rendered fails the check.
+	plugin.Query = ".up"
+	status, err = checkArgs(event)
+	require.NoError(t, err)
+	status, output := runCheck(t, event)
+	assert.Equal(sensu.CheckStateCritical, status)
+	assert.Regexp(`^http-get CRITICAL: `+first.URL+`: query error: .*\n$`, output)
+	plugin.Query = ""
+	_, err = checkArgs(event)
+	require.NoError(t, err)
+
+	// A single failing URL fails the check.
+	plugin.URLs = []string{first.URL, "http://127.0.0.1:1/metrics"}
+	status, err = executeCheck(event)
+	assert.NoError(err)
+	assert.Equal(sensu.CheckStateCritical, status)
+
+	plugin.FallbackURLs = []string{second.URL}
+	status, err = checkArgs(event)
+	assert.Error(err)
+	assert.Equal(sensu.CheckStateUnknown, status)
+	plugin.FallbackURLs = []string{}
+}
+
+func TestFileURLMaxAge(t *testing.T) {
+	assert := assert.New(t)
+	event := corev2.FixtureEvent("entity1", "check")
+
+	dir, err := ioutil.TempDir("", "http-get-file")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "feed.csv")
+	require.NoError(t, ioutil.WriteFile(path, []byte("sku,price\n"), 0644))
+
+	plugin.URLs = []string{"file://" + filepath.ToSlash(path)}
+	plugin.MaxAge = "1h"
+	defer func() { plugin.MaxAge = "" }()
+	status, err := checkArgs(event)
+	assert.NoError(err)
+	assert.Equal(sensu.CheckStateOK, status)
+	status, err = executeCheck(event)
+	assert.NoError(err)
+	assert.Equal(sensu.CheckStateOK, status)
+
+	stale := time.Now().Add(-2 * time.Hour)
+	require.NoError(t, os.Chtimes(path, stale, stale))
+	status, err = executeCheck(event)
+	assert.NoError(err)
+	assert.Equal(sensu.CheckStateCritical, status)
+
+	plugin.MaxAge = "soon"
+	_, err = checkArgs(event)
+	assert.Error(err)
+	plugin.MaxAge = ""
+	plugin.URLs = []string{"gopher://example.com/"}
+	_, err = checkArgs(event)
+	assert.Error(err)
+}
+
+func TestCheckAge(t *testing.T) {
+	assert := assert.New(t)
+	maxAge = time.Hour
+	defer func() { maxAge = 0 }()
+	now := time.Date(2021, 3, 4, 12, 0, 0, 0, time.UTC)
+
+	assert.Equal("", checkAge(&fetchResult{source: "ftp://feeds/a", lastModified: "Thu, 04 Mar 2021 11:30:00 GMT"}, now))
+	assert.Equal("ftp://feeds/a last modified 2h0m0s ago, older than 1h0m0s", checkAge(&fetchResult{source: "ftp://feeds/a", lastModified: "Thu, 04 Mar 2021 10:00:00 GMT"}, now))
+	assert.Contains(checkAge(&fetchResult{source: "ftp://feeds/a"}, now), "no Last-Modified")
+}
+
+func TestURLFlags(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal([]string{"http://es:9200/_cat/indices?h=index,health", "host1:9100/metrics", "host2:9100/metrics", "host3"},
+		urlFlags([]string{"--url", "http://es:9200/_cat/indices?h=index,health", "-u", "host1:9100/metrics", "--timeout", "5", "--url=host2:9100/metrics", "-uhost3", "--", "--url", "host4"}))
+	assert.Empty(urlFlags([]string{"--timeout", "5", "--url"}))
+}
+
+func TestCommandLineURLs(t *testing.T) {
+	assert := assert.New(t)
+	args := []string{"http://es:9200/_cat/indices?h=index,health", "host1:9100/metrics"}
+	assert.Equal(args, commandLineURLs([]string{"http://es:9200/_cat/indices?h=index", "health", "host1:9100/metrics"}, args))
+	// URLs set by an annotation are kept.
+	assert.Equal([]string{"http://localhost/"}, commandLineURLs([]string{"http://localhost/"}, args))
+	assert.Equal([]string{"host1:9100/metrics", "host2:9100/metrics"}, commandLineURLs([]string{"host1:9100/metrics", "host2:9100/metrics"}, nil))
+	assert.Empty(commandLineURLs([]string{""}, nil))
+}
+
+func TestSchemelessURLs(t *testing.T) {
+	assert := assert.New(t)
+	event := corev2.FixtureEvent("entity1", "check")
+
+	var requests int32
+	exporter := func(metrics string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&requests, 1)
+			_, _ = w.Write([]byte(metrics))
+		}))
+	}
+	first := exporter("up 1\n")
+	defer first.Close()
+	second := exporter("up 0\n")
+	defer second.Close()
+
+	urlArgs = urlFlags([]string{"--url", strings.TrimPrefix(first.URL, "http://") + "/metrics", "--url", strings.TrimPrefix(second.URL, "http://") + "/metrics"})
+	plugin.URLs = urlArgs
+	defer func() { urlArgs = nil }()
+	status, err := checkArgs(event)
+	assert.NoError(err)
+	assert.Equal(sensu.CheckStateOK, status)
+	assert.Len(plugin.URLs, 2)
+	status, output := runCheck(t, event)
+	assert.Equal(sensu.CheckStateOK, status)
+	assert.Equal(int32(2), atomic.LoadInt32(&requests))
+	assert.Equal("up 1\nup 0\n", output)
+}
+
+func TestLabelMetrics(t *testing.T) {
+	assert := assert.New(t)
+	seen := map[string]bool{}
+	assert.Equal("# TYPE a counter\na{src=\"h:1\"} 1\nb{src=\"h:1\"} 2 1600000000\nc{src=\"h:1\",x=\"y\"} 3\n\n",
+		labelMetrics("# TYPE a counter\na 1\nb{} 2 1600000000\nc{x=\"y\"} 3\n\n", "src", "h:1", seen))
+	assert.Equal("a{src=\"h:2\"} 4", labelMetrics("# TYPE a counter\na 4", "src", "h:2", seen))
+}
+
+func TestDefaultClientUntouched(t *testing.T) {
+	assert := assert.New(t)
+	event := corev2.FixtureEvent("entity1", "check")
+
+	var test = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(`{"status": "SUCCESS"}`))
+	}))
+	defer test.Close()
+
+	plugin.URLs = []string{test.URL}
+	plugin.Headers = nil
+	plugin.Timeout = 15
+	plugin.InsecureSkipVerify = true
+	plugin.Method = ""
+	plugin.PostData = ""
+	plugin.Query = ""
+	status, err := checkArgs(event)
+	assert.NoError(err)
+	assert.Equal(sensu.CheckStateOK, status)
+	status, err = executeCheck(event)
+	assert.NoError(err)
+	assert.Equal(sensu.CheckStateOK, status)
+	plugin.InsecureSkipVerify = false
+
+	// The check must use its own client and transport
+	// httptest.Server.Close may initialise the default TLS config itself, so
+	// only check that ours was not installed.
+	if defaultTLS := http.DefaultTransport.(*http.Transport).TLSClientConfig; defaultTLS != nil {
+		assert.False(defaultTLS.InsecureSkipVerify)
+	}
+	assert.Nil(http.DefaultClient.Transport)
+	assert.Nil(http.DefaultClient.CheckRedirect)
+	assert.Zero(http.DefaultClient.Timeout)
+}
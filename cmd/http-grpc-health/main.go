@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/nixwiz/http-checks/internal/buildinfo"
+	"github.com/nixwiz/http-checks/internal/exitstatus"
+	"github.com/nixwiz/http-checks/internal/httpclient"
+	"github.com/nixwiz/http-checks/internal/logging"
+	"github.com/nixwiz/http-checks/internal/overrides"
+	"github.com/nixwiz/http-checks/internal/selfmetrics"
+	corev2 "github.com/sensu/sensu-go/api/core/v2"
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// Config represents the check plugin config.
+type Config struct {
+	sensu.PluginConfig
+	Address            string
+	Service            string
+	TLS                bool
+	ServerName         string
+	TrustedCAFile      string
+	UseSystemCAsPlus   bool
+	InsecureSkipVerify bool
+	Timeout            int
+	MTLSKeyFile        string
+	MTLSCertFile       string
+	Source             httpclient.SourceConfig
+	Log                logging.Config
+	Overrides          overrides.Config
+	Status             exitstatus.Config
+	Metrics            selfmetrics.Config
+}
+
+var (
+	tlsConfig tls.Config
+
+	plugin = Config{
+		PluginConfig: sensu.PluginConfig{
+			Name:     "http-grpc-health",
+			Short:    "gRPC Health Check",
+			Keyspace: "sensu.io/plugins/http-grpc-health/config",
+		},
+	}
+
+	options = []*sensu.PluginConfigOption{
+		{
+			Path:      "address",
+			Env:       "CHECK_ADDRESS",
+			Argument:  "address",
+			Shorthand: "a",
+			Default:   "localhost:50051",
+			Usage:     "Address of the gRPC server in host:port form",
+			Value:     &plugin.Address,
+		},
+		{
+			Path:      "service",
+			Env:       "",
+			Argument:  "service",
+			Shorthand: "s",
+			Default:   "",
+			Usage:     "Service name to check, if not provided the overall server health is checked",
+			Value:     &plugin.Service,
+		},
+		{
+			Path:      "tls",
+			Env:       "",
+			Argument:  "tls",
+			Shorthand: "",
+			Default:   false,
+			Usage:     "Connect using TLS",
+			Value:     &plugin.TLS,
+		},
+		{
+			Path:      "servername",
+			Env:       "",
+			Argument:  "servername",
+			Shorthand: "",
+			Default:   "",
+			Usage:     "Server name to use for TLS verification (defaults to the host in --address)",
+			Value:     &plugin.ServerName,
+		},
+		{
+			Path:      "insecure-skip-verify",
+			Env:       "",
+			Argument:  "insecure-skip-verify",
+			Shorthand: "i",
+			Default:   false,
+			Usage:     "Skip TLS certificate verification (not recommended!)",
+			Value:     &plugin.InsecureSkipVerify,
+		},
+		{
+			Path:      "trusted-ca-file",
+			Env:       "",
+			Argument:  "trusted-ca-file",
+			Shorthand: "t",
+			Default:   "",
+			Usage:     "TLS CA certificate bundle in PEM format, or a directory of them",
+			Value:     &plugin.TrustedCAFile,
+		},
+		{
+			Path:      "use-system-cas-plus",
+			Env:       "",
+			Argument:  "use-system-cas-plus",
+			Shorthand: "",
+			Default:   false,
+			Usage:     "Add the CA certificates from --trusted-ca-file to the system trust store rather than replacing it",
+			Value:     &plugin.UseSystemCAsPlus,
+		},
+		{
+			Path:      "timeout",
+			Env:       "",
+			Argument:  "timeout",
+			Shorthand: "T",
+			Default:   15,
+			Usage:     "Request timeout in seconds",
+			Value:     &plugin.Timeout,
+		},
+		{
+			Path:      "mtls-key-file",
+			Env:       "",
+			Argument:  "mtls-key-file",
+			Shorthand: "K",
+			Default:   "",
+			Usage:     "Key file for mutual TLS auth in PEM format",
+			Value:     &plugin.MTLSKeyFile,
+		},
+		{
+			Path:      "mtls-cert-file",
+			Env:       "",
+			Argument:  "mtls-cert-file",
+			Shorthand: "C",
+			Default:   "",
+			Usage:     "Certificate file for mutual TLS auth in PEM format",
+			Value:     &plugin.MTLSCertFile,
+		},
+	}
+)
+
+func main() {
+	options = append(options, plugin.Source.Options()...)
+	options = append(options, plugin.Log.Options()...)
+	options = append(options, plugin.Overrides.Options()...)
+	options = append(options, plugin.Status.Options()...)
+	options = append(options, plugin.Metrics.Options()...)
+	buildinfo.Handle(plugin.PluginConfig.Name, options, os.Args[1:])
+	exitstatus.ParseFlags(plugin.PluginConfig.Name, options, os.Args[1:])
+	check := sensu.NewGoCheck(&plugin.PluginConfig, options, plugin.Status.Wrap(plugin.PluginConfig.Name, checkArgs), plugin.Metrics.Wrap(plugin.PluginConfig.Name, plugin.Status.Wrap(plugin.PluginConfig.Name, executeCheck)), overrides.Requested(os.Args[1:]))
+	check.Execute()
+}
+
+func checkArgs(event *corev2.Event) (int, error) {
+	if err := plugin.Log.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+
+	if len(plugin.Address) == 0 {
+		return sensu.CheckStateUnknown, fmt.Errorf("--address or CHECK_ADDRESS environment variable is required")
+	}
+	if len(plugin.TrustedCAFile) > 0 {
+		caCertPool, err := httpclient.LoadCACerts(plugin.TrustedCAFile, plugin.UseSystemCAsPlus)
+		if err != nil {
+			return sensu.CheckStateUnknown, fmt.Errorf("Error loading specified CA file: %v", err)
+		}
+		tlsConfig.RootCAs = caCertPool
+	}
+	tlsConfig.InsecureSkipVerify = plugin.InsecureSkipVerify
+	tlsConfig.ServerName = plugin.ServerName
+
+	if (len(plugin.MTLSKeyFile) > 0 && len(plugin.MTLSCertFile) == 0) || (len(plugin.MTLSCertFile) > 0 && len(plugin.MTLSKeyFile) == 0) {
+		return sensu.CheckStateUnknown, fmt.Errorf("mTLS auth requires both --mtls-key-file and --mtls-cert-file")
+	}
+	if len(plugin.MTLSKeyFile) > 0 && len(plugin.MTLSCertFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(plugin.MTLSCertFile, plugin.MTLSKeyFile)
+		if err != nil {
+			return sensu.CheckStateUnknown, fmt.Errorf("Failed to load mTLS key pair %s/%s: %v", plugin.MTLSCertFile, plugin.MTLSKeyFile, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if err := plugin.Source.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+
+	return sensu.CheckStateOK, nil
+}
+
+func executeCheck(event *corev2.Event) (int, error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(plugin.Timeout)*time.Second)
+	defer cancel()
+
+	dialOptions := []grpc.DialOption{grpc.WithBlock()}
+	if plugin.TLS {
+		dialOptions = append(dialOptions, grpc.WithTransportCredentials(credentials.NewTLS(&tlsConfig)))
+	} else {
+		dialOptions = append(dialOptions, grpc.WithInsecure())
+	}
+	// The dialer of the source address also counts the self metrics.
+	if plugin.Source.LocalAddr("tcp") != nil || plugin.Metrics.Enabled {
+		dialOptions = append(dialOptions, grpc.WithContextDialer(func(ctx context.Context, address string) (net.Conn, error) {
+			return plugin.Source.DialContext(ctx, "tcp", address)
+		}))
+	}
+
+	logging.Debug("dial", "address", plugin.Address, "tls", plugin.TLS)
+	start := time.Now()
+	conn, err := grpc.DialContext(ctx, plugin.Address, dialOptions...)
+	logging.Debug("dial done", "address", plugin.Address, "error", err, "elapsed", time.Since(start))
+	if err != nil {
+		fmt.Fprintf(selfmetrics.Stdout, "%s CRITICAL: failed to connect to %s: %s\n", plugin.PluginConfig.Name, plugin.Address, httpclient.Describe(err))
+		return sensu.CheckStateCritical, nil
+	}
+	defer conn.Close()
+
+	resp, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{Service: plugin.Service})
+	duration := time.Since(start)
+	logging.Debug("health check done", "service", plugin.Service, "status", resp.GetStatus(), "error", err, "elapsed", duration)
+	if err != nil {
+		fmt.Fprintf(selfmetrics.Stdout, "%s CRITICAL: health check of %s failed: %v\n", plugin.PluginConfig.Name, target(), err)
+		return sensu.CheckStateCritical, nil
+	}
+
+	perfdata := fmt.Sprintf("response_duration=%0.6f", duration.Seconds())
+	if resp.GetStatus() == healthpb.HealthCheckResponse_SERVING {
+		fmt.Fprintf(selfmetrics.Stdout, "%s OK: %s is %s | %s\n", plugin.PluginConfig.Name, target(), resp.GetStatus(), perfdata)
+		return sensu.CheckStateOK, nil
+	}
+
+	fmt.Fprintf(selfmetrics.Stdout, "%s CRITICAL: %s is %s | %s\n", plugin.PluginConfig.Name, target(), resp.GetStatus(), perfdata)
+	return sensu.CheckStateCritical, nil
+}
+
+// target describes what is being checked, for use in output.
+func target() string {
+	if len(plugin.Service) > 0 {
+		return fmt.Sprintf("service %q at %s", plugin.Service, plugin.Address)
+	}
+	return plugin.Address
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+
+	corev2 "github.com/sensu/sensu-go/api/core/v2"
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func TestMain(t *testing.T) {
+}
+
+func TestExecuteCheck(t *testing.T) {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := grpc.NewServer()
+	healthServer := health.NewServer()
+	healthServer.SetServingStatus("orders", healthpb.HealthCheckResponse_SERVING)
+	healthServer.SetServingStatus("payments", healthpb.HealthCheckResponse_NOT_SERVING)
+	healthpb.RegisterHealthServer(server, healthServer)
+	go func() {
+		_ = server.Serve(listener)
+	}()
+	defer server.Stop()
+
+	testCases := []struct {
+		status  int
+		service string
+	}{
+		{sensu.CheckStateOK, ""},
+		{sensu.CheckStateOK, "orders"},
+		{sensu.CheckStateCritical, "payments"},
+		{sensu.CheckStateCritical, "unknown"},
+	}
+
+	for _, tc := range testCases {
+		event := corev2.FixtureEvent("entity1", "check")
+		assert := assert.New(t)
+
+		plugin.Address = listener.Addr().String()
+		plugin.Service = tc.service
+		plugin.Timeout = 5
+		status, err := checkArgs(event)
+		assert.NoError(err)
+		assert.Equal(sensu.CheckStateOK, status)
+		status, err = executeCheck(event)
+		assert.NoError(err)
+		assert.Equal(tc.status, status)
+	}
+
+	// Connection errors are described like those of the other commands.
+	stdout := os.Stdout
+	r, w, err := os.Pipe()
+	require.NoError(t, err)
+	os.Stdout = w
+	plugin.Address = "127.0.0.1:1"
+	plugin.Service = ""
+	plugin.Timeout = 1
+	status, err := executeCheck(corev2.FixtureEvent("entity1", "check"))
+	w.Close()
+	os.Stdout = stdout
+	output, _ := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, sensu.CheckStateCritical, status)
+	assert.Equal(t, "http-grpc-health CRITICAL: failed to connect to 127.0.0.1:1: request timed out\n", string(output))
+}
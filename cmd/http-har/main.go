@@ -0,0 +1,547 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/nixwiz/http-checks/internal/buildinfo"
+	"github.com/nixwiz/http-checks/internal/exitstatus"
+	"github.com/nixwiz/http-checks/internal/httpclient"
+	"github.com/nixwiz/http-checks/internal/logging"
+	"github.com/nixwiz/http-checks/internal/overrides"
+	"github.com/nixwiz/http-checks/internal/selfmetrics"
+	corev2 "github.com/sensu/sensu-go/api/core/v2"
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+)
+
+// Config represents the check plugin config.
+type Config struct {
+	sensu.PluginConfig
+	HARFile            string
+	Origin             string
+	Methods            []string
+	Include            string
+	Exclude            string
+	Limit              int
+	WarningRatio       float64
+	CriticalRatio      float64
+	Slack              string
+	TrustedCAFile      string
+	UseSystemCAsPlus   bool
+	InsecureSkipVerify bool
+	Timeout            int
+	Headers            []string
+	HeadersFile        httpclient.HeadersFileConfig
+	MTLSKeyFile        string
+	MTLSCertFile       string
+	Proxy              httpclient.ProxyConfig
+	Transport          httpclient.TransportConfig
+	Source             httpclient.SourceConfig
+	Resolver           httpclient.ResolverConfig
+	Record             httpclient.RecordConfig
+	Log                logging.Config
+	Overrides          overrides.Config
+	Status             exitstatus.Config
+	Metrics            selfmetrics.Config
+}
+
+// HAR is the subset of the HTTP Archive format used for replay.
+type HAR struct {
+	Log struct {
+		Entries []Entry `json:"entries"`
+	} `json:"log"`
+}
+
+// Entry is a single recorded request and response.
+type Entry struct {
+	Time    float64 `json:"time"`
+	Request struct {
+		Method   string `json:"method"`
+		URL      string `json:"url"`
+		Headers  []Pair `json:"headers"`
+		PostData *struct {
+			MimeType string `json:"mimeType"`
+			Text     string `json:"text"`
+		} `json:"postData"`
+	} `json:"request"`
+	Response struct {
+		Status int `json:"status"`
+	} `json:"response"`
+}
+
+// Pair is a HAR name/value pair.
+type Pair struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// replayResult is the outcome of replaying a single entry.
+type replayResult struct {
+	Entry    Entry
+	Status   int
+	Duration time.Duration
+	Err      error
+}
+
+var (
+	tlsConfig    tls.Config
+	slack        time.Duration
+	includeRegex *regexp.Regexp
+	excludeRegex *regexp.Regexp
+	entries      []Entry
+
+	// skipHeaders are recorded request headers that are set by the client
+	// itself and so are not replayed. HTTP/2 pseudo headers are also skipped.
+	skipHeaders = map[string]bool{
+		"host":              true,
+		"content-length":    true,
+		"connection":        true,
+		"accept-encoding":   true,
+		"transfer-encoding": true,
+	}
+
+	plugin = Config{
+		PluginConfig: sensu.PluginConfig{
+			Name:     "http-har",
+			Short:    "HTTP HAR Replay Check",
+			Keyspace: "sensu.io/plugins/http-har/config",
+		},
+	}
+
+	options = []*sensu.PluginConfigOption{
+		{
+			Path:      "har-file",
+			Env:       "CHECK_HAR_FILE",
+			Argument:  "har-file",
+			Shorthand: "f",
+			Default:   "",
+			Usage:     "HAR file containing the requests to replay",
+			Value:     &plugin.HARFile,
+		},
+		{
+			Path:      "origin",
+			Env:       "",
+			Argument:  "origin",
+			Shorthand: "o",
+			Default:   "",
+			Usage:     "Only replay requests to this origin (defaults to the origin of the first request in the HAR file)",
+			Value:     &plugin.Origin,
+		},
+		{
+			Path:      "method",
+			Env:       "",
+			Argument:  "method",
+			Shorthand: "m",
+			Default:   []string{"GET"},
+			Usage:     "HTTP method(s) of the requests to replay",
+			Value:     &plugin.Methods,
+		},
+		{
+			Path:      "include",
+			Env:       "",
+			Argument:  "include",
+			Shorthand: "",
+			Default:   "",
+			Usage:     "Only replay requests with a URL matching this regular expression",
+			Value:     &plugin.Include,
+		},
+		{
+			Path:      "exclude",
+			Env:       "",
+			Argument:  "exclude",
+			Shorthand: "",
+			Default:   "",
+			Usage:     "Do not replay requests with a URL matching this regular expression",
+			Value:     &plugin.Exclude,
+		},
+		{
+			Path:      "limit",
+			Env:       "",
+			Argument:  "limit",
+			Shorthand: "l",
+			Default:   50,
+			Usage:     "Maximum number of requests to replay",
+			Value:     &plugin.Limit,
+		},
+		{
+			Path:      "warning-ratio",
+			Env:       "",
+			Argument:  "warning-ratio",
+			Shorthand: "w",
+			Default:   2.0,
+			Usage:     "Warning if a request takes longer than this multiple of its recorded time",
+			Value:     &plugin.WarningRatio,
+		},
+		{
+			Path:      "critical-ratio",
+			Env:       "",
+			Argument:  "critical-ratio",
+			Shorthand: "c",
+			Default:   5.0,
+			Usage:     "Critical if a request takes longer than this multiple of its recorded time",
+			Value:     &plugin.CriticalRatio,
+		},
+		{
+			Path:      "slack",
+			Env:       "",
+			Argument:  "slack",
+			Shorthand: "",
+			Default:   "100ms",
+			Usage:     "Time added to the thresholds of every request, so that very fast recorded requests do not trip them",
+			Value:     &plugin.Slack,
+		},
+		{
+			Path:      "insecure-skip-verify",
+			Env:       "",
+			Argument:  "insecure-skip-verify",
+			Shorthand: "i",
+			Default:   false,
+			Usage:     "Skip TLS certificate verification (not recommended!)",
+			Value:     &plugin.InsecureSkipVerify,
+		},
+		{
+			Path:      "trusted-ca-file",
+			Env:       "",
+			Argument:  "trusted-ca-file",
+			Shorthand: "t",
+			Default:   "",
+			Usage:     "TLS CA certificate bundle in PEM format, or a directory of them",
+			Value:     &plugin.TrustedCAFile,
+		},
+		{
+			Path:      "use-system-cas-plus",
+			Env:       "",
+			Argument:  "use-system-cas-plus",
+			Shorthand: "",
+			Default:   false,
+			Usage:     "Add the CA certificates from --trusted-ca-file to the system trust store rather than replacing it",
+			Value:     &plugin.UseSystemCAsPlus,
+		},
+		{
+			Path:      "timeout",
+			Env:       "",
+			Argument:  "timeout",
+			Shorthand: "T",
+			Default:   15,
+			Usage:     "Request timeout in seconds, applied to each request",
+			Value:     &plugin.Timeout,
+		},
+		{
+			Path:      "header",
+			Env:       "",
+			Argument:  "header",
+			Shorthand: "H",
+			Default:   []string{},
+			Usage:     "Additional header(s) to send with every request, replacing recorded headers of the same name",
+			Value:     &plugin.Headers,
+		},
+		{
+			Path:      "mtls-key-file",
+			Env:       "",
+			Argument:  "mtls-key-file",
+			Shorthand: "K",
+			Default:   "",
+			Usage:     "Key file for mutual TLS auth in PEM format",
+			Value:     &plugin.MTLSKeyFile,
+		},
+		{
+			Path:      "mtls-cert-file",
+			Env:       "",
+			Argument:  "mtls-cert-file",
+			Shorthand: "C",
+			Default:   "",
+			Usage:     "Certificate file for mutual TLS auth in PEM format",
+			Value:     &plugin.MTLSCertFile,
+		},
+	}
+)
+
+func main() {
+	options = append(options, plugin.Proxy.Options()...)
+	options = append(options, plugin.Transport.Options()...)
+	options = append(options, plugin.Source.Options()...)
+	options = append(options, plugin.Resolver.Options()...)
+	options = append(options, plugin.HeadersFile.Options()...)
+	options = append(options, plugin.Record.Options()...)
+	options = append(options, plugin.Log.Options()...)
+	options = append(options, plugin.Overrides.Options()...)
+	options = append(options, plugin.Status.Options()...)
+	options = append(options, plugin.Metrics.Options()...)
+	buildinfo.Handle(plugin.PluginConfig.Name, options, os.Args[1:])
+	exitstatus.ParseFlags(plugin.PluginConfig.Name, options, os.Args[1:])
+	check := sensu.NewGoCheck(&plugin.PluginConfig, options, plugin.Status.Wrap(plugin.PluginConfig.Name, checkArgs), plugin.Record.Wrap(plugin.PluginConfig.Name, plugin.Metrics.Wrap(plugin.PluginConfig.Name, plugin.Status.Wrap(plugin.PluginConfig.Name, executeCheck))), overrides.Requested(os.Args[1:]))
+	check.Execute()
+}
+
+func checkArgs(event *corev2.Event) (int, error) {
+	if err := plugin.Log.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+
+	var err error
+
+	if len(plugin.HARFile) == 0 {
+		return sensu.CheckStateUnknown, fmt.Errorf("--har-file or CHECK_HAR_FILE environment variable is required")
+	}
+	headers, err := plugin.HeadersFile.Headers(event)
+	if err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	plugin.Headers = append(headers, plugin.Headers...)
+	if len(plugin.Headers) > 0 {
+		for _, header := range plugin.Headers {
+			headerSplit := strings.SplitN(header, ":", 2)
+			if len(headerSplit) != 2 {
+				return sensu.CheckStateUnknown, fmt.Errorf("--header %q value malformed should be \"Header-Name: Header Value\"", header)
+			}
+		}
+	}
+	if plugin.Limit < 1 {
+		return sensu.CheckStateUnknown, fmt.Errorf("--limit must be 1 or greater")
+	}
+	if plugin.WarningRatio <= 0 || plugin.CriticalRatio < plugin.WarningRatio {
+		return sensu.CheckStateUnknown, fmt.Errorf("--warning-ratio must be greater than 0 and --critical-ratio must be greater than or equal to it")
+	}
+	slack, err = time.ParseDuration(plugin.Slack)
+	if err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	includeRegex, excludeRegex = nil, nil
+	if len(plugin.Include) > 0 {
+		includeRegex, err = regexp.Compile(plugin.Include)
+		if err != nil {
+			return sensu.CheckStateUnknown, fmt.Errorf("--include %q is not a valid regular expression: %v", plugin.Include, err)
+		}
+	}
+	if len(plugin.Exclude) > 0 {
+		excludeRegex, err = regexp.Compile(plugin.Exclude)
+		if err != nil {
+			return sensu.CheckStateUnknown, fmt.Errorf("--exclude %q is not a valid regular expression: %v", plugin.Exclude, err)
+		}
+	}
+	if len(plugin.TrustedCAFile) > 0 {
+		caCertPool, err := httpclient.LoadCACerts(plugin.TrustedCAFile, plugin.UseSystemCAsPlus)
+		if err != nil {
+			return sensu.CheckStateUnknown, fmt.Errorf("Error loading specified CA file: %v", err)
+		}
+		tlsConfig.RootCAs = caCertPool
+	}
+	tlsConfig.InsecureSkipVerify = plugin.InsecureSkipVerify
+
+	if (len(plugin.MTLSKeyFile) > 0 && len(plugin.MTLSCertFile) == 0) || (len(plugin.MTLSCertFile) > 0 && len(plugin.MTLSKeyFile) == 0) {
+		return sensu.CheckStateUnknown, fmt.Errorf("mTLS auth requires both --mtls-key-file and --mtls-cert-file")
+	}
+	if len(plugin.MTLSKeyFile) > 0 && len(plugin.MTLSCertFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(plugin.MTLSCertFile, plugin.MTLSKeyFile)
+		if err != nil {
+			return sensu.CheckStateUnknown, fmt.Errorf("Failed to load mTLS key pair %s/%s: %v", plugin.MTLSCertFile, plugin.MTLSKeyFile, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	data, err := ioutil.ReadFile(plugin.HARFile)
+	if err != nil {
+		return sensu.CheckStateUnknown, fmt.Errorf("Failed to read HAR file %s: %v", plugin.HARFile, err)
+	}
+	var har HAR
+	if err := json.Unmarshal(data, &har); err != nil {
+		return sensu.CheckStateUnknown, fmt.Errorf("Failed to parse HAR file %s: %v", plugin.HARFile, err)
+	}
+	entries, err = filterEntries(har.Log.Entries)
+	if err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	if len(entries) == 0 {
+		return sensu.CheckStateUnknown, fmt.Errorf("no requests in HAR file %s match the filters", plugin.HARFile)
+	}
+
+	if err := plugin.Proxy.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	if err := plugin.Transport.Validate(&plugin.Proxy); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	if err := plugin.Source.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	if err := plugin.Resolver.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+
+	if err := plugin.Record.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+
+	return sensu.CheckStateOK, nil
+}
+
+func executeCheck(event *corev2.Event) (int, error) {
+
+	// The recorded entries include any redirects as separate requests, so the
+	// recorded status is compared to the first response.
+	client := httpclient.New(&tlsConfig, time.Duration(plugin.Timeout)*time.Second, false, plugin.Proxy.Configure, plugin.Source.Configure, plugin.Resolver.Configure, plugin.Transport.Configure)
+
+	status := sensu.CheckStateOK
+	mismatches, slow := []string{}, []string{}
+	var total time.Duration
+	for _, entry := range entries {
+		result := replay(client, entry)
+		total += result.Duration
+		if result.Err != nil {
+			mismatches = append(mismatches, fmt.Sprintf("%s %s (%v)", entry.Request.Method, entry.Request.URL, httpclient.Describe(result.Err)))
+			status = sensu.CheckStateCritical
+			continue
+		}
+		if result.Status != entry.Response.Status {
+			mismatches = append(mismatches, fmt.Sprintf("%s %s (%d, recorded %d)", entry.Request.Method, entry.Request.URL, result.Status, entry.Response.Status))
+			status = sensu.CheckStateCritical
+			continue
+		}
+		recorded := time.Duration(entry.Time * float64(time.Millisecond))
+		switch {
+		case result.Duration > threshold(recorded, plugin.CriticalRatio):
+			status = sensu.CheckStateCritical
+		case result.Duration > threshold(recorded, plugin.WarningRatio):
+			if status == sensu.CheckStateOK {
+				status = sensu.CheckStateWarning
+			}
+		default:
+			continue
+		}
+		slow = append(slow, fmt.Sprintf("%s %s (%dms, recorded %dms)", entry.Request.Method, entry.Request.URL, result.Duration.Milliseconds(), recorded.Milliseconds()))
+	}
+
+	perfdata := fmt.Sprintf("requests=%d, status_mismatches=%d, slow_requests=%d, total_duration=%0.6f", len(entries), len(mismatches), len(slow), total.Seconds())
+	summary := fmt.Sprintf("%d requests replayed from %s", len(entries), plugin.HARFile)
+	if len(mismatches) > 0 {
+		summary = fmt.Sprintf("%s, status mismatches: %s", summary, strings.Join(mismatches, ", "))
+	}
+	if len(slow) > 0 {
+		summary = fmt.Sprintf("%s, slow: %s", summary, strings.Join(slow, ", "))
+	}
+
+	fmt.Fprintf(selfmetrics.Stdout, "%s %s: %s | %s\n", plugin.PluginConfig.Name, stateName(status), summary, perfdata)
+	return status, nil
+}
+
+// filterEntries returns the entries to replay, limited to the origin, methods
+// and URL patterns provided, and to --limit entries. Entries without a
+// recorded response (status 0, e.g. blocked or cancelled) are skipped.
+func filterEntries(all []Entry) ([]Entry, error) {
+	origin := plugin.Origin
+	if len(origin) == 0 && len(all) > 0 {
+		u, err := url.Parse(all[0].Request.URL)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse URL of first HAR entry: %v", err)
+		}
+		origin = u.Scheme + "://" + u.Host
+	}
+	origin = strings.TrimSuffix(strings.ToLower(origin), "/")
+
+	filtered := []Entry{}
+	for _, entry := range all {
+		if len(filtered) == plugin.Limit {
+			break
+		}
+		u, err := url.Parse(entry.Request.URL)
+		if err != nil || strings.ToLower(u.Scheme+"://"+u.Host) != origin {
+			continue
+		}
+		if !containsFold(plugin.Methods, entry.Request.Method) || entry.Response.Status == 0 {
+			continue
+		}
+		if includeRegex != nil && !includeRegex.MatchString(entry.Request.URL) {
+			continue
+		}
+		if excludeRegex != nil && excludeRegex.MatchString(entry.Request.URL) {
+			continue
+		}
+		filtered = append(filtered, entry)
+	}
+	return filtered, nil
+}
+
+// replay sends the recorded request, returning the response status and the
+// time taken to read the full response.
+func replay(client *http.Client, entry Entry) replayResult {
+	result := replayResult{Entry: entry}
+
+	var body io.Reader
+	if entry.Request.PostData != nil {
+		body = strings.NewReader(entry.Request.PostData.Text)
+	}
+	req, err := http.NewRequest(entry.Request.Method, entry.Request.URL, body)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	for _, header := range entry.Request.Headers {
+		if strings.HasPrefix(header.Name, ":") || skipHeaders[strings.ToLower(header.Name)] {
+			continue
+		}
+		req.Header.Add(header.Name, header.Value)
+	}
+	if entry.Request.PostData != nil && len(entry.Request.PostData.MimeType) > 0 {
+		req.Header.Set("Content-Type", entry.Request.PostData.MimeType)
+	}
+	for _, header := range plugin.Headers {
+		headerSplit := strings.SplitN(header, ":", 2)
+		headerKey := strings.TrimSpace(headerSplit[0])
+		headerValue := strings.TrimSpace(headerSplit[1])
+		if strings.EqualFold(headerKey, "host") {
+			req.Host = headerValue
+			continue
+		}
+		req.Header.Set(headerKey, headerValue)
+	}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		result.Duration = time.Since(start)
+		result.Err = err
+		return result
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(ioutil.Discard, resp.Body)
+	result.Duration = time.Since(start)
+	result.Status = resp.StatusCode
+	result.Err = err
+	return result
+}
+
+// threshold returns the longest acceptable duration for a request recorded as
+// taking recorded.
+func threshold(recorded time.Duration, ratio float64) time.Duration {
+	return time.Duration(float64(recorded)*ratio) + slack
+}
+
+func containsFold(values []string, s string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func stateName(status int) string {
+	switch status {
+	case sensu.CheckStateOK:
+		return "OK"
+	case sensu.CheckStateWarning:
+		return "WARNING"
+	case sensu.CheckStateCritical:
+		return "CRITICAL"
+	}
+	return "UNKNOWN"
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	corev2 "github.com/sensu/sensu-go/api/core/v2"
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMain(t *testing.T) {
+}
+
+func writeHAR(t *testing.T, dir, base string, entries string) string {
+	path := filepath.Join(dir, "test.har")
+	har := fmt.Sprintf(`{"log": {"version": "1.2", "entries": [%s]}}`, strings.Replace(entries, "BASE", base, -1))
+	require.NoError(t, ioutil.WriteFile(path, []byte(har), 0644))
+	return path
+}
+
+func TestExecuteCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "http-har")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		assert.Equal(t, "text/html", r.Header.Get("Accept"))
+		assert.Empty(t, r.Header.Get(":authority"))
+		_, _ = w.Write([]byte("<html></html>"))
+	})
+	mux.HandleFunc("/old", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/", http.StatusMovedPermanently)
+	})
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(60 * time.Millisecond)
+	})
+	mux.HandleFunc("/api/login", func(w http.ResponseWriter, r *http.Request) {
+		t.Error("POST requests should not be replayed by default")
+	})
+	test := httptest.NewServer(mux)
+	defer test.Close()
+
+	page := `{"time": 50, "request": {"method": "GET", "url": "BASE/", "headers": [{"name": ":authority", "value": "example.com"}, {"name": "Accept", "value": "text/html"}]}, "response": {"status": 200}}`
+	redirect := `{"time": 50, "request": {"method": "GET", "url": "BASE/old", "headers": []}, "response": {"status": 301}}`
+	missing := `{"time": 50, "request": {"method": "GET", "url": "BASE/missing", "headers": []}, "response": {"status": 200}}`
+	slow := `{"time": 10, "request": {"method": "GET", "url": "BASE/slow", "headers": []}, "response": {"status": 200}}`
+	post := `{"time": 50, "request": {"method": "POST", "url": "BASE/api/login", "headers": [], "postData": {"mimeType": "application/json", "text": "{}"}}, "response": {"status": 200}}`
+	other := `{"time": 50, "request": {"method": "GET", "url": "https://cdn.example.com/app.js", "headers": []}, "response": {"status": 200}}`
+	blocked := `{"time": 0, "request": {"method": "GET", "url": "BASE/blocked", "headers": []}, "response": {"status": 0}}`
+
+	testCases := []struct {
+		returnStatus  int
+		entries       string
+		criticalRatio float64
+	}{
+		{sensu.CheckStateOK, page + "," + redirect + "," + post + "," + other + "," + blocked, 5},
+		{sensu.CheckStateCritical, page + "," + missing + "," + redirect + "," + post + "," + blocked, 5},
+		{sensu.CheckStateWarning, page + "," + slow + "," + redirect + "," + post + "," + blocked, 10},
+		{sensu.CheckStateCritical, page + "," + slow + "," + redirect + "," + post + "," + blocked, 2},
+	}
+
+	for _, tc := range testCases {
+		assert := assert.New(t)
+		event := corev2.FixtureEvent("entity1", "check")
+		plugin.HARFile = writeHAR(t, dir, test.URL, tc.entries)
+		plugin.Origin = ""
+		plugin.Methods = []string{"GET"}
+		plugin.Limit = 50
+		plugin.WarningRatio = 1
+		plugin.CriticalRatio = tc.criticalRatio
+		plugin.Slack = "30ms"
+		status, err := checkArgs(event)
+		assert.NoError(err)
+		assert.Equal(sensu.CheckStateOK, status)
+		status, err = executeCheck(event)
+		assert.NoError(err)
+		assert.Equal(tc.returnStatus, status)
+	}
+}
+
+func TestFilterEntries(t *testing.T) {
+	assert := assert.New(t)
+	entry := func(method, url string, status int) Entry {
+		var e Entry
+		e.Request.Method = method
+		e.Request.URL = url
+		e.Response.Status = status
+		return e
+	}
+	all := []Entry{
+		entry("GET", "https://example.com/", 200),
+		entry("get", "https://EXAMPLE.com/about", 200),
+		entry("POST", "https://example.com/api", 201),
+		entry("GET", "https://cdn.example.com/app.js", 200),
+		entry("GET", "https://example.com/static/app.css", 200),
+		entry("GET", "https://example.com/cancelled", 0),
+	}
+
+	plugin.Origin = ""
+	plugin.Methods = []string{"GET"}
+	plugin.Limit = 50
+	includeRegex, excludeRegex = nil, nil
+	filtered, err := filterEntries(all)
+	require.NoError(t, err)
+	assert.Len(filtered, 3)
+
+	plugin.Methods = []string{"GET", "POST"}
+	plugin.Limit = 2
+	filtered, err = filterEntries(all)
+	require.NoError(t, err)
+	assert.Len(filtered, 2)
+
+	plugin.Origin = "https://cdn.example.com"
+	plugin.Limit = 50
+	filtered, err = filterEntries(all)
+	require.NoError(t, err)
+	assert.Len(filtered, 1)
+	plugin.Origin = ""
+}
+
+func TestCheckArgs(t *testing.T) {
+	assert := assert.New(t)
+	event := corev2.FixtureEvent("entity1", "check")
+
+	dir, err := ioutil.TempDir("", "http-har")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	plugin.HARFile = writeHAR(t, dir, "https://example.com", `{"time": 50, "request": {"method": "POST", "url": "BASE/", "headers": []}, "response": {"status": 200}}`)
+	plugin.Methods = []string{"GET"}
+	plugin.Limit = 50
+	plugin.WarningRatio = 2
+	plugin.CriticalRatio = 5
+	plugin.Slack = "100ms"
+	status, err := checkArgs(event)
+	assert.Error(err)
+	assert.Equal(sensu.CheckStateUnknown, status)
+
+	plugin.Methods = []string{"POST"}
+	plugin.CriticalRatio = 1
+	status, err = checkArgs(event)
+	assert.Error(err)
+	assert.Equal(sensu.CheckStateUnknown, status)
+
+	plugin.CriticalRatio = 5
+	plugin.Include = "("
+	status, err = checkArgs(event)
+	assert.Error(err)
+	assert.Equal(sensu.CheckStateUnknown, status)
+	plugin.Include = ""
+}
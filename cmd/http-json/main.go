@@ -5,38 +5,109 @@
 package main
 
 import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
+	"math/big"
 	"net/http"
 	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"text/scanner"
 	"time"
 
 	"github.com/PaesslerAG/gval"
 	"github.com/itchyny/gojq"
+	"github.com/nixwiz/http-checks/internal/auth"
+	"github.com/nixwiz/http-checks/internal/buildinfo"
+	"github.com/nixwiz/http-checks/internal/exitstatus"
+	"github.com/nixwiz/http-checks/internal/httpclient"
+	"github.com/nixwiz/http-checks/internal/logging"
+	"github.com/nixwiz/http-checks/internal/overrides"
+	"github.com/nixwiz/http-checks/internal/policy"
+	"github.com/nixwiz/http-checks/internal/selfmetrics"
 	corev2 "github.com/sensu/sensu-go/api/core/v2"
 	"github.com/sensu/sensu-plugin-sdk/sensu"
 )
 
+// stateEntry is the value of the previous run persisted in the state file.
+type stateEntry struct {
+	URL   string          `json:"url"`
+	Query string          `json:"query"`
+	Value json.RawMessage `json:"value"`
+	Time  time.Time       `json:"time"`
+}
+
+// stateValue is the value of the previous run and when it was measured.
+type stateValue struct {
+	value interface{}
+	time  time.Time
+}
+
 // Config represents the check plugin config.
 type Config struct {
 	sensu.PluginConfig
 	URL                string
 	TrustedCAFile      string
+	UseSystemCAsPlus   bool
 	InsecureSkipVerify bool
 	Timeout            int
 	Query              string
+	QueryLanguage      string
 	Expression         string
+	DefaultValue       string
+	StateFile          string
 	Headers            []string
+	HeadersFile        httpclient.HeadersFileConfig
 	MTLSKeyFile        string
 	MTLSCertFile       string
+	AcceptEncoding     string
+	GoldenFile         string
+	IgnorePaths        []string
+	Auth               auth.Config
+	Proxy              httpclient.ProxyConfig
+	Transport          httpclient.TransportConfig
+	Source             httpclient.SourceConfig
+	Resolver           httpclient.ResolverConfig
+	URLParsing         httpclient.URLConfig
+	Policy             policy.Config
+	Record             httpclient.RecordConfig
+	Log                logging.Config
+	Overrides          overrides.Config
+	Status             exitstatus.Config
+	Metrics            selfmetrics.Config
 }
 
 var (
 	tlsConfig tls.Config
 
+	// golden is the decoded --expect-body-json-equal file, nil if not set.
+	golden      interface{}
+	ignorePaths [][]string
+	// defaultValue is the decoded --default-value, used if hasDefault.
+	defaultValue interface{}
+	hasDefault   bool
+
+	// stateVariables matches the variables of an expression that come from
+	// the previous run, stringLiterals the strings of an expression, and
+	// fullExpression an expression that starts with a variable rather than
+	// with the operator applied to the value.
+	stateVariables = regexp.MustCompile(`\b(previous|delta|rate)\b`)
+	stringLiterals = regexp.MustCompile("\"(?:[^\"\\\\]|\\\\.)*\"|'(?:[^'\\\\]|\\\\.)*'|`[^`]*`")
+	fullExpression = regexp.MustCompile(`^\s*(value|previous|delta|rate)\b`)
+
 	plugin = Config{
 		PluginConfig: sensu.PluginConfig{
 			Name:     "http-json",
@@ -70,9 +141,18 @@ var (
 			Argument:  "trusted-ca-file",
 			Shorthand: "t",
 			Default:   "",
-			Usage:     "TLS CA certificate bundle in PEM format",
+			Usage:     "TLS CA certificate bundle in PEM format, or a directory of them",
 			Value:     &plugin.TrustedCAFile,
 		},
+		{
+			Path:      "use-system-cas-plus",
+			Env:       "",
+			Argument:  "use-system-cas-plus",
+			Shorthand: "",
+			Default:   false,
+			Usage:     "Add the CA certificates from --trusted-ca-file to the system trust store rather than replacing it",
+			Value:     &plugin.UseSystemCAsPlus,
+		},
 		{
 			Path:      "timeout",
 			Env:       "",
@@ -91,6 +171,15 @@ var (
 			Usage:     "Query written in jq format",
 			Value:     &plugin.Query,
 		},
+		{
+			Path:      "query-language",
+			Env:       "",
+			Argument:  "query-language",
+			Shorthand: "",
+			Default:   "jq",
+			Usage:     "Language of --query, one of jq, jsonpath and dot (e.g. items(0).name)",
+			Value:     &plugin.QueryLanguage,
+		},
 		{
 			Path:      "expression",
 			Env:       "",
@@ -100,6 +189,24 @@ var (
 			Usage:     "Expression for comparing result of query",
 			Value:     &plugin.Expression,
 		},
+		{
+			Path:      "default-value",
+			Env:       "",
+			Argument:  "default-value",
+			Shorthand: "",
+			Default:   "",
+			Usage:     "JSON value (e.g. 0 or \"down\") to evaluate --expression against when the key of --query is absent, instead of going critical",
+			Value:     &plugin.DefaultValue,
+		},
+		{
+			Path:      "state-file",
+			Env:       "",
+			Argument:  "state-file",
+			Shorthand: "",
+			Default:   "",
+			Usage:     "File to keep the value in between runs, making previous, delta and rate (per second) available to --expression (e.g. \"delta > 100\")",
+			Value:     &plugin.StateFile,
+		},
 		{
 			Path:      "header",
 			Env:       "",
@@ -127,77 +234,215 @@ var (
 			Usage:     "Certificate file for mutual TLS auth in PEM format",
 			Value:     &plugin.MTLSCertFile,
 		},
+		{
+			Path:      "accept-encoding",
+			Env:       "",
+			Argument:  "accept-encoding",
+			Shorthand: "",
+			Default:   "",
+			Usage:     "Accept-Encoding header to send, of gzip, deflate and identity (e.g. \"gzip, deflate\"), by default gzip is requested",
+			Value:     &plugin.AcceptEncoding,
+		},
+		{
+			Path:      "expect-body-json-equal",
+			Env:       "",
+			Argument:  "expect-body-json-equal",
+			Shorthand: "",
+			Default:   "",
+			Usage:     "Golden JSON file the whole response body must be equal to, --query and --expression are optional with it",
+			Value:     &plugin.GoldenFile,
+		},
+		{
+			Path:      "ignore-path",
+			Env:       "",
+			Argument:  "ignore-path",
+			Shorthand: "",
+			Default:   []string{},
+			Usage:     "Path(s) to ignore when comparing with --expect-body-json-equal, e.g. .meta.timestamp or .items[].id",
+			Value:     &plugin.IgnorePaths,
+		},
 	}
 )
 
 func main() {
-	check := sensu.NewGoCheck(&plugin.PluginConfig, options, checkArgs, executeCheck, false)
+	options = append(options, plugin.Auth.Options()...)
+	options = append(options, plugin.Proxy.Options()...)
+	options = append(options, plugin.Transport.Options()...)
+	options = append(options, plugin.Source.Options()...)
+	options = append(options, plugin.Resolver.Options()...)
+	options = append(options, plugin.URLParsing.Options()...)
+	options = append(options, plugin.HeadersFile.Options()...)
+	options = append(options, plugin.Policy.Options()...)
+	options = append(options, plugin.Record.Options()...)
+	options = append(options, plugin.Log.Options()...)
+	options = append(options, plugin.Overrides.Options()...)
+	options = append(options, plugin.Status.Options()...)
+	options = append(options, plugin.Metrics.Options()...)
+	buildinfo.Handle(plugin.PluginConfig.Name, options, os.Args[1:])
+	exitstatus.ParseFlags(plugin.PluginConfig.Name, options, os.Args[1:])
+	check := sensu.NewGoCheck(&plugin.PluginConfig, options, plugin.Status.Wrap(plugin.PluginConfig.Name, checkArgs), plugin.Record.Wrap(plugin.PluginConfig.Name, plugin.Metrics.Wrap(plugin.PluginConfig.Name, plugin.Status.Wrap(plugin.PluginConfig.Name, executeCheck))), overrides.Requested(os.Args[1:]))
 	check.Execute()
 }
 
 func checkArgs(event *corev2.Event) (int, error) {
+	if err := plugin.Log.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	if err := plugin.URLParsing.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+
 	if len(plugin.URL) == 0 {
-		return sensu.CheckStateWarning, fmt.Errorf("--url or CHECK_URL environment variable is required")
+		return sensu.CheckStateUnknown, fmt.Errorf("--url or CHECK_URL environment variable is required")
+	}
+	headers, err := plugin.HeadersFile.Headers(event)
+	if err != nil {
+		return sensu.CheckStateUnknown, err
 	}
+	plugin.Headers = append(headers, plugin.Headers...)
 	if len(plugin.Headers) > 0 {
 		for _, header := range plugin.Headers {
 			headerSplit := strings.SplitN(header, ":", 2)
 			if len(headerSplit) != 2 {
-				return sensu.CheckStateWarning, fmt.Errorf("--header %q value malformed should be \"Header-Name: Header Value\"", header)
+				return sensu.CheckStateUnknown, fmt.Errorf("--header %q value malformed should be \"Header-Name: Header Value\"", header)
 			}
 		}
 	}
 	if len(plugin.TrustedCAFile) > 0 {
-		caCertPool, err := corev2.LoadCACerts(plugin.TrustedCAFile)
+		caCertPool, err := httpclient.LoadCACerts(plugin.TrustedCAFile, plugin.UseSystemCAsPlus)
 		if err != nil {
-			return sensu.CheckStateWarning, fmt.Errorf("Error loading specified CA file")
+			return sensu.CheckStateUnknown, fmt.Errorf("Error loading specified CA file: %v", err)
 		}
 		tlsConfig.RootCAs = caCertPool
 	}
 	tlsConfig.InsecureSkipVerify = plugin.InsecureSkipVerify
 
 	if (len(plugin.MTLSKeyFile) > 0 && len(plugin.MTLSCertFile) == 0) || (len(plugin.MTLSCertFile) > 0 && len(plugin.MTLSKeyFile) == 0) {
-		return sensu.CheckStateWarning, fmt.Errorf("mTLS auth requires both --mtls-key-file and --mtls-cert-file")
+		return sensu.CheckStateUnknown, fmt.Errorf("mTLS auth requires both --mtls-key-file and --mtls-cert-file")
 	}
 	if len(plugin.MTLSKeyFile) > 0 && len(plugin.MTLSCertFile) > 0 {
 		cert, err := tls.LoadX509KeyPair(plugin.MTLSCertFile, plugin.MTLSKeyFile)
 		if err != nil {
-			return sensu.CheckStateWarning, fmt.Errorf("Failed to load mTLS key pair %s/%s: %v", plugin.MTLSCertFile, plugin.MTLSKeyFile, err)
+			return sensu.CheckStateUnknown, fmt.Errorf("Failed to load mTLS key pair %s/%s: %v", plugin.MTLSCertFile, plugin.MTLSKeyFile, err)
 		}
 		tlsConfig.Certificates = []tls.Certificate{cert}
 	}
 
-	if len(plugin.Query) == 0 {
-		return sensu.CheckStateWarning, fmt.Errorf("--query is required")
+	for _, coding := range strings.Split(plugin.AcceptEncoding, ",") {
+		coding = strings.ToLower(strings.TrimSpace(strings.SplitN(coding, ";", 2)[0]))
+		switch coding {
+		case "", "gzip", "x-gzip", "deflate", "identity":
+		default:
+			return sensu.CheckStateUnknown, fmt.Errorf("--accept-encoding %q is not supported, must be gzip, deflate or identity", coding)
+		}
+	}
+
+	golden, ignorePaths = nil, nil
+	if len(plugin.GoldenFile) > 0 {
+		data, err := ioutil.ReadFile(plugin.GoldenFile)
+		if err != nil {
+			return sensu.CheckStateUnknown, fmt.Errorf("Error reading --expect-body-json-equal file: %v", err)
+		}
+		if golden, err = unmarshalJSON(data); err != nil {
+			return sensu.CheckStateUnknown, fmt.Errorf("Error decoding --expect-body-json-equal file %s: %v", plugin.GoldenFile, err)
+		}
+		for _, path := range plugin.IgnorePaths {
+			segments, err := parsePath(path)
+			if err != nil {
+				return sensu.CheckStateUnknown, fmt.Errorf("--ignore-path %q: %v", path, err)
+			}
+			ignorePaths = append(ignorePaths, segments)
+		}
+	} else if len(plugin.IgnorePaths) > 0 {
+		return sensu.CheckStateUnknown, fmt.Errorf("--ignore-path requires --expect-body-json-equal")
+	}
+
+	usePolicy := len(plugin.Policy.File) > 0
+	if len(plugin.Expression) > 0 && usePolicy {
+		return sensu.CheckStateUnknown, fmt.Errorf("--expression and --policy-file are mutually exclusive")
+	}
+	if len(plugin.Query) == 0 && (golden == nil || len(plugin.Expression) > 0 || usePolicy) {
+		return sensu.CheckStateUnknown, fmt.Errorf("--query is required")
+	}
+	if len(plugin.Expression) == 0 && !usePolicy && (golden == nil || len(plugin.Query) > 0) {
+		return sensu.CheckStateUnknown, fmt.Errorf("--expression is required")
+	}
+	if len(plugin.StateFile) > 0 && len(plugin.Expression) == 0 {
+		return sensu.CheckStateUnknown, fmt.Errorf("--state-file requires --expression, use --policy-state-file with --policy-file")
+	}
+	if usesState(plugin.Expression) && len(plugin.StateFile) == 0 {
+		return sensu.CheckStateUnknown, fmt.Errorf("--expression using previous, delta or rate requires --state-file")
+	}
+	if _, err := translateQuery(plugin.Query, plugin.QueryLanguage); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	defaultValue, hasDefault = nil, false
+	if len(plugin.DefaultValue) > 0 {
+		var err error
+		if defaultValue, err = parseDefaultValue(plugin.DefaultValue); err != nil {
+			return sensu.CheckStateUnknown, fmt.Errorf("--default-value %q: %v", plugin.DefaultValue, err)
+		}
+		hasDefault = true
+	}
+	if err := plugin.Auth.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	checkURL, err := httpclient.ParseURL("--url", plugin.URL)
+	if err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	if err := plugin.Auth.FromURL("--url", checkURL); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	plugin.URL = checkURL.String()
+
+	if err := plugin.Proxy.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	if err := plugin.Transport.Validate(&plugin.Proxy); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	if err := plugin.Source.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	if err := plugin.Resolver.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+
+	if err := plugin.Policy.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
 	}
-	if len(plugin.Expression) == 0 {
-		return sensu.CheckStateWarning, fmt.Errorf("--expression is required")
+
+	if err := plugin.Record.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
 	}
+
 	return sensu.CheckStateOK, nil
 }
 
 func executeCheck(event *corev2.Event) (int, error) {
 
-	client := http.DefaultClient
-	client.Transport = http.DefaultTransport
-	client.Timeout = time.Duration(plugin.Timeout) * time.Second
+	client := httpclient.New(&tlsConfig, time.Duration(plugin.Timeout)*time.Second, true, plugin.Proxy.Configure, plugin.Source.Configure, plugin.Resolver.Configure, plugin.Transport.Configure)
+	client.Transport = plugin.Auth.RoundTripper(client.Transport)
 
-	checkURL, err := url.Parse(plugin.URL)
+	_, err := url.Parse(plugin.URL)
 	if err != nil {
-		fmt.Printf("url parse error: %s\n", err)
-		return sensu.CheckStateCritical, nil
-	}
-	if checkURL.Scheme == "https" {
-		client.Transport.(*http.Transport).TLSClientConfig = &tlsConfig
+		fmt.Fprintf(selfmetrics.Stdout, "%s UNKNOWN: url parse error: %s\n", plugin.PluginConfig.Name, err)
+		return sensu.CheckStateUnknown, nil
 	}
 
 	req, err := http.NewRequest("GET", plugin.URL, nil)
 	if err != nil {
-		fmt.Printf("request creation error: %s\n", err)
-		return sensu.CheckStateCritical, nil
+		fmt.Fprintf(selfmetrics.Stdout, "%s UNKNOWN: request creation error: %s\n", plugin.PluginConfig.Name, err)
+		return sensu.CheckStateUnknown, nil
 	}
 
 	req.Header.Set("Accept", "application/json")
+	// Setting Accept-Encoding stops the transport from decompressing the
+	// response, decodeBody does that instead.
+	if len(plugin.AcceptEncoding) > 0 {
+		req.Header.Set("Accept-Encoding", plugin.AcceptEncoding)
+	}
 	if len(plugin.Headers) > 0 {
 		for _, header := range plugin.Headers {
 			headerSplit := strings.SplitN(header, ":", 2)
@@ -213,7 +458,7 @@ func executeCheck(event *corev2.Event) (int, error) {
 
 	resp, err := client.Do(req)
 	if err != nil {
-		fmt.Printf("request error: %s\n", err)
+		fmt.Fprintf(selfmetrics.Stdout, "%s CRITICAL: %s\n", plugin.PluginConfig.Name, httpclient.Describe(err))
 		return sensu.CheckStateCritical, nil
 	}
 
@@ -221,32 +466,61 @@ func executeCheck(event *corev2.Event) (int, error) {
 
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		fmt.Printf("read response body error: %s\n", err)
+		fmt.Fprintf(selfmetrics.Stdout, "%s CRITICAL: reading response body: %s\n", plugin.PluginConfig.Name, httpclient.Describe(err))
 		return sensu.CheckStateCritical, nil
 	}
-
-	query, err := gojq.Parse(plugin.Query)
+	body, err = decodeBody(body, resp.Header.Get("Content-Encoding"))
 	if err != nil {
-		fmt.Printf("Failed to parse query %q, error: %v", plugin.Query, err)
+		fmt.Fprintf(selfmetrics.Stdout, "%s CRITICAL: %v at %s\n", plugin.PluginConfig.Name, err, plugin.URL)
 		return sensu.CheckStateCritical, nil
 	}
-	code, err := gojq.Compile(query)
+
+	jsonBody, err := unmarshalJSON(body)
 	if err != nil {
-		fmt.Printf("Failed to compile query %q, error: %v", plugin.Query, err)
+		fmt.Fprintf(selfmetrics.Stdout, "%s CRITICAL: could not unmarshal response body (Content-Type %q) into JSON: %v\n", plugin.PluginConfig.Name, resp.Header.Get("Content-Type"), err)
 		return sensu.CheckStateCritical, nil
 	}
 
-	var jsonBody interface{}
+	// Compared before the query runs, gojq normalizes the numbers of the
+	// body in place.
+	if golden != nil {
+		differences := diffJSON(nil, golden, jsonBody)
+		if len(differences) > 0 {
+			summary := differences
+			if len(summary) > maxDifferences {
+				summary = append(summary[:maxDifferences:maxDifferences], fmt.Sprintf("and %d more", len(differences)-maxDifferences))
+			}
+			fmt.Fprintf(selfmetrics.Stdout, "%s CRITICAL: response body differs from %s in %d place(s): %s\n", plugin.PluginConfig.Name, plugin.GoldenFile, len(differences), strings.Join(summary, "; "))
+			return sensu.CheckStateCritical, nil
+		}
+		if len(plugin.Query) == 0 {
+			fmt.Fprintf(selfmetrics.Stdout, "%s OK: response body matches %s\n", plugin.PluginConfig.Name, plugin.GoldenFile)
+			return sensu.CheckStateOK, nil
+		}
+	}
 
-	err = json.Unmarshal(body, &jsonBody)
+	jqQuery, err := translateQuery(plugin.Query, plugin.QueryLanguage)
 	if err != nil {
-		fmt.Printf("Could not unmarshal response body into JSON: %v", err)
+		return sensu.CheckStateUnknown, err
+	}
+	if jqQuery != plugin.Query {
+		logging.Debug("translated query to jq", "query", plugin.Query, "jq", jqQuery)
+	}
+	query, err := gojq.Parse(jqQuery)
+	if err != nil {
+		fmt.Fprintf(selfmetrics.Stdout, "Failed to parse query %q, error: %v", plugin.Query, err)
+		return sensu.CheckStateCritical, nil
+	}
+	code, err := gojq.Compile(query)
+	if err != nil {
+		fmt.Fprintf(selfmetrics.Stdout, "Failed to compile query %q, error: %v", plugin.Query, err)
 		return sensu.CheckStateCritical, nil
 	}
 
 	iter := code.Run(jsonBody)
 
 	var value interface{}
+	returned := false
 
 	for {
 		var ok bool
@@ -260,29 +534,923 @@ func executeCheck(event *corev2.Event) (int, error) {
 			continue
 		}
 		value = v
+		returned = true
 	}
 
+	at := "found at " + plugin.Query
 	if value == nil {
-		fmt.Printf("%s CRITICAL: No value was returned for query %q\n", plugin.PluginConfig.Name, plugin.Query)
-		return sensu.CheckStateCritical, nil
+		// jq returns null for both a null and an absent key, the path of
+		// the query tells them apart.
+		present, known := keyPresent(jqQuery, jsonBody)
+		switch {
+		case returned && present:
+			fmt.Fprintf(selfmetrics.Stdout, "%s CRITICAL: The key at %s is present but null\n", plugin.PluginConfig.Name, plugin.Query)
+			return sensu.CheckStateCritical, nil
+		case returned && !known:
+			fmt.Fprintf(selfmetrics.Stdout, "%s CRITICAL: The query %s returned null\n", plugin.PluginConfig.Name, plugin.Query)
+			return sensu.CheckStateCritical, nil
+		case !hasDefault && returned:
+			fmt.Fprintf(selfmetrics.Stdout, "%s CRITICAL: The key at %s is absent\n", plugin.PluginConfig.Name, plugin.Query)
+			return sensu.CheckStateCritical, nil
+		case !hasDefault:
+			fmt.Fprintf(selfmetrics.Stdout, "%s CRITICAL: No value was returned for query %q\n", plugin.PluginConfig.Name, plugin.Query)
+			return sensu.CheckStateCritical, nil
+		}
+		logging.Debug("key absent, using --default-value", "query", plugin.Query, "default", plugin.DefaultValue)
+		value = defaultValue
+		at = fmt.Sprintf("defaulted as %s is absent", plugin.Query)
 	}
 
-	found, err := evaluateExpression(value, plugin.Expression)
+	if plugin.Policy.Enabled() {
+		// Policy rules are plain gval expressions, which compare numbers
+		// as float64.
+		policyValue := value
+		if n, ok := value.(*big.Int); ok {
+			policyValue, _ = new(big.Float).SetInt(n).Float64()
+		}
+		status, description, err := plugin.Policy.Evaluate(map[string]interface{}{"value": policyValue})
+		if err != nil {
+			return sensu.CheckStateUnknown, fmt.Errorf("Error evaluating policy: %v", err)
+		}
+		fmt.Fprintf(selfmetrics.Stdout, "%s %s: The value %v %s: %s\n", plugin.PluginConfig.Name, stateName(status), value, at, description)
+		return status, nil
+	}
+
+	variables := map[string]interface{}{}
+	if len(plugin.StateFile) > 0 {
+		now := time.Now()
+		previous, ok := loadState(plugin.StateFile, plugin.URL, plugin.Query)
+		if err := saveState(plugin.StateFile, stateEntry{URL: plugin.URL, Query: plugin.Query, Time: now}, value); err != nil {
+			logging.Warn("failed to write state file", "file", plugin.StateFile, "error", err)
+		}
+		if !ok && usesState(plugin.Expression) {
+			fmt.Fprintf(selfmetrics.Stdout, "%s OK:  The value %v %s is stored in %s, expression %q needs the value of a previous run\n", plugin.PluginConfig.Name, value, at, plugin.StateFile, plugin.Expression)
+			return sensu.CheckStateOK, nil
+		}
+		if ok {
+			variables = stateVariableValues(value, previous, now)
+		}
+	}
+
+	found, err := evaluateExpression(value, plugin.Expression, variables)
 	if err != nil {
-		return sensu.CheckStateCritical, fmt.Errorf("Error evaluating expression: %v", err)
+		return sensu.CheckStateUnknown, fmt.Errorf("Error evaluating expression: %v", err)
 	}
 	if found {
-		fmt.Printf("%s OK:  The value %v found at %s matched with expression %q and returned true\n", plugin.PluginConfig.Name, value, plugin.Query, plugin.Expression)
+		fmt.Fprintf(selfmetrics.Stdout, "%s OK:  The value %v %s matched with expression %q and returned true\n", plugin.PluginConfig.Name, value, at, plugin.Expression)
 		return sensu.CheckStateOK, nil
 	}
 
-	fmt.Printf("%s CRITICAL: The value %v found at %s did not match with expression %q and returned false\n", plugin.PluginConfig.Name, value, plugin.Query, plugin.Expression)
+	fmt.Fprintf(selfmetrics.Stdout, "%s CRITICAL: The value %v %s did not match with expression %q and returned false\n", plugin.PluginConfig.Name, value, at, plugin.Expression)
 	return sensu.CheckStateCritical, nil
 }
-func evaluateExpression(actualValue interface{}, expression string) (bool, error) {
-	evalResult, err := gval.Evaluate("value "+expression, map[string]interface{}{"value": actualValue})
+
+func stateName(status int) string {
+	switch status {
+	case sensu.CheckStateOK:
+		return "OK"
+	case sensu.CheckStateWarning:
+		return "WARNING"
+	case sensu.CheckStateCritical:
+		return "CRITICAL"
+	}
+	return "UNKNOWN"
+}
+
+// keyPresent reports whether the last path of jqQuery exists in body, known
+// is false if jqQuery is not a path expression (e.g. .items | length).
+func keyPresent(jqQuery string, body interface{}) (present, known bool) {
+	query, err := gojq.Parse("path(" + jqQuery + ")")
+	if err != nil {
+		return false, false
+	}
+	code, err := gojq.Compile(query)
+	if err != nil {
+		return false, false
+	}
+	var path []interface{}
+	iter := code.Run(body)
+	for {
+		v, ok := iter.Next()
+		if !ok {
+			break
+		}
+		p, ok := v.([]interface{})
+		if !ok {
+			// An error, the query is not a path expression.
+			return false, false
+		}
+		path = p
+	}
+	if path == nil {
+		return false, false
+	}
+	node := body
+	for _, step := range path {
+		switch key := step.(type) {
+		case string:
+			object, ok := node.(map[string]interface{})
+			if !ok {
+				return false, true
+			}
+			if node, ok = object[key]; !ok {
+				return false, true
+			}
+		case int:
+			array, ok := node.([]interface{})
+			if !ok {
+				return false, true
+			}
+			if key < 0 {
+				key += len(array)
+			}
+			if key < 0 || key >= len(array) {
+				return false, true
+			}
+			node = array[key]
+		default:
+			// Slices, which are never null.
+			return false, false
+		}
+	}
+	return true, true
+}
+
+// parseDefaultValue decodes --default-value as JSON, normalized as gojq does
+// with the values it returns, or as a string if it is not JSON.
+func parseDefaultValue(s string) (interface{}, error) {
+	v, err := unmarshalJSON([]byte(s))
+	if err != nil {
+		return s, nil
+	}
+	identity, err := gojq.Parse(".")
+	if err != nil {
+		return nil, err
+	}
+	code, err := gojq.Compile(identity)
+	if err != nil {
+		return nil, err
+	}
+	v, _ = code.Run(v).Next()
+	if err, ok := v.(error); ok {
+		return nil, err
+	}
+	if v == nil {
+		return nil, fmt.Errorf("must not be null")
+	}
+	return v, nil
+}
+
+// unmarshalJSON decodes body keeping numbers as json.Number, gojq turns those
+// into int or *big.Int for integers rather than float64, so that 64 bit
+// counters and IDs keep their precision.
+func unmarshalJSON(body []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var v interface{}
+	if err := decoder.Decode(&v); err != nil {
+		return nil, err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, fmt.Errorf("invalid character after top-level value")
+	}
+	return v, nil
+}
+
+// translateQuery returns query, written in language, as a jq query. A jq
+// query that does not compile is taken for a JSONPath if it starts with $,
+// and for dot notation otherwise, as used by the checks users migrate from.
+func translateQuery(query, language string) (string, error) {
+	if len(query) == 0 {
+		return "", nil
+	}
+	switch language {
+	case "", "jq":
+		parsed, err := gojq.Parse(query)
+		if err == nil {
+			_, err = gojq.Compile(parsed)
+		}
+		if err == nil {
+			return query, nil
+		}
+		translated, fallbackErr := dotToJQ(query)
+		if strings.HasPrefix(query, "$") {
+			translated, fallbackErr = jsonPathToJQ(query)
+		}
+		if fallbackErr != nil || strings.HasPrefix(query, ".") {
+			// Reported as the jq error it is when the query runs.
+			return query, nil
+		}
+		return translated, nil
+	case "jsonpath":
+		translated, err := jsonPathToJQ(query)
+		if err != nil {
+			return "", fmt.Errorf("--query %q is not a supported JSONPath: %v", query, err)
+		}
+		return translated, nil
+	case "dot":
+		translated, err := dotToJQ(query)
+		if err != nil {
+			return "", fmt.Errorf("--query %q is not a valid dot notation path: %v", query, err)
+		}
+		return translated, nil
+	}
+	return "", fmt.Errorf("--query-language %q is not supported, must be one of jq, jsonpath and dot", language)
+}
+
+// jsonPathToJQ translates a JSONPath to jq: child names (.name and
+// ['name']), wildcards, recursive descent (..), indexes, slices, unions and
+// filters with comparisons of @ (e.g. [?(@.status == 'up')]).
+func jsonPathToJQ(path string) (string, error) {
+	if !strings.HasPrefix(path, "$") {
+		return "", fmt.Errorf("must start with $")
+	}
+	steps := []string{"."}
+	recursive := false
+	for rest := path[1:]; len(rest) > 0; {
+		switch {
+		case strings.HasPrefix(rest, ".."):
+			rest = rest[2:]
+			steps = append(steps, "..")
+			recursive = true
+			if strings.HasPrefix(rest, "[") {
+				continue
+			}
+			var name string
+			name, rest = readName(rest)
+			switch name {
+			case "":
+				return "", fmt.Errorf("missing name after ..")
+			case "*":
+				steps = append(steps, ".[]?")
+			default:
+				key := jqString(name)
+				steps = append(steps, "objects | select(has("+key+")) | .["+key+"]")
+			}
+			recursive = false
+		case rest[0] == '.':
+			var name string
+			name, rest = readName(rest[1:])
+			switch name {
+			case "":
+				return "", fmt.Errorf("missing name after .")
+			case "*":
+				steps = append(steps, ".[]")
+			default:
+				steps = append(steps, ".["+jqString(name)+"]")
+			}
+		case rest[0] == '[':
+			end := closingBracket(rest)
+			if end < 0 {
+				return "", fmt.Errorf("missing ]")
+			}
+			step, err := bracketToJQ(strings.TrimSpace(rest[1:end]))
+			if err != nil {
+				return "", err
+			}
+			rest = rest[end+1:]
+			if recursive && !strings.Contains(step, "select(") {
+				// Descendants of other types have no such children.
+				step += "?"
+			}
+			steps = append(steps, step)
+			recursive = false
+		default:
+			return "", fmt.Errorf("unexpected %q", rest[0])
+		}
+	}
+	return strings.Join(steps, " | "), nil
+}
+
+// readName reads a child name up to the next . or [ of a JSONPath.
+func readName(path string) (name, rest string) {
+	end := strings.IndexAny(path, ".[")
+	if end < 0 {
+		end = len(path)
+	}
+	return strings.TrimSpace(path[:end]), path[end:]
+}
+
+// closingBracket returns the index of the ] closing the [ path starts with,
+// skipping quoted strings and nested brackets, or -1.
+func closingBracket(path string) int {
+	depth := 0
+	var quote byte
+	for i := 0; i < len(path); i++ {
+		switch c := path[i]; {
+		case quote != 0:
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '[':
+			depth++
+		case c == ']':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// bracketToJQ translates the inside of a JSONPath bracket to a jq step.
+func bracketToJQ(inner string) (string, error) {
+	switch {
+	case inner == "*":
+		return ".[]", nil
+	case strings.HasPrefix(inner, "?(") && strings.HasSuffix(inner, ")"):
+		filter, err := filterToJQ(inner[2 : len(inner)-1])
+		if err != nil {
+			return "", err
+		}
+		return ".[]? | select(try (" + filter + ") catch false)", nil
+	case strings.Contains(inner, ":") && !strings.ContainsAny(inner, "'\""):
+		bounds := strings.Split(inner, ":")
+		if len(bounds) != 2 {
+			return "", fmt.Errorf("slice [%s] with a step is not supported", inner)
+		}
+		for _, bound := range bounds {
+			if _, err := strconv.Atoi(strings.TrimSpace(bound)); err != nil && len(strings.TrimSpace(bound)) > 0 {
+				return "", fmt.Errorf("invalid slice [%s]", inner)
+			}
+		}
+		// A JSONPath slice selects the elements, a jq slice is an array.
+		return ".[" + strings.TrimSpace(bounds[0]) + ":" + strings.TrimSpace(bounds[1]) + "][]", nil
+	}
+	var members []string
+	for _, member := range splitUnion(inner) {
+		member = strings.TrimSpace(member)
+		if _, err := strconv.Atoi(member); err == nil {
+			members = append(members, member)
+			continue
+		}
+		key, err := unquote(member)
+		if err != nil {
+			return "", fmt.Errorf("invalid [%s]", inner)
+		}
+		members = append(members, jqString(key))
+	}
+	return ".[" + strings.Join(members, ",") + "]", nil
+}
+
+// splitUnion splits the members of a JSONPath union, e.g. 'a','b', on the
+// commas outside quotes.
+func splitUnion(inner string) []string {
+	var members []string
+	var quote byte
+	start := 0
+	for i := 0; i < len(inner); i++ {
+		switch c := inner[i]; {
+		case quote != 0:
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == ',':
+			members = append(members, inner[start:i])
+			start = i + 1
+		}
+	}
+	return append(members, inner[start:])
+}
+
+// filterToJQ translates the expression of a JSONPath filter, @ being the
+// current node, to jq.
+func filterToJQ(filter string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(filter); i++ {
+		c := filter[i]
+		switch {
+		case c == '\'' || c == '"':
+			end := i + 1
+			for ; end < len(filter) && filter[end] != c; end++ {
+				if filter[end] == '\\' {
+					end++
+				}
+			}
+			if end >= len(filter) {
+				return "", fmt.Errorf("unterminated string in filter %q", filter)
+			}
+			s, err := unquote(filter[i : end+1])
+			if err != nil {
+				return "", fmt.Errorf("invalid string in filter %q", filter)
+			}
+			b.WriteString(jqString(s))
+			i = end
+		case c == '@':
+			if i+1 < len(filter) && filter[i+1] == '.' {
+				continue
+			}
+			b.WriteByte('.')
+		case strings.HasPrefix(filter[i:], "&&"):
+			b.WriteString(" and ")
+			i++
+		case strings.HasPrefix(filter[i:], "||"):
+			b.WriteString(" or ")
+			i++
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String(), nil
+}
+
+// unquote returns the string in single or double quotes s.
+func unquote(s string) (string, error) {
+	if len(s) >= 2 && s[0] == '\'' && s[len(s)-1] == '\'' {
+		s = `"` + strings.Replace(strings.Replace(s[1:len(s)-1], `\'`, "'", -1), `"`, `\"`, -1) + `"`
+	}
+	return strconv.Unquote(s)
+}
+
+// jqString returns s as a jq string literal.
+func jqString(s string) string {
+	quoted, _ := json.Marshal(s)
+	return string(quoted)
+}
+
+// dotToJQ translates a dot notation path, keys separated by dots, to jq. A
+// numeric key or a key suffixed with (N), as in items(0).name, indexes an
+// array.
+func dotToJQ(path string) (string, error) {
+	steps := []string{"."}
+	for _, segment := range strings.Split(path, ".") {
+		var indexes []string
+		for strings.HasSuffix(segment, ")") {
+			open := strings.LastIndex(segment, "(")
+			if open < 0 {
+				return "", fmt.Errorf("missing ( in %q", segment)
+			}
+			index := segment[open+1 : len(segment)-1]
+			if _, err := strconv.Atoi(index); err != nil {
+				return "", fmt.Errorf("invalid index (%s)", index)
+			}
+			indexes = append([]string{".[" + index + "]"}, indexes...)
+			segment = segment[:open]
+		}
+		switch _, err := strconv.Atoi(segment); {
+		case len(segment) == 0 && len(indexes) == 0:
+			return "", fmt.Errorf("empty key")
+		case len(segment) == 0:
+		case err == nil:
+			steps = append(steps, `if type == "array" then .[`+segment+`] else .[`+jqString(segment)+`] end`)
+		case strings.ContainsAny(segment, " |()[]\"'$"):
+			return "", fmt.Errorf("invalid key %q", segment)
+		default:
+			steps = append(steps, ".["+jqString(segment)+"]")
+		}
+		steps = append(steps, indexes...)
+	}
+	return strings.Join(steps, " | "), nil
+}
+
+// maxDifferences is the number of differences from the golden file listed in
+// the check output.
+const maxDifferences = 5
+
+// parsePath parses an --ignore-path into its segments, object keys and [N]
+// array indexes. A * key matches any key and [] any index.
+func parsePath(path string) ([]string, error) {
+	if !strings.HasPrefix(path, ".") && !strings.HasPrefix(path, "[") {
+		return nil, fmt.Errorf("must start with . or [")
+	}
+	var segments []string
+	for rest := path; len(rest) > 0; {
+		switch rest[0] {
+		case '.':
+			rest = rest[1:]
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			if end == 0 {
+				if len(rest) == 0 && len(segments) == 0 {
+					// . is the whole body.
+					return segments, nil
+				}
+				continue
+			}
+			segments = append(segments, rest[:end])
+			rest = rest[end:]
+		case '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("missing ]")
+			}
+			index := rest[1:end]
+			rest = rest[end+1:]
+			if key, err := strconv.Unquote(index); err == nil {
+				segments = append(segments, key)
+				continue
+			}
+			if _, err := strconv.Atoi(index); err != nil && len(index) > 0 {
+				return nil, fmt.Errorf("invalid index [%s]", index)
+			}
+			segments = append(segments, "["+index+"]")
+		default:
+			return nil, fmt.Errorf("unexpected %q", rest[0])
+		}
+	}
+	return segments, nil
+}
+
+// ignored reports whether the value at path, or a value containing it, is
+// ignored with --ignore-path.
+func ignored(path []string) bool {
+	for _, ignore := range ignorePaths {
+		if len(ignore) > len(path) {
+			continue
+		}
+		matched := true
+		for i, segment := range ignore {
+			isIndex := strings.HasPrefix(path[i], "[")
+			switch {
+			case segment == "[]" && isIndex, segment == "*" && !isIndex, segment == path[i]:
+			default:
+				matched = false
+			}
+			if !matched {
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// diffJSON returns the differences between the expected and actual values at
+// path, as decoded by unmarshalJSON.
+func diffJSON(path []string, expected, actual interface{}) []string {
+	if ignored(path) {
+		return nil
+	}
+	switch e := expected.(type) {
+	case map[string]interface{}:
+		a, ok := actual.(map[string]interface{})
+		if !ok {
+			break
+		}
+		var differences []string
+		keys := make([]string, 0, len(e)+len(a))
+		for key := range e {
+			keys = append(keys, key)
+		}
+		for key := range a {
+			if _, ok := e[key]; !ok {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			keyPath := append(path[:len(path):len(path)], key)
+			ev, eok := e[key]
+			av, aok := a[key]
+			switch {
+			case ignored(keyPath):
+			case !aok:
+				differences = append(differences, fmt.Sprintf("%s missing", formatPath(keyPath)))
+			case !eok:
+				differences = append(differences, fmt.Sprintf("%s unexpected", formatPath(keyPath)))
+			default:
+				differences = append(differences, diffJSON(keyPath, ev, av)...)
+			}
+		}
+		return differences
+	case []interface{}:
+		a, ok := actual.([]interface{})
+		if !ok {
+			break
+		}
+		var differences []string
+		for i := 0; i < len(e) || i < len(a); i++ {
+			indexPath := append(path[:len(path):len(path)], fmt.Sprintf("[%d]", i))
+			switch {
+			case ignored(indexPath):
+			case i >= len(a):
+				differences = append(differences, fmt.Sprintf("%s missing", formatPath(indexPath)))
+			case i >= len(e):
+				differences = append(differences, fmt.Sprintf("%s unexpected", formatPath(indexPath)))
+			default:
+				differences = append(differences, diffJSON(indexPath, e[i], a[i])...)
+			}
+		}
+		return differences
+	case json.Number:
+		if a, ok := actual.(json.Number); ok {
+			x, xOK := new(big.Rat).SetString(e.String())
+			y, yOK := new(big.Rat).SetString(a.String())
+			if xOK && yOK && x.Cmp(y) == 0 {
+				return nil
+			}
+		}
+	default:
+		if reflect.DeepEqual(expected, actual) {
+			return nil
+		}
+	}
+	return []string{fmt.Sprintf("%s expected %s, got %s", formatPath(path), formatValue(expected), formatValue(actual))}
+}
+
+// formatPath formats path in the --ignore-path syntax.
+func formatPath(path []string) string {
+	if len(path) == 0 {
+		return "."
+	}
+	var b strings.Builder
+	for _, segment := range path {
+		switch {
+		case strings.HasPrefix(segment, "["):
+			b.WriteString(segment)
+		case isIdentifier(segment):
+			b.WriteString("." + segment)
+		default:
+			b.WriteString("[" + strconv.Quote(segment) + "]")
+		}
+	}
+	return b.String()
+}
+
+func isIdentifier(s string) bool {
+	if len(s) == 0 {
+		return false
+	}
+	for _, r := range s {
+		if !(r == '_' || r == '-' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9')) {
+			return false
+		}
+	}
+	return true
+}
+
+// formatValue formats a JSON value for the check output, long values are
+// shortened.
+func formatValue(v interface{}) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	if len(data) > 40 {
+		return string(data[:37]) + "..."
+	}
+	return string(data)
+}
+
+// maxExactFloat is the largest integer up to which every integer is exactly
+// representable as a float64.
+const maxExactFloat = 1 << 53
+
+// expressionLanguage is the full gval language, with integers that a float64
+// cannot represent exactly kept as *big.Rat, in the value as well as in the
+// expression, and compared exactly. Everything else is evaluated by gval as
+// before. Operators of earlier languages take precedence when merged,
+// prefixes of later ones.
+var expressionLanguage = gval.NewLanguage(
+	exactComparison("==", func(c int) bool { return c == 0 }, func(a, b interface{}) (interface{}, error) { return reflect.DeepEqual(a, b), nil }),
+	exactComparison("!=", func(c int) bool { return c != 0 }, func(a, b interface{}) (interface{}, error) { return !reflect.DeepEqual(a, b), nil }),
+	exactComparison(">", func(c int) bool { return c > 0 }, compareText(func(a, b string) bool { return a > b })),
+	exactComparison(">=", func(c int) bool { return c >= 0 }, compareText(func(a, b string) bool { return a >= b })),
+	exactComparison("<", func(c int) bool { return c < 0 }, compareText(func(a, b string) bool { return a < b })),
+	exactComparison("<=", func(c int) bool { return c <= 0 }, compareText(func(a, b string) bool { return a <= b })),
+	gval.Full(),
+	gval.PrefixExtension(scanner.Int, parseExactNumber),
+	gval.PrefixOperator("-", func(c context.Context, v interface{}) (interface{}, error) {
+		if r, ok := v.(*big.Rat); ok {
+			return new(big.Rat).Neg(r), nil
+		}
+		f, ok := toFloat(v)
+		if !ok {
+			return nil, fmt.Errorf("unexpected %v(%T) expected number", v, v)
+		}
+		return -f, nil
+	}),
+)
+
+// evaluateExpression evaluates expression against actualValue, as value,
+// and variables. An expression starting with an operator (e.g. "> 100") is
+// applied to the value, one starting with a variable (e.g. "value - previous
+// > 100") is evaluated as is.
+func evaluateExpression(actualValue interface{}, expression string, variables map[string]interface{}) (bool, error) {
+	parameters := map[string]interface{}{"value": exactNumber(actualValue)}
+	for name, v := range variables {
+		parameters[name] = v
+	}
+	if !fullExpression.MatchString(expression) {
+		expression = "value " + expression
+	}
+	evalResult, err := expressionLanguage.Evaluate(expression, parameters)
 	if err != nil {
 		return false, err
 	}
-	return evalResult.(bool), nil
+	result, ok := evalResult.(bool)
+	if !ok {
+		return false, fmt.Errorf("expression %q returned %v, not a boolean", expression, evalResult)
+	}
+	return result, nil
+}
+
+// usesState returns whether expression uses a variable of the previous run,
+// outside of its strings.
+func usesState(expression string) bool {
+	return stateVariables.MatchString(stringLiterals.ReplaceAllString(expression, `""`))
+}
+
+// stateVariableValues returns the expression variables of value relative to
+// the value of the previous run, previous as is and, if both are numbers,
+// delta as the difference and rate as the difference per second.
+func stateVariableValues(value interface{}, previous stateValue, now time.Time) map[string]interface{} {
+	variables := map[string]interface{}{"previous": exactNumber(previous.value)}
+	current, currentOK := toFloat(exactFloat(value))
+	last, lastOK := toFloat(exactFloat(previous.value))
+	if currentOK && lastOK {
+		variables["delta"] = current - last
+		if elapsed := now.Sub(previous.time).Seconds(); elapsed > 0 {
+			variables["rate"] = (current - last) / elapsed
+		}
+	}
+	return variables
+}
+
+// exactFloat returns v as a float64 if it is a *big.Int, for delta and rate,
+// and v unchanged otherwise.
+func exactFloat(v interface{}) interface{} {
+	if n, ok := v.(*big.Int); ok {
+		f, _ := new(big.Float).SetInt(n).Float64()
+		return f
+	}
+	return v
+}
+
+// loadState reads the value of the previous run of checkURL and query from
+// path, ok is false if there is none or the file is missing or unreadable.
+func loadState(path, checkURL, query string) (stateValue, bool) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return stateValue{}, false
+	}
+	var entry stateEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		logging.Warn("ignoring invalid state file", "file", path, "error", err)
+		return stateValue{}, false
+	}
+	if entry.URL != checkURL || entry.Query != query || len(entry.Value) == 0 {
+		return stateValue{}, false
+	}
+	// The value is decoded like --default-value, as gojq returns values.
+	value, err := parseDefaultValue(string(entry.Value))
+	if err != nil {
+		return stateValue{}, false
+	}
+	return stateValue{value: value, time: entry.Time}, true
+}
+
+// saveState writes entry with value to path.
+func saveState(path string, entry stateEntry, value interface{}) error {
+	var err error
+	if entry.Value, err = json.Marshal(value); err != nil {
+		return err
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0600)
+}
+
+// exactNumber returns v as a *big.Rat if it is an integer a float64 cannot
+// represent exactly, and v unchanged otherwise.
+func exactNumber(v interface{}) interface{} {
+	switch n := v.(type) {
+	case int:
+		if n > maxExactFloat || n < -maxExactFloat {
+			return new(big.Rat).SetInt64(int64(n))
+		}
+	case *big.Int:
+		return new(big.Rat).SetInt(n)
+	}
+	return v
+}
+
+func parseExactNumber(c context.Context, p *gval.Parser) (gval.Evaluable, error) {
+	n, ok := new(big.Int).SetString(p.TokenText(), 0)
+	if !ok {
+		return nil, fmt.Errorf("could not parse number %q", p.TokenText())
+	}
+	if n.IsInt64() && n.Int64() <= maxExactFloat {
+		return p.Const(float64(n.Int64())), nil
+	}
+	return p.Const(new(big.Rat).SetInt(n)), nil
+}
+
+// exactComparison returns comparison operator name for operands of which
+// either is a *big.Rat, as gval cannot convert those to float64. Other
+// operands are compared by fallback.
+func exactComparison(name string, result func(int) bool, fallback func(a, b interface{}) (interface{}, error)) gval.Language {
+	return gval.InfixOperator(name, func(a, b interface{}) (interface{}, error) {
+		_, aExact := a.(*big.Rat)
+		_, bExact := b.(*big.Rat)
+		if aExact || bExact {
+			x, xOK := toRat(a)
+			y, yOK := toRat(b)
+			if xOK && yOK {
+				return result(x.Cmp(y)), nil
+			}
+		}
+		return fallback(a, b)
+	})
+}
+
+// compareText compares operands as text, as gval does for operands that are
+// not both numbers.
+func compareText(f func(a, b string) bool) func(a, b interface{}) (interface{}, error) {
+	return func(a, b interface{}) (interface{}, error) {
+		if a == nil || b == nil {
+			return nil, fmt.Errorf("invalid operation (%T) with (%T)", a, b)
+		}
+		return f(fmt.Sprintf("%v", a), fmt.Sprintf("%v", b)), nil
+	}
+}
+
+func toRat(v interface{}) (*big.Rat, bool) {
+	switch n := v.(type) {
+	case *big.Rat:
+		return n, true
+	case int:
+		return new(big.Rat).SetInt64(int64(n)), true
+	case float64:
+		if math.IsInf(n, 0) || math.IsNaN(n) {
+			return nil, false
+		}
+		return new(big.Rat).SetFloat64(n), true
+	case string:
+		return new(big.Rat).SetString(n)
+	}
+	return nil, false
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case int:
+		return float64(n), true
+	case string:
+		f, err := strconv.ParseFloat(n, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// decodeBody decodes body according to the codings of the Content-Encoding
+// header, applied in the order listed. Responses the transport decompressed
+// have no Content-Encoding anymore. Gzip bodies are detected without the
+// header too, as some servers compress regardless of Accept-Encoding without
+// saying so.
+func decodeBody(body []byte, contentEncoding string) ([]byte, error) {
+	var codings []string
+	for _, coding := range strings.Split(contentEncoding, ",") {
+		if coding = strings.ToLower(strings.TrimSpace(coding)); len(coding) > 0 {
+			codings = append(codings, coding)
+		}
+	}
+	if len(codings) == 0 && bytes.HasPrefix(body, []byte{0x1f, 0x8b}) {
+		codings = []string{"gzip"}
+	}
+	for i := len(codings) - 1; i >= 0; i-- {
+		var (
+			r   io.Reader
+			err error
+		)
+		switch codings[i] {
+		case "identity":
+			continue
+		case "gzip", "x-gzip":
+			r, err = gzip.NewReader(bytes.NewReader(body))
+		case "deflate":
+			// Deflate is meant to be zlib wrapped, but some servers send
+			// raw deflate data.
+			r, err = zlib.NewReader(bytes.NewReader(body))
+			if err != nil {
+				r, err = flate.NewReader(bytes.NewReader(body)), nil
+			}
+		default:
+			return nil, fmt.Errorf("unsupported Content-Encoding %q", codings[i])
+		}
+		if err == nil {
+			body, err = ioutil.ReadAll(r)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("decoding %s response body: %v", codings[i], err)
+		}
+	}
+	return body, nil
 }
@@ -1,12 +1,21 @@
 package main
 
 import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
 	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
 	"testing"
 
+	"github.com/itchyny/gojq"
 	"github.com/sensu/sensu-plugin-sdk/sensu"
 	corev2 "github.com/sensu/sensu-go/api/core/v2"
 	"github.com/stretchr/testify/assert"
@@ -90,3 +99,614 @@ func TestExecuteCheck(t *testing.T) {
 	assert.NoError(err)
 	assert.Equal(sensu.CheckStateOK, status)
 }
+
+func TestExecuteCheckBigIntegers(t *testing.T) {
+	assert := assert.New(t)
+	event := corev2.FixtureEvent("entity1", "check")
+
+	// 2^53+1 and 2^64+1 are not representable as float64, they would
+	// compare equal to 2^53 and 2^64.
+	var test = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"counter": 9007199254740993, "id": 18446744073709551617, "negative": -9007199254740993, "ratio": 0.5, "text": "9007199254740993"}`))
+	}))
+	defer test.Close()
+	plugin.URL = test.URL
+	plugin.Headers = nil
+
+	testCases := []struct {
+		status     int
+		query      string
+		expression string
+	}{
+		{sensu.CheckStateOK, ".counter", "== 9007199254740993"},
+		{sensu.CheckStateCritical, ".counter", "== 9007199254740992"},
+		{sensu.CheckStateOK, ".counter", "> 9007199254740992"},
+		{sensu.CheckStateCritical, ".counter", "< 9007199254740993"},
+		{sensu.CheckStateOK, ".counter", "!= 9007199254740992"},
+		{sensu.CheckStateOK, ".counter", "> 1.5"},
+		{sensu.CheckStateOK, ".counter", "> 9007199254740992 && value < 18446744073709551617"},
+		{sensu.CheckStateOK, ".id", "== 18446744073709551617"},
+		{sensu.CheckStateCritical, ".id", "<= 18446744073709551616"},
+		{sensu.CheckStateOK, ".id", "> .5"},
+		{sensu.CheckStateOK, ".negative", "== -9007199254740993"},
+		{sensu.CheckStateOK, ".negative", "< -9007199254740992"},
+		{sensu.CheckStateOK, ".counter - 1", "== 9007199254740992"},
+		{sensu.CheckStateOK, ".ratio", "< 1"},
+		{sensu.CheckStateOK, ".text", "== \"9007199254740993\""},
+		{sensu.CheckStateOK, ".text", "== 9007199254740993"},
+	}
+	for _, tc := range testCases {
+		plugin.Query = tc.query
+		plugin.Expression = tc.expression
+		status, err := executeCheck(event)
+		assert.NoError(err)
+		assert.Equal(tc.status, status, "%s %s", tc.query, tc.expression)
+	}
+}
+
+func TestUnmarshalJSON(t *testing.T) {
+	assert := assert.New(t)
+	_, err := unmarshalJSON([]byte(`{"a": 1} {"b": 2}`))
+	assert.Error(err)
+	_, err = unmarshalJSON([]byte(`{"a": `))
+	assert.Error(err)
+	v, err := unmarshalJSON([]byte(" [1, 2.5]\n"))
+	assert.NoError(err)
+	assert.Len(v, 2)
+}
+
+func TestExecuteCheckContentEncoding(t *testing.T) {
+	assert := assert.New(t)
+	event := corev2.FixtureEvent("entity1", "check")
+	body := []byte(`{"status": "SUCCESS"}`)
+
+	var gzipped, zlibbed, deflated bytes.Buffer
+	gw := gzip.NewWriter(&gzipped)
+	_, _ = gw.Write(body)
+	gw.Close()
+	zw := zlib.NewWriter(&zlibbed)
+	_, _ = zw.Write(body)
+	zw.Close()
+	fw, _ := flate.NewWriter(&deflated, flate.DefaultCompression)
+	_, _ = fw.Write(body)
+	fw.Close()
+
+	var test = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/gzip":
+			w.Header().Set("Content-Encoding", "gzip")
+			_, _ = w.Write(gzipped.Bytes())
+		case "/undeclared":
+			// Compressed regardless of Accept-Encoding, without saying so.
+			_, _ = w.Write(gzipped.Bytes())
+		case "/deflate":
+			w.Header().Set("Content-Encoding", "deflate")
+			_, _ = w.Write(zlibbed.Bytes())
+		case "/raw-deflate":
+			w.Header().Set("Content-Encoding", "deflate")
+			_, _ = w.Write(deflated.Bytes())
+		case "/br":
+			w.Header().Set("Content-Encoding", "br")
+			_, _ = w.Write(body)
+		case "/broken":
+			w.Header().Set("Content-Encoding", "gzip")
+			_, _ = w.Write(body)
+		}
+	}))
+	defer test.Close()
+
+	testCases := []struct {
+		status         int
+		path           string
+		acceptEncoding string
+	}{
+		{sensu.CheckStateOK, "/gzip", ""},
+		{sensu.CheckStateOK, "/gzip", "gzip"},
+		{sensu.CheckStateOK, "/undeclared", ""},
+		{sensu.CheckStateOK, "/deflate", "gzip, deflate"},
+		{sensu.CheckStateOK, "/raw-deflate", "deflate;q=0.5"},
+		{sensu.CheckStateCritical, "/br", ""},
+		{sensu.CheckStateCritical, "/broken", "gzip"},
+	}
+
+	plugin.Headers = nil
+	plugin.Query = ".status"
+	plugin.Expression = "== \"SUCCESS\""
+	for _, tc := range testCases {
+		plugin.URL = test.URL + tc.path
+		plugin.AcceptEncoding = tc.acceptEncoding
+		status, err := checkArgs(event)
+		assert.NoError(err)
+		assert.Equal(sensu.CheckStateOK, status)
+		status, err = executeCheck(event)
+		assert.NoError(err)
+		assert.Equal(tc.status, status, tc.path)
+	}
+
+	plugin.AcceptEncoding = "br"
+	status, err := checkArgs(event)
+	assert.Error(err)
+	assert.Equal(sensu.CheckStateUnknown, status)
+	plugin.AcceptEncoding = ""
+}
+
+func TestDefaultClientUntouched(t *testing.T) {
+	assert := assert.New(t)
+	event := corev2.FixtureEvent("entity1", "check")
+
+	var test = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(`{"status": "SUCCESS"}`))
+	}))
+	defer test.Close()
+
+	plugin.URL = test.URL
+	plugin.Headers = nil
+	plugin.Timeout = 15
+	plugin.InsecureSkipVerify = true
+	plugin.Query = ".status"
+	plugin.Expression = "== \"SUCCESS\""
+	status, err := checkArgs(event)
+	assert.NoError(err)
+	assert.Equal(sensu.CheckStateOK, status)
+	status, err = executeCheck(event)
+	assert.NoError(err)
+	assert.Equal(sensu.CheckStateOK, status)
+	plugin.InsecureSkipVerify = false
+
+	// The check must use its own client and transport
+	// httptest.Server.Close may initialise the default TLS config itself, so
+	// only check that ours was not installed.
+	if defaultTLS := http.DefaultTransport.(*http.Transport).TLSClientConfig; defaultTLS != nil {
+		assert.False(defaultTLS.InsecureSkipVerify)
+	}
+	assert.Nil(http.DefaultClient.Transport)
+	assert.Nil(http.DefaultClient.CheckRedirect)
+	assert.Zero(http.DefaultClient.Timeout)
+}
+
+func TestExecuteCheckGolden(t *testing.T) {
+	assert := assert.New(t)
+	event := corev2.FixtureEvent("entity1", "check")
+
+	goldenFile, err := ioutil.TempFile("", "http-json-golden")
+	require.NoError(t, err)
+	defer os.Remove(goldenFile.Name())
+	_, err = goldenFile.WriteString(`{"status": "ok", "version": 2.0, "meta": {"timestamp": "2020-01-01T00:00:00Z"}, "items": [{"id": "a1", "name": "one"}, {"id": "b2", "name": "two"}]}`)
+	require.NoError(t, err)
+	goldenFile.Close()
+
+	var body string
+	var test = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(body))
+	}))
+	defer test.Close()
+	plugin.URL = test.URL
+	plugin.Headers = nil
+	plugin.Query = ""
+	plugin.Expression = ""
+	plugin.GoldenFile = goldenFile.Name()
+	plugin.IgnorePaths = []string{".meta.timestamp", ".items[].id"}
+	defer func() {
+		plugin.GoldenFile = ""
+		plugin.IgnorePaths = nil
+		golden, ignorePaths = nil, nil
+	}()
+	status, err := checkArgs(event)
+	assert.NoError(err)
+	assert.Equal(sensu.CheckStateOK, status)
+
+	testCases := []struct {
+		status int
+		body   string
+	}{
+		{sensu.CheckStateOK, `{"status": "ok", "version": 2, "meta": {"timestamp": "2021-06-01T12:00:00Z"}, "items": [{"id": "x", "name": "one"}, {"id": "y", "name": "two"}]}`},
+		{sensu.CheckStateCritical, `{"status": "degraded", "version": 2, "meta": {}, "items": [{"id": "x", "name": "one"}, {"id": "y", "name": "two"}]}`},
+		{sensu.CheckStateCritical, `{"status": "ok", "version": 2, "meta": {}, "items": [{"id": "x", "name": "one"}]}`},
+		{sensu.CheckStateCritical, `{"status": "ok", "version": 2, "meta": {}, "extra": true, "items": [{"id": "x", "name": "one"}, {"id": "y", "name": "two"}]}`},
+		{sensu.CheckStateCritical, `[]`},
+	}
+	for _, tc := range testCases {
+		body = tc.body
+		status, err := executeCheck(event)
+		assert.NoError(err)
+		assert.Equal(tc.status, status, tc.body)
+	}
+
+	// With a query and expression both must pass.
+	body = testCases[0].body
+	plugin.Query = ".items | length"
+	plugin.Expression = "== 3"
+	status, err = executeCheck(event)
+	assert.NoError(err)
+	assert.Equal(sensu.CheckStateCritical, status)
+
+	plugin.Expression = ""
+	_, err = checkArgs(event)
+	assert.Error(err)
+	plugin.Query = ""
+	plugin.GoldenFile = ""
+	_, err = checkArgs(event)
+	assert.Error(err)
+}
+
+func TestDiffJSON(t *testing.T) {
+	assert := assert.New(t)
+	ignorePaths = nil
+	expected, _ := unmarshalJSON([]byte(`{"a": {"b c": [1, 2]}, "d": "x"}`))
+	actual, _ := unmarshalJSON([]byte(`{"a": {"b c": [1, 3, 4]}, "e": null}`))
+	assert.Equal([]string{
+		`.a["b c"][1] expected 2, got 3`,
+		`.a["b c"][2] unexpected`,
+		`.d missing`,
+		`.e unexpected`,
+	}, diffJSON(nil, expected, actual))
+
+	ignorePaths = [][]string{{"*", "b c", "[]"}, {"d"}, {"e"}}
+	assert.Empty(diffJSON(nil, expected, actual))
+	ignorePaths = nil
+}
+
+func TestParsePath(t *testing.T) {
+	assert := assert.New(t)
+	testCases := []struct {
+		path     string
+		segments []string
+	}{
+		{".", nil},
+		{".meta.timestamp", []string{"meta", "timestamp"}},
+		{".items[].id", []string{"items", "[]", "id"}},
+		{".items[2].id", []string{"items", "[2]", "id"}},
+		{`.["a.b"].c`, []string{"a.b", "c"}},
+		{"[0]", []string{"[0]"}},
+	}
+	for _, tc := range testCases {
+		segments, err := parsePath(tc.path)
+		assert.NoError(err, tc.path)
+		assert.Equal(tc.segments, segments, tc.path)
+	}
+	for _, path := range []string{"meta", ".items[x]", ".items[0"} {
+		_, err := parsePath(path)
+		assert.Error(err, path)
+	}
+}
+
+func TestExecuteCheckPolicy(t *testing.T) {
+	assert := assert.New(t)
+	event := corev2.FixtureEvent("entity1", "check")
+
+	dir, err := ioutil.TempDir("", "http-json-policy")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	policyFile := filepath.Join(dir, "policy.yml")
+	require.NoError(t, ioutil.WriteFile(policyFile, []byte(`
+rules:
+  - status: critical
+    when: value > 100 && value > (previous.value ?? value)
+    message: queue above 100 and growing
+  - status: warning
+    when: value > 100
+`), 0644))
+
+	var depth int
+	var test = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprintf(w, `{"queue": {"depth": %d}}`, depth)
+	}))
+	defer test.Close()
+
+	plugin.URL = test.URL
+	plugin.Headers = nil
+	plugin.Query = ".queue.depth"
+	plugin.Expression = ""
+	plugin.Policy.File = policyFile
+	plugin.Policy.StateFile = filepath.Join(dir, "state.json")
+	defer func() {
+		plugin.Policy.File = ""
+		plugin.Policy.StateFile = ""
+		_ = plugin.Policy.Validate()
+	}()
+	status, err := checkArgs(event)
+	assert.NoError(err)
+	assert.Equal(sensu.CheckStateOK, status)
+
+	for _, tc := range []struct {
+		depth  int
+		status int
+	}{
+		{10, sensu.CheckStateOK},
+		{150, sensu.CheckStateCritical},
+		{120, sensu.CheckStateWarning},
+	} {
+		depth = tc.depth
+		status, err := executeCheck(event)
+		assert.NoError(err)
+		assert.Equal(tc.status, status, tc.depth)
+	}
+
+	plugin.Expression = "> 100"
+	_, err = checkArgs(event)
+	assert.Error(err)
+	plugin.Expression = ""
+}
+
+func TestExecuteCheckDefaultValue(t *testing.T) {
+	assert := assert.New(t)
+	event := corev2.FixtureEvent("entity1", "check")
+
+	var body string
+	var test = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(body))
+	}))
+	defer test.Close()
+
+	run := func() (int, string) {
+		stdout := os.Stdout
+		defer func() { os.Stdout = stdout }()
+		r, w, err := os.Pipe()
+		require.NoError(t, err)
+		os.Stdout = w
+		status, err := executeCheck(event)
+		assert.NoError(err)
+		w.Close()
+		output, _ := ioutil.ReadAll(r)
+		return status, string(output)
+	}
+
+	plugin.URL = test.URL
+	plugin.Headers = nil
+	plugin.Query = ".queue.depth"
+	plugin.Expression = "< 100"
+	defer func() {
+		plugin.DefaultValue = ""
+		defaultValue, hasDefault = nil, false
+	}()
+
+	body = `{"queue": {"depth": null}}`
+	status, output := run()
+	assert.Equal(sensu.CheckStateCritical, status)
+	assert.Contains(output, "is present but null")
+	body = `{"queue": {}}`
+	status, output = run()
+	assert.Equal(sensu.CheckStateCritical, status)
+	assert.Contains(output, "is absent")
+
+	plugin.DefaultValue = "0"
+	_, err := checkArgs(event)
+	assert.NoError(err)
+	status, output = run()
+	assert.Equal(sensu.CheckStateOK, status)
+	assert.Contains(output, "The value 0 defaulted as .queue.depth is absent matched")
+	// The default is only for absent keys.
+	body = `{"queue": {"depth": null}}`
+	status, _ = run()
+	assert.Equal(sensu.CheckStateCritical, status)
+
+	plugin.DefaultValue = "idle"
+	plugin.Query = ".queue.state"
+	plugin.Expression = "== \"idle\""
+	_, err = checkArgs(event)
+	assert.NoError(err)
+	status, _ = run()
+	assert.Equal(sensu.CheckStateOK, status)
+
+	plugin.DefaultValue = "null"
+	_, err = checkArgs(event)
+	assert.Error(err)
+}
+
+func TestKeyPresent(t *testing.T) {
+	assert := assert.New(t)
+	body, err := unmarshalJSON([]byte(`{"a": {"b": null}, "items": [{"id": null}]}`))
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		query          string
+		present, known bool
+	}{
+		{".a.b", true, true},
+		{".a.c", false, true},
+		{".x.y", false, true},
+		{".items[0].id", true, true},
+		{".items[-1].id", true, true},
+		{".items[1].id", false, true},
+		{".items[].id", true, true},
+		{".items | length", false, false},
+	} {
+		present, known := keyPresent(tc.query, body)
+		assert.Equal(tc.present, present, tc.query)
+		assert.Equal(tc.known, known, tc.query)
+	}
+}
+
+func TestTranslateQuery(t *testing.T) {
+	assert := assert.New(t)
+	var doc interface{}
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"status": "ok",
+		"store": {
+			"name with space": 1,
+			"0": "zero",
+			"book": [
+				{"title": "A", "price": 8, "tags": ["x"]},
+				{"title": "B", "price": 12},
+				{"title": "C's", "price": 20}
+			]
+		},
+		"nodes": [{"id": "n1", "state": "up"}, {"id": "n2", "state": "down"}]
+	}`), &doc))
+
+	run := func(query, language string) []interface{} {
+		jq, err := translateQuery(query, language)
+		require.NoError(t, err, query)
+		parsed, err := gojq.Parse(jq)
+		require.NoError(t, err, jq)
+		code, err := gojq.Compile(parsed)
+		require.NoError(t, err, jq)
+		values := []interface{}{}
+		iter := code.Run(doc)
+		for {
+			v, ok := iter.Next()
+			if !ok {
+				break
+			}
+			if err, ok := v.(error); ok {
+				require.NoError(t, err, jq)
+			}
+			values = append(values, v)
+		}
+		return values
+	}
+
+	testCases := []struct {
+		query, language string
+		values          []interface{}
+	}{
+		{".status", "jq", []interface{}{"ok"}},
+		{"$.status", "jsonpath", []interface{}{"ok"}},
+		{"$.store.book[1].title", "jsonpath", []interface{}{"B"}},
+		{"$['store']['name with space']", "jsonpath", []interface{}{1.0}},
+		{"$.store.book[-1].title", "jsonpath", []interface{}{"C's"}},
+		{"$.store.book[*].price", "jsonpath", []interface{}{8.0, 12.0, 20.0}},
+		{"$.store.book[0:2].title", "jsonpath", []interface{}{"A", "B"}},
+		{"$.store.book[1:].title", "jsonpath", []interface{}{"B", "C's"}},
+		{"$.store.book[0,2].title", "jsonpath", []interface{}{"A", "C's"}},
+		{"$..price", "jsonpath", []interface{}{8.0, 12.0, 20.0}},
+		{"$..book[0].title", "jsonpath", []interface{}{"A"}},
+		{"$.store.book[?(@.price > 10)].title", "jsonpath", []interface{}{"B", "C's"}},
+		{"$.nodes[?(@.state == 'down' || @.id == \"n0\")].id", "jsonpath", []interface{}{"n2"}},
+		{"$.store.book[?(@.title == 'C\\'s')].price", "jsonpath", []interface{}{20.0}},
+		{"store.book.1.title", "dot", []interface{}{"B"}},
+		{"store.book(2).title", "dot", []interface{}{"C's"}},
+		{"store.0", "dot", []interface{}{"zero"}},
+		// Fallbacks of queries that are not valid jq.
+		{"status", "jq", []interface{}{"ok"}},
+		{"nodes(1).state", "", []interface{}{"down"}},
+		{"$.nodes[0].id", "jq", []interface{}{"n1"}},
+	}
+	for _, tc := range testCases {
+		assert.Equal(tc.values, run(tc.query, tc.language), tc.query)
+	}
+
+	for _, invalid := range []struct{ query, language string }{
+		{".status", "jsonpath"},
+		{"$.store[", "jsonpath"},
+		{"$.store.book[::2]", "jsonpath"},
+		{"store..book", "dot"},
+		{"store.book(x)", "dot"},
+		{".status", "xpath"},
+	} {
+		_, err := translateQuery(invalid.query, invalid.language)
+		assert.Error(err, invalid.query)
+	}
+	jq, err := translateQuery(".status |", "jq")
+	assert.NoError(err)
+	assert.Equal(".status |", jq, "invalid jq is left to fail as jq")
+}
+
+func TestExecuteCheckStateFile(t *testing.T) {
+	assert := assert.New(t)
+	event := corev2.FixtureEvent("entity1", "check")
+
+	dir, err := ioutil.TempDir("", "http-json-state")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var restarts string
+	var test = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprintf(w, `{"restarts": %s}`, restarts)
+	}))
+	defer test.Close()
+
+	plugin.URL = test.URL
+	plugin.Headers = nil
+	plugin.Query = ".restarts"
+	plugin.Expression = "delta < 5"
+	plugin.StateFile = ""
+	defer func() {
+		plugin.StateFile = ""
+	}()
+	_, err = checkArgs(event)
+	assert.Error(err, "delta requires --state-file")
+
+	plugin.StateFile = filepath.Join(dir, "state.json")
+	status, err := checkArgs(event)
+	assert.NoError(err)
+	assert.Equal(sensu.CheckStateOK, status)
+
+	for _, tc := range []struct {
+		restarts   string
+		expression string
+		status     int
+	}{
+		// The first run has no previous value.
+		{"10", "delta < 5", sensu.CheckStateOK},
+		{"12", "delta < 5", sensu.CheckStateOK},
+		{"20", "delta < 5", sensu.CheckStateCritical},
+		{"20", "value - previous == 0", sensu.CheckStateOK},
+		{"30", "rate > 0 && previous == 20", sensu.CheckStateOK},
+		{"9007199254740993", "> previous", sensu.CheckStateOK},
+		{"9007199254740993", "== previous", sensu.CheckStateOK},
+		{"\"up\"", "== \"up\" && previous != \"up\"", sensu.CheckStateOK},
+	} {
+		restarts = tc.restarts
+		plugin.Expression = tc.expression
+		status, err := executeCheck(event)
+		assert.NoError(err, tc.expression)
+		assert.Equal(tc.status, status, tc.expression)
+	}
+
+	// Another query does not compare against the value of this one.
+	plugin.Query = ".restarts + 0"
+	restarts = "1"
+	plugin.Expression = "delta > 100"
+	status, err = executeCheck(event)
+	assert.NoError(err)
+	assert.Equal(sensu.CheckStateOK, status)
+
+	plugin.Expression = ""
+	plugin.Policy.File = "policy.yml"
+	_, err = checkArgs(event)
+	assert.Error(err)
+	plugin.Policy.File = ""
+}
+
+func TestExecuteCheckStringLiterals(t *testing.T) {
+	assert := assert.New(t)
+	event := corev2.FixtureEvent("entity1", "check")
+
+	var test = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"status": "rate-limited", "log": "previous run failed"}`))
+	}))
+	defer test.Close()
+
+	plugin.URL = test.URL
+	plugin.Headers = nil
+	plugin.StateFile = ""
+	for _, tc := range []struct {
+		query      string
+		expression string
+		status     int
+	}{
+		{".status", `value == "rate-limited"`, sensu.CheckStateOK},
+		{".status", "== `delta`", sensu.CheckStateCritical},
+		{".log", `value =~ "previous run"`, sensu.CheckStateOK},
+	} {
+		plugin.Query = tc.query
+		plugin.Expression = tc.expression
+		status, err := checkArgs(event)
+		assert.NoError(err, tc.expression)
+		assert.Equal(sensu.CheckStateOK, status, tc.expression)
+		status, err = executeCheck(event)
+		assert.NoError(err, tc.expression)
+		assert.Equal(tc.status, status, tc.expression)
+	}
+}
+
+func TestUsesState(t *testing.T) {
+	assert := assert.New(t)
+	assert.True(usesState("delta < 5"))
+	assert.True(usesState(`== "up" && previous != "up"`))
+	assert.False(usesState(`value == "rate-limited"`))
+	assert.False(usesState(`value =~ "previous \"run\"" || value == 'delta'`))
+	assert.False(usesState("value == `rate`"))
+}
@@ -0,0 +1,728 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nixwiz/http-checks/internal/buildinfo"
+	"github.com/nixwiz/http-checks/internal/exitstatus"
+	"github.com/nixwiz/http-checks/internal/httpclient"
+	"github.com/nixwiz/http-checks/internal/logging"
+	"github.com/nixwiz/http-checks/internal/overrides"
+	"github.com/nixwiz/http-checks/internal/selfmetrics"
+	corev2 "github.com/sensu/sensu-go/api/core/v2"
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+	"golang.org/x/net/html"
+)
+
+// Config represents the check plugin config.
+type Config struct {
+	sensu.PluginConfig
+	URL                string
+	TrustedCAFile      string
+	UseSystemCAsPlus   bool
+	InsecureSkipVerify bool
+	Timeout            int
+	Headers            []string
+	HeadersFile        httpclient.HeadersFileConfig
+	MTLSKeyFile        string
+	MTLSCertFile       string
+	Depth              int
+	Limit              int
+	Concurrency        int
+	Warning            int
+	Critical           int
+	SitemapMaxAge      string
+	SitemapMinURLs     int
+	Proxy              httpclient.ProxyConfig
+	Transport          httpclient.TransportConfig
+	Source             httpclient.SourceConfig
+	Resolver           httpclient.ResolverConfig
+	URLParsing         httpclient.URLConfig
+	Record             httpclient.RecordConfig
+	Log                logging.Config
+	Overrides          overrides.Config
+	Status             exitstatus.Config
+	Metrics            selfmetrics.Config
+}
+
+// link is a URL to be checked, along with the page it was found on.
+type link struct {
+	URL    string
+	Source string
+	Level  int
+}
+
+// linkResult is the outcome of checking a single link.
+type linkResult struct {
+	link
+	StatusCode int
+	Err        error
+	Links      []string
+}
+
+// broken returns true if the link could not be fetched or returned a non-2xx
+// response.
+func (r linkResult) broken() bool {
+	return r.Err != nil || r.StatusCode < 200 || r.StatusCode > 299
+}
+
+// sitemap is the subset of the sitemap protocol needed to extract URLs from
+// both a urlset and a sitemapindex.
+type sitemap struct {
+	XMLName xml.Name
+	URLs    []struct {
+		Loc     string `xml:"loc"`
+		LastMod string `xml:"lastmod"`
+	} `xml:"url"`
+	Sitemaps []struct {
+		Loc     string `xml:"loc"`
+		LastMod string `xml:"lastmod"`
+	} `xml:"sitemap"`
+}
+
+// lastModLayouts are the W3C datetime layouts of sitemap lastmod entries.
+var lastModLayouts = []string{
+	"2006-01-02",
+	"2006-01-02T15:04Z07:00",
+	time.RFC3339,
+	time.RFC3339Nano,
+}
+
+var (
+	tlsConfig tls.Config
+
+	// linkAttributes are the element attributes that links are extracted from.
+	linkAttributes = map[string]string{
+		"a":      "href",
+		"link":   "href",
+		"area":   "href",
+		"img":    "src",
+		"script": "src",
+		"iframe": "src",
+		"source": "src",
+	}
+
+	// maxBrokenOutput is the number of broken links listed in the output.
+	maxBrokenOutput = 10
+
+	// sitemapMaxAge is the parsed --sitemap-max-age, 0 if not set.
+	sitemapMaxAge time.Duration
+
+	plugin = Config{
+		PluginConfig: sensu.PluginConfig{
+			Name:     "http-links",
+			Short:    "HTTP Link Crawler Check",
+			Keyspace: "sensu.io/plugins/http-links/config",
+		},
+	}
+
+	options = []*sensu.PluginConfigOption{
+		{
+			Path:      "url",
+			Env:       "CHECK_URL",
+			Argument:  "url",
+			Shorthand: "u",
+			Default:   "http://localhost:80/",
+			Usage:     "URL of the page or sitemap to start from",
+			Value:     &plugin.URL,
+		},
+		{
+			Path:      "insecure-skip-verify",
+			Env:       "",
+			Argument:  "insecure-skip-verify",
+			Shorthand: "i",
+			Default:   false,
+			Usage:     "Skip TLS certificate verification (not recommended!)",
+			Value:     &plugin.InsecureSkipVerify,
+		},
+		{
+			Path:      "trusted-ca-file",
+			Env:       "",
+			Argument:  "trusted-ca-file",
+			Shorthand: "t",
+			Default:   "",
+			Usage:     "TLS CA certificate bundle in PEM format, or a directory of them",
+			Value:     &plugin.TrustedCAFile,
+		},
+		{
+			Path:      "use-system-cas-plus",
+			Env:       "",
+			Argument:  "use-system-cas-plus",
+			Shorthand: "",
+			Default:   false,
+			Usage:     "Add the CA certificates from --trusted-ca-file to the system trust store rather than replacing it",
+			Value:     &plugin.UseSystemCAsPlus,
+		},
+		{
+			Path:      "timeout",
+			Env:       "",
+			Argument:  "timeout",
+			Shorthand: "T",
+			Default:   15,
+			Usage:     "Request timeout in seconds, applied to each request",
+			Value:     &plugin.Timeout,
+		},
+		{
+			Path:      "header",
+			Env:       "",
+			Argument:  "header",
+			Shorthand: "H",
+			Default:   []string{},
+			Usage:     "Additional header(s) to send in each request",
+			Value:     &plugin.Headers,
+		},
+		{
+			Path:      "mtls-key-file",
+			Env:       "",
+			Argument:  "mtls-key-file",
+			Shorthand: "K",
+			Default:   "",
+			Usage:     "Key file for mutual TLS auth in PEM format",
+			Value:     &plugin.MTLSKeyFile,
+		},
+		{
+			Path:      "mtls-cert-file",
+			Env:       "",
+			Argument:  "mtls-cert-file",
+			Shorthand: "C",
+			Default:   "",
+			Usage:     "Certificate file for mutual TLS auth in PEM format",
+			Value:     &plugin.MTLSCertFile,
+		},
+		{
+			Path:      "depth",
+			Env:       "",
+			Argument:  "depth",
+			Shorthand: "d",
+			Default:   1,
+			Usage:     "Number of levels of links to follow from the starting URL",
+			Value:     &plugin.Depth,
+		},
+		{
+			Path:      "limit",
+			Env:       "",
+			Argument:  "limit",
+			Shorthand: "l",
+			Default:   100,
+			Usage:     "Maximum number of links to check",
+			Value:     &plugin.Limit,
+		},
+		{
+			Path:      "concurrency",
+			Env:       "",
+			Argument:  "concurrency",
+			Shorthand: "n",
+			Default:   5,
+			Usage:     "Number of links to check concurrently",
+			Value:     &plugin.Concurrency,
+		},
+		{
+			Path:      "warning",
+			Env:       "",
+			Argument:  "warning",
+			Shorthand: "w",
+			Default:   1,
+			Usage:     "Number of broken links at which to return a warning",
+			Value:     &plugin.Warning,
+		},
+		{
+			Path:      "critical",
+			Env:       "",
+			Argument:  "critical",
+			Shorthand: "c",
+			Default:   5,
+			Usage:     "Number of broken links at which to return a critical",
+			Value:     &plugin.Critical,
+		},
+		{
+			Path:      "sitemap-max-age",
+			Env:       "",
+			Argument:  "sitemap-max-age",
+			Shorthand: "",
+			Default:   "",
+			Usage:     "Check the freshness of the sitemap at --url instead of crawling, returning a critical if its newest lastmod is older than this duration (e.g. 48h)",
+			Value:     &plugin.SitemapMaxAge,
+		},
+		{
+			Path:      "sitemap-min-urls",
+			Env:       "",
+			Argument:  "sitemap-min-urls",
+			Shorthand: "",
+			Default:   0,
+			Usage:     "Check the sitemap at --url instead of crawling, returning a critical if it lists fewer URLs than this",
+			Value:     &plugin.SitemapMinURLs,
+		},
+	}
+)
+
+func main() {
+	options = append(options, plugin.Proxy.Options()...)
+	options = append(options, plugin.Transport.Options()...)
+	options = append(options, plugin.Source.Options()...)
+	options = append(options, plugin.Resolver.Options()...)
+	options = append(options, plugin.URLParsing.Options()...)
+	options = append(options, plugin.HeadersFile.Options()...)
+	options = append(options, plugin.Record.Options()...)
+	options = append(options, plugin.Log.Options()...)
+	options = append(options, plugin.Overrides.Options()...)
+	options = append(options, plugin.Status.Options()...)
+	options = append(options, plugin.Metrics.Options()...)
+	buildinfo.Handle(plugin.PluginConfig.Name, options, os.Args[1:])
+	exitstatus.ParseFlags(plugin.PluginConfig.Name, options, os.Args[1:])
+	check := sensu.NewGoCheck(&plugin.PluginConfig, options, plugin.Status.Wrap(plugin.PluginConfig.Name, checkArgs), plugin.Record.Wrap(plugin.PluginConfig.Name, plugin.Metrics.Wrap(plugin.PluginConfig.Name, plugin.Status.Wrap(plugin.PluginConfig.Name, executeCheck))), overrides.Requested(os.Args[1:]))
+	check.Execute()
+}
+
+func checkArgs(event *corev2.Event) (int, error) {
+	if err := plugin.Log.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	if err := plugin.URLParsing.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+
+	if len(plugin.URL) == 0 {
+		return sensu.CheckStateUnknown, fmt.Errorf("--url or CHECK_URL environment variable is required")
+	}
+	checkURL, err := httpclient.ParseURL("--url", plugin.URL)
+	if err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	plugin.URL = checkURL.String()
+	headers, err := plugin.HeadersFile.Headers(event)
+	if err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	plugin.Headers = append(headers, plugin.Headers...)
+	if len(plugin.Headers) > 0 {
+		for _, header := range plugin.Headers {
+			headerSplit := strings.SplitN(header, ":", 2)
+			if len(headerSplit) != 2 {
+				return sensu.CheckStateUnknown, fmt.Errorf("--header %q value malformed should be \"Header-Name: Header Value\"", header)
+			}
+		}
+	}
+	if plugin.Depth < 1 {
+		return sensu.CheckStateUnknown, fmt.Errorf("--depth must be 1 or greater")
+	}
+	if plugin.Limit < 1 {
+		return sensu.CheckStateUnknown, fmt.Errorf("--limit must be 1 or greater")
+	}
+	if plugin.Concurrency < 1 {
+		return sensu.CheckStateUnknown, fmt.Errorf("--concurrency must be 1 or greater")
+	}
+	if plugin.Warning < 1 || plugin.Critical < 1 {
+		return sensu.CheckStateUnknown, fmt.Errorf("--warning and --critical must be 1 or greater")
+	}
+	if plugin.Critical < plugin.Warning {
+		return sensu.CheckStateUnknown, fmt.Errorf("--critical must be greater than or equal to --warning")
+	}
+	sitemapMaxAge = 0
+	if len(plugin.SitemapMaxAge) > 0 {
+		if sitemapMaxAge, err = time.ParseDuration(plugin.SitemapMaxAge); err != nil {
+			return sensu.CheckStateUnknown, fmt.Errorf("--sitemap-max-age: %v", err)
+		}
+		if sitemapMaxAge <= 0 {
+			return sensu.CheckStateUnknown, fmt.Errorf("--sitemap-max-age must be greater than 0")
+		}
+	}
+	if plugin.SitemapMinURLs < 0 {
+		return sensu.CheckStateUnknown, fmt.Errorf("--sitemap-min-urls must be 0 or greater")
+	}
+	if len(plugin.TrustedCAFile) > 0 {
+		caCertPool, err := httpclient.LoadCACerts(plugin.TrustedCAFile, plugin.UseSystemCAsPlus)
+		if err != nil {
+			return sensu.CheckStateUnknown, fmt.Errorf("Error loading specified CA file: %v", err)
+		}
+		tlsConfig.RootCAs = caCertPool
+	}
+	tlsConfig.InsecureSkipVerify = plugin.InsecureSkipVerify
+
+	if (len(plugin.MTLSKeyFile) > 0 && len(plugin.MTLSCertFile) == 0) || (len(plugin.MTLSCertFile) > 0 && len(plugin.MTLSKeyFile) == 0) {
+		return sensu.CheckStateUnknown, fmt.Errorf("mTLS auth requires both --mtls-key-file and --mtls-cert-file")
+	}
+	if len(plugin.MTLSKeyFile) > 0 && len(plugin.MTLSCertFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(plugin.MTLSCertFile, plugin.MTLSKeyFile)
+		if err != nil {
+			return sensu.CheckStateUnknown, fmt.Errorf("Failed to load mTLS key pair %s/%s: %v", plugin.MTLSCertFile, plugin.MTLSKeyFile, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if err := plugin.Proxy.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	if err := plugin.Transport.Validate(&plugin.Proxy); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	if err := plugin.Source.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	if err := plugin.Resolver.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+
+	if err := plugin.Record.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+
+	return sensu.CheckStateOK, nil
+}
+
+func executeCheck(event *corev2.Event) (int, error) {
+
+	client := httpclient.New(&tlsConfig, time.Duration(plugin.Timeout)*time.Second, true, plugin.Proxy.Configure, plugin.Source.Configure, plugin.Resolver.Configure, plugin.Transport.Configure)
+
+	start, err := url.Parse(plugin.URL)
+	if err != nil {
+		fmt.Fprintf(selfmetrics.Stdout, "%s UNKNOWN: url parse error: %s\n", plugin.PluginConfig.Name, err)
+		return sensu.CheckStateUnknown, nil
+	}
+
+	if sitemapMaxAge > 0 || plugin.SitemapMinURLs > 0 {
+		return checkSitemap(client, start, time.Now())
+	}
+
+	root := checkLink(client, start, link{URL: plugin.URL}, true)
+	if root.broken() {
+		if root.Err != nil {
+			fmt.Fprintf(selfmetrics.Stdout, "%s CRITICAL: failed to fetch %s: %v\n", plugin.PluginConfig.Name, plugin.URL, httpclient.Describe(root.Err))
+		} else {
+			fmt.Fprintf(selfmetrics.Stdout, "%s CRITICAL: HTTP Status %v for %s\n", plugin.PluginConfig.Name, root.StatusCode, plugin.URL)
+		}
+		return sensu.CheckStateCritical, nil
+	}
+
+	results := crawl(client, start, root)
+	broken := []linkResult{}
+	for _, result := range results {
+		if result.broken() {
+			broken = append(broken, result)
+		}
+	}
+
+	perfdata := fmt.Sprintf("links_checked=%d, broken_links=%d", len(results), len(broken))
+	summary := fmt.Sprintf("%d of %d links from %s are broken", len(broken), len(results), plugin.URL)
+	if len(broken) > 0 {
+		summary = fmt.Sprintf("%s: %s", summary, describeBroken(broken))
+	}
+
+	switch {
+	case len(broken) >= plugin.Critical:
+		fmt.Fprintf(selfmetrics.Stdout, "%s CRITICAL: %s | %s\n", plugin.PluginConfig.Name, summary, perfdata)
+		return sensu.CheckStateCritical, nil
+	case len(broken) >= plugin.Warning:
+		fmt.Fprintf(selfmetrics.Stdout, "%s WARNING: %s | %s\n", plugin.PluginConfig.Name, summary, perfdata)
+		return sensu.CheckStateWarning, nil
+	}
+
+	fmt.Fprintf(selfmetrics.Stdout, "%s OK: %s | %s\n", plugin.PluginConfig.Name, summary, perfdata)
+	return sensu.CheckStateOK, nil
+}
+
+// crawl checks the links found on the root page level by level, following
+// links found on pages up to --depth levels from the root, and stopping once
+// --limit links have been checked.
+func crawl(client *http.Client, start *url.URL, root linkResult) []linkResult {
+	seen := map[string]bool{root.URL: true}
+	results := []linkResult{}
+	pending := []linkResult{root}
+
+	for level := 1; level <= plugin.Depth && len(pending) > 0; level++ {
+		next := []link{}
+		for _, page := range pending {
+			for _, l := range page.Links {
+				if seen[l] || len(results)+len(next) >= plugin.Limit {
+					continue
+				}
+				seen[l] = true
+				next = append(next, link{URL: l, Source: page.URL, Level: level})
+			}
+		}
+		pending = checkLinks(client, start, next, level < plugin.Depth)
+		results = append(results, pending...)
+	}
+
+	return results
+}
+
+// checkLinks checks the provided links using --concurrency workers, returning
+// the results in the same order as links.
+func checkLinks(client *http.Client, start *url.URL, links []link, parse bool) []linkResult {
+	results := make([]linkResult, len(links))
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+
+	for i := 0; i < plugin.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range indexes {
+				results[idx] = checkLink(client, start, links[idx], parse)
+			}
+		}()
+	}
+	for i := range links {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	return results
+}
+
+// checkLink fetches l and, if parse is true, extracts the same origin links
+// from the response body.
+func checkLink(client *http.Client, start *url.URL, l link, parse bool) linkResult {
+	result := linkResult{link: l}
+
+	req, err := newRequest(l.URL)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	defer resp.Body.Close()
+	result.StatusCode = resp.StatusCode
+
+	if !parse || result.broken() {
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		return result
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	result.Links = sameOrigin(start, extractLinks(resp.Request.URL, resp.Header.Get("Content-Type"), body))
+	return result
+}
+
+// newRequest returns a GET request for rawURL with the --header headers.
+func newRequest(rawURL string) (*http.Request, error) {
+	req, err := http.NewRequest("GET", rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, header := range plugin.Headers {
+		headerSplit := strings.SplitN(header, ":", 2)
+		headerKey := strings.TrimSpace(headerSplit[0])
+		headerValue := strings.TrimSpace(headerSplit[1])
+		if strings.EqualFold(headerKey, "host") {
+			req.Host = headerValue
+			continue
+		}
+		req.Header.Set(headerKey, headerValue)
+	}
+	return req, nil
+}
+
+// checkSitemap checks the freshness of the sitemap at --url rather than its
+// links: the newest lastmod of its URLs must be within --sitemap-max-age and
+// it must list at least --sitemap-min-urls URLs. The sitemaps of a
+// sitemapindex are fetched, one level deep, and their URLs counted together.
+func checkSitemap(client *http.Client, start *url.URL, now time.Time) (int, error) {
+	root, err := fetchSitemap(client, plugin.URL)
+	if err != nil {
+		fmt.Fprintf(selfmetrics.Stdout, "%s CRITICAL: %v\n", plugin.PluginConfig.Name, err)
+		return sensu.CheckStateCritical, nil
+	}
+	urls := root.URLs
+	for _, child := range root.Sitemaps {
+		loc, err := start.Parse(strings.TrimSpace(child.Loc))
+		if err != nil {
+			fmt.Fprintf(selfmetrics.Stdout, "%s CRITICAL: sitemap %s lists invalid sitemap %q\n", plugin.PluginConfig.Name, plugin.URL, child.Loc)
+			return sensu.CheckStateCritical, nil
+		}
+		sm, err := fetchSitemap(client, loc.String())
+		if err != nil {
+			fmt.Fprintf(selfmetrics.Stdout, "%s CRITICAL: %v\n", plugin.PluginConfig.Name, err)
+			return sensu.CheckStateCritical, nil
+		}
+		urls = append(urls, sm.URLs...)
+	}
+
+	var newest time.Time
+	for _, u := range urls {
+		lastMod, ok := parseLastMod(u.LastMod)
+		if ok && lastMod.After(newest) {
+			newest = lastMod
+		}
+	}
+
+	problems := []string{}
+	perfdata := fmt.Sprintf("sitemap_urls=%d", len(urls))
+	summary := fmt.Sprintf("sitemap %s lists %d URLs", plugin.URL, len(urls))
+	if newest.IsZero() {
+		summary += ", none with a lastmod"
+		if sitemapMaxAge > 0 {
+			problems = append(problems, "no lastmod to check the age of")
+		}
+	} else {
+		age := now.Sub(newest)
+		summary += fmt.Sprintf(", newest lastmod %s", newest.Format(time.RFC3339))
+		perfdata += fmt.Sprintf(", sitemap_age=%d", int64(age.Seconds()))
+		if sitemapMaxAge > 0 && age > sitemapMaxAge {
+			problems = append(problems, fmt.Sprintf("newest lastmod is older than %s", sitemapMaxAge))
+		}
+	}
+	if len(urls) < plugin.SitemapMinURLs {
+		problems = append(problems, fmt.Sprintf("fewer than %d URLs", plugin.SitemapMinURLs))
+	}
+
+	if len(problems) > 0 {
+		fmt.Fprintf(selfmetrics.Stdout, "%s CRITICAL: %s: %s | %s\n", plugin.PluginConfig.Name, summary, strings.Join(problems, ", "), perfdata)
+		return sensu.CheckStateCritical, nil
+	}
+	fmt.Fprintf(selfmetrics.Stdout, "%s OK: %s | %s\n", plugin.PluginConfig.Name, summary, perfdata)
+	return sensu.CheckStateOK, nil
+}
+
+// fetchSitemap fetches and parses the sitemap at rawURL.
+func fetchSitemap(client *http.Client, rawURL string) (sitemap, error) {
+	var sm sitemap
+	req, err := newRequest(rawURL)
+	if err != nil {
+		return sm, fmt.Errorf("failed to fetch sitemap %s: %v", rawURL, err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return sm, fmt.Errorf("failed to fetch sitemap %s: %v", rawURL, httpclient.Describe(err))
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		return sm, fmt.Errorf("HTTP Status %v for sitemap %s", resp.StatusCode, rawURL)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return sm, fmt.Errorf("failed to read sitemap %s: %v", rawURL, err)
+	}
+	if err := xml.Unmarshal(body, &sm); err != nil {
+		return sm, fmt.Errorf("sitemap %s is not valid XML: %v", rawURL, err)
+	}
+	if sm.XMLName.Local != "urlset" && sm.XMLName.Local != "sitemapindex" {
+		return sm, fmt.Errorf("%s is not a sitemap, its root element is %q", rawURL, sm.XMLName.Local)
+	}
+	return sm, nil
+}
+
+// parseLastMod parses a sitemap lastmod entry in any of lastModLayouts.
+func parseLastMod(value string) (time.Time, bool) {
+	value = strings.TrimSpace(value)
+	for _, layout := range lastModLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// extractLinks returns the links found in body, which is parsed as a sitemap
+// if it is XML and as HTML otherwise. Relative links are resolved against
+// base.
+func extractLinks(base *url.URL, contentType string, body []byte) []string {
+	var refs []string
+	if strings.Contains(contentType, "xml") || bytes.HasPrefix(bytes.TrimSpace(body), []byte("<?xml")) {
+		var sm sitemap
+		if err := xml.Unmarshal(body, &sm); err == nil {
+			for _, u := range sm.URLs {
+				refs = append(refs, strings.TrimSpace(u.Loc))
+			}
+			for _, s := range sm.Sitemaps {
+				refs = append(refs, strings.TrimSpace(s.Loc))
+			}
+		}
+	} else {
+		refs = htmlLinks(body)
+	}
+
+	links := []string{}
+	for _, ref := range refs {
+		u, err := base.Parse(ref)
+		if err != nil {
+			continue
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			continue
+		}
+		u.Fragment = ""
+		links = append(links, u.String())
+	}
+	return links
+}
+
+// htmlLinks returns the raw values of the link attributes in an HTML document.
+func htmlLinks(body []byte) []string {
+	refs := []string{}
+	tokenizer := html.NewTokenizer(bytes.NewReader(body))
+	for {
+		tokenType := tokenizer.Next()
+		switch tokenType {
+		case html.ErrorToken:
+			return refs
+		case html.StartTagToken, html.SelfClosingTagToken:
+			token := tokenizer.Token()
+			attribute, ok := linkAttributes[token.Data]
+			if !ok {
+				continue
+			}
+			for _, attr := range token.Attr {
+				if attr.Key == attribute && len(strings.TrimSpace(attr.Val)) > 0 {
+					refs = append(refs, strings.TrimSpace(attr.Val))
+				}
+			}
+		}
+	}
+}
+
+// sameOrigin returns the links that share a scheme and host with start.
+func sameOrigin(start *url.URL, links []string) []string {
+	filtered := []string{}
+	for _, l := range links {
+		u, err := url.Parse(l)
+		if err != nil {
+			continue
+		}
+		if strings.EqualFold(u.Scheme, start.Scheme) && strings.EqualFold(u.Host, start.Host) {
+			filtered = append(filtered, l)
+		}
+	}
+	return filtered
+}
+
+// describeBroken summarizes up to maxBrokenOutput broken links for output.
+func describeBroken(broken []linkResult) string {
+	sort.Slice(broken, func(i, j int) bool { return broken[i].URL < broken[j].URL })
+	descriptions := []string{}
+	for i, result := range broken {
+		if i == maxBrokenOutput {
+			descriptions = append(descriptions, fmt.Sprintf("and %d more", len(broken)-maxBrokenOutput))
+			break
+		}
+		if result.Err != nil {
+			descriptions = append(descriptions, fmt.Sprintf("%s (%v, linked from %s)", result.URL, httpclient.Describe(result.Err), result.Source))
+		} else {
+			descriptions = append(descriptions, fmt.Sprintf("%s (%d, linked from %s)", result.URL, result.StatusCode, result.Source))
+		}
+	}
+	return strings.Join(descriptions, ", ")
+}
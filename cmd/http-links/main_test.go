@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	corev2 "github.com/sensu/sensu-go/api/core/v2"
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMain(t *testing.T) {
+}
+
+func newSite() *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, `<html><body>
+<a href="/about">About</a>
+<a href="/missing#top">Missing</a>
+<a href="https://elsewhere.example.com/">Elsewhere</a>
+<a href="mailto:info@example.com">Mail</a>
+<img src="/logo.png">
+</body></html>`)
+	})
+	mux.HandleFunc("/about", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, `<html><body><a href="/">Home</a><a href="team">Team</a></body></html>`)
+	})
+	mux.HandleFunc("/team", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "oops", http.StatusInternalServerError)
+	})
+	mux.HandleFunc("/logo.png", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+	})
+	mux.HandleFunc("/sitemap.xml", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/xml")
+		fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <url><loc>http://%s/about</loc></url>
+  <url><loc>http://%s/gone</loc></url>
+</urlset>`, r.Host, r.Host)
+	})
+	return httptest.NewServer(mux)
+}
+
+func TestExecuteCheck(t *testing.T) {
+	site := newSite()
+	defer site.Close()
+
+	testCases := []struct {
+		path         string
+		depth        int
+		limit        int
+		warning      int
+		critical     int
+		returnStatus int
+	}{
+		{"/", 1, 100, 1, 5, sensu.CheckStateWarning},
+		{"/", 1, 100, 2, 5, sensu.CheckStateOK},
+		{"/", 2, 100, 1, 2, sensu.CheckStateCritical},
+		{"/", 2, 1, 1, 2, sensu.CheckStateOK},
+		{"/sitemap.xml", 1, 100, 1, 1, sensu.CheckStateCritical},
+		{"/nothing", 1, 100, 1, 5, sensu.CheckStateCritical},
+	}
+
+	for _, tc := range testCases {
+		assert := assert.New(t)
+		event := corev2.FixtureEvent("entity1", "check")
+		plugin.URL = site.URL + tc.path
+		plugin.Depth = tc.depth
+		plugin.Limit = tc.limit
+		plugin.Concurrency = 2
+		plugin.Warning = tc.warning
+		plugin.Critical = tc.critical
+		status, err := checkArgs(event)
+		assert.NoError(err)
+		assert.Equal(sensu.CheckStateOK, status)
+		status, err = executeCheck(event)
+		assert.NoError(err)
+		assert.Equal(tc.returnStatus, status, "url %s depth %d", tc.path, tc.depth)
+	}
+}
+
+func TestExtractLinks(t *testing.T) {
+	assert := assert.New(t)
+	base, err := url.Parse("http://example.com/docs/")
+	require.NoError(t, err)
+
+	links := extractLinks(base, "text/html", []byte(`<a href="intro">x</a><a href="/top#a">y</a><script src="//cdn.example.com/app.js"></script><a href="javascript:void(0)">z</a>`))
+	assert.Equal([]string{"http://example.com/docs/intro", "http://example.com/top", "http://cdn.example.com/app.js"}, links)
+	assert.Equal([]string{"http://example.com/docs/intro", "http://example.com/top"}, sameOrigin(base, links))
+
+	links = extractLinks(base, "", []byte(`<?xml version="1.0"?><sitemapindex><sitemap><loc> http://example.com/a.xml </loc></sitemap></sitemapindex>`))
+	assert.Equal([]string{"http://example.com/a.xml"}, links)
+}
+
+func TestCheckArgs(t *testing.T) {
+	assert := assert.New(t)
+	event := corev2.FixtureEvent("entity1", "check")
+
+	plugin.URL = "http://localhost:80/"
+	plugin.Depth = 1
+	plugin.Limit = 100
+	plugin.Concurrency = 5
+	plugin.Warning = 5
+	plugin.Critical = 1
+	status, err := checkArgs(event)
+	assert.Error(err)
+	assert.Equal(sensu.CheckStateUnknown, status)
+
+	plugin.Critical = 5
+	plugin.Depth = 0
+	status, err = checkArgs(event)
+	assert.Error(err)
+	assert.Equal(sensu.CheckStateUnknown, status)
+	plugin.Depth = 1
+
+	for _, maxAge := range []string{"2 days", "-1h"} {
+		plugin.SitemapMaxAge = maxAge
+		status, err = checkArgs(event)
+		assert.Error(err, maxAge)
+		assert.Equal(sensu.CheckStateUnknown, status)
+	}
+	plugin.SitemapMaxAge = ""
+}
+
+func TestExecuteCheckSitemap(t *testing.T) {
+	now := time.Now().UTC()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sitemap.xml", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <url><loc>http://%s/a</loc><lastmod>%s</lastmod></url>
+  <url><loc>http://%s/b</loc><lastmod>%s</lastmod></url>
+  <url><loc>http://%s/c</loc></url>
+</urlset>`, r.Host, now.Add(-72*time.Hour).Format("2006-01-02"), r.Host, now.Add(-3*time.Hour).Format(time.RFC3339), r.Host)
+	})
+	mux.HandleFunc("/posts.xml", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `<urlset><url><loc>/post</loc></url></urlset>`)
+	})
+	mux.HandleFunc("/index.xml", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `<sitemapindex><sitemap><loc>/sitemap.xml</loc></sitemap><sitemap><loc>/posts.xml</loc></sitemap></sitemapindex>`)
+	})
+	mux.HandleFunc("/page.html", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `<html><body></body></html>`)
+	})
+	site := httptest.NewServer(mux)
+	defer site.Close()
+	defer func() {
+		plugin.SitemapMaxAge = ""
+		plugin.SitemapMinURLs = 0
+		sitemapMaxAge = 0
+	}()
+
+	testCases := []struct {
+		path         string
+		maxAge       string
+		minURLs      int
+		returnStatus int
+	}{
+		{"/sitemap.xml", "6h", 0, sensu.CheckStateOK},
+		{"/sitemap.xml", "1h", 0, sensu.CheckStateCritical},
+		{"/sitemap.xml", "", 3, sensu.CheckStateOK},
+		{"/sitemap.xml", "", 4, sensu.CheckStateCritical},
+		{"/index.xml", "6h", 4, sensu.CheckStateOK},
+		{"/index.xml", "", 5, sensu.CheckStateCritical},
+		{"/posts.xml", "", 1, sensu.CheckStateOK},
+		{"/posts.xml", "6h", 0, sensu.CheckStateCritical},
+		{"/page.html", "", 1, sensu.CheckStateCritical},
+		{"/missing.xml", "6h", 0, sensu.CheckStateCritical},
+	}
+
+	for _, tc := range testCases {
+		assert := assert.New(t)
+		event := corev2.FixtureEvent("entity1", "check")
+		plugin.URL = site.URL + tc.path
+		plugin.Depth = 1
+		plugin.Limit = 100
+		plugin.Concurrency = 2
+		plugin.Warning = 1
+		plugin.Critical = 5
+		plugin.SitemapMaxAge = tc.maxAge
+		plugin.SitemapMinURLs = tc.minURLs
+		status, err := checkArgs(event)
+		assert.NoError(err)
+		assert.Equal(sensu.CheckStateOK, status)
+		status, err = executeCheck(event)
+		assert.NoError(err)
+		assert.Equal(tc.returnStatus, status, "url %s max age %q min urls %d", tc.path, tc.maxAge, tc.minURLs)
+	}
+}
+
+func TestParseLastMod(t *testing.T) {
+	assert := assert.New(t)
+	for value, expected := range map[string]string{
+		"2024-05-01":                   "2024-05-01T00:00:00Z",
+		" 2024-05-01T10:30+02:00 ":     "2024-05-01T08:30:00Z",
+		"2024-05-01T10:30:15Z":         "2024-05-01T10:30:15Z",
+		"2024-05-01T10:30:15.25-05:00": "2024-05-01T15:30:15Z",
+	} {
+		lastMod, ok := parseLastMod(value)
+		assert.True(ok, value)
+		assert.Equal(expected, lastMod.UTC().Truncate(time.Second).Format(time.RFC3339), value)
+	}
+	_, ok := parseLastMod("yesterday")
+	assert.False(ok)
+}
@@ -0,0 +1,559 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/nixwiz/http-checks/internal/buildinfo"
+	"github.com/nixwiz/http-checks/internal/exitstatus"
+	"github.com/nixwiz/http-checks/internal/httpclient"
+	"github.com/nixwiz/http-checks/internal/logging"
+	"github.com/nixwiz/http-checks/internal/overrides"
+	"github.com/nixwiz/http-checks/internal/secret"
+	"github.com/nixwiz/http-checks/internal/selfmetrics"
+	corev2 "github.com/sensu/sensu-go/api/core/v2"
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+)
+
+// Config represents the check plugin config.
+type Config struct {
+	sensu.PluginConfig
+	IssuerURL          string
+	DiscoveryURL       string
+	ClientID           string
+	ClientSecret       string
+	ClientSecretFile   string
+	Scopes             []string
+	Audience           string
+	AuthMethod         string
+	TrustedCAFile      string
+	UseSystemCAsPlus   bool
+	InsecureSkipVerify bool
+	Timeout            int
+	MTLSKeyFile        string
+	MTLSCertFile       string
+	Warning            string
+	Critical           string
+	MinExpiry          int
+	Proxy              httpclient.ProxyConfig
+	Transport          httpclient.TransportConfig
+	Source             httpclient.SourceConfig
+	Resolver           httpclient.ResolverConfig
+	URLParsing         httpclient.URLConfig
+	Record             httpclient.RecordConfig
+	Log                logging.Config
+	Overrides          overrides.Config
+	Status             exitstatus.Config
+	Metrics            selfmetrics.Config
+}
+
+// discovery is the subset of the OpenID Connect discovery document used by
+// the check.
+type discovery struct {
+	Issuer        string `json:"issuer"`
+	TokenEndpoint string `json:"token_endpoint"`
+	JWKSURI       string `json:"jwks_uri"`
+}
+
+// jwks is a JSON Web Key Set, only the key IDs are needed.
+type jwks struct {
+	Keys []struct {
+		KeyID string `json:"kid"`
+	} `json:"keys"`
+}
+
+// tokenResponse is a successful (or error) response from the token endpoint.
+type tokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	TokenType        string `json:"token_type"`
+	ExpiresIn        int64  `json:"expires_in"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+var (
+	tlsConfig         tls.Config
+	warning, critical time.Duration
+
+	plugin = Config{
+		PluginConfig: sensu.PluginConfig{
+			Name:     "http-oauth",
+			Short:    "OAuth2/OpenID Connect Provider Check",
+			Keyspace: "sensu.io/plugins/http-oauth/config",
+		},
+	}
+
+	options = []*sensu.PluginConfigOption{
+		{
+			Path:      "issuer-url",
+			Env:       "CHECK_ISSUER_URL",
+			Argument:  "issuer-url",
+			Shorthand: "u",
+			Default:   "",
+			Usage:     "Issuer URL of the provider",
+			Value:     &plugin.IssuerURL,
+		},
+		{
+			Path:      "discovery-url",
+			Env:       "",
+			Argument:  "discovery-url",
+			Shorthand: "",
+			Default:   "",
+			Usage:     "URL of the discovery document (defaults to the issuer URL + /.well-known/openid-configuration)",
+			Value:     &plugin.DiscoveryURL,
+		},
+		{
+			Path:      "client-id",
+			Env:       "CHECK_CLIENT_ID",
+			Argument:  "client-id",
+			Shorthand: "",
+			Default:   "",
+			Usage:     "Client ID for the client credentials grant, if not provided no token is requested",
+			Value:     &plugin.ClientID,
+		},
+		{
+			Path:      "client-secret",
+			Env:       "CHECK_CLIENT_SECRET",
+			Argument:  "client-secret",
+			Shorthand: "",
+			Default:   "",
+			Secret:    true,
+			Usage:     "Client secret for the client credentials grant",
+			Value:     &plugin.ClientSecret,
+		},
+		{
+			Path:      "client-secret-file",
+			Env:       "",
+			Argument:  "client-secret-file",
+			Shorthand: "",
+			Default:   "",
+			Usage:     "File holding the client secret, instead of --client-secret",
+			Value:     &plugin.ClientSecretFile,
+		},
+		{
+			Path:      "scope",
+			Env:       "",
+			Argument:  "scope",
+			Shorthand: "",
+			Default:   []string{},
+			Usage:     "Scope(s) to request with the token",
+			Value:     &plugin.Scopes,
+		},
+		{
+			Path:      "audience",
+			Env:       "",
+			Argument:  "audience",
+			Shorthand: "",
+			Default:   "",
+			Usage:     "Audience to request with the token, for providers that require it",
+			Value:     &plugin.Audience,
+		},
+		{
+			Path:      "auth-method",
+			Env:       "",
+			Argument:  "auth-method",
+			Shorthand: "",
+			Default:   "basic",
+			Usage:     "How to send the client credentials, either basic (HTTP Basic auth) or post (in the request body)",
+			Value:     &plugin.AuthMethod,
+		},
+		{
+			Path:      "insecure-skip-verify",
+			Env:       "",
+			Argument:  "insecure-skip-verify",
+			Shorthand: "i",
+			Default:   false,
+			Usage:     "Skip TLS certificate verification (not recommended!)",
+			Value:     &plugin.InsecureSkipVerify,
+		},
+		{
+			Path:      "trusted-ca-file",
+			Env:       "",
+			Argument:  "trusted-ca-file",
+			Shorthand: "t",
+			Default:   "",
+			Usage:     "TLS CA certificate bundle in PEM format, or a directory of them",
+			Value:     &plugin.TrustedCAFile,
+		},
+		{
+			Path:      "use-system-cas-plus",
+			Env:       "",
+			Argument:  "use-system-cas-plus",
+			Shorthand: "",
+			Default:   false,
+			Usage:     "Add the CA certificates from --trusted-ca-file to the system trust store rather than replacing it",
+			Value:     &plugin.UseSystemCAsPlus,
+		},
+		{
+			Path:      "timeout",
+			Env:       "",
+			Argument:  "timeout",
+			Shorthand: "T",
+			Default:   15,
+			Usage:     "Request timeout in seconds, applied to each request",
+			Value:     &plugin.Timeout,
+		},
+		{
+			Path:      "mtls-key-file",
+			Env:       "",
+			Argument:  "mtls-key-file",
+			Shorthand: "K",
+			Default:   "",
+			Usage:     "Key file for mutual TLS auth in PEM format",
+			Value:     &plugin.MTLSKeyFile,
+		},
+		{
+			Path:      "mtls-cert-file",
+			Env:       "",
+			Argument:  "mtls-cert-file",
+			Shorthand: "C",
+			Default:   "",
+			Usage:     "Certificate file for mutual TLS auth in PEM format",
+			Value:     &plugin.MTLSCertFile,
+		},
+		{
+			Path:      "warning",
+			Env:       "",
+			Argument:  "warning",
+			Shorthand: "w",
+			Default:   "1s",
+			Usage:     "Warning threshold for token issuance latency, can be expressed as seconds or milliseconds (1s = 1000ms)",
+			Value:     &plugin.Warning,
+		},
+		{
+			Path:      "critical",
+			Env:       "",
+			Argument:  "critical",
+			Shorthand: "c",
+			Default:   "3s",
+			Usage:     "Critical threshold for token issuance latency, can be expressed as seconds or milliseconds (1s = 1000ms)",
+			Value:     &plugin.Critical,
+		},
+		{
+			Path:      "min-expiry",
+			Env:       "",
+			Argument:  "min-expiry",
+			Shorthand: "",
+			Default:   60,
+			Usage:     "Minimum lifetime in seconds of an issued token",
+			Value:     &plugin.MinExpiry,
+		},
+	}
+)
+
+func main() {
+	options = append(options, plugin.Proxy.Options()...)
+	options = append(options, plugin.Transport.Options()...)
+	options = append(options, plugin.Source.Options()...)
+	options = append(options, plugin.Resolver.Options()...)
+	options = append(options, plugin.URLParsing.Options()...)
+	options = append(options, plugin.Record.Options()...)
+	options = append(options, plugin.Log.Options()...)
+	options = append(options, plugin.Overrides.Options()...)
+	options = append(options, plugin.Status.Options()...)
+	options = append(options, plugin.Metrics.Options()...)
+	buildinfo.Handle(plugin.PluginConfig.Name, options, os.Args[1:])
+	exitstatus.ParseFlags(plugin.PluginConfig.Name, options, os.Args[1:])
+	check := sensu.NewGoCheck(&plugin.PluginConfig, options, plugin.Status.Wrap(plugin.PluginConfig.Name, checkArgs), plugin.Record.Wrap(plugin.PluginConfig.Name, plugin.Metrics.Wrap(plugin.PluginConfig.Name, plugin.Status.Wrap(plugin.PluginConfig.Name, executeCheck))), overrides.Requested(os.Args[1:]))
+	check.Execute()
+}
+
+func checkArgs(event *corev2.Event) (int, error) {
+	if err := plugin.Log.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	if err := plugin.URLParsing.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+
+	var err error
+
+	if len(plugin.IssuerURL) == 0 {
+		return sensu.CheckStateUnknown, fmt.Errorf("--issuer-url or CHECK_ISSUER_URL environment variable is required")
+	}
+	issuerURL, err := httpclient.ParseURL("--issuer-url", plugin.IssuerURL)
+	if err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	plugin.IssuerURL = issuerURL.String()
+	if len(plugin.DiscoveryURL) == 0 {
+		plugin.DiscoveryURL = strings.TrimSuffix(plugin.IssuerURL, "/") + "/.well-known/openid-configuration"
+	}
+	discoveryURL, err := httpclient.ParseURL("--discovery-url", plugin.DiscoveryURL)
+	if err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	plugin.DiscoveryURL = discoveryURL.String()
+	if len(plugin.ClientSecretFile) > 0 {
+		if len(plugin.ClientSecret) > 0 {
+			return sensu.CheckStateUnknown, fmt.Errorf("--client-secret and --client-secret-file are mutually exclusive")
+		}
+		plugin.ClientSecret, err = secret.ReadFile(plugin.ClientSecretFile)
+		if err != nil {
+			return sensu.CheckStateUnknown, fmt.Errorf("--client-secret-file: %v", err)
+		}
+	}
+	if len(plugin.ClientSecret) > 0 && len(plugin.ClientID) == 0 {
+		return sensu.CheckStateUnknown, fmt.Errorf("--client-secret requires --client-id")
+	}
+	if plugin.AuthMethod != "basic" && plugin.AuthMethod != "post" {
+		return sensu.CheckStateUnknown, fmt.Errorf("--auth-method must be either basic or post")
+	}
+	warning, err = time.ParseDuration(plugin.Warning)
+	if err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	critical, err = time.ParseDuration(plugin.Critical)
+	if err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	if len(plugin.TrustedCAFile) > 0 {
+		caCertPool, err := httpclient.LoadCACerts(plugin.TrustedCAFile, plugin.UseSystemCAsPlus)
+		if err != nil {
+			return sensu.CheckStateUnknown, fmt.Errorf("Error loading specified CA file: %v", err)
+		}
+		tlsConfig.RootCAs = caCertPool
+	}
+	tlsConfig.InsecureSkipVerify = plugin.InsecureSkipVerify
+
+	if (len(plugin.MTLSKeyFile) > 0 && len(plugin.MTLSCertFile) == 0) || (len(plugin.MTLSCertFile) > 0 && len(plugin.MTLSKeyFile) == 0) {
+		return sensu.CheckStateUnknown, fmt.Errorf("mTLS auth requires both --mtls-key-file and --mtls-cert-file")
+	}
+	if len(plugin.MTLSKeyFile) > 0 && len(plugin.MTLSCertFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(plugin.MTLSCertFile, plugin.MTLSKeyFile)
+		if err != nil {
+			return sensu.CheckStateUnknown, fmt.Errorf("Failed to load mTLS key pair %s/%s: %v", plugin.MTLSCertFile, plugin.MTLSKeyFile, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if err := plugin.Proxy.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	if err := plugin.Transport.Validate(&plugin.Proxy); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	if err := plugin.Source.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	if err := plugin.Resolver.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+
+	if err := plugin.Record.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+
+	return sensu.CheckStateOK, nil
+}
+
+func executeCheck(event *corev2.Event) (int, error) {
+
+	client := httpclient.New(&tlsConfig, time.Duration(plugin.Timeout)*time.Second, true, plugin.Proxy.Configure, plugin.Source.Configure, plugin.Resolver.Configure, plugin.Transport.Configure)
+
+	var doc discovery
+	start := time.Now()
+	if err := getJSON(client, plugin.DiscoveryURL, &doc); err != nil {
+		fmt.Fprintf(selfmetrics.Stdout, "%s CRITICAL: discovery document: %v\n", plugin.PluginConfig.Name, httpclient.Describe(err))
+		return sensu.CheckStateCritical, nil
+	}
+	discoveryDuration := time.Since(start)
+	if strings.TrimSuffix(doc.Issuer, "/") != strings.TrimSuffix(plugin.IssuerURL, "/") {
+		fmt.Fprintf(selfmetrics.Stdout, "%s CRITICAL: discovery document issuer %q does not match %q\n", plugin.PluginConfig.Name, doc.Issuer, plugin.IssuerURL)
+		return sensu.CheckStateCritical, nil
+	}
+	if len(doc.JWKSURI) == 0 {
+		fmt.Fprintf(selfmetrics.Stdout, "%s CRITICAL: discovery document does not contain a jwks_uri\n", plugin.PluginConfig.Name)
+		return sensu.CheckStateCritical, nil
+	}
+
+	var keys jwks
+	start = time.Now()
+	if err := getJSON(client, doc.JWKSURI, &keys); err != nil {
+		fmt.Fprintf(selfmetrics.Stdout, "%s CRITICAL: JWKS: %v\n", plugin.PluginConfig.Name, httpclient.Describe(err))
+		return sensu.CheckStateCritical, nil
+	}
+	jwksDuration := time.Since(start)
+	if len(keys.Keys) == 0 {
+		fmt.Fprintf(selfmetrics.Stdout, "%s CRITICAL: JWKS at %s contains no keys\n", plugin.PluginConfig.Name, doc.JWKSURI)
+		return sensu.CheckStateCritical, nil
+	}
+
+	perfdata := fmt.Sprintf("discovery_duration=%0.6f, jwks_duration=%0.6f, jwks_keys=%d", discoveryDuration.Seconds(), jwksDuration.Seconds(), len(keys.Keys))
+	if len(plugin.ClientID) == 0 {
+		fmt.Fprintf(selfmetrics.Stdout, "%s OK: %s discovery document and JWKS (%d keys) available | %s\n", plugin.PluginConfig.Name, plugin.IssuerURL, len(keys.Keys), perfdata)
+		return sensu.CheckStateOK, nil
+	}
+
+	if len(doc.TokenEndpoint) == 0 {
+		fmt.Fprintf(selfmetrics.Stdout, "%s CRITICAL: discovery document does not contain a token_endpoint | %s\n", plugin.PluginConfig.Name, perfdata)
+		return sensu.CheckStateCritical, nil
+	}
+	start = time.Now()
+	token, err := requestToken(client, doc.TokenEndpoint)
+	tokenDuration := time.Since(start)
+	if err != nil {
+		fmt.Fprintf(selfmetrics.Stdout, "%s CRITICAL: client credentials grant: %v | %s\n", plugin.PluginConfig.Name, httpclient.Describe(err), perfdata)
+		return sensu.CheckStateCritical, nil
+	}
+
+	expiresIn, err := tokenExpiry(token, keys, time.Now())
+	if err != nil {
+		fmt.Fprintf(selfmetrics.Stdout, "%s CRITICAL: issued token: %v | %s\n", plugin.PluginConfig.Name, err, perfdata)
+		return sensu.CheckStateCritical, nil
+	}
+	perfdata = fmt.Sprintf("%s, token_duration=%0.6f, token_expires_in=%d", perfdata, tokenDuration.Seconds(), expiresIn)
+	if expiresIn < int64(plugin.MinExpiry) {
+		fmt.Fprintf(selfmetrics.Stdout, "%s CRITICAL: issued token expires in %ds, expected at least %ds | %s\n", plugin.PluginConfig.Name, expiresIn, plugin.MinExpiry, perfdata)
+		return sensu.CheckStateCritical, nil
+	}
+
+	summary := fmt.Sprintf("token issued by %s in %0.6fs, expires in %ds", plugin.IssuerURL, tokenDuration.Seconds(), expiresIn)
+	switch {
+	case tokenDuration > critical:
+		fmt.Fprintf(selfmetrics.Stdout, "%s CRITICAL: %s | %s\n", plugin.PluginConfig.Name, summary, perfdata)
+		return sensu.CheckStateCritical, nil
+	case tokenDuration > warning:
+		fmt.Fprintf(selfmetrics.Stdout, "%s WARNING: %s | %s\n", plugin.PluginConfig.Name, summary, perfdata)
+		return sensu.CheckStateWarning, nil
+	}
+
+	fmt.Fprintf(selfmetrics.Stdout, "%s OK: %s | %s\n", plugin.PluginConfig.Name, summary, perfdata)
+	return sensu.CheckStateOK, nil
+}
+
+// getJSON fetches url and decodes the JSON response into v.
+func getJSON(client *http.Client, url string, v interface{}) error {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("HTTP Status %v for %s", resp.StatusCode, url)
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("invalid JSON from %s: %v", url, err)
+	}
+	return nil
+}
+
+// requestToken performs a client credentials grant against endpoint.
+func requestToken(client *http.Client, endpoint string) (*tokenResponse, error) {
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	if len(plugin.Scopes) > 0 {
+		form.Set("scope", strings.Join(plugin.Scopes, " "))
+	}
+	if len(plugin.Audience) > 0 {
+		form.Set("audience", plugin.Audience)
+	}
+	if plugin.AuthMethod == "post" {
+		form.Set("client_id", plugin.ClientID)
+		form.Set("client_secret", plugin.ClientSecret)
+	}
+
+	req, err := http.NewRequest("POST", endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if plugin.AuthMethod == "basic" {
+		req.SetBasicAuth(url.QueryEscape(plugin.ClientID), url.QueryEscape(plugin.ClientSecret))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var token tokenResponse
+	if err := json.Unmarshal(body, &token); err != nil {
+		return nil, fmt.Errorf("HTTP Status %v for %s, invalid JSON: %v", resp.StatusCode, endpoint, err)
+	}
+	if resp.StatusCode != http.StatusOK || len(token.Error) > 0 {
+		if len(token.ErrorDescription) > 0 {
+			return nil, fmt.Errorf("HTTP Status %v for %s: %s: %s", resp.StatusCode, endpoint, token.Error, token.ErrorDescription)
+		}
+		return nil, fmt.Errorf("HTTP Status %v for %s: %s", resp.StatusCode, endpoint, token.Error)
+	}
+	if len(token.AccessToken) == 0 {
+		return nil, fmt.Errorf("no access_token in response from %s", endpoint)
+	}
+	return &token, nil
+}
+
+// tokenExpiry returns the number of seconds until the token expires. If the
+// access token is a JWT its exp claim is used and its kid must be present in
+// keys, otherwise expires_in from the token response is used.
+func tokenExpiry(token *tokenResponse, keys jwks, now time.Time) (int64, error) {
+	parts := strings.Split(token.AccessToken, ".")
+	if len(parts) != 3 {
+		if token.ExpiresIn == 0 {
+			return 0, fmt.Errorf("no expires_in in token response")
+		}
+		return token.ExpiresIn, nil
+	}
+
+	var header struct {
+		KeyID string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return 0, fmt.Errorf("invalid JWT header: %v", err)
+	}
+	if len(header.KeyID) > 0 {
+		found := false
+		for _, key := range keys.Keys {
+			if key.KeyID == header.KeyID {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("signing key %q is not in the JWKS", header.KeyID)
+		}
+	}
+
+	var claims struct {
+		Expiry int64 `json:"exp"`
+	}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return 0, fmt.Errorf("invalid JWT claims: %v", err)
+	}
+	if claims.Expiry == 0 {
+		return 0, fmt.Errorf("no exp claim in JWT")
+	}
+	return claims.Expiry - now.Unix(), nil
+}
+
+// decodeSegment decodes a base64url encoded JWT segment into v.
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(segment, "="))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
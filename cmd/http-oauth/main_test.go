@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	corev2 "github.com/sensu/sensu-go/api/core/v2"
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMain(t *testing.T) {
+}
+
+func jwt(kid string, exp int64) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": kid})
+	claims, _ := json.Marshal(map[string]int64{"exp": exp})
+	return base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims) + ".c2lnbmF0dXJl"
+}
+
+type provider struct {
+	issuer      string
+	keys        string
+	tokenStatus int
+	token       string
+	expiresIn   int64
+}
+
+func (p *provider) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	switch r.URL.Path {
+	case "/.well-known/openid-configuration":
+		fmt.Fprintf(w, `{"issuer": %q, "token_endpoint": "http://%s/token", "jwks_uri": "http://%s/jwks"}`, p.issuer, r.Host, r.Host)
+	case "/jwks":
+		fmt.Fprint(w, p.keys)
+	case "/token":
+		id, secret, ok := r.BasicAuth()
+		if r.Method != "POST" || r.FormValue("grant_type") != "client_credentials" || !ok || id != "sensu" || secret != "s3cret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"error": "invalid_client"}`)
+			return
+		}
+		w.WriteHeader(p.tokenStatus)
+		fmt.Fprintf(w, `{"access_token": %q, "token_type": "Bearer", "expires_in": %d}`, p.token, p.expiresIn)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestExecuteCheck(t *testing.T) {
+	now := time.Now().Unix()
+	keys := `{"keys": [{"kid": "key-1", "kty": "RSA"}]}`
+
+	testCases := []struct {
+		returnStatus int
+		provider     provider
+		clientID     string
+		secret       string
+		issuer       string
+	}{
+		{sensu.CheckStateOK, provider{keys: keys}, "", "", ""},
+		{sensu.CheckStateOK, provider{keys: keys, tokenStatus: http.StatusOK, token: "opaque", expiresIn: 3600}, "sensu", "s3cret", ""},
+		{sensu.CheckStateOK, provider{keys: keys, tokenStatus: http.StatusOK, token: jwt("key-1", now+3600)}, "sensu", "s3cret", ""},
+		{sensu.CheckStateCritical, provider{keys: keys, tokenStatus: http.StatusOK, token: jwt("key-2", now+3600)}, "sensu", "s3cret", ""},
+		{sensu.CheckStateCritical, provider{keys: keys, tokenStatus: http.StatusOK, token: jwt("key-1", now+30)}, "sensu", "s3cret", ""},
+		{sensu.CheckStateCritical, provider{keys: keys, tokenStatus: http.StatusOK, token: "opaque", expiresIn: 3600}, "sensu", "wrong", ""},
+		{sensu.CheckStateCritical, provider{keys: `{"keys": []}`}, "", "", ""},
+		{sensu.CheckStateCritical, provider{keys: keys}, "", "", "https://other.example.com"},
+	}
+
+	for _, tc := range testCases {
+		assert := assert.New(t)
+		event := corev2.FixtureEvent("entity1", "check")
+
+		p := tc.provider
+		test := httptest.NewServer(&p)
+		p.issuer = test.URL
+		if len(tc.issuer) > 0 {
+			p.issuer = tc.issuer
+		}
+
+		plugin.IssuerURL = test.URL
+		plugin.DiscoveryURL = ""
+		plugin.ClientID = tc.clientID
+		plugin.ClientSecret = tc.secret
+		plugin.AuthMethod = "basic"
+		plugin.Warning = "1s"
+		plugin.Critical = "3s"
+		plugin.MinExpiry = 60
+		status, err := checkArgs(event)
+		assert.NoError(err)
+		assert.Equal(sensu.CheckStateOK, status)
+		status, err = executeCheck(event)
+		assert.NoError(err)
+		assert.Equal(tc.returnStatus, status)
+		test.Close()
+	}
+}
+
+func TestCheckArgs(t *testing.T) {
+	assert := assert.New(t)
+	event := corev2.FixtureEvent("entity1", "check")
+
+	plugin.IssuerURL = "https://idp.example.com/"
+	plugin.DiscoveryURL = ""
+	plugin.ClientID = ""
+	plugin.ClientSecret = ""
+	plugin.AuthMethod = "basic"
+	plugin.Warning = "1s"
+	plugin.Critical = "3s"
+	status, err := checkArgs(event)
+	assert.NoError(err)
+	assert.Equal(sensu.CheckStateOK, status)
+	assert.Equal("https://idp.example.com/.well-known/openid-configuration", plugin.DiscoveryURL)
+
+	plugin.AuthMethod = "jwt"
+	status, err = checkArgs(event)
+	assert.Error(err)
+	assert.Equal(sensu.CheckStateUnknown, status)
+
+	plugin.AuthMethod = "basic"
+	plugin.ClientSecret = "s3cret"
+	status, err = checkArgs(event)
+	assert.Error(err)
+	assert.Equal(sensu.CheckStateUnknown, status)
+	plugin.ClientSecret = ""
+}
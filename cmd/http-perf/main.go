@@ -1,15 +1,31 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptrace"
 	"net/url"
+	"os"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	corev2 "github.com/sensu/sensu-go/api/core/v2"
+	"github.com/nixwiz/http-checks/internal/auth"
+	"github.com/nixwiz/http-checks/internal/buildinfo"
+	"github.com/nixwiz/http-checks/internal/exitstatus"
+	"github.com/nixwiz/http-checks/internal/httpclient"
+	"github.com/nixwiz/http-checks/internal/logging"
+	"github.com/nixwiz/http-checks/internal/otlp"
+	"github.com/nixwiz/http-checks/internal/overrides"
+	"github.com/nixwiz/http-checks/internal/policy"
+	"github.com/nixwiz/http-checks/internal/selfmetrics"
 	"github.com/sensu/sensu-go/types"
 	"github.com/sensu/sensu-plugin-sdk/sensu"
 )
@@ -19,19 +35,53 @@ type Config struct {
 	sensu.PluginConfig
 	URL                  string
 	TrustedCAFile        string
+	UseSystemCAsPlus     bool
 	InsecureSkipVerify   bool
 	Timeout              int
 	Warning              string
 	Critical             string
 	OutputInMilliseconds bool
+	CompareURLs          []string
+	BaselineURL          string
+	DeltaWarning         string
+	DeltaCritical        string
+	StateFile            string
+	SLOTarget            string
+	SLOThreshold         string
 	Headers              []string
+	HeadersFile          httpclient.HeadersFileConfig
+	MetricFormat         string
+	MetricTags           []string
+	OutputFormat         string
 	MTLSKeyFile          string
 	MTLSCertFile         string
+	Auth                 auth.Config
+	Proxy                httpclient.ProxyConfig
+	Transport            httpclient.TransportConfig
+	Source               httpclient.SourceConfig
+	Resolver             httpclient.ResolverConfig
+	URLParsing           httpclient.URLConfig
+	Upload               httpclient.UploadConfig
+	OTel                 otlp.Config
+	Policy               policy.Config
+	Record               httpclient.RecordConfig
+	Log                  logging.Config
+	Overrides            overrides.Config
+	Status               exitstatus.Config
+	Metrics              selfmetrics.Config
 }
 
 var (
 	tlsConfig         tls.Config
 	warning, critical time.Duration
+	// deltaWarning and deltaCritical are 0 if not set.
+	deltaWarning, deltaCritical time.Duration
+	// sloBudget is the error budget of --slo-target as a fraction, 0 if
+	// not set.
+	sloBudget    float64
+	sloThreshold time.Duration
+	// metricTags are the parsed --metric-tags.
+	metricTags []metricTag
 
 	plugin = Config{
 		PluginConfig: sensu.PluginConfig{
@@ -66,9 +116,18 @@ var (
 			Argument:  "trusted-ca-file",
 			Shorthand: "t",
 			Default:   "",
-			Usage:     "TLS CA certificate bundle in PEM format",
+			Usage:     "TLS CA certificate bundle in PEM format, or a directory of them",
 			Value:     &plugin.TrustedCAFile,
 		},
+		{
+			Path:      "use-system-cas-plus",
+			Env:       "",
+			Argument:  "use-system-cas-plus",
+			Shorthand: "",
+			Default:   false,
+			Usage:     "Add the CA certificates from --trusted-ca-file to the system trust store rather than replacing it",
+			Value:     &plugin.UseSystemCAsPlus,
+		},
 		{
 			Path:      "timeout",
 			Env:       "",
@@ -105,6 +164,69 @@ var (
 			Usage:     "Provide output in milliseconds (default false, display in seconds)",
 			Value:     &plugin.OutputInMilliseconds,
 		},
+		{
+			Path:      "compare-url",
+			Env:       "",
+			Argument:  "compare-url",
+			Shorthand: "",
+			Default:   []string{},
+			Usage:     "Additional URL(s) to measure in parallel with --url, e.g. the endpoints of the same service in other regions",
+			Value:     &plugin.CompareURLs,
+		},
+		{
+			Path:      "baseline-url",
+			Env:       "",
+			Argument:  "baseline-url",
+			Shorthand: "",
+			Default:   "",
+			Usage:     "URL measured in parallel with --url whose total request duration is subtracted from that of --url before --warning and --critical, e.g. a known-fast endpoint on the same load balancer",
+			Value:     &plugin.BaselineURL,
+		},
+		{
+			Path:      "delta-warning",
+			Env:       "",
+			Argument:  "delta-warning",
+			Shorthand: "",
+			Default:   "",
+			Usage:     "Warning threshold for the difference between the slowest and fastest of --url and --compare-url",
+			Value:     &plugin.DeltaWarning,
+		},
+		{
+			Path:      "delta-critical",
+			Env:       "",
+			Argument:  "delta-critical",
+			Shorthand: "",
+			Default:   "",
+			Usage:     "Critical threshold for the difference between the slowest and fastest of --url and --compare-url",
+			Value:     &plugin.DeltaCritical,
+		},
+		{
+			Path:      "state-file",
+			Env:       "",
+			Argument:  "state-file",
+			Shorthand: "",
+			Default:   "",
+			Usage:     "File to keep the samples of --url from the last 6 hours in between runs, required by --slo-target",
+			Value:     &plugin.StateFile,
+		},
+		{
+			Path:      "slo-target",
+			Env:       "",
+			Argument:  "slo-target",
+			Shorthand: "",
+			Default:   "",
+			Usage:     "Share of requests to --url that must succeed within --slo-threshold (e.g. 99%), to alert on the burn rate of its error budget",
+			Value:     &plugin.SLOTarget,
+		},
+		{
+			Path:      "slo-threshold",
+			Env:       "",
+			Argument:  "slo-threshold",
+			Shorthand: "",
+			Default:   "",
+			Usage:     "Response time above which a request counts against --slo-target (e.g. 500ms)",
+			Value:     &plugin.SLOThreshold,
+		},
 		{
 			Path:      "header",
 			Env:       "",
@@ -114,6 +236,33 @@ var (
 			Usage:     "Additional header(s) to send in check request",
 			Value:     &plugin.Headers,
 		},
+		{
+			Path:      "metric-format",
+			Env:       "",
+			Argument:  "metric-format",
+			Shorthand: "",
+			Default:   "nagios_perfdata",
+			Usage:     "Output metric format, nagios_perfdata, prometheus_text or influxdb_line, to match the output_metric_format of the check",
+			Value:     &plugin.MetricFormat,
+		},
+		{
+			Path:      "output-format",
+			Env:       "",
+			Argument:  "output-format",
+			Shorthand: "",
+			Default:   "text",
+			Usage:     "Output format, text or json, json prints the status, timings, byte counts, address and TLS details of each request as one JSON object",
+			Value:     &plugin.OutputFormat,
+		},
+		{
+			Path:      "metric-tags",
+			Env:       "",
+			Argument:  "metric-tags",
+			Shorthand: "",
+			Default:   []string{},
+			Usage:     "Tag(s) to add to all metrics as key=value, the value may use entity tokens (e.g. region={{ .labels.region }}), requires --metric-format prometheus_text or influxdb_line",
+			Value:     &plugin.MetricTags,
+		},
 		{
 			Path:      "mtls-key-file",
 			Env:       "",
@@ -136,76 +285,236 @@ var (
 )
 
 func main() {
-	check := sensu.NewGoCheck(&plugin.PluginConfig, options, checkArgs, executeCheck, false)
+	options = append(options, plugin.Auth.Options()...)
+	options = append(options, plugin.Proxy.Options()...)
+	options = append(options, plugin.Transport.Options()...)
+	options = append(options, plugin.Source.Options()...)
+	options = append(options, plugin.Resolver.Options()...)
+	options = append(options, plugin.URLParsing.Options()...)
+	options = append(options, plugin.Upload.Options()...)
+	options = append(options, plugin.HeadersFile.Options()...)
+	options = append(options, plugin.OTel.Options()...)
+	options = append(options, plugin.Policy.Options()...)
+	options = append(options, plugin.Record.Options()...)
+	options = append(options, plugin.Log.Options()...)
+	options = append(options, plugin.Overrides.Options()...)
+	options = append(options, plugin.Status.Options()...)
+	options = append(options, plugin.Metrics.Options()...)
+	buildinfo.Handle(plugin.PluginConfig.Name, options, os.Args[1:])
+	exitstatus.ParseFlags(plugin.PluginConfig.Name, options, os.Args[1:])
+	check := sensu.NewGoCheck(&plugin.PluginConfig, options, plugin.Status.Wrap(plugin.PluginConfig.Name, checkArgs), plugin.Record.Wrap(plugin.PluginConfig.Name, plugin.Metrics.Wrap(plugin.PluginConfig.Name, plugin.Status.Wrap(plugin.PluginConfig.Name, executeCheck))), overrides.Requested(os.Args[1:]))
 	check.Execute()
 }
 
 func checkArgs(event *types.Event) (int, error) {
+	if err := plugin.Log.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	if err := plugin.URLParsing.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+
 	var err error
 
 	if len(plugin.URL) == 0 {
-		return sensu.CheckStateWarning, fmt.Errorf("--url or CHECK_URL environment variable is required")
+		return sensu.CheckStateUnknown, fmt.Errorf("--url or CHECK_URL environment variable is required")
+	}
+	headers, err := plugin.HeadersFile.Headers(event)
+	if err != nil {
+		return sensu.CheckStateUnknown, err
 	}
+	plugin.Headers = append(headers, plugin.Headers...)
 	if len(plugin.Headers) > 0 {
 		for _, header := range plugin.Headers {
 			headerSplit := strings.SplitN(header, ":", 2)
 			if len(headerSplit) != 2 {
-				return sensu.CheckStateWarning, fmt.Errorf("--header %q value malformed should be \"Header-Name: Header Value\"", header)
+				return sensu.CheckStateUnknown, fmt.Errorf("--header %q value malformed should be \"Header-Name: Header Value\"", header)
 			}
 		}
 	}
+	metricTags = nil
+	switch plugin.OutputFormat {
+	case "", "text":
+	case "json":
+		if len(plugin.MetricFormat) > 0 && plugin.MetricFormat != "nagios_perfdata" {
+			return sensu.CheckStateUnknown, fmt.Errorf("--output-format json and --metric-format %s are mutually exclusive", plugin.MetricFormat)
+		}
+		if plugin.Metrics.Enabled || plugin.Metrics.Errors {
+			return sensu.CheckStateUnknown, fmt.Errorf("--output-format json and --self-metrics or --error-metrics are mutually exclusive, the metrics would not be part of the JSON object")
+		}
+	default:
+		return sensu.CheckStateUnknown, fmt.Errorf("--output-format %q is not supported, must be text or json", plugin.OutputFormat)
+	}
+	switch plugin.MetricFormat {
+	case "", "nagios_perfdata":
+		if len(plugin.MetricTags) > 0 && plugin.OutputFormat != "json" {
+			return sensu.CheckStateUnknown, fmt.Errorf("--metric-tags requires --metric-format prometheus_text or influxdb_line, or --output-format json, nagios perfdata has no tags")
+		}
+	case "prometheus_text", "influxdb_line":
+	default:
+		return sensu.CheckStateUnknown, fmt.Errorf("--metric-format %q is not supported, must be nagios_perfdata, prometheus_text or influxdb_line", plugin.MetricFormat)
+	}
+	for _, tag := range plugin.MetricTags {
+		t, err := parseMetricTag(tag)
+		if err != nil {
+			return sensu.CheckStateUnknown, err
+		}
+		metricTags = append(metricTags, t)
+	}
 	warning, err = time.ParseDuration(plugin.Warning)
 	if err != nil {
-		return sensu.CheckStateCritical, err
+		return sensu.CheckStateUnknown, err
 	}
 	critical, err = time.ParseDuration(plugin.Critical)
 	if err != nil {
-		return sensu.CheckStateCritical, err
+		return sensu.CheckStateUnknown, err
+	}
+	deltaWarning, deltaCritical = 0, 0
+	if len(plugin.DeltaWarning) > 0 || len(plugin.DeltaCritical) > 0 {
+		if len(plugin.CompareURLs) == 0 {
+			return sensu.CheckStateUnknown, fmt.Errorf("--delta-warning and --delta-critical require --compare-url")
+		}
+	}
+	if len(plugin.DeltaWarning) > 0 {
+		if deltaWarning, err = time.ParseDuration(plugin.DeltaWarning); err != nil {
+			return sensu.CheckStateUnknown, err
+		}
+	}
+	if len(plugin.DeltaCritical) > 0 {
+		if deltaCritical, err = time.ParseDuration(plugin.DeltaCritical); err != nil {
+			return sensu.CheckStateUnknown, err
+		}
+	}
+	sloBudget, sloThreshold = 0, 0
+	if len(plugin.SLOTarget) > 0 {
+		target, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(plugin.SLOTarget), "%"), 64)
+		if err != nil || target <= 0 || target >= 100 {
+			return sensu.CheckStateUnknown, fmt.Errorf("--slo-target %q must be a percentage between 0 and 100, e.g. 99.9%%", plugin.SLOTarget)
+		}
+		sloBudget = 1 - target/100
+		if len(plugin.SLOThreshold) == 0 {
+			return sensu.CheckStateUnknown, fmt.Errorf("--slo-target requires --slo-threshold")
+		}
+		if sloThreshold, err = time.ParseDuration(plugin.SLOThreshold); err != nil {
+			return sensu.CheckStateUnknown, err
+		}
+		if len(plugin.StateFile) == 0 {
+			return sensu.CheckStateUnknown, fmt.Errorf("--slo-target requires --state-file")
+		}
+	} else if len(plugin.SLOThreshold) > 0 || len(plugin.StateFile) > 0 {
+		return sensu.CheckStateUnknown, fmt.Errorf("--slo-threshold and --state-file require --slo-target")
 	}
 	if len(plugin.TrustedCAFile) > 0 {
-		caCertPool, err := corev2.LoadCACerts(plugin.TrustedCAFile)
+		caCertPool, err := httpclient.LoadCACerts(plugin.TrustedCAFile, plugin.UseSystemCAsPlus)
 		if err != nil {
-			return sensu.CheckStateWarning, fmt.Errorf("Error loading specified CA file")
+			return sensu.CheckStateUnknown, fmt.Errorf("Error loading specified CA file: %v", err)
 		}
 		tlsConfig.RootCAs = caCertPool
 	}
 	tlsConfig.InsecureSkipVerify = plugin.InsecureSkipVerify
 
 	if (len(plugin.MTLSKeyFile) > 0 && len(plugin.MTLSCertFile) == 0) || (len(plugin.MTLSCertFile) > 0 && len(plugin.MTLSKeyFile) == 0) {
-		return sensu.CheckStateWarning, fmt.Errorf("mTLS auth requires both --mtls-key-file and --mtls-cert-file")
+		return sensu.CheckStateUnknown, fmt.Errorf("mTLS auth requires both --mtls-key-file and --mtls-cert-file")
 	}
 	if len(plugin.MTLSKeyFile) > 0 && len(plugin.MTLSCertFile) > 0 {
 		cert, err := tls.LoadX509KeyPair(plugin.MTLSCertFile, plugin.MTLSKeyFile)
 		if err != nil {
-			return sensu.CheckStateWarning, fmt.Errorf("Failed to load mTLS key pair %s/%s: %v", plugin.MTLSCertFile, plugin.MTLSKeyFile, err)
+			return sensu.CheckStateUnknown, fmt.Errorf("Failed to load mTLS key pair %s/%s: %v", plugin.MTLSCertFile, plugin.MTLSKeyFile, err)
 		}
 		tlsConfig.Certificates = []tls.Certificate{cert}
 	}
 
+	if err := plugin.Auth.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	checkURL, err := httpclient.ParseURL("--url", plugin.URL)
+	if err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	if err := plugin.Auth.FromURL("--url", checkURL); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	plugin.URL = checkURL.String()
+	for i, compareURL := range plugin.CompareURLs {
+		u, err := httpclient.ParseURL("--compare-url", compareURL)
+		if err != nil {
+			return sensu.CheckStateUnknown, err
+		}
+		if err := plugin.Auth.FromURL("--compare-url", u); err != nil {
+			return sensu.CheckStateUnknown, err
+		}
+		plugin.CompareURLs[i] = u.String()
+	}
+	if len(plugin.BaselineURL) > 0 {
+		u, err := httpclient.ParseURL("--baseline-url", plugin.BaselineURL)
+		if err != nil {
+			return sensu.CheckStateUnknown, err
+		}
+		if err := plugin.Auth.FromURL("--baseline-url", u); err != nil {
+			return sensu.CheckStateUnknown, err
+		}
+		plugin.BaselineURL = u.String()
+	}
+
+	if err := plugin.Proxy.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	if err := plugin.Transport.Validate(&plugin.Proxy); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	if err := plugin.Source.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	if err := plugin.Resolver.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	if err := plugin.Upload.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	if err := plugin.OTel.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+
+	if err := plugin.Policy.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+
+	if err := plugin.Record.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+
 	return sensu.CheckStateOK, nil
 }
 
 func executeCheck(event *types.Event) (int, error) {
 
-	client := http.DefaultClient
-	client.Transport = http.DefaultTransport
-	client.Timeout = time.Duration(plugin.Timeout) * time.Second
-
-	checkURL, err := url.Parse(plugin.URL)
-	if err != nil {
-		fmt.Printf("url parse error: %s\n", err)
-		return sensu.CheckStateCritical, nil
-	}
-	if checkURL.Scheme == "https" {
-		client.Transport.(*http.Transport).TLSClientConfig = &tlsConfig
+	// The request is made directly on the transport so that the timings are
+	// not affected by redirects, apply the timeout the same way a client
+	// would (a timeout of 0 means no timeout).
+	transport := httpclient.NewTransport(&tlsConfig, plugin.Proxy.Configure, plugin.Source.Configure, plugin.Resolver.Configure, plugin.Transport.Configure)
+	ctx := context.Background()
+	if plugin.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(plugin.Timeout)*time.Second)
+		defer cancel()
 	}
 
-	req, err := http.NewRequest("GET", plugin.URL, nil)
-	if err != nil {
-		fmt.Printf("request creation error: %s\n", err)
-		return sensu.CheckStateCritical, nil
+	urls := append([]string{plugin.URL}, plugin.CompareURLs...)
+	if len(plugin.BaselineURL) > 0 {
+		urls = append(urls, plugin.BaselineURL)
 	}
-	if len(plugin.Headers) > 0 {
+	requests := make([]*http.Request, len(urls))
+	for i, u := range urls {
+		_, err := url.Parse(u)
+		if err != nil {
+			fmt.Fprintf(selfmetrics.Stdout, "%s UNKNOWN: url parse error: %s\n", plugin.PluginConfig.Name, err)
+			return sensu.CheckStateUnknown, nil
+		}
+		req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+		if err != nil {
+			fmt.Fprintf(selfmetrics.Stdout, "%s UNKNOWN: request creation error: %s\n", plugin.PluginConfig.Name, err)
+			return sensu.CheckStateUnknown, nil
+		}
 		for _, header := range plugin.Headers {
 			headerSplit := strings.SplitN(header, ":", 2)
 			headerKey := strings.TrimSpace(headerSplit[0])
@@ -216,70 +525,725 @@ func executeCheck(event *types.Event) (int, error) {
 			}
 			req.Header.Set(headerKey, headerValue)
 		}
+		requests[i] = req
+	}
+	// Only --url is sent the upload, the other URLs are measured as is.
+	var upload *httpclient.Upload
+	if plugin.Upload.Enabled() {
+		var err error
+		if requests[0], upload, err = plugin.Upload.Prepare(requests[0]); err != nil {
+			fmt.Fprintf(selfmetrics.Stdout, "%s UNKNOWN: %s\n", plugin.PluginConfig.Name, err)
+			return sensu.CheckStateUnknown, nil
+		}
+	}
+
+	// The URLs are measured in parallel, so that they see the same network
+	// conditions.
+	roundTripper := plugin.Auth.RoundTripper(httpclient.Recording(httpclient.Logging(transport)))
+	measurements := make([]measurement, len(requests))
+	var wg sync.WaitGroup
+	for i, req := range requests {
+		wg.Add(1)
+		go func(i int, req *http.Request) {
+			defer wg.Done()
+			measurements[i] = measure(roundTripper, req)
+		}(i, req)
+	}
+	wg.Wait()
+	measurements[0].upload = upload
+
+	all := measurements
+	var baseline *measurement
+	if len(plugin.BaselineURL) > 0 {
+		baseline = &measurements[len(measurements)-1]
+		measurements = measurements[:len(measurements)-1]
+	}
+	primary := measurements[0]
+	var slo sloResult
+	if sloBudget > 0 {
+		slo = evaluateSLO(primary.err != nil || primary.total > sloThreshold, time.Now())
+	}
+	if primary.err != nil {
+		if err := printResult(event, sensu.CheckStateCritical, append([]string{httpclient.Describe(primary.err)}, slo.output...), slo.perfdata, all); err != nil {
+			return sensu.CheckStateUnknown, err
+		}
+		return sensu.CheckStateCritical, nil
+	}
+	switch {
+	case plugin.OutputFormat == "json":
+		// The JSON output has the protocol of each request.
+	case plugin.MetricFormat == "prometheus_text":
+		// Printed after the metrics, as a comment like the check output.
+		defer fmt.Fprintf(selfmetrics.Stdout, "# Protocol: %s\n", primary.proto)
+	default:
+		// Printed after the check output line.
+		defer fmt.Fprintf(selfmetrics.Stdout, "Protocol: %s\n", primary.proto)
+	}
+
+	status := sensu.CheckStateOK
+	raise := func(s int) {
+		if s > status {
+			status = s
+		}
+	}
+	output := []string{formatDuration(primary.total)}
+	perfdata := []string{primary.perfdata("")}
+	if upload != nil {
+		output = append(output, upload.Output())
+		perfdata = append(perfdata, uploadPerfdata(upload))
+	}
+	// The latency of --baseline-url, that of the shared network and load
+	// balancer, is subtracted from that of --url before the thresholds so
+	// that they apply to the latency of the application alone.
+	adjusted := primary.total
+	if baseline != nil {
+		if baseline.err != nil {
+			raise(sensu.CheckStateWarning)
+			output = append(output, fmt.Sprintf("baseline %s %s", baseline.url, httpclient.Describe(baseline.err)))
+		} else {
+			if adjusted -= baseline.total; adjusted < 0 {
+				adjusted = 0
+			}
+			output = append(output, fmt.Sprintf("%s over baseline %s", formatDuration(adjusted), formatDuration(baseline.total)))
+			perfdata = append(perfdata, "baseline_total_request_duration="+formatValue(baseline.total), "adjusted_request_duration="+formatValue(adjusted))
+		}
+	}
+	prefixes := map[string]bool{}
+	fastest, slowest := primary.total, primary.total
+	for i, m := range measurements {
+		if m.err == nil {
+			total := m.total
+			if i == 0 {
+				total = adjusted
+			}
+			switch {
+			case plugin.Policy.Enabled():
+			case total > critical:
+				raise(sensu.CheckStateCritical)
+			case total > warning:
+				raise(sensu.CheckStateWarning)
+			}
+			if m.total < fastest {
+				fastest = m.total
+			}
+			if m.total > slowest {
+				slowest = m.total
+			}
+		}
+		if i == 0 {
+			continue
+		}
+		if m.err != nil {
+			raise(sensu.CheckStateCritical)
+			output = append(output, fmt.Sprintf("%s %s", m.url, httpclient.Describe(m.err)))
+			continue
+		}
+		output = append(output, fmt.Sprintf("%s %s", m.url, formatDuration(m.total)))
+		prefix := metricPrefix(m.url)
+		if prefixes[prefix] {
+			prefix = fmt.Sprintf("%s_%d", prefix, i)
+		}
+		prefixes[prefix] = true
+		perfdata = append(perfdata, m.perfdata(prefix+"_"))
+	}
+	if len(measurements) > 1 {
+		delta := slowest - fastest
+		deltaOutput := fmt.Sprintf("max delta %s", formatDuration(delta))
+		switch {
+		case deltaCritical > 0 && delta > deltaCritical:
+			raise(sensu.CheckStateCritical)
+			deltaOutput += fmt.Sprintf(" exceeds %s", formatDuration(deltaCritical))
+		case deltaWarning > 0 && delta > deltaWarning:
+			raise(sensu.CheckStateWarning)
+			deltaOutput += fmt.Sprintf(" exceeds %s", formatDuration(deltaWarning))
+		}
+		output = append(output, deltaOutput)
+		perfdata = append(perfdata, "max_delta="+formatValue(delta))
+	}
+
+	raise(slo.status)
+	output = append(output, slo.output...)
+	perfdata = append(perfdata, slo.perfdata...)
+
+	// The policy replaces --warning and --critical, durations are in
+	// seconds.
+	if plugin.Policy.Enabled() {
+		policyStatus, description, err := plugin.Policy.Evaluate(map[string]interface{}{
+			"dns":           primary.dns.Seconds(),
+			"tls_handshake": primary.tlsHandshake.Seconds(),
+			"connect":       primary.connect.Seconds(),
+			"first_byte":    primary.firstByte.Seconds(),
+			"total":         primary.total.Seconds(),
+			"max_delta":     (slowest - fastest).Seconds(),
+			"adjusted":      adjusted.Seconds(),
+		})
+		if err != nil {
+			return sensu.CheckStateUnknown, fmt.Errorf("Error evaluating policy: %v", err)
+		}
+		raise(policyStatus)
+		output = append(output, description)
+	}
+
+	if err := printResult(event, status, output, perfdata, all); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	return status, nil
+}
+
+// measurement holds the timings of a request.
+type measurement struct {
+	url                                          string
+	dns, tlsHandshake, connect, firstByte, total time.Duration
+	proto                                        string
+	err                                          error
+	// The details of the response for --output-format json, bytesReceived
+	// is only counted with it.
+	statusCode    int
+	contentLength int64
+	bytesReceived int64
+	remoteAddress string
+	tls           *tls.ConnectionState
+	upload        *httpclient.Upload
+}
+
+// perfdata returns the timings of m as perfdata, with names prefixed by
+// prefix.
+func (m measurement) perfdata(prefix string) string {
+	return fmt.Sprintf("%sdns_duration=%s, %stls_handshake_duration=%s, %sconnect_duration=%s, %sfirst_byte_duration=%s, %stotal_request_duration=%s",
+		prefix, formatValue(m.dns), prefix, formatValue(m.tlsHandshake), prefix, formatValue(m.connect), prefix, formatValue(m.firstByte), prefix, formatValue(m.total))
+}
+
+// uploadPerfdata returns the metrics of upload as perfdata, like
+// httpclient.Upload.Perfdata but with the durations formatted by
+// formatValue.
+func uploadPerfdata(upload *httpclient.Upload) string {
+	sent, duration := upload.Sent()
+	perfdata := fmt.Sprintf("upload_bytes=%d, upload_duration=%s, upload_throughput=%.0f", sent, formatValue(duration), upload.Throughput())
+	if upload.ExpectContinue {
+		continueDuration := "-1"
+		if continued, after := upload.Continued(); continued {
+			continueDuration = formatValue(after)
+		}
+		perfdata += ", continue_duration=" + continueDuration
 	}
+	return perfdata
+}
+
+// measure sends req with roundTripper and returns its timings. With
+// --otel-endpoint the request is traced, the trace is propagated to the
+// server so it can be correlated with server side traces.
+func measure(roundTripper http.RoundTripper, req *http.Request) measurement {
+	m := measurement{url: req.URL.String()}
+	var start, dns, connect, tlsHandshake time.Time
 
 	var (
-		start                time.Time
-		connect              time.Time
-		dns                  time.Time
-		tlsHandshake         time.Time
-		totalRequestDuration time.Duration
-		firstByteDuration    time.Duration
-		connectDuration      time.Duration
-		dnsDuration          time.Duration
-		tlsHandshakeDuration time.Duration
-		output               string
-		perfdata             string
+		otelTrace *otlp.Trace
+		otelRoot  *otlp.Span
 	)
+	if plugin.OTel.Enabled() {
+		otelTrace = otlp.NewTrace()
+		otelRoot = otelTrace.Span(nil, req.Method, otlp.KindClient, time.Time{}, time.Time{})
+		if len(req.Header.Get("traceparent")) == 0 {
+			req.Header.Set("traceparent", otelTrace.TraceParent(otelRoot))
+		}
+	}
+	exportTrace := func(end time.Time, resp *http.Response, err error) {
+		if otelTrace == nil {
+			return
+		}
+		otelRoot.Start, otelRoot.End = start, end
+		otelRoot.Attributes["http.method"] = req.Method
+		otelRoot.Attributes["http.url"] = req.URL.String()
+		if err != nil {
+			otelRoot.Error = httpclient.Describe(err)
+		} else {
+			otelRoot.Attributes["http.status_code"] = resp.StatusCode
+			otelRoot.Attributes["http.flavor"] = fmt.Sprintf("%d.%d", resp.ProtoMajor, resp.ProtoMinor)
+			if resp.StatusCode >= http.StatusInternalServerError {
+				otelRoot.Error = resp.Status
+			}
+		}
+		if !dns.IsZero() {
+			otelTrace.Span(otelRoot, "dns", otlp.KindInternal, dns, dns.Add(m.dns))
+		}
+		if !connect.IsZero() {
+			otelTrace.Span(otelRoot, "connect", otlp.KindInternal, connect, connect.Add(m.connect))
+		}
+		if !tlsHandshake.IsZero() {
+			otelTrace.Span(otelRoot, "tls", otlp.KindInternal, tlsHandshake, tlsHandshake.Add(m.tlsHandshake))
+		}
+		if m.firstByte > 0 {
+			otelTrace.Span(otelRoot, "ttfb", otlp.KindInternal, start, start.Add(m.firstByte))
+		}
+		// The collector is not reached through the proxy of the check.
+		client := &http.Client{Transport: httpclient.NewTransport(&tls.Config{}, plugin.Source.Configure, plugin.Resolver.Configure)}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := plugin.OTel.Export(ctx, client, plugin.PluginConfig.Name, otelTrace); err != nil {
+			logging.Warn("failed to export trace", "endpoint", plugin.OTel.Endpoint, "error", err)
+		}
+	}
 
 	trace := &httptrace.ClientTrace{
 		DNSStart: func(dsi httptrace.DNSStartInfo) { dns = time.Now() },
 		DNSDone: func(ddi httptrace.DNSDoneInfo) {
-			dnsDuration = time.Since(dns)
+			m.dns = time.Since(dns)
 		},
 
 		TLSHandshakeStart: func() { tlsHandshake = time.Now() },
 		TLSHandshakeDone: func(cs tls.ConnectionState, err error) {
-			tlsHandshakeDuration = time.Since(tlsHandshake)
+			m.tlsHandshake = time.Since(tlsHandshake)
 		},
 
 		ConnectStart: func(network, addr string) { connect = time.Now() },
 		ConnectDone: func(network, addr string, err error) {
-			connectDuration = time.Since(connect)
+			m.connect = time.Since(connect)
+		},
+
+		GotConn: func(info httptrace.GotConnInfo) {
+			m.remoteAddress = info.Conn.RemoteAddr().String()
 		},
 
 		GotFirstResponseByte: func() {
-			firstByteDuration = time.Since(start)
+			m.firstByte = time.Since(start)
 		},
 	}
 
 	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
 	start = time.Now()
-	resp, err := http.DefaultTransport.RoundTrip(req)
+	resp, err := roundTripper.RoundTrip(req)
 	if err != nil {
-		fmt.Printf("request error: %s\n", err)
-		return sensu.CheckStateCritical, nil
+		exportTrace(time.Now(), nil, err)
+		m.err = err
+		return m
 	}
-	totalRequestDuration = time.Since(start)
+	m.total = time.Since(start)
+	exportTrace(start.Add(m.total), resp, nil)
+	m.proto = resp.Proto
+	m.statusCode = resp.StatusCode
+	m.contentLength = resp.ContentLength
+	m.tls = resp.TLS
+	if plugin.OutputFormat == "json" {
+		// Read after the timings, so that they are the same as without
+		// it.
+		m.bytesReceived, _ = io.Copy(ioutil.Discard, resp.Body)
+	}
+	resp.Body.Close()
+	return m
+}
 
-	defer resp.Body.Close()
+// formatDuration formats d for the check output, in seconds or milliseconds
+// with --output-in-ms.
+func formatDuration(d time.Duration) string {
+	if plugin.OutputInMilliseconds {
+		return fmt.Sprintf("%dms", d.Milliseconds())
+	}
+	return fmt.Sprintf("%0.6fs", d.Seconds())
+}
 
+// formatValue formats d as a perfdata value, in seconds or milliseconds with
+// --output-in-ms.
+func formatValue(d time.Duration) string {
 	if plugin.OutputInMilliseconds {
-		output = fmt.Sprintf("%dms", totalRequestDuration.Milliseconds())
-		perfdata = fmt.Sprintf("dns_duration=%d, tls_handshake_duration=%d, connect_duration=%d, first_byte_duration=%d, total_request_duration=%d", dnsDuration.Milliseconds(), tlsHandshakeDuration.Milliseconds(), connectDuration.Milliseconds(), firstByteDuration.Milliseconds(), totalRequestDuration.Milliseconds())
-	} else {
-		output = fmt.Sprintf("%0.6fs", totalRequestDuration.Seconds())
-		perfdata = fmt.Sprintf("dns_duration=%0.6f, tls_handshake_duration=%0.6f, connect_duration=%0.6f, first_byte_duration=%0.6f, total_request_duration=%0.6f", dnsDuration.Seconds(), tlsHandshakeDuration.Seconds(), connectDuration.Seconds(), firstByteDuration.Seconds(), totalRequestDuration.Seconds())
-	}
-	if totalRequestDuration > critical {
-		fmt.Printf("http-perf CRITICAL: %s | %s\n", output, perfdata)
-		return sensu.CheckStateCritical, nil
-	} else if totalRequestDuration > warning {
-		fmt.Printf("http-perf WARNING: %s | %s\n", output, perfdata)
-		return sensu.CheckStateWarning, nil
+		return fmt.Sprintf("%d", d.Milliseconds())
+	}
+	return fmt.Sprintf("%0.6f", d.Seconds())
+}
+
+// metricPrefix returns the host of rawURL as a perfdata name prefix, e.g.
+// eu_example_com for https://eu.example.com/health.
+func metricPrefix(rawURL string) string {
+	host := rawURL
+	if u, err := url.Parse(rawURL); err == nil && len(u.Hostname()) > 0 {
+		host = u.Hostname()
 	}
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		if r >= 'A' && r <= 'Z' {
+			return r - 'A' + 'a'
+		}
+		return '_'
+	}, host)
+}
 
-	fmt.Printf("http-perf OK: %s | %s\n", output, perfdata)
+func stateName(status int) string {
+	switch status {
+	case sensu.CheckStateOK:
+		return "OK"
+	case sensu.CheckStateWarning:
+		return "WARNING"
+	case sensu.CheckStateCritical:
+		return "CRITICAL"
+	}
+	return "UNKNOWN"
+}
 
-	return sensu.CheckStateOK, nil
+// metricTag is a --metric-tags tag, its value may have entity tokens.
+type metricTag struct {
+	key, value string
+}
+
+// metricTagKey is the syntax of tag keys valid as both Prometheus labels and
+// InfluxDB tags.
+var metricTagKey = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// parseMetricTag parses a --metric-tags key=value tag.
+func parseMetricTag(tag string) (metricTag, error) {
+	parts := strings.SplitN(tag, "=", 2)
+	if len(parts) != 2 {
+		return metricTag{}, fmt.Errorf("--metric-tags %q value malformed should be \"key=value\"", tag)
+	}
+	key := strings.TrimSpace(parts[0])
+	if !metricTagKey.MatchString(key) {
+		return metricTag{}, fmt.Errorf("--metric-tags %q key must be letters, digits and underscores, not starting with a digit", tag)
+	}
+	if _, err := overrides.ParseTokens("--metric-tags "+key, parts[1]); err != nil {
+		return metricTag{}, err
+	}
+	return metricTag{key: key, value: parts[1]}, nil
+}
+
+// resolveMetricTags returns the keys and values of metricTags, with the
+// entity tokens substituted from event.
+func resolveMetricTags(event *types.Event) ([][2]string, error) {
+	tags := make([][2]string, 0, len(metricTags))
+	for _, tag := range metricTags {
+		value, err := overrides.SubstituteTokens("--metric-tags "+tag.key, tag.value, event)
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, [2]string{tag.key, value})
+	}
+	return tags, nil
+}
+
+// printResult prints the check output, with the metrics in perfdata in the
+// --metric-format format, or with --output-format json as a JSON object of
+// the output, the metrics and the details of measurements.
+func printResult(event *types.Event, status int, output, perfdata []string, measurements []measurement) error {
+	summary := fmt.Sprintf("%s %s: %s", plugin.PluginConfig.Name, stateName(status), strings.Join(output, ", "))
+	if plugin.OutputFormat == "json" {
+		return printJSON(event, status, strings.Join(output, ", "), perfdata, measurements)
+	}
+	if plugin.MetricFormat != "prometheus_text" && plugin.MetricFormat != "influxdb_line" {
+		if len(perfdata) > 0 {
+			summary += " | " + strings.Join(perfdata, ", ")
+		}
+		fmt.Fprintln(selfmetrics.Stdout, summary)
+		return nil
+	}
+	tags, err := resolveMetricTags(event)
+	if err != nil {
+		return err
+	}
+	metrics := splitPerfdata(perfdata)
+	if plugin.MetricFormat == "prometheus_text" {
+		// The output is a comment, ignored by the metric extraction.
+		fmt.Fprintf(selfmetrics.Stdout, "# %s\n", summary)
+		labels := make([]string, len(tags))
+		for i, tag := range tags {
+			labels[i] = fmt.Sprintf("%s=%q", tag[0], tag[1])
+		}
+		for _, metric := range metrics {
+			if len(labels) > 0 {
+				fmt.Fprintf(selfmetrics.Stdout, "%s{%s} %s\n", metric[0], strings.Join(labels, ","), metric[1])
+			} else {
+				fmt.Fprintf(selfmetrics.Stdout, "%s %s\n", metric[0], metric[1])
+			}
+		}
+		return nil
+	}
+	fmt.Fprintln(selfmetrics.Stdout, summary)
+	if len(metrics) == 0 {
+		return nil
+	}
+	measurement := strings.Replace(plugin.PluginConfig.Name, "-", "_", -1)
+	for _, tag := range tags {
+		measurement += "," + influxEscape(tag[0]) + "=" + influxEscape(tag[1])
+	}
+	fields := make([]string, len(metrics))
+	for i, metric := range metrics {
+		fields[i] = metric[0] + "=" + metric[1]
+	}
+	fmt.Fprintf(selfmetrics.Stdout, "%s %s %d\n", measurement, strings.Join(fields, ","), time.Now().UnixNano())
+	return nil
+}
+
+// splitPerfdata returns the names and values of the metrics of perfdata.
+// Entries of perfdata may hold several metrics, as with the timings of a
+// measurement.
+func splitPerfdata(perfdata []string) [][2]string {
+	var metrics [][2]string
+	for _, entry := range perfdata {
+		for _, metric := range strings.Split(entry, ", ") {
+			if parts := strings.SplitN(metric, "=", 2); len(parts) == 2 {
+				metrics = append(metrics, [2]string{parts[0], parts[1]})
+			}
+		}
+	}
+	return metrics
+}
+
+// jsonResult is the output of --output-format json.
+type jsonResult struct {
+	Check    string             `json:"check"`
+	Status   int                `json:"status"`
+	State    string             `json:"state"`
+	Output   string             `json:"output"`
+	Tags     map[string]string  `json:"tags,omitempty"`
+	Metrics  map[string]float64 `json:"metrics"`
+	Requests []jsonRequest      `json:"requests"`
+}
+
+// jsonRequest is a measurement in the output of --output-format json, the
+// durations are in seconds, or milliseconds with --output-in-ms.
+type jsonRequest struct {
+	URL                  string      `json:"url"`
+	Error                string      `json:"error,omitempty"`
+	StatusCode           int         `json:"status_code,omitempty"`
+	Protocol             string      `json:"protocol,omitempty"`
+	RemoteAddress        string      `json:"remote_address,omitempty"`
+	DNSDuration          float64     `json:"dns_duration"`
+	ConnectDuration      float64     `json:"connect_duration"`
+	TLSHandshakeDuration float64     `json:"tls_handshake_duration"`
+	FirstByteDuration    float64     `json:"first_byte_duration"`
+	TotalDuration        float64     `json:"total_request_duration"`
+	ContentLength        *int64      `json:"content_length,omitempty"`
+	BytesReceived        int64       `json:"bytes_received"`
+	TLS                  *jsonTLS    `json:"tls,omitempty"`
+	Upload               *jsonUpload `json:"upload,omitempty"`
+}
+
+// jsonUpload holds the --upload-file details of a jsonRequest, the continue
+// duration is only set with --expect-100-continue.
+type jsonUpload struct {
+	BytesSent        int64    `json:"bytes_sent"`
+	Duration         float64  `json:"duration"`
+	Throughput       float64  `json:"throughput"`
+	ContinueDuration *float64 `json:"continue_duration,omitempty"`
+}
+
+// jsonTLS holds the TLS details of a jsonRequest.
+type jsonTLS struct {
+	Version            string `json:"version"`
+	CipherSuite        string `json:"cipher_suite"`
+	NegotiatedProtocol string `json:"alpn,omitempty"`
+	ServerName         string `json:"server_name,omitempty"`
+	Subject            string `json:"subject,omitempty"`
+	Issuer             string `json:"issuer,omitempty"`
+	NotAfter           string `json:"not_after,omitempty"`
+}
+
+// printJSON prints the result of the check as a jsonResult.
+func printJSON(event *types.Event, status int, output string, perfdata []string, measurements []measurement) error {
+	tags, err := resolveMetricTags(event)
+	if err != nil {
+		return err
+	}
+	result := jsonResult{
+		Check:    plugin.PluginConfig.Name,
+		Status:   status,
+		State:    stateName(status),
+		Output:   output,
+		Metrics:  map[string]float64{},
+		Requests: []jsonRequest{},
+	}
+	if len(tags) > 0 {
+		result.Tags = map[string]string{}
+		for _, tag := range tags {
+			result.Tags[tag[0]] = tag[1]
+		}
+	}
+	for _, metric := range splitPerfdata(perfdata) {
+		if value, err := strconv.ParseFloat(metric[1], 64); err == nil {
+			result.Metrics[metric[0]] = value
+		}
+	}
+	value := func(d time.Duration) float64 {
+		v, _ := strconv.ParseFloat(formatValue(d), 64)
+		return v
+	}
+	for _, m := range measurements {
+		request := jsonRequest{URL: m.url}
+		if m.err != nil {
+			request.Error = httpclient.Describe(m.err)
+		} else {
+			request.StatusCode = m.statusCode
+			request.Protocol = m.proto
+			request.BytesReceived = m.bytesReceived
+			if m.contentLength >= 0 {
+				contentLength := m.contentLength
+				request.ContentLength = &contentLength
+			}
+		}
+		request.RemoteAddress = m.remoteAddress
+		request.DNSDuration = value(m.dns)
+		request.ConnectDuration = value(m.connect)
+		request.TLSHandshakeDuration = value(m.tlsHandshake)
+		request.FirstByteDuration = value(m.firstByte)
+		request.TotalDuration = value(m.total)
+		if m.tls != nil {
+			request.TLS = &jsonTLS{
+				Version:            httpclient.TLSVersionName(m.tls.Version),
+				CipherSuite:        fmt.Sprintf("0x%04x", m.tls.CipherSuite),
+				NegotiatedProtocol: m.tls.NegotiatedProtocol,
+				ServerName:         m.tls.ServerName,
+			}
+			if len(m.tls.PeerCertificates) > 0 {
+				leaf := m.tls.PeerCertificates[0]
+				request.TLS.Subject = leaf.Subject.String()
+				request.TLS.Issuer = leaf.Issuer.String()
+				request.TLS.NotAfter = leaf.NotAfter.UTC().Format(time.RFC3339)
+			}
+		}
+		if m.upload != nil {
+			sent, duration := m.upload.Sent()
+			request.Upload = &jsonUpload{BytesSent: sent, Duration: value(duration), Throughput: m.upload.Throughput()}
+			if continued, after := m.upload.Continued(); continued {
+				continueDuration := value(after)
+				request.Upload.ContinueDuration = &continueDuration
+			}
+		}
+		result.Requests = append(result.Requests, request)
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(selfmetrics.Stdout, string(data))
+	return nil
+}
+
+// influxEscape escapes the commas, spaces and equal signs of an InfluxDB line
+// protocol tag key or value.
+func influxEscape(s string) string {
+	return strings.NewReplacer(",", "\\,", " ", "\\ ", "=", "\\=").Replace(s)
+}
+
+// burnWindows are the windows of the multiwindow, multi-burn-rate alerts of
+// the Google SRE workbook for a 30 day SLO period: CRITICAL when 2% of the
+// error budget is spent within an hour, WARNING when 5% is spent within 6
+// hours. The short window of each makes the alert stop soon after the
+// burning does.
+var burnWindows = []struct {
+	long, short time.Duration
+	rate        float64
+	status      int
+	name        string
+}{
+	{time.Hour, 5 * time.Minute, 14.4, sensu.CheckStateCritical, "fast burn"},
+	{6 * time.Hour, 30 * time.Minute, 6, sensu.CheckStateWarning, "slow burn"},
+}
+
+// sloState is the content of the state file, the samples of --url within
+// the longest burn window.
+type sloState struct {
+	URL     string      `json:"url"`
+	Samples []sloSample `json:"samples"`
+}
+
+// sloSample is a request to --url, bad if it failed or took longer than
+// --slo-threshold.
+type sloSample struct {
+	Time int64 `json:"t"`
+	Bad  bool  `json:"bad,omitempty"`
+}
+
+// sloResult is the outcome of evaluateSLO.
+type sloResult struct {
+	status   int
+	output   []string
+	perfdata []string
+}
+
+// evaluateSLO adds a sample to the state file and returns the burn rates of
+// the error budget over the burn windows, and the status they alert with.
+// A window pair alerts only once the samples span its short window, so that
+// a single slow request after starting with an empty state does not.
+func evaluateSLO(bad bool, now time.Time) sloResult {
+	state := loadSLOState(plugin.StateFile, plugin.URL)
+	longest := burnWindows[len(burnWindows)-1].long
+	samples := []sloSample{}
+	for _, sample := range state.Samples {
+		if now.Sub(time.Unix(sample.Time, 0)) <= longest {
+			samples = append(samples, sample)
+		}
+	}
+	state.Samples = append(samples, sloSample{Time: now.Unix(), Bad: bad})
+	if err := saveSLOState(plugin.StateFile, state); err != nil {
+		logging.Warn("failed to write state file", "file", plugin.StateFile, "error", err)
+	}
+	span := now.Sub(time.Unix(state.Samples[0].Time, 0))
+
+	result := sloResult{status: sensu.CheckStateOK}
+	for _, w := range burnWindows {
+		long := burnRate(state.Samples, now, w.long)
+		short := burnRate(state.Samples, now, w.short)
+		result.perfdata = append(result.perfdata,
+			fmt.Sprintf("slo_burn_rate_%s=%0.2f", windowName(w.long), long),
+			fmt.Sprintf("slo_burn_rate_%s=%0.2f", windowName(w.short), short))
+		if span >= w.short && long > w.rate && short > w.rate && w.status > result.status {
+			result.status = w.status
+			result.output = []string{fmt.Sprintf("SLO %s %0.1fx over %s and %0.1fx over %s exceeds %0.1fx", w.name, long, windowName(w.long), short, windowName(w.short), w.rate)}
+		}
+	}
+	return result
+}
+
+// burnRate returns the rate at which the error budget is spent by the
+// samples within window before now, 1 being the rate that spends exactly
+// the budget over the SLO period.
+func burnRate(samples []sloSample, now time.Time, window time.Duration) float64 {
+	total, bad := 0, 0
+	for _, sample := range samples {
+		if now.Sub(time.Unix(sample.Time, 0)) <= window {
+			total++
+			if sample.Bad {
+				bad++
+			}
+		}
+	}
+	if total == 0 {
+		return 0
+	}
+	return float64(bad) / float64(total) / sloBudget
+}
+
+// windowName formats a burn window for output and perfdata names, e.g. 5m
+// or 6h.
+func windowName(d time.Duration) string {
+	if d%time.Hour == 0 {
+		return fmt.Sprintf("%dh", d/time.Hour)
+	}
+	return fmt.Sprintf("%dm", d/time.Minute)
+}
+
+// loadSLOState reads the state of checkURL from path, a missing or
+// unreadable state file, or one for another URL, is an empty state.
+func loadSLOState(path, checkURL string) sloState {
+	empty := sloState{URL: checkURL}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return empty
+	}
+	var state sloState
+	if err := json.Unmarshal(data, &state); err != nil {
+		logging.Warn("ignoring invalid state file", "file", path, "error", err)
+		return empty
+	}
+	if state.URL != checkURL {
+		return empty
+	}
+	return state
+}
+
+// saveSLOState writes the state to path.
+func saveSLOState(path string, state sloState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0600)
 }
@@ -1,9 +1,15 @@
 package main
 
 import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -42,3 +48,535 @@ func TestExecuteCheck(t *testing.T) {
 	assert.NoError(err)
 	assert.Equal(sensu.CheckStateOK, status)
 }
+
+func TestDefaultClientUntouched(t *testing.T) {
+	assert := assert.New(t)
+	event := corev2.FixtureEvent("entity1", "check")
+
+	var test = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(`{"status": "SUCCESS"}`))
+	}))
+	defer test.Close()
+
+	plugin.URL = test.URL
+	plugin.Headers = nil
+	plugin.Timeout = 15
+	plugin.InsecureSkipVerify = true
+	plugin.Warning = "2s"
+	plugin.Critical = "5s"
+	status, err := checkArgs(event)
+	assert.NoError(err)
+	assert.Equal(sensu.CheckStateOK, status)
+	status, err = executeCheck(event)
+	assert.NoError(err)
+	assert.Equal(sensu.CheckStateOK, status)
+	plugin.InsecureSkipVerify = false
+
+	// The check must use its own client and transport
+	// httptest.Server.Close may initialise the default TLS config itself, so
+	// only check that ours was not installed.
+	if defaultTLS := http.DefaultTransport.(*http.Transport).TLSClientConfig; defaultTLS != nil {
+		assert.False(defaultTLS.InsecureSkipVerify)
+	}
+	assert.Nil(http.DefaultClient.Transport)
+	assert.Nil(http.DefaultClient.CheckRedirect)
+	assert.Zero(http.DefaultClient.Timeout)
+}
+
+func TestExecuteCheckOTel(t *testing.T) {
+	assert := assert.New(t)
+	event := corev2.FixtureEvent("entity1", "check")
+
+	var traceparent string
+	var test = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+	}))
+	defer test.Close()
+
+	var exported map[string]interface{}
+	var collector = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal("/v1/traces", r.URL.Path)
+		assert.NoError(json.NewDecoder(r.Body).Decode(&exported))
+	}))
+	defer collector.Close()
+
+	plugin.URL = test.URL
+	plugin.Headers = nil
+	plugin.Timeout = 15
+	plugin.InsecureSkipVerify = true
+	plugin.Warning = "2s"
+	plugin.Critical = "5s"
+	plugin.OTel.Endpoint = collector.URL
+	defer func() {
+		plugin.OTel.Endpoint = ""
+		plugin.InsecureSkipVerify = false
+	}()
+	status, err := checkArgs(event)
+	assert.NoError(err)
+	assert.Equal(sensu.CheckStateOK, status)
+	status, err = executeCheck(event)
+	assert.NoError(err)
+	assert.Equal(sensu.CheckStateOK, status)
+
+	require.NotNil(t, exported)
+	spans := exported["resourceSpans"].([]interface{})[0].(map[string]interface{})["scopeSpans"].([]interface{})[0].(map[string]interface{})["spans"].([]interface{})
+	var names []string
+	for _, span := range spans {
+		names = append(names, span.(map[string]interface{})["name"].(string))
+	}
+	assert.Equal([]string{"GET", "connect", "tls", "ttfb"}, names)
+	root := spans[0].(map[string]interface{})
+	assert.Equal("00-"+root["traceId"].(string)+"-"+root["spanId"].(string)+"-01", traceparent)
+
+	plugin.OTel.Endpoint = "localhost:4318"
+	status, err = checkArgs(event)
+	assert.Error(err)
+	assert.Equal(sensu.CheckStateUnknown, status)
+}
+
+func TestExecuteCheckCompareURL(t *testing.T) {
+	assert := assert.New(t)
+	event := corev2.FixtureEvent("entity1", "check")
+
+	var fast = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer fast.Close()
+	var slow = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer slow.Close()
+
+	run := func() (int, string) {
+		stdout := os.Stdout
+		defer func() { os.Stdout = stdout }()
+		r, w, err := os.Pipe()
+		require.NoError(t, err)
+		os.Stdout = w
+		status, err := executeCheck(event)
+		assert.NoError(err)
+		w.Close()
+		output, _ := ioutil.ReadAll(r)
+		return status, string(output)
+	}
+
+	plugin.URL = fast.URL
+	plugin.CompareURLs = []string{slow.URL}
+	plugin.Headers = nil
+	plugin.Timeout = 15
+	plugin.Warning = "2s"
+	plugin.Critical = "5s"
+	plugin.DeltaWarning = "50ms"
+	plugin.DeltaCritical = "10s"
+	defer func() {
+		plugin.CompareURLs = nil
+		plugin.DeltaWarning = ""
+		plugin.DeltaCritical = ""
+	}()
+	status, err := checkArgs(event)
+	assert.NoError(err)
+	assert.Equal(sensu.CheckStateOK, status)
+	status, output := run()
+	assert.Equal(sensu.CheckStateWarning, status)
+	assert.Contains(output, "max delta ")
+	assert.Contains(output, " exceeds 0.050000s")
+	assert.Regexp(`, 127_0_0_1_total_request_duration=0\.2[0-9]+, max_delta=0\.[12][0-9]+\nProtocol: HTTP/1\.1\n$`, output)
+
+	plugin.DeltaWarning = "5s"
+	_, err = checkArgs(event)
+	assert.NoError(err)
+	status, _ = run()
+	assert.Equal(sensu.CheckStateOK, status)
+
+	// The compare URLs are reported separately when they cannot be reached.
+	plugin.CompareURLs = []string{slow.URL, "http://127.0.0.1:1"}
+	status, output = run()
+	assert.Equal(sensu.CheckStateCritical, status)
+	assert.Contains(output, "http://127.0.0.1:1 ")
+	assert.Contains(output, ", 127_0_0_1_total_request_duration=")
+
+	plugin.CompareURLs = nil
+	_, err = checkArgs(event)
+	assert.Error(err)
+
+	assert.Equal("eu_example_com", metricPrefix("https://EU.example.com:8443/health"))
+}
+
+func TestExecuteCheckBaseline(t *testing.T) {
+	assert := assert.New(t)
+	event := corev2.FixtureEvent("entity1", "check")
+
+	var target = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(250 * time.Millisecond)
+	}))
+	defer target.Close()
+	var baseline = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer baseline.Close()
+
+	run := func() (int, string) {
+		stdout := os.Stdout
+		defer func() { os.Stdout = stdout }()
+		r, w, err := os.Pipe()
+		require.NoError(t, err)
+		os.Stdout = w
+		status, err := executeCheck(event)
+		assert.NoError(err)
+		w.Close()
+		output, _ := ioutil.ReadAll(r)
+		return status, string(output)
+	}
+
+	plugin.URL = target.URL
+	plugin.Headers = nil
+	plugin.Timeout = 15
+	plugin.Warning = "150ms"
+	plugin.Critical = "5s"
+	plugin.BaselineURL = baseline.URL
+	defer func() {
+		plugin.BaselineURL = ""
+	}()
+	status, err := checkArgs(event)
+	assert.NoError(err)
+	assert.Equal(sensu.CheckStateOK, status)
+	status, output := run()
+	assert.Equal(sensu.CheckStateOK, status)
+	assert.Contains(output, " over baseline 0.2")
+	assert.Regexp(`, baseline_total_request_duration=0\.2[0-9]+, adjusted_request_duration=0\.0[0-9]+\nProtocol: HTTP/1\.1\n$`, output)
+
+	// Without a baseline the thresholds apply to the latency of --url.
+	plugin.BaselineURL = "http://127.0.0.1:1"
+	plugin.Warning = "1s"
+	_, err = checkArgs(event)
+	assert.NoError(err)
+	status, output = run()
+	assert.Equal(sensu.CheckStateWarning, status)
+	assert.Contains(output, "baseline http://127.0.0.1:1 ")
+
+	plugin.BaselineURL = "ftp://example.com"
+	_, err = checkArgs(event)
+	assert.Error(err)
+}
+
+func TestExecuteCheckPolicy(t *testing.T) {
+	assert := assert.New(t)
+	event := corev2.FixtureEvent("entity1", "check")
+
+	policyFile, err := ioutil.TempFile("", "http-perf-policy")
+	require.NoError(t, err)
+	defer os.Remove(policyFile.Name())
+	_, err = policyFile.WriteString(`
+rules:
+  - status: critical
+    when: total > 0.1 && first_byte > 0.1
+    message: slow backend
+`)
+	require.NoError(t, err)
+	policyFile.Close()
+
+	var delay time.Duration
+	var test = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+	}))
+	defer test.Close()
+
+	plugin.URL = test.URL
+	plugin.Headers = nil
+	plugin.Timeout = 15
+	plugin.Warning = "1ms"
+	plugin.Critical = "2ms"
+	plugin.Policy.File = policyFile.Name()
+	defer func() {
+		plugin.Policy.File = ""
+		_ = plugin.Policy.Validate()
+	}()
+	status, err := checkArgs(event)
+	assert.NoError(err)
+	assert.Equal(sensu.CheckStateOK, status)
+
+	// The policy replaces the thresholds.
+	delay = 20 * time.Millisecond
+	status, err = executeCheck(event)
+	assert.NoError(err)
+	assert.Equal(sensu.CheckStateOK, status)
+	delay = 150 * time.Millisecond
+	status, err = executeCheck(event)
+	assert.NoError(err)
+	assert.Equal(sensu.CheckStateCritical, status)
+}
+
+func TestExecuteCheckMetricTags(t *testing.T) {
+	assert := assert.New(t)
+	event := corev2.FixtureEvent("entity1", "check")
+	event.Entity.Labels = map[string]string{"region": "eu-west"}
+
+	var test = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer test.Close()
+
+	run := func(event *corev2.Event) (int, string, error) {
+		stdout := os.Stdout
+		defer func() { os.Stdout = stdout }()
+		r, w, err := os.Pipe()
+		require.NoError(t, err)
+		os.Stdout = w
+		status, err := executeCheck(event)
+		w.Close()
+		output, _ := ioutil.ReadAll(r)
+		return status, string(output), err
+	}
+
+	plugin.URL = test.URL
+	plugin.Headers = nil
+	plugin.Timeout = 15
+	plugin.Warning = "2s"
+	plugin.Critical = "5s"
+	plugin.MetricTags = []string{"region={{ .labels.region }}", "team={{ .labels.team | default \"sre\" }}", "service=check out"}
+	defer func() {
+		plugin.MetricFormat = ""
+		plugin.MetricTags = nil
+		metricTags = nil
+	}()
+
+	// nagios perfdata has no tags.
+	_, err := checkArgs(event)
+	assert.Error(err)
+
+	plugin.MetricFormat = "prometheus_text"
+	status, err := checkArgs(event)
+	assert.NoError(err)
+	assert.Equal(sensu.CheckStateOK, status)
+	status, output, err := run(event)
+	assert.NoError(err)
+	assert.Equal(sensu.CheckStateOK, status)
+	assert.Regexp(`^# http-perf OK: `, output)
+	assert.Regexp(`\ntotal_request_duration\{region="eu-west",team="sre",service="check out"\} 0\.[0-9]+\n`, output)
+	assert.Regexp(`\n# Protocol: HTTP/1\.1\n$`, output)
+
+	plugin.MetricFormat = "influxdb_line"
+	_, err = checkArgs(event)
+	assert.NoError(err)
+	_, output, err = run(event)
+	assert.NoError(err)
+	assert.Regexp(`^http-perf OK: `, output)
+	assert.Regexp(`\nhttp_perf,region=eu-west,team=sre,service=check\\ out dns_duration=[0-9.]+,.*total_request_duration=[0-9.]+ [0-9]+\nProtocol: HTTP/1\.1\n$`, output)
+
+	// The entity is only known with --event-stdin.
+	status, _, err = run(nil)
+	assert.Error(err)
+	assert.Equal(sensu.CheckStateUnknown, status)
+
+	plugin.MetricTags = []string{"zone={{ .labels.zone }}"}
+	_, err = checkArgs(event)
+	assert.NoError(err)
+	_, _, err = run(event)
+	assert.Error(err)
+
+	plugin.MetricTags = []string{"1zone=a"}
+	_, err = checkArgs(event)
+	assert.Error(err)
+	plugin.MetricFormat = "graphite"
+	plugin.MetricTags = nil
+	_, err = checkArgs(event)
+	assert.Error(err)
+}
+
+func TestExecuteCheckJSONOutput(t *testing.T) {
+	assert := assert.New(t)
+	event := corev2.FixtureEvent("entity1", "check")
+	event.Entity.Labels = map[string]string{"region": "eu-west"}
+
+	var test = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("hello world"))
+	}))
+	defer test.Close()
+
+	run := func(event *corev2.Event) (int, string, error) {
+		stdout := os.Stdout
+		defer func() { os.Stdout = stdout }()
+		r, w, err := os.Pipe()
+		require.NoError(t, err)
+		os.Stdout = w
+		status, err := executeCheck(event)
+		w.Close()
+		output, _ := ioutil.ReadAll(r)
+		return status, string(output), err
+	}
+
+	plugin.URL = test.URL
+	plugin.Headers = nil
+	plugin.Timeout = 15
+	plugin.Warning = "2s"
+	plugin.Critical = "5s"
+	plugin.InsecureSkipVerify = true
+	plugin.OutputFormat = "json"
+	plugin.MetricTags = []string{"region={{ .labels.region }}"}
+	defer func() {
+		plugin.InsecureSkipVerify = false
+		plugin.OutputFormat = ""
+		plugin.MetricFormat = ""
+		plugin.MetricTags = nil
+		metricTags = nil
+	}()
+	status, err := checkArgs(event)
+	require.NoError(t, err)
+	assert.Equal(sensu.CheckStateOK, status)
+	status, output, err := run(event)
+	assert.NoError(err)
+	assert.Equal(sensu.CheckStateOK, status)
+
+	var result jsonResult
+	require.NoError(t, json.Unmarshal([]byte(output), &result), output)
+	assert.Equal("OK", result.State)
+	assert.Equal(map[string]string{"region": "eu-west"}, result.Tags)
+	assert.Contains(result.Metrics, "total_request_duration")
+	require.Len(t, result.Requests, 1)
+	request := result.Requests[0]
+	assert.Equal(http.StatusOK, request.StatusCode)
+	assert.Equal(test.Listener.Addr().String(), request.RemoteAddress)
+	assert.Equal(int64(11), request.BytesReceived)
+	require.NotNil(t, request.ContentLength)
+	assert.Equal(int64(11), *request.ContentLength)
+	assert.True(request.TotalDuration > 0)
+	require.NotNil(t, request.TLS)
+	assert.Regexp(`^TLS 1\.[0-9]$`, request.TLS.Version)
+	assert.Contains(request.TLS.Issuer, "Acme Co")
+
+	// Even wrapped for self metrics the output is a single JSON object.
+	plugin.Metrics.Enabled = true
+	defer func() { plugin.Metrics.Enabled = false }()
+	stdout := os.Stdout
+	r, w, err := os.Pipe()
+	require.NoError(t, err)
+	os.Stdout = w
+	status, err = plugin.Metrics.Wrap(plugin.PluginConfig.Name, executeCheck)(event)
+	w.Close()
+	os.Stdout = stdout
+	assert.NoError(err)
+	assert.Equal(sensu.CheckStateOK, status)
+	data, _ := ioutil.ReadAll(r)
+	assert.NoError(json.Unmarshal(data, &result), string(data))
+
+	// But the combination is rejected, the metrics would not be part of it.
+	_, err = checkArgs(event)
+	assert.Error(err)
+	plugin.Metrics.Enabled = false
+	plugin.Metrics.Errors = true
+	_, err = checkArgs(event)
+	assert.Error(err)
+	plugin.Metrics.Errors = false
+
+	plugin.MetricFormat = "prometheus_text"
+	_, err = checkArgs(event)
+	assert.Error(err)
+	plugin.MetricFormat = ""
+	plugin.OutputFormat = "yaml"
+	_, err = checkArgs(event)
+	assert.Error(err)
+}
+
+func TestExecuteCheckUpload(t *testing.T) {
+	assert := assert.New(t)
+	event := corev2.FixtureEvent("entity1", "check")
+
+	var method string
+	var received int64
+	var test = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method = r.Method
+		received, _ = io.Copy(ioutil.Discard, r.Body)
+	}))
+	defer test.Close()
+
+	dir, err := ioutil.TempDir("", "http-perf-upload")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	plugin.URL = test.URL
+	plugin.Headers = nil
+	plugin.Timeout = 15
+	plugin.Warning = "2s"
+	plugin.Critical = "5s"
+	plugin.Upload.File = filepath.Join(dir, "upload.bin")
+	plugin.Upload.Method = "POST"
+	plugin.Upload.ExpectContinue = true
+	defer func() {
+		plugin.Upload.File, plugin.Upload.Method = "", ""
+		plugin.Upload.ExpectContinue = false
+	}()
+	require.NoError(t, ioutil.WriteFile(plugin.Upload.File, []byte(strings.Repeat("x", 65536)), 0644))
+	_, err = checkArgs(event)
+	require.NoError(t, err)
+
+	stdout := os.Stdout
+	r, w, err := os.Pipe()
+	require.NoError(t, err)
+	os.Stdout = w
+	status, err := executeCheck(event)
+	w.Close()
+	os.Stdout = stdout
+	output, _ := ioutil.ReadAll(r)
+	assert.NoError(err)
+	assert.Equal(sensu.CheckStateOK, status)
+	assert.Equal("POST", method)
+	assert.Equal(int64(65536), received)
+	assert.Regexp(`^http-perf OK: [0-9.]+s, uploaded 65536 bytes at [0-9.]+ MB/s, 100 Continue after [0-9.]+s \| .*total_request_duration=[0-9.]+, upload_bytes=65536, upload_duration=[0-9.]+, upload_throughput=[0-9]+, continue_duration=[0-9.]+\nProtocol: HTTP/1\.1\n$`, string(output))
+}
+
+func TestEvaluateSLO(t *testing.T) {
+	assert := assert.New(t)
+	event := corev2.FixtureEvent("entity1", "check")
+
+	dir, err := ioutil.TempDir("", "http-perf-slo")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	plugin.URL = "http://localhost/"
+	plugin.Warning = "2s"
+	plugin.Critical = "4s"
+	plugin.SLOTarget = "99%"
+	plugin.SLOThreshold = "500ms"
+	defer func() {
+		plugin.SLOTarget, plugin.SLOThreshold, plugin.StateFile = "", "", ""
+		sloBudget, sloThreshold = 0, 0
+	}()
+	_, err = checkArgs(event)
+	assert.Error(err, "--slo-target requires --state-file")
+	plugin.SLOTarget = "100%"
+	_, err = checkArgs(event)
+	assert.Error(err)
+	plugin.SLOTarget = "99%"
+	plugin.StateFile = dir + "/state.json"
+	status, err := checkArgs(event)
+	require.NoError(t, err)
+	assert.Equal(sensu.CheckStateOK, status)
+	assert.InDelta(0.01, sloBudget, 1e-9)
+
+	// A minute apart for 6 hours, 3 bad: burning less than the budget.
+	now := time.Now().Add(-6 * time.Hour)
+	var result sloResult
+	for i := 1; i <= 360; i++ {
+		result = evaluateSLO(i%100 == 0, now)
+		now = now.Add(time.Minute)
+	}
+	assert.Equal(sensu.CheckStateOK, result.status)
+	assert.Contains(result.perfdata, "slo_burn_rate_6h=0.83")
+
+	// An outage: everything is bad for 10 minutes.
+	for i := 0; i < 10; i++ {
+		result = evaluateSLO(true, now)
+		now = now.Add(time.Minute)
+	}
+	assert.Equal(sensu.CheckStateCritical, result.status)
+	assert.Contains(result.output[0], "fast burn")
+
+	// Recovery: the short window stops the alert before the hour is over.
+	for i := 0; i < 6; i++ {
+		result = evaluateSLO(false, now)
+		now = now.Add(time.Minute)
+	}
+	assert.Equal(sensu.CheckStateOK, result.status)
+
+	// The state is per URL.
+	plugin.URL = "http://localhost/other"
+	result = evaluateSLO(true, now)
+	assert.Equal(sensu.CheckStateOK, result.status, "no history yet")
+	assert.Contains(result.perfdata, "slo_burn_rate_1h=100.00")
+}
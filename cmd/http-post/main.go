@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nixwiz/http-checks/internal/buildinfo"
+	"github.com/nixwiz/http-checks/internal/exitstatus"
+	"github.com/nixwiz/http-checks/internal/httpclient"
+	"github.com/nixwiz/http-checks/internal/logging"
+	"github.com/nixwiz/http-checks/internal/overrides"
+	"github.com/nixwiz/http-checks/internal/selfmetrics"
+	corev2 "github.com/sensu/sensu-go/api/core/v2"
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+)
+
+// Config represents the check plugin config.
+type Config struct {
+	sensu.PluginConfig
+	URL                string
+	TrustedCAFile      string
+	UseSystemCAsPlus   bool
+	InsecureSkipVerify bool
+	Timeout            int
+	Headers            []string
+	HeadersFile        httpclient.HeadersFileConfig
+	MTLSKeyFile        string
+	MTLSCertFile       string
+	Method             string
+	PostData           string
+	BodyFile           string
+	ContentType        string
+	ResponseCode       []string
+	Proxy              httpclient.ProxyConfig
+	Transport          httpclient.TransportConfig
+	Source             httpclient.SourceConfig
+	Resolver           httpclient.ResolverConfig
+	URLParsing         httpclient.URLConfig
+	Record             httpclient.RecordConfig
+	Log                logging.Config
+	Overrides          overrides.Config
+	Status             exitstatus.Config
+	Metrics            selfmetrics.Config
+}
+
+var (
+	tlsConfig   tls.Config
+	requestBody []byte
+
+	plugin = Config{
+		PluginConfig: sensu.PluginConfig{
+			Name:     "http-post",
+			Short:    "HTTP POST Check",
+			Keyspace: "sensu.io/plugins/http-post/config",
+		},
+	}
+
+	options = []*sensu.PluginConfigOption{
+		{
+			Path:      "url",
+			Env:       "CHECK_URL",
+			Argument:  "url",
+			Shorthand: "u",
+			Default:   "http://localhost:80/",
+			Usage:     "URL to post to",
+			Value:     &plugin.URL,
+		},
+		{
+			Path:      "insecure-skip-verify",
+			Env:       "",
+			Argument:  "insecure-skip-verify",
+			Shorthand: "i",
+			Default:   false,
+			Usage:     "Skip TLS certificate verification (not recommended!)",
+			Value:     &plugin.InsecureSkipVerify,
+		},
+		{
+			Path:      "trusted-ca-file",
+			Env:       "",
+			Argument:  "trusted-ca-file",
+			Shorthand: "t",
+			Default:   "",
+			Usage:     "TLS CA certificate bundle in PEM format, or a directory of them",
+			Value:     &plugin.TrustedCAFile,
+		},
+		{
+			Path:      "use-system-cas-plus",
+			Env:       "",
+			Argument:  "use-system-cas-plus",
+			Shorthand: "",
+			Default:   false,
+			Usage:     "Add the CA certificates from --trusted-ca-file to the system trust store rather than replacing it",
+			Value:     &plugin.UseSystemCAsPlus,
+		},
+		{
+			Path:      "timeout",
+			Env:       "",
+			Argument:  "timeout",
+			Shorthand: "T",
+			Default:   15,
+			Usage:     "Request timeout in seconds",
+			Value:     &plugin.Timeout,
+		},
+		{
+			Path:      "header",
+			Env:       "",
+			Argument:  "header",
+			Shorthand: "H",
+			Default:   []string{},
+			Usage:     "Additional header(s) to send in check request",
+			Value:     &plugin.Headers,
+		},
+		{
+			Path:      "mtls-key-file",
+			Env:       "",
+			Argument:  "mtls-key-file",
+			Shorthand: "K",
+			Default:   "",
+			Usage:     "Key file for mutual TLS auth in PEM format",
+			Value:     &plugin.MTLSKeyFile,
+		},
+		{
+			Path:      "mtls-cert-file",
+			Env:       "",
+			Argument:  "mtls-cert-file",
+			Shorthand: "C",
+			Default:   "",
+			Usage:     "Certificate file for mutual TLS auth in PEM format",
+			Value:     &plugin.MTLSCertFile,
+		},
+		{
+			Path:      "method",
+			Env:       "",
+			Argument:  "method",
+			Shorthand: "m",
+			Default:   "POST",
+			Usage:     "HTTP method to use",
+			Value:     &plugin.Method,
+		},
+		{
+			Path:      "post-data",
+			Env:       "",
+			Argument:  "post-data",
+			Shorthand: "d",
+			Default:   "",
+			Usage:     "Data to send as the request body",
+			Value:     &plugin.PostData,
+		},
+		{
+			Path:      "body-file",
+			Env:       "",
+			Argument:  "body-file",
+			Shorthand: "",
+			Default:   "",
+			Usage:     "File containing data to send as the request body, use - to read from stdin",
+			Value:     &plugin.BodyFile,
+		},
+		{
+			Path:      "content-type",
+			Env:       "",
+			Argument:  "content-type",
+			Shorthand: "",
+			Default:   "application/json",
+			Usage:     "Content-Type header to send with the request body",
+			Value:     &plugin.ContentType,
+		},
+		{
+			Path:      "response-code",
+			Env:       "",
+			Argument:  "response-code",
+			Shorthand: "R",
+			Default:   []string{},
+			Usage:     "Expected http response code(s), if not provided any 2xx response is OK",
+			Value:     &plugin.ResponseCode,
+		},
+	}
+)
+
+func main() {
+	options = append(options, plugin.Proxy.Options()...)
+	options = append(options, plugin.Transport.Options()...)
+	options = append(options, plugin.Source.Options()...)
+	options = append(options, plugin.Resolver.Options()...)
+	options = append(options, plugin.URLParsing.Options()...)
+	options = append(options, plugin.HeadersFile.Options()...)
+	options = append(options, plugin.Record.Options()...)
+	options = append(options, plugin.Log.Options()...)
+	options = append(options, plugin.Overrides.Options()...)
+	options = append(options, plugin.Status.Options()...)
+	options = append(options, plugin.Metrics.Options()...)
+	buildinfo.Handle(plugin.PluginConfig.Name, options, os.Args[1:])
+	exitstatus.ParseFlags(plugin.PluginConfig.Name, options, os.Args[1:])
+	check := sensu.NewGoCheck(&plugin.PluginConfig, options, plugin.Status.Wrap(plugin.PluginConfig.Name, checkArgs), plugin.Record.Wrap(plugin.PluginConfig.Name, plugin.Metrics.Wrap(plugin.PluginConfig.Name, plugin.Status.Wrap(plugin.PluginConfig.Name, executeCheck))), overrides.Requested(os.Args[1:]))
+	check.Execute()
+}
+
+func checkArgs(event *corev2.Event) (int, error) {
+	if err := plugin.Log.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	if err := plugin.URLParsing.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+
+	if len(plugin.URL) == 0 {
+		return sensu.CheckStateUnknown, fmt.Errorf("--url or CHECK_URL environment variable is required")
+	}
+	checkURL, err := httpclient.ParseURL("--url", plugin.URL)
+	if err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	plugin.URL = checkURL.String()
+	headers, err := plugin.HeadersFile.Headers(event)
+	if err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	plugin.Headers = append(headers, plugin.Headers...)
+	if len(plugin.Headers) > 0 {
+		for _, header := range plugin.Headers {
+			headerSplit := strings.SplitN(header, ":", 2)
+			if len(headerSplit) != 2 {
+				return sensu.CheckStateUnknown, fmt.Errorf("--header %q value malformed should be \"Header-Name: Header Value\"", header)
+			}
+		}
+	}
+	if len(plugin.ResponseCode) > 0 {
+		for _, code := range plugin.ResponseCode {
+			_, err := strconv.Atoi(code)
+			if err != nil {
+				return sensu.CheckStateUnknown, fmt.Errorf("--response-code %q value malformed, should be a valid http response code ", code)
+			}
+		}
+	}
+	if len(plugin.TrustedCAFile) > 0 {
+		caCertPool, err := httpclient.LoadCACerts(plugin.TrustedCAFile, plugin.UseSystemCAsPlus)
+		if err != nil {
+			return sensu.CheckStateUnknown, fmt.Errorf("Error loading specified CA file: %v", err)
+		}
+		tlsConfig.RootCAs = caCertPool
+	}
+	tlsConfig.InsecureSkipVerify = plugin.InsecureSkipVerify
+
+	if (len(plugin.MTLSKeyFile) > 0 && len(plugin.MTLSCertFile) == 0) || (len(plugin.MTLSCertFile) > 0 && len(plugin.MTLSKeyFile) == 0) {
+		return sensu.CheckStateUnknown, fmt.Errorf("mTLS auth requires both --mtls-key-file and --mtls-cert-file")
+	}
+	if len(plugin.MTLSKeyFile) > 0 && len(plugin.MTLSCertFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(plugin.MTLSCertFile, plugin.MTLSKeyFile)
+		if err != nil {
+			return sensu.CheckStateUnknown, fmt.Errorf("Failed to load mTLS key pair %s/%s: %v", plugin.MTLSCertFile, plugin.MTLSKeyFile, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if len(plugin.PostData) > 0 && len(plugin.BodyFile) > 0 {
+		return sensu.CheckStateUnknown, fmt.Errorf("--post-data and --body-file are mutually exclusive")
+	}
+	requestBody = []byte(plugin.PostData)
+	switch plugin.BodyFile {
+	case "":
+	case "-":
+		data, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return sensu.CheckStateUnknown, fmt.Errorf("Failed to read body from stdin: %v", err)
+		}
+		requestBody = data
+	default:
+		data, err := ioutil.ReadFile(plugin.BodyFile)
+		if err != nil {
+			return sensu.CheckStateUnknown, fmt.Errorf("Failed to read body file %s: %v", plugin.BodyFile, err)
+		}
+		requestBody = data
+	}
+
+	plugin.Method = strings.ToUpper(strings.TrimSpace(plugin.Method))
+	if len(plugin.Method) == 0 {
+		return sensu.CheckStateUnknown, fmt.Errorf("--method must not be empty")
+	}
+
+	if err := plugin.Proxy.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	if err := plugin.Transport.Validate(&plugin.Proxy); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	if err := plugin.Source.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	if err := plugin.Resolver.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+
+	if err := plugin.Record.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+
+	return sensu.CheckStateOK, nil
+}
+
+func executeCheck(event *corev2.Event) (int, error) {
+
+	client := httpclient.New(&tlsConfig, time.Duration(plugin.Timeout)*time.Second, true, plugin.Proxy.Configure, plugin.Source.Configure, plugin.Resolver.Configure, plugin.Transport.Configure)
+
+	_, err := url.Parse(plugin.URL)
+	if err != nil {
+		fmt.Fprintf(selfmetrics.Stdout, "%s UNKNOWN: url parse error: %s\n", plugin.PluginConfig.Name, err)
+		return sensu.CheckStateUnknown, nil
+	}
+
+	req, err := http.NewRequest(plugin.Method, plugin.URL, bytes.NewReader(requestBody))
+	if err != nil {
+		fmt.Fprintf(selfmetrics.Stdout, "%s UNKNOWN: request creation error: %s\n", plugin.PluginConfig.Name, err)
+		return sensu.CheckStateUnknown, nil
+	}
+
+	if len(plugin.ContentType) > 0 {
+		req.Header.Set("Content-Type", plugin.ContentType)
+	}
+
+	if len(plugin.Headers) > 0 {
+		for _, header := range plugin.Headers {
+			headerSplit := strings.SplitN(header, ":", 2)
+			headerKey := strings.TrimSpace(headerSplit[0])
+			headerValue := strings.TrimSpace(headerSplit[1])
+			if strings.EqualFold(headerKey, "host") {
+				req.Host = headerValue
+				continue
+			}
+			req.Header.Set(headerKey, headerValue)
+		}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		fmt.Fprintf(selfmetrics.Stdout, "%s CRITICAL: %s\n", plugin.PluginConfig.Name, httpclient.Describe(err))
+		return sensu.CheckStateCritical, nil
+	}
+
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		fmt.Fprintf(selfmetrics.Stdout, "%s CRITICAL: reading response body: %s\n", plugin.PluginConfig.Name, httpclient.Describe(err))
+		return sensu.CheckStateCritical, nil
+	}
+
+	status := responseState(resp.StatusCode)
+	switch status {
+	case sensu.CheckStateWarning:
+		fmt.Fprintf(selfmetrics.Stdout, "%s WARNING: HTTP Status %v for %s\n", plugin.PluginConfig.Name, resp.StatusCode, plugin.URL)
+	case sensu.CheckStateCritical:
+		fmt.Fprintf(selfmetrics.Stdout, "%s CRITICAL: HTTP Status %v for %s\n", plugin.PluginConfig.Name, resp.StatusCode, plugin.URL)
+	}
+
+	fmt.Fprintf(selfmetrics.Stdout, "%s", string(body))
+
+	return status, nil
+}
+
+// responseState maps the response status code to a check state, using the
+// expected response codes if they were provided.
+func responseState(statusCode int) int {
+	if len(plugin.ResponseCode) > 0 {
+		for _, code := range plugin.ResponseCode {
+			expected, _ := strconv.Atoi(code)
+			if expected == statusCode {
+				return sensu.CheckStateOK
+			}
+		}
+		return sensu.CheckStateCritical
+	}
+
+	switch {
+	case statusCode >= http.StatusBadRequest:
+		return sensu.CheckStateCritical
+	case statusCode >= http.StatusMultipleChoices:
+		return sensu.CheckStateWarning
+	}
+	return sensu.CheckStateOK
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	corev2 "github.com/sensu/sensu-go/api/core/v2"
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMain(t *testing.T) {
+}
+
+func TestExecuteCheck(t *testing.T) {
+
+	testCases := []struct {
+		returnStatus int
+		httpStatus   int
+		method       string
+		responseCode []string
+	}{
+		{sensu.CheckStateOK, http.StatusOK, "POST", nil},
+		{sensu.CheckStateOK, http.StatusCreated, "put", nil},
+		{sensu.CheckStateWarning, http.StatusFound, "POST", nil},
+		{sensu.CheckStateCritical, http.StatusBadRequest, "POST", nil},
+		{sensu.CheckStateCritical, http.StatusInternalServerError, "POST", nil},
+		{sensu.CheckStateOK, http.StatusAccepted, "POST", []string{"202"}},
+		{sensu.CheckStateCritical, http.StatusOK, "POST", []string{"202"}},
+	}
+
+	for _, tc := range testCases {
+		event := corev2.FixtureEvent("entity1", "check")
+		assert := assert.New(t)
+
+		var test = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			assert.Equal("{\"action\": \"restart\"}", string(body))
+			assert.Equal("application/json", r.Header.Get("Content-Type"))
+			assert.Equal("Test Header 1 Value", r.Header.Get("Test-Header-1"))
+			w.WriteHeader(tc.httpStatus)
+			_, _ = w.Write([]byte("{\"result\": \"queued\"}"))
+		}))
+		_, err := url.ParseRequestURI(test.URL)
+		require.NoError(t, err)
+		plugin.URL = test.URL
+		plugin.Method = tc.method
+		plugin.PostData = "{\"action\": \"restart\"}"
+		plugin.ContentType = "application/json"
+		plugin.Headers = []string{"Test-Header-1: Test Header 1 Value"}
+		plugin.ResponseCode = tc.responseCode
+		status, err := checkArgs(event)
+		assert.NoError(err)
+		assert.Equal(sensu.CheckStateOK, status)
+		status, err = executeCheck(event)
+		assert.NoError(err)
+		assert.Equal(tc.returnStatus, status)
+		test.Close()
+	}
+}
+
+func TestCheckArgs(t *testing.T) {
+	assert := assert.New(t)
+	event := corev2.FixtureEvent("entity1", "check")
+
+	plugin.URL = "http://localhost:80/"
+	plugin.Method = "POST"
+	plugin.PostData = "data"
+	plugin.BodyFile = "body.json"
+	status, err := checkArgs(event)
+	assert.Error(err)
+	assert.Equal(sensu.CheckStateUnknown, status)
+
+	plugin.BodyFile = ""
+	plugin.ResponseCode = []string{"two hundred"}
+	status, err = checkArgs(event)
+	assert.Error(err)
+	assert.Equal(sensu.CheckStateUnknown, status)
+	plugin.ResponseCode = nil
+}
+
+func TestDefaultClientUntouched(t *testing.T) {
+	assert := assert.New(t)
+	event := corev2.FixtureEvent("entity1", "check")
+
+	var test = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(`{"status": "SUCCESS"}`))
+	}))
+	defer test.Close()
+
+	plugin.URL = test.URL
+	plugin.Headers = nil
+	plugin.Timeout = 15
+	plugin.InsecureSkipVerify = true
+	plugin.Method = "POST"
+	plugin.PostData = "{}"
+	plugin.BodyFile = ""
+	plugin.ResponseCode = nil
+	status, err := checkArgs(event)
+	assert.NoError(err)
+	assert.Equal(sensu.CheckStateOK, status)
+	status, err = executeCheck(event)
+	assert.NoError(err)
+	assert.Equal(sensu.CheckStateOK, status)
+	plugin.InsecureSkipVerify = false
+
+	// The check must use its own client and transport
+	// httptest.Server.Close may initialise the default TLS config itself, so
+	// only check that ours was not installed.
+	if defaultTLS := http.DefaultTransport.(*http.Transport).TLSClientConfig; defaultTLS != nil {
+		assert.False(defaultTLS.InsecureSkipVerify)
+	}
+	assert.Nil(http.DefaultClient.Transport)
+	assert.Nil(http.DefaultClient.CheckRedirect)
+	assert.Zero(http.DefaultClient.Timeout)
+}
@@ -0,0 +1,577 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"os"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/itchyny/gojq"
+	"github.com/nixwiz/http-checks/internal/buildinfo"
+	"github.com/nixwiz/http-checks/internal/exitstatus"
+	"github.com/nixwiz/http-checks/internal/httpclient"
+	"github.com/nixwiz/http-checks/internal/logging"
+	"github.com/nixwiz/http-checks/internal/overrides"
+	"github.com/nixwiz/http-checks/internal/selfmetrics"
+	corev2 "github.com/sensu/sensu-go/api/core/v2"
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+	"gopkg.in/yaml.v2"
+)
+
+// Config represents the check plugin config.
+type Config struct {
+	sensu.PluginConfig
+	SequenceFile       string
+	TrustedCAFile      string
+	UseSystemCAsPlus   bool
+	InsecureSkipVerify bool
+	Timeout            int
+	Warning            string
+	Critical           string
+	Headers            []string
+	HeadersFile        httpclient.HeadersFileConfig
+	MTLSKeyFile        string
+	MTLSCertFile       string
+	Proxy              httpclient.ProxyConfig
+	Transport          httpclient.TransportConfig
+	Source             httpclient.SourceConfig
+	Resolver           httpclient.ResolverConfig
+	Record             httpclient.RecordConfig
+	Log                logging.Config
+	Overrides          overrides.Config
+	Status             exitstatus.Config
+	Metrics            selfmetrics.Config
+}
+
+// Sequence is the document describing the steps to execute.
+type Sequence struct {
+	Variables map[string]string `yaml:"variables"`
+	Steps     []*Step           `yaml:"steps"`
+}
+
+// Step is a single HTTP request within a sequence.
+type Step struct {
+	Name          string                 `yaml:"name"`
+	Method        string                 `yaml:"method"`
+	URL           string                 `yaml:"url"`
+	Headers       map[string]string      `yaml:"headers"`
+	Body          string                 `yaml:"body"`
+	ResponseCodes []int                  `yaml:"response-codes"`
+	SearchString  string                 `yaml:"search-string"`
+	Extract       map[string]*Extraction `yaml:"extract"`
+	Warning       string                 `yaml:"warning"`
+	Critical      string                 `yaml:"critical"`
+
+	warning  time.Duration
+	critical time.Duration
+}
+
+// Extraction describes how to obtain a variable from a step's response.
+// Exactly one of JQ, Regex or Header must be set.
+type Extraction struct {
+	JQ     string `yaml:"jq"`
+	Regex  string `yaml:"regex"`
+	Header string `yaml:"header"`
+
+	query *gojq.Code
+	regex *regexp.Regexp
+}
+
+var (
+	tlsConfig         tls.Config
+	warning, critical time.Duration
+	sequence          *Sequence
+
+	plugin = Config{
+		PluginConfig: sensu.PluginConfig{
+			Name:     "http-sequence",
+			Short:    "HTTP Multi-Step Sequence Check",
+			Keyspace: "sensu.io/plugins/http-sequence/config",
+		},
+	}
+
+	options = []*sensu.PluginConfigOption{
+		{
+			Path:      "sequence-file",
+			Env:       "CHECK_SEQUENCE_FILE",
+			Argument:  "sequence-file",
+			Shorthand: "f",
+			Default:   "",
+			Usage:     "YAML or JSON file describing the steps of the sequence",
+			Value:     &plugin.SequenceFile,
+		},
+		{
+			Path:      "insecure-skip-verify",
+			Env:       "",
+			Argument:  "insecure-skip-verify",
+			Shorthand: "i",
+			Default:   false,
+			Usage:     "Skip TLS certificate verification (not recommended!)",
+			Value:     &plugin.InsecureSkipVerify,
+		},
+		{
+			Path:      "trusted-ca-file",
+			Env:       "",
+			Argument:  "trusted-ca-file",
+			Shorthand: "t",
+			Default:   "",
+			Usage:     "TLS CA certificate bundle in PEM format, or a directory of them",
+			Value:     &plugin.TrustedCAFile,
+		},
+		{
+			Path:      "use-system-cas-plus",
+			Env:       "",
+			Argument:  "use-system-cas-plus",
+			Shorthand: "",
+			Default:   false,
+			Usage:     "Add the CA certificates from --trusted-ca-file to the system trust store rather than replacing it",
+			Value:     &plugin.UseSystemCAsPlus,
+		},
+		{
+			Path:      "timeout",
+			Env:       "",
+			Argument:  "timeout",
+			Shorthand: "T",
+			Default:   15,
+			Usage:     "Request timeout in seconds, applied to each step",
+			Value:     &plugin.Timeout,
+		},
+		{
+			Path:      "warning",
+			Env:       "",
+			Argument:  "warning",
+			Shorthand: "w",
+			Default:   "",
+			Usage:     "Warning threshold for the total duration of the sequence, can be expressed as seconds or milliseconds (1s = 1000ms)",
+			Value:     &plugin.Warning,
+		},
+		{
+			Path:      "critical",
+			Env:       "",
+			Argument:  "critical",
+			Shorthand: "c",
+			Default:   "",
+			Usage:     "Critical threshold for the total duration of the sequence, can be expressed as seconds or milliseconds (1s = 1000ms)",
+			Value:     &plugin.Critical,
+		},
+		{
+			Path:      "header",
+			Env:       "",
+			Argument:  "header",
+			Shorthand: "H",
+			Default:   []string{},
+			Usage:     "Additional header(s) to send with every request in the sequence",
+			Value:     &plugin.Headers,
+		},
+		{
+			Path:      "mtls-key-file",
+			Env:       "",
+			Argument:  "mtls-key-file",
+			Shorthand: "K",
+			Default:   "",
+			Usage:     "Key file for mutual TLS auth in PEM format",
+			Value:     &plugin.MTLSKeyFile,
+		},
+		{
+			Path:      "mtls-cert-file",
+			Env:       "",
+			Argument:  "mtls-cert-file",
+			Shorthand: "C",
+			Default:   "",
+			Usage:     "Certificate file for mutual TLS auth in PEM format",
+			Value:     &plugin.MTLSCertFile,
+		},
+	}
+)
+
+func main() {
+	options = append(options, plugin.Proxy.Options()...)
+	options = append(options, plugin.Transport.Options()...)
+	options = append(options, plugin.Source.Options()...)
+	options = append(options, plugin.Resolver.Options()...)
+	options = append(options, plugin.HeadersFile.Options()...)
+	options = append(options, plugin.Record.Options()...)
+	options = append(options, plugin.Log.Options()...)
+	options = append(options, plugin.Overrides.Options()...)
+	options = append(options, plugin.Status.Options()...)
+	options = append(options, plugin.Metrics.Options()...)
+	buildinfo.Handle(plugin.PluginConfig.Name, options, os.Args[1:])
+	exitstatus.ParseFlags(plugin.PluginConfig.Name, options, os.Args[1:])
+	check := sensu.NewGoCheck(&plugin.PluginConfig, options, plugin.Status.Wrap(plugin.PluginConfig.Name, checkArgs), plugin.Record.Wrap(plugin.PluginConfig.Name, plugin.Metrics.Wrap(plugin.PluginConfig.Name, plugin.Status.Wrap(plugin.PluginConfig.Name, executeCheck))), overrides.Requested(os.Args[1:]))
+	check.Execute()
+}
+
+func checkArgs(event *corev2.Event) (int, error) {
+	if err := plugin.Log.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+
+	var err error
+
+	if len(plugin.SequenceFile) == 0 {
+		return sensu.CheckStateUnknown, fmt.Errorf("--sequence-file or CHECK_SEQUENCE_FILE environment variable is required")
+	}
+	headers, err := plugin.HeadersFile.Headers(event)
+	if err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	plugin.Headers = append(headers, plugin.Headers...)
+	if len(plugin.Headers) > 0 {
+		for _, header := range plugin.Headers {
+			headerSplit := strings.SplitN(header, ":", 2)
+			if len(headerSplit) != 2 {
+				return sensu.CheckStateUnknown, fmt.Errorf("--header %q value malformed should be \"Header-Name: Header Value\"", header)
+			}
+		}
+	}
+	warning, critical = 0, 0
+	if len(plugin.Warning) > 0 {
+		warning, err = time.ParseDuration(plugin.Warning)
+		if err != nil {
+			return sensu.CheckStateUnknown, fmt.Errorf("--warning %q is not a valid duration: %v", plugin.Warning, err)
+		}
+	}
+	if len(plugin.Critical) > 0 {
+		critical, err = time.ParseDuration(plugin.Critical)
+		if err != nil {
+			return sensu.CheckStateUnknown, fmt.Errorf("--critical %q is not a valid duration: %v", plugin.Critical, err)
+		}
+	}
+	if len(plugin.TrustedCAFile) > 0 {
+		caCertPool, err := httpclient.LoadCACerts(plugin.TrustedCAFile, plugin.UseSystemCAsPlus)
+		if err != nil {
+			return sensu.CheckStateUnknown, fmt.Errorf("Error loading specified CA file: %v", err)
+		}
+		tlsConfig.RootCAs = caCertPool
+	}
+	tlsConfig.InsecureSkipVerify = plugin.InsecureSkipVerify
+
+	if (len(plugin.MTLSKeyFile) > 0 && len(plugin.MTLSCertFile) == 0) || (len(plugin.MTLSCertFile) > 0 && len(plugin.MTLSKeyFile) == 0) {
+		return sensu.CheckStateUnknown, fmt.Errorf("mTLS auth requires both --mtls-key-file and --mtls-cert-file")
+	}
+	if len(plugin.MTLSKeyFile) > 0 && len(plugin.MTLSCertFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(plugin.MTLSCertFile, plugin.MTLSKeyFile)
+		if err != nil {
+			return sensu.CheckStateUnknown, fmt.Errorf("Failed to load mTLS key pair %s/%s: %v", plugin.MTLSCertFile, plugin.MTLSKeyFile, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	data, err := ioutil.ReadFile(plugin.SequenceFile)
+	if err != nil {
+		return sensu.CheckStateUnknown, fmt.Errorf("Failed to read sequence file %s: %v", plugin.SequenceFile, err)
+	}
+	sequence, err = parseSequence(data)
+	if err != nil {
+		return sensu.CheckStateUnknown, fmt.Errorf("Invalid sequence file %s: %v", plugin.SequenceFile, err)
+	}
+
+	if err := plugin.Proxy.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	if err := plugin.Transport.Validate(&plugin.Proxy); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	if err := plugin.Source.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	if err := plugin.Resolver.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+
+	if err := plugin.Record.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+
+	return sensu.CheckStateOK, nil
+}
+
+// parseSequence parses and validates a YAML or JSON sequence document.
+func parseSequence(data []byte) (*Sequence, error) {
+	seq := &Sequence{}
+	if err := yaml.UnmarshalStrict(data, seq); err != nil {
+		return nil, err
+	}
+	if len(seq.Steps) == 0 {
+		return nil, fmt.Errorf("no steps defined")
+	}
+	if seq.Variables == nil {
+		seq.Variables = map[string]string{}
+	}
+
+	for i, step := range seq.Steps {
+		if len(step.Name) == 0 {
+			step.Name = fmt.Sprintf("step%d", i+1)
+		}
+		if len(step.URL) == 0 {
+			return nil, fmt.Errorf("step %q has no url", step.Name)
+		}
+		step.Method = strings.ToUpper(step.Method)
+		if len(step.Method) == 0 {
+			step.Method = http.MethodGet
+		}
+		var err error
+		if len(step.Warning) > 0 {
+			if step.warning, err = time.ParseDuration(step.Warning); err != nil {
+				return nil, fmt.Errorf("step %q warning: %v", step.Name, err)
+			}
+		}
+		if len(step.Critical) > 0 {
+			if step.critical, err = time.ParseDuration(step.Critical); err != nil {
+				return nil, fmt.Errorf("step %q critical: %v", step.Name, err)
+			}
+		}
+		for name, extraction := range step.Extract {
+			if extraction == nil {
+				return nil, fmt.Errorf("step %q extraction %q is empty", step.Name, name)
+			}
+			set := 0
+			if len(extraction.JQ) > 0 {
+				set++
+				query, err := gojq.Parse(extraction.JQ)
+				if err != nil {
+					return nil, fmt.Errorf("step %q extraction %q: %v", step.Name, name, err)
+				}
+				if extraction.query, err = gojq.Compile(query); err != nil {
+					return nil, fmt.Errorf("step %q extraction %q: %v", step.Name, name, err)
+				}
+			}
+			if len(extraction.Regex) > 0 {
+				set++
+				if extraction.regex, err = regexp.Compile(extraction.Regex); err != nil {
+					return nil, fmt.Errorf("step %q extraction %q: %v", step.Name, name, err)
+				}
+			}
+			if len(extraction.Header) > 0 {
+				set++
+			}
+			if set != 1 {
+				return nil, fmt.Errorf("step %q extraction %q must specify exactly one of jq, regex or header", step.Name, name)
+			}
+		}
+	}
+	return seq, nil
+}
+
+func executeCheck(event *corev2.Event) (int, error) {
+
+	jar, _ := cookiejar.New(nil)
+	client := httpclient.New(&tlsConfig, time.Duration(plugin.Timeout)*time.Second, true, plugin.Proxy.Configure, plugin.Source.Configure, plugin.Resolver.Configure, plugin.Transport.Configure)
+	client.Jar = jar
+
+	variables := map[string]string{}
+	for k, v := range sequence.Variables {
+		variables[k] = v
+	}
+
+	status := sensu.CheckStateOK
+	messages := []string{}
+	perfdata := []string{}
+	var total time.Duration
+
+	for i, step := range sequence.Steps {
+		duration, err := runStep(client, step, variables)
+		total += duration
+		perfdata = append(perfdata, fmt.Sprintf("%s_duration=%0.6f", perfName(step.Name), duration.Seconds()))
+		if err != nil {
+			fmt.Fprintf(selfmetrics.Stdout, "%s CRITICAL: step %d (%s) failed: %v | %s\n", plugin.PluginConfig.Name, i+1, step.Name, err, strings.Join(perfdata, ", "))
+			return sensu.CheckStateCritical, nil
+		}
+		switch {
+		case step.critical > 0 && duration > step.critical:
+			status = sensu.CheckStateCritical
+			messages = append(messages, fmt.Sprintf("step %s took %0.6fs", step.Name, duration.Seconds()))
+		case step.warning > 0 && duration > step.warning:
+			if status < sensu.CheckStateWarning {
+				status = sensu.CheckStateWarning
+			}
+			messages = append(messages, fmt.Sprintf("step %s took %0.6fs", step.Name, duration.Seconds()))
+		}
+	}
+	perfdata = append(perfdata, fmt.Sprintf("total_duration=%0.6f", total.Seconds()))
+
+	switch {
+	case critical > 0 && total > critical:
+		status = sensu.CheckStateCritical
+		messages = append(messages, fmt.Sprintf("sequence took %0.6fs", total.Seconds()))
+	case warning > 0 && total > warning:
+		if status < sensu.CheckStateWarning {
+			status = sensu.CheckStateWarning
+		}
+		messages = append(messages, fmt.Sprintf("sequence took %0.6fs", total.Seconds()))
+	}
+
+	summary := fmt.Sprintf("%d steps completed in %0.6fs", len(sequence.Steps), total.Seconds())
+	if len(messages) > 0 {
+		summary = summary + ", " + strings.Join(messages, ", ")
+	}
+	fmt.Fprintf(selfmetrics.Stdout, "%s %s: %s | %s\n", plugin.PluginConfig.Name, stateName(status), summary, strings.Join(perfdata, ", "))
+
+	return status, nil
+}
+
+// runStep executes a single step, asserting on its response and adding any
+// extracted values to variables.
+func runStep(client *http.Client, step *Step, variables map[string]string) (time.Duration, error) {
+	stepURL, err := render(step.URL, variables)
+	if err != nil {
+		return 0, fmt.Errorf("url template error: %v", err)
+	}
+	body, err := render(step.Body, variables)
+	if err != nil {
+		return 0, fmt.Errorf("body template error: %v", err)
+	}
+
+	req, err := http.NewRequest(step.Method, stepURL, strings.NewReader(body))
+	if err != nil {
+		return 0, fmt.Errorf("request creation error: %v", err)
+	}
+
+	for _, header := range plugin.Headers {
+		headerSplit := strings.SplitN(header, ":", 2)
+		setHeader(req, strings.TrimSpace(headerSplit[0]), strings.TrimSpace(headerSplit[1]))
+	}
+	for key, value := range step.Headers {
+		value, err = render(value, variables)
+		if err != nil {
+			return 0, fmt.Errorf("header %s template error: %v", key, err)
+		}
+		setHeader(req, key, value)
+	}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return time.Since(start), fmt.Errorf("request error: %s", httpclient.Describe(err))
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	duration := time.Since(start)
+	if err != nil {
+		return duration, fmt.Errorf("read response body error: %s", httpclient.Describe(err))
+	}
+
+	if len(step.ResponseCodes) > 0 {
+		found := false
+		for _, code := range step.ResponseCodes {
+			if code == resp.StatusCode {
+				found = true
+			}
+		}
+		if !found {
+			return duration, fmt.Errorf("HTTP Status %v for %s, expected %v", resp.StatusCode, stepURL, step.ResponseCodes)
+		}
+	} else if resp.StatusCode >= http.StatusBadRequest {
+		return duration, fmt.Errorf("HTTP Status %v for %s", resp.StatusCode, stepURL)
+	}
+
+	if len(step.SearchString) > 0 {
+		search, err := render(step.SearchString, variables)
+		if err != nil {
+			return duration, fmt.Errorf("search-string template error: %v", err)
+		}
+		if !strings.Contains(string(respBody), search) {
+			return duration, fmt.Errorf("%q not found at %s", search, stepURL)
+		}
+	}
+
+	for name, extraction := range step.Extract {
+		value, err := extract(extraction, resp, respBody)
+		if err != nil {
+			return duration, fmt.Errorf("extracting %q: %v", name, err)
+		}
+		variables[name] = value
+	}
+
+	return duration, nil
+}
+
+// extract obtains a single value from the response as described by the
+// extraction.
+func extract(extraction *Extraction, resp *http.Response, body []byte) (string, error) {
+	switch {
+	case extraction.query != nil:
+		var jsonBody interface{}
+		if err := json.Unmarshal(body, &jsonBody); err != nil {
+			return "", fmt.Errorf("could not unmarshal response body into JSON: %v", err)
+		}
+		iter := extraction.query.Run(jsonBody)
+		v, ok := iter.Next()
+		if !ok || v == nil {
+			return "", fmt.Errorf("no value returned for query %q", extraction.JQ)
+		}
+		if err, ok := v.(error); ok {
+			return "", err
+		}
+		if str, ok := v.(string); ok {
+			return str, nil
+		}
+		b, err := json.Marshal(v)
+		return string(b), err
+	case extraction.regex != nil:
+		match := extraction.regex.FindSubmatch(body)
+		if match == nil {
+			return "", fmt.Errorf("regex %q did not match", extraction.Regex)
+		}
+		if len(match) > 1 {
+			return string(match[1]), nil
+		}
+		return string(match[0]), nil
+	default:
+		value := resp.Header.Get(extraction.Header)
+		if len(value) == 0 {
+			return "", fmt.Errorf("header %s not present", extraction.Header)
+		}
+		return value, nil
+	}
+}
+
+func setHeader(req *http.Request, key, value string) {
+	if strings.EqualFold(key, "host") {
+		req.Host = value
+		return
+	}
+	req.Header.Set(key, value)
+}
+
+// render expands {{ .name }} references to variables within text.
+func render(text string, variables map[string]string) (string, error) {
+	if !strings.Contains(text, "{{") {
+		return text, nil
+	}
+	tmpl, err := template.New("step").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var output strings.Builder
+	if err := tmpl.Execute(&output, variables); err != nil {
+		return "", err
+	}
+	return output.String(), nil
+}
+
+var perfNameRegex = regexp.MustCompile(`[^A-Za-z0-9_]+`)
+
+func perfName(name string) string {
+	return perfNameRegex.ReplaceAllString(name, "_")
+}
+
+func stateName(status int) string {
+	switch status {
+	case sensu.CheckStateOK:
+		return "OK"
+	case sensu.CheckStateWarning:
+		return "WARNING"
+	case sensu.CheckStateCritical:
+		return "CRITICAL"
+	}
+	return "UNKNOWN"
+}
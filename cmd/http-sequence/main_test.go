@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	corev2 "github.com/sensu/sensu-go/api/core/v2"
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMain(t *testing.T) {
+}
+
+func TestExecuteCheck(t *testing.T) {
+	assert := assert.New(t)
+	event := corev2.FixtureEvent("entity1", "check")
+
+	var test = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/login":
+			if r.Method == http.MethodPost {
+				body, _ := ioutil.ReadAll(r.Body)
+				assert.Equal(`{"user": "sensu"}`, string(body))
+			}
+			w.Header().Set("X-Session", "abc123")
+			_, _ = w.Write([]byte(`{"token": "s3cr3t", "account": {"id": 42}}`))
+		case "/accounts/42":
+			assert.Equal("Bearer s3cr3t", r.Header.Get("Authorization"))
+			assert.Equal("abc123", r.Header.Get("X-Session"))
+			_, _ = w.Write([]byte(`<span id="balance">100</span>`))
+		case "/logout":
+			assert.Equal("100", r.URL.Query().Get("balance"))
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer test.Close()
+
+	testCases := []struct {
+		status   int
+		sequence string
+	}{
+		{sensu.CheckStateOK, `
+variables:
+  user: sensu
+steps:
+- name: login
+  method: POST
+  url: %[1]s/login
+  body: '{"user": "{{ .user }}"}'
+  extract:
+    token: {jq: .token}
+    account: {jq: .account.id}
+    session: {header: X-Session}
+- name: account
+  url: '%[1]s/accounts/{{ .account }}'
+  headers:
+    Authorization: 'Bearer {{ .token }}'
+    X-Session: '{{ .session }}'
+  search-string: balance
+  extract:
+    balance: {regex: 'id="balance">(\d+)<'}
+- name: logout
+  url: '%[1]s/logout?balance={{ .balance }}'
+  response-codes: [204]
+`},
+		{sensu.CheckStateCritical, `{"steps": [{"name": "missing", "url": "%[1]s/missing"}]}`},
+		{sensu.CheckStateCritical, `{"steps": [{"url": "%[1]s/logout?balance=100", "response-codes": [200]}]}`},
+		{sensu.CheckStateCritical, `{"steps": [{"url": "%[1]s/login", "extract": {"id": {"jq": ".missing"}}}]}`},
+		{sensu.CheckStateWarning, `{"steps": [{"url": "%[1]s/logout?balance=100", "warning": "1ns"}]}`},
+	}
+
+	for _, tc := range testCases {
+		sequenceFile, err := ioutil.TempFile("", "http-sequence")
+		require.NoError(t, err)
+		_, _ = sequenceFile.WriteString(fmt.Sprintf(tc.sequence, test.URL))
+		_ = sequenceFile.Close()
+
+		plugin.SequenceFile = sequenceFile.Name()
+		status, err := checkArgs(event)
+		assert.NoError(err)
+		assert.Equal(sensu.CheckStateOK, status)
+		status, err = executeCheck(event)
+		assert.NoError(err)
+		assert.Equal(tc.status, status)
+		os.Remove(sequenceFile.Name())
+	}
+}
+
+func TestParseSequence(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := parseSequence([]byte(`steps: []`))
+	assert.Error(err)
+
+	_, err = parseSequence([]byte(`steps: [{name: nourl}]`))
+	assert.Error(err)
+
+	_, err = parseSequence([]byte(`steps: [{url: "http://localhost", unknown: true}]`))
+	assert.Error(err)
+
+	_, err = parseSequence([]byte(`steps: [{url: "http://localhost", extract: {id: {jq: .id, header: X-Id}}}]`))
+	assert.Error(err)
+
+	seq, err := parseSequence([]byte(`steps: [{url: "http://localhost", warning: 1s}]`))
+	assert.NoError(err)
+	assert.Equal("step1", seq.Steps[0].Name)
+	assert.Equal("GET", seq.Steps[0].Method)
+}
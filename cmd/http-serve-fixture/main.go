@@ -0,0 +1,421 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/nixwiz/http-checks/internal/buildinfo"
+	"github.com/nixwiz/http-checks/internal/logging"
+	corev2 "github.com/sensu/sensu-go/api/core/v2"
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+	"gopkg.in/yaml.v2"
+)
+
+// Config represents the fixture server config. http-serve-fixture is not a
+// check, it serves canned responses for the checks to be tested against, so
+// it is not part of the released asset.
+type Config struct {
+	sensu.PluginConfig
+	Listen      string
+	Status      int
+	Latency     string
+	Body        string
+	ContentType string
+	Headers     []string
+	FixtureFile string
+	TLS         bool
+	TLSCertFile string
+	TLSKeyFile  string
+	TLSCertOut  string
+	Duration    string
+	Log         logging.Config
+}
+
+// Fixture is the content of a fixture file, the responses of the server by
+// path.
+type Fixture struct {
+	Routes []*Route `yaml:"routes"`
+}
+
+// Route is a canned response, served for requests to Path, and with Method
+// if set.
+type Route struct {
+	Path    string            `yaml:"path"`
+	Method  string            `yaml:"method"`
+	Status  int               `yaml:"status"`
+	Latency string            `yaml:"latency"`
+	Headers map[string]string `yaml:"headers"`
+	Body    string            `yaml:"body"`
+
+	latency time.Duration
+}
+
+var (
+	// fixture holds the routes of --fixture-file, and the response of the
+	// flags as the last route, matching any request.
+	fixture  Fixture
+	duration time.Duration
+
+	// stop is closed in tests to stop the server.
+	stop = make(chan struct{})
+
+	plugin = Config{
+		PluginConfig: sensu.PluginConfig{
+			Name:     "http-serve-fixture",
+			Short:    "HTTP test fixture server, serving canned responses to check configurations against",
+			Keyspace: "sensu.io/plugins/http-serve-fixture/config",
+		},
+	}
+
+	options = []*sensu.PluginConfigOption{
+		{
+			Path:      "listen",
+			Env:       "",
+			Argument:  "listen",
+			Shorthand: "l",
+			Default:   "127.0.0.1:8080",
+			Usage:     "Address to listen on",
+			Value:     &plugin.Listen,
+		},
+		{
+			Path:      "status",
+			Env:       "",
+			Argument:  "status",
+			Shorthand: "",
+			Default:   200,
+			Usage:     "Status code of the response to requests not matching a route of --fixture-file",
+			Value:     &plugin.Status,
+		},
+		{
+			Path:      "latency",
+			Env:       "",
+			Argument:  "latency",
+			Shorthand: "",
+			Default:   "0s",
+			Usage:     "Delay before the response to requests not matching a route of --fixture-file",
+			Value:     &plugin.Latency,
+		},
+		{
+			Path:      "body",
+			Env:       "",
+			Argument:  "body",
+			Shorthand: "",
+			Default:   "",
+			Usage:     "Body of the response to requests not matching a route of --fixture-file",
+			Value:     &plugin.Body,
+		},
+		{
+			Path:      "content-type",
+			Env:       "",
+			Argument:  "content-type",
+			Shorthand: "",
+			Default:   "text/plain; charset=utf-8",
+			Usage:     "Content-Type of the response to requests not matching a route of --fixture-file",
+			Value:     &plugin.ContentType,
+		},
+		{
+			Path:      "header",
+			Env:       "",
+			Argument:  "header",
+			Shorthand: "H",
+			Default:   []string{},
+			Usage:     "Additional header(s) of the response to requests not matching a route of --fixture-file",
+			Value:     &plugin.Headers,
+		},
+		{
+			Path:      "fixture-file",
+			Env:       "",
+			Argument:  "fixture-file",
+			Shorthand: "f",
+			Default:   "",
+			Usage:     "YAML file of routes, each with a path, and optionally a method, status, latency, headers and body",
+			Value:     &plugin.FixtureFile,
+		},
+		{
+			Path:      "tls",
+			Env:       "",
+			Argument:  "tls",
+			Shorthand: "",
+			Default:   false,
+			Usage:     "Serve HTTPS, with a self-signed certificate for localhost unless --tls-cert-file and --tls-key-file are given",
+			Value:     &plugin.TLS,
+		},
+		{
+			Path:      "tls-cert-file",
+			Env:       "",
+			Argument:  "tls-cert-file",
+			Shorthand: "",
+			Default:   "",
+			Usage:     "Certificate (chain) file to serve HTTPS with in PEM format",
+			Value:     &plugin.TLSCertFile,
+		},
+		{
+			Path:      "tls-key-file",
+			Env:       "",
+			Argument:  "tls-key-file",
+			Shorthand: "",
+			Default:   "",
+			Usage:     "Key file of --tls-cert-file in PEM format",
+			Value:     &plugin.TLSKeyFile,
+		},
+		{
+			Path:      "tls-cert-out",
+			Env:       "",
+			Argument:  "tls-cert-out",
+			Shorthand: "",
+			Default:   "",
+			Usage:     "File to write the self-signed certificate to, for the --trusted-ca-file of the checks",
+			Value:     &plugin.TLSCertOut,
+		},
+		{
+			Path:      "duration",
+			Env:       "",
+			Argument:  "duration",
+			Shorthand: "",
+			Default:   "0s",
+			Usage:     "How long to serve for, 0 to serve until interrupted",
+			Value:     &plugin.Duration,
+		},
+	}
+)
+
+func main() {
+	options = append(options, plugin.Log.Options()...)
+	buildinfo.Handle(plugin.PluginConfig.Name, options, os.Args[1:])
+	check := sensu.NewGoCheck(&plugin.PluginConfig, options, checkArgs, executeCheck, false)
+	check.Execute()
+}
+
+func checkArgs(event *corev2.Event) (int, error) {
+	if err := plugin.Log.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+
+	var err error
+	if duration, err = time.ParseDuration(plugin.Duration); err != nil || duration < 0 {
+		return sensu.CheckStateUnknown, fmt.Errorf("--duration %q must be 0 or a positive duration, e.g. 5m", plugin.Duration)
+	}
+
+	fixture = Fixture{}
+	if len(plugin.FixtureFile) > 0 {
+		data, err := ioutil.ReadFile(plugin.FixtureFile)
+		if err != nil {
+			return sensu.CheckStateUnknown, fmt.Errorf("Error reading fixture file: %v", err)
+		}
+		if fixture, err = parseFixture(data); err != nil {
+			return sensu.CheckStateUnknown, fmt.Errorf("Error parsing fixture file %s: %v", plugin.FixtureFile, err)
+		}
+	}
+	route := &Route{Status: plugin.Status, Latency: plugin.Latency, Headers: map[string]string{}, Body: plugin.Body}
+	if len(plugin.ContentType) > 0 {
+		route.Headers["Content-Type"] = plugin.ContentType
+	}
+	for _, header := range plugin.Headers {
+		headerSplit := strings.SplitN(header, ":", 2)
+		if len(headerSplit) != 2 {
+			return sensu.CheckStateUnknown, fmt.Errorf("--header %q value malformed should be \"Header-Name: Header Value\"", header)
+		}
+		route.Headers[strings.TrimSpace(headerSplit[0])] = strings.TrimSpace(headerSplit[1])
+	}
+	if err := route.validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	fixture.Routes = append(fixture.Routes, route)
+
+	if (len(plugin.TLSCertFile) > 0) != (len(plugin.TLSKeyFile) > 0) {
+		return sensu.CheckStateUnknown, fmt.Errorf("--tls-cert-file and --tls-key-file must be given together")
+	}
+	if len(plugin.TLSCertFile) > 0 && len(plugin.TLSCertOut) > 0 {
+		return sensu.CheckStateUnknown, fmt.Errorf("--tls-cert-out is only for the self-signed certificate, not --tls-cert-file")
+	}
+
+	return sensu.CheckStateOK, nil
+}
+
+func executeCheck(event *corev2.Event) (int, error) {
+	server := &http.Server{Handler: &fixture}
+	listener, err := net.Listen("tcp", plugin.Listen)
+	if err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	scheme := "http"
+	if plugin.TLS || len(plugin.TLSCertFile) > 0 {
+		scheme = "https"
+		config, err := serverTLSConfig()
+		if err != nil {
+			listener.Close()
+			return sensu.CheckStateUnknown, err
+		}
+		listener = tls.NewListener(listener, config)
+	}
+
+	fmt.Printf("%s serving %d route(s) on %s://%s\n", plugin.PluginConfig.Name, len(fixture.Routes), scheme, listener.Addr())
+	go func() {
+		_ = server.Serve(listener)
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	var timeout <-chan time.Time
+	if duration > 0 {
+		timeout = time.After(duration)
+	}
+	select {
+	case <-signals:
+	case <-timeout:
+	case <-stop:
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	fmt.Printf("%s OK: stopped serving\n", plugin.PluginConfig.Name)
+	return sensu.CheckStateOK, nil
+}
+
+// parseFixture parses and validates a YAML or JSON fixture document.
+func parseFixture(data []byte) (Fixture, error) {
+	var f Fixture
+	if err := yaml.UnmarshalStrict(data, &f); err != nil {
+		return Fixture{}, err
+	}
+	if len(f.Routes) == 0 {
+		return Fixture{}, fmt.Errorf("no routes defined")
+	}
+	for i, route := range f.Routes {
+		if route == nil || !strings.HasPrefix(route.Path, "/") {
+			return Fixture{}, fmt.Errorf("route %d: path must start with /", i+1)
+		}
+		if route.Status == 0 {
+			route.Status = http.StatusOK
+		}
+		if err := route.validate(); err != nil {
+			return Fixture{}, fmt.Errorf("route %d (%s): %v", i+1, route.Path, err)
+		}
+	}
+	return f, nil
+}
+
+// validate checks the status and parses the latency of r.
+func (r *Route) validate() error {
+	if r.Status < 100 || r.Status > 999 {
+		return fmt.Errorf("status %d must be between 100 and 999", r.Status)
+	}
+	r.latency = 0
+	if len(r.Latency) > 0 {
+		latency, err := time.ParseDuration(r.Latency)
+		if err != nil || latency < 0 {
+			return fmt.Errorf("latency %q must be a positive duration, e.g. 250ms", r.Latency)
+		}
+		r.latency = latency
+	}
+	return nil
+}
+
+// match reports whether r serves req. A route without a path, that of the
+// flags, matches any request.
+func (r *Route) match(req *http.Request) bool {
+	if len(r.Path) > 0 && r.Path != req.URL.Path {
+		return false
+	}
+	return len(r.Method) == 0 || strings.EqualFold(r.Method, req.Method)
+}
+
+// ServeHTTP serves the first route of f matching req, after its latency, or
+// 404 if none does.
+func (f *Fixture) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	for _, route := range f.Routes {
+		if !route.match(req) {
+			continue
+		}
+		logging.Debug("request", "method", req.Method, "path", req.URL.Path, "status", route.Status, "latency", route.latency)
+		select {
+		case <-time.After(route.latency):
+		case <-req.Context().Done():
+			return
+		}
+		for name, value := range route.Headers {
+			w.Header().Set(name, value)
+		}
+		w.WriteHeader(route.Status)
+		if req.Method != http.MethodHead {
+			_, _ = w.Write([]byte(route.Body))
+		}
+		return
+	}
+	logging.Debug("request", "method", req.Method, "path", req.URL.Path, "status", http.StatusNotFound)
+	http.NotFound(w, req)
+}
+
+// serverTLSConfig returns the TLS config of the server, with the certificate
+// of --tls-cert-file or a self-signed one for localhost, written to
+// --tls-cert-out if set.
+func serverTLSConfig() (*tls.Config, error) {
+	if len(plugin.TLSCertFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(plugin.TLSCertFile, plugin.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load TLS key pair %s/%s: %v", plugin.TLSCertFile, plugin.TLSKeyFile, err)
+		}
+		return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+	}
+	cert, err := selfSignedCertificate(time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if len(plugin.TLSCertOut) > 0 {
+		data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+		if err := ioutil.WriteFile(plugin.TLSCertOut, data, 0644); err != nil {
+			return nil, fmt.Errorf("Error writing --tls-cert-out: %v", err)
+		}
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+}
+
+// selfSignedCertificate returns a certificate for localhost, 127.0.0.1 and
+// ::1 valid for a day from now.
+func selfSignedCertificate(now time.Time) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		NotBefore:             now.Add(-time.Minute),
+		NotAfter:              now.Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
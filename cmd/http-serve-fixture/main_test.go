@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	corev2 "github.com/sensu/sensu-go/api/core/v2"
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMain(t *testing.T) {
+}
+
+func TestServeHTTP(t *testing.T) {
+	assert := assert.New(t)
+	event := corev2.FixtureEvent("entity1", "check")
+
+	dir, err := ioutil.TempDir("", "http-serve-fixture")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	plugin.FixtureFile = filepath.Join(dir, "fixture.yml")
+	require.NoError(t, ioutil.WriteFile(plugin.FixtureFile, []byte(`
+routes:
+  - path: /health
+    headers:
+      Content-Type: application/json
+    body: '{"status": "ok"}'
+  - path: /slow
+    latency: 200ms
+  - path: /orders
+    method: POST
+    status: 201
+`), 0644))
+	plugin.Status = http.StatusServiceUnavailable
+	plugin.Latency = "0s"
+	plugin.Body = "maintenance"
+	plugin.ContentType = "text/plain"
+	plugin.Headers = []string{"Retry-After: 120"}
+	plugin.Duration = "0s"
+	defer func() {
+		plugin.FixtureFile = ""
+		plugin.Headers = nil
+	}()
+	status, err := checkArgs(event)
+	assert.NoError(err)
+	assert.Equal(sensu.CheckStateOK, status)
+
+	server := httptest.NewServer(&fixture)
+	defer server.Close()
+	get := func(method, path string) (*http.Response, string, time.Duration) {
+		req, err := http.NewRequest(method, server.URL+path, nil)
+		require.NoError(t, err)
+		start := time.Now()
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp, string(body), time.Since(start)
+	}
+
+	resp, body, _ := get("GET", "/health")
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.Equal("application/json", resp.Header.Get("Content-Type"))
+	assert.Equal(`{"status": "ok"}`, body)
+	resp, _, elapsed := get("GET", "/slow")
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.True(elapsed >= 200*time.Millisecond, elapsed)
+	resp, _, _ = get("POST", "/orders")
+	assert.Equal(http.StatusCreated, resp.StatusCode)
+	// The response of the flags matches any other request.
+	resp, body, _ = get("GET", "/orders")
+	assert.Equal(http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal("120", resp.Header.Get("Retry-After"))
+	assert.Equal("maintenance", body)
+
+	for _, content := range []string{"routes: []", "routes:\n  - path: health", "routes:\n  - path: /x\n    status: 42", "routes:\n  - path: /x\n    latency: soon", "routes:\n  - path: /x\n    code: 200"} {
+		require.NoError(t, ioutil.WriteFile(plugin.FixtureFile, []byte(content), 0644))
+		_, err = checkArgs(event)
+		assert.Error(err, content)
+	}
+}
+
+func TestExecuteCheck(t *testing.T) {
+	assert := assert.New(t)
+	event := corev2.FixtureEvent("entity1", "check")
+
+	dir, err := ioutil.TempDir("", "http-serve-fixture")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	plugin.Listen = listener.Addr().String()
+	listener.Close()
+	plugin.Status = http.StatusOK
+	plugin.Latency = ""
+	plugin.Body = "ok"
+	plugin.TLS = true
+	plugin.TLSCertOut = filepath.Join(dir, "cert.pem")
+	plugin.Duration = "0s"
+	defer func() {
+		plugin.TLS = false
+		plugin.TLSCertOut = ""
+	}()
+	_, err = checkArgs(event)
+	require.NoError(t, err)
+
+	stop = make(chan struct{})
+	done := make(chan int)
+	go func() {
+		status, err := executeCheck(event)
+		assert.NoError(err)
+		done <- status
+	}()
+
+	var resp *http.Response
+	for i := 0; i < 50; i++ {
+		if data, err := ioutil.ReadFile(plugin.TLSCertOut); err == nil && len(data) > 0 {
+			pool := x509.NewCertPool()
+			require.True(t, pool.AppendCertsFromPEM(data))
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+			if resp, err = client.Get("https://" + plugin.Listen + "/"); err == nil {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	require.NotNil(t, resp)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal("ok", string(body))
+
+	close(stop)
+	assert.Equal(sensu.CheckStateOK, <-done)
+
+	plugin.TLSCertFile = "cert.pem"
+	_, err = checkArgs(event)
+	assert.Error(err)
+	plugin.TLSCertFile = ""
+	plugin.Duration = "-1s"
+	_, err = checkArgs(event)
+	assert.Error(err)
+	plugin.Duration = "0s"
+}
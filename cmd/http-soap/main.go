@@ -0,0 +1,481 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/antchfx/xmlquery"
+	"github.com/antchfx/xpath"
+	"github.com/nixwiz/http-checks/internal/buildinfo"
+	"github.com/nixwiz/http-checks/internal/exitstatus"
+	"github.com/nixwiz/http-checks/internal/httpclient"
+	"github.com/nixwiz/http-checks/internal/logging"
+	"github.com/nixwiz/http-checks/internal/overrides"
+	"github.com/nixwiz/http-checks/internal/selfmetrics"
+	corev2 "github.com/sensu/sensu-go/api/core/v2"
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+)
+
+// Config represents the check plugin config.
+type Config struct {
+	sensu.PluginConfig
+	URL                string
+	TrustedCAFile      string
+	UseSystemCAsPlus   bool
+	InsecureSkipVerify bool
+	Timeout            int
+	Headers            []string
+	HeadersFile        httpclient.HeadersFileConfig
+	MTLSKeyFile        string
+	MTLSCertFile       string
+	EnvelopeFile       string
+	Variables          []string
+	SOAPAction         string
+	SOAPVersion        string
+	XPaths             []string
+	Proxy              httpclient.ProxyConfig
+	Transport          httpclient.TransportConfig
+	Source             httpclient.SourceConfig
+	Resolver           httpclient.ResolverConfig
+	URLParsing         httpclient.URLConfig
+	Record             httpclient.RecordConfig
+	Log                logging.Config
+	Overrides          overrides.Config
+	Status             exitstatus.Config
+	Metrics            selfmetrics.Config
+}
+
+// assertion is a compiled --xpath expression.
+type assertion struct {
+	text string
+	expr *xpath.Expr
+}
+
+var (
+	tlsConfig  tls.Config
+	envelope   []byte
+	assertions []assertion
+
+	// faultExpr matches a SOAP 1.1 or 1.2 Fault element regardless of the
+	// namespace prefix used.
+	faultExpr = xpath.MustCompile("//*[local-name()='Body']/*[local-name()='Fault']")
+
+	// envelopeExpr matches the root Envelope element of a SOAP message.
+	envelopeExpr = xpath.MustCompile("/*[local-name()='Envelope']")
+
+	plugin = Config{
+		PluginConfig: sensu.PluginConfig{
+			Name:     "http-soap",
+			Short:    "HTTP SOAP Check",
+			Keyspace: "sensu.io/plugins/http-soap/config",
+		},
+	}
+
+	options = []*sensu.PluginConfigOption{
+		{
+			Path:      "url",
+			Env:       "CHECK_URL",
+			Argument:  "url",
+			Shorthand: "u",
+			Default:   "http://localhost:80/",
+			Usage:     "URL of the SOAP endpoint",
+			Value:     &plugin.URL,
+		},
+		{
+			Path:      "insecure-skip-verify",
+			Env:       "",
+			Argument:  "insecure-skip-verify",
+			Shorthand: "i",
+			Default:   false,
+			Usage:     "Skip TLS certificate verification (not recommended!)",
+			Value:     &plugin.InsecureSkipVerify,
+		},
+		{
+			Path:      "trusted-ca-file",
+			Env:       "",
+			Argument:  "trusted-ca-file",
+			Shorthand: "t",
+			Default:   "",
+			Usage:     "TLS CA certificate bundle in PEM format, or a directory of them",
+			Value:     &plugin.TrustedCAFile,
+		},
+		{
+			Path:      "use-system-cas-plus",
+			Env:       "",
+			Argument:  "use-system-cas-plus",
+			Shorthand: "",
+			Default:   false,
+			Usage:     "Add the CA certificates from --trusted-ca-file to the system trust store rather than replacing it",
+			Value:     &plugin.UseSystemCAsPlus,
+		},
+		{
+			Path:      "timeout",
+			Env:       "",
+			Argument:  "timeout",
+			Shorthand: "T",
+			Default:   15,
+			Usage:     "Request timeout in seconds",
+			Value:     &plugin.Timeout,
+		},
+		{
+			Path:      "header",
+			Env:       "",
+			Argument:  "header",
+			Shorthand: "H",
+			Default:   []string{},
+			Usage:     "Additional header(s) to send in check request",
+			Value:     &plugin.Headers,
+		},
+		{
+			Path:      "mtls-key-file",
+			Env:       "",
+			Argument:  "mtls-key-file",
+			Shorthand: "K",
+			Default:   "",
+			Usage:     "Key file for mutual TLS auth in PEM format",
+			Value:     &plugin.MTLSKeyFile,
+		},
+		{
+			Path:      "mtls-cert-file",
+			Env:       "",
+			Argument:  "mtls-cert-file",
+			Shorthand: "C",
+			Default:   "",
+			Usage:     "Certificate file for mutual TLS auth in PEM format",
+			Value:     &plugin.MTLSCertFile,
+		},
+		{
+			Path:      "envelope-file",
+			Env:       "CHECK_ENVELOPE_FILE",
+			Argument:  "envelope-file",
+			Shorthand: "f",
+			Default:   "",
+			Usage:     "File containing the SOAP envelope to send, may reference variables as {{ .name }}",
+			Value:     &plugin.EnvelopeFile,
+		},
+		{
+			Path:      "variable",
+			Env:       "",
+			Argument:  "variable",
+			Shorthand: "V",
+			Default:   []string{},
+			Usage:     "Variable(s) to substitute in the envelope in name=value form",
+			Value:     &plugin.Variables,
+		},
+		{
+			Path:      "soap-action",
+			Env:       "",
+			Argument:  "soap-action",
+			Shorthand: "a",
+			Default:   "",
+			Usage:     "SOAPAction of the request",
+			Value:     &plugin.SOAPAction,
+		},
+		{
+			Path:      "soap-version",
+			Env:       "",
+			Argument:  "soap-version",
+			Shorthand: "",
+			Default:   "1.1",
+			Usage:     "SOAP version of the envelope, either 1.1 or 1.2",
+			Value:     &plugin.SOAPVersion,
+		},
+		{
+			Path:      "xpath",
+			Env:       "",
+			Argument:  "xpath",
+			Shorthand: "x",
+			Default:   []string{},
+			Usage:     "XPath expression(s) that must select a node or evaluate to true in the response",
+			Value:     &plugin.XPaths,
+		},
+	}
+)
+
+func main() {
+	options = append(options, plugin.Proxy.Options()...)
+	options = append(options, plugin.Transport.Options()...)
+	options = append(options, plugin.Source.Options()...)
+	options = append(options, plugin.Resolver.Options()...)
+	options = append(options, plugin.URLParsing.Options()...)
+	options = append(options, plugin.HeadersFile.Options()...)
+	options = append(options, plugin.Record.Options()...)
+	options = append(options, plugin.Log.Options()...)
+	options = append(options, plugin.Overrides.Options()...)
+	options = append(options, plugin.Status.Options()...)
+	options = append(options, plugin.Metrics.Options()...)
+	buildinfo.Handle(plugin.PluginConfig.Name, options, os.Args[1:])
+	exitstatus.ParseFlags(plugin.PluginConfig.Name, options, os.Args[1:])
+	check := sensu.NewGoCheck(&plugin.PluginConfig, options, plugin.Status.Wrap(plugin.PluginConfig.Name, checkArgs), plugin.Record.Wrap(plugin.PluginConfig.Name, plugin.Metrics.Wrap(plugin.PluginConfig.Name, plugin.Status.Wrap(plugin.PluginConfig.Name, executeCheck))), overrides.Requested(os.Args[1:]))
+	check.Execute()
+}
+
+func checkArgs(event *corev2.Event) (int, error) {
+	if err := plugin.Log.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	if err := plugin.URLParsing.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+
+	if len(plugin.URL) == 0 {
+		return sensu.CheckStateUnknown, fmt.Errorf("--url or CHECK_URL environment variable is required")
+	}
+	checkURL, err := httpclient.ParseURL("--url", plugin.URL)
+	if err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	plugin.URL = checkURL.String()
+	if len(plugin.EnvelopeFile) == 0 {
+		return sensu.CheckStateUnknown, fmt.Errorf("--envelope-file or CHECK_ENVELOPE_FILE environment variable is required")
+	}
+	headers, err := plugin.HeadersFile.Headers(event)
+	if err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	plugin.Headers = append(headers, plugin.Headers...)
+	if len(plugin.Headers) > 0 {
+		for _, header := range plugin.Headers {
+			headerSplit := strings.SplitN(header, ":", 2)
+			if len(headerSplit) != 2 {
+				return sensu.CheckStateUnknown, fmt.Errorf("--header %q value malformed should be \"Header-Name: Header Value\"", header)
+			}
+		}
+	}
+	if plugin.SOAPVersion != "1.1" && plugin.SOAPVersion != "1.2" {
+		return sensu.CheckStateUnknown, fmt.Errorf("--soap-version must be either 1.1 or 1.2")
+	}
+	if len(plugin.TrustedCAFile) > 0 {
+		caCertPool, err := httpclient.LoadCACerts(plugin.TrustedCAFile, plugin.UseSystemCAsPlus)
+		if err != nil {
+			return sensu.CheckStateUnknown, fmt.Errorf("Error loading specified CA file: %v", err)
+		}
+		tlsConfig.RootCAs = caCertPool
+	}
+	tlsConfig.InsecureSkipVerify = plugin.InsecureSkipVerify
+
+	if (len(plugin.MTLSKeyFile) > 0 && len(plugin.MTLSCertFile) == 0) || (len(plugin.MTLSCertFile) > 0 && len(plugin.MTLSKeyFile) == 0) {
+		return sensu.CheckStateUnknown, fmt.Errorf("mTLS auth requires both --mtls-key-file and --mtls-cert-file")
+	}
+	if len(plugin.MTLSKeyFile) > 0 && len(plugin.MTLSCertFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(plugin.MTLSCertFile, plugin.MTLSKeyFile)
+		if err != nil {
+			return sensu.CheckStateUnknown, fmt.Errorf("Failed to load mTLS key pair %s/%s: %v", plugin.MTLSCertFile, plugin.MTLSKeyFile, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	variables := map[string]string{}
+	for _, variable := range plugin.Variables {
+		variableSplit := strings.SplitN(variable, "=", 2)
+		if len(variableSplit) != 2 || len(strings.TrimSpace(variableSplit[0])) == 0 {
+			return sensu.CheckStateUnknown, fmt.Errorf("--variable %q value malformed should be \"name=value\"", variable)
+		}
+		variables[strings.TrimSpace(variableSplit[0])] = variableSplit[1]
+	}
+	data, err := ioutil.ReadFile(plugin.EnvelopeFile)
+	if err != nil {
+		return sensu.CheckStateUnknown, fmt.Errorf("Failed to read envelope file %s: %v", plugin.EnvelopeFile, err)
+	}
+	envelope, err = render(string(data), variables)
+	if err != nil {
+		return sensu.CheckStateUnknown, fmt.Errorf("Failed to render envelope file %s: %v", plugin.EnvelopeFile, err)
+	}
+
+	assertions = []assertion{}
+	for _, text := range plugin.XPaths {
+		expr, err := xpath.Compile(text)
+		if err != nil {
+			return sensu.CheckStateUnknown, fmt.Errorf("--xpath %q is not a valid XPath expression: %v", text, err)
+		}
+		assertions = append(assertions, assertion{text: text, expr: expr})
+	}
+
+	if err := plugin.Proxy.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	if err := plugin.Transport.Validate(&plugin.Proxy); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	if err := plugin.Source.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	if err := plugin.Resolver.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+
+	if err := plugin.Record.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+
+	return sensu.CheckStateOK, nil
+}
+
+func executeCheck(event *corev2.Event) (int, error) {
+
+	client := httpclient.New(&tlsConfig, time.Duration(plugin.Timeout)*time.Second, true, plugin.Proxy.Configure, plugin.Source.Configure, plugin.Resolver.Configure, plugin.Transport.Configure)
+
+	req, err := http.NewRequest("POST", plugin.URL, bytes.NewReader(envelope))
+	if err != nil {
+		fmt.Fprintf(selfmetrics.Stdout, "%s UNKNOWN: request creation error: %s\n", plugin.PluginConfig.Name, err)
+		return sensu.CheckStateUnknown, nil
+	}
+	// SOAP 1.1 carries the action in its own header, SOAP 1.2 as a parameter
+	// of the content type.
+	if plugin.SOAPVersion == "1.2" {
+		contentType := "application/soap+xml; charset=utf-8"
+		if len(plugin.SOAPAction) > 0 {
+			contentType = fmt.Sprintf("%s; action=%q", contentType, plugin.SOAPAction)
+		}
+		req.Header.Set("Content-Type", contentType)
+	} else {
+		req.Header.Set("Content-Type", "text/xml; charset=utf-8")
+		req.Header.Set("SOAPAction", fmt.Sprintf("%q", plugin.SOAPAction))
+	}
+
+	for _, header := range plugin.Headers {
+		headerSplit := strings.SplitN(header, ":", 2)
+		headerKey := strings.TrimSpace(headerSplit[0])
+		headerValue := strings.TrimSpace(headerSplit[1])
+		if strings.EqualFold(headerKey, "host") {
+			req.Host = headerValue
+			continue
+		}
+		req.Header.Set(headerKey, headerValue)
+	}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		fmt.Fprintf(selfmetrics.Stdout, "%s CRITICAL: %s\n", plugin.PluginConfig.Name, httpclient.Describe(err))
+		return sensu.CheckStateCritical, nil
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	duration := time.Since(start)
+	if err != nil {
+		fmt.Fprintf(selfmetrics.Stdout, "%s CRITICAL: reading response body: %s\n", plugin.PluginConfig.Name, httpclient.Describe(err))
+		return sensu.CheckStateCritical, nil
+	}
+	perfdata := fmt.Sprintf("response_duration=%0.6f", duration.Seconds())
+
+	doc, err := xmlquery.Parse(bytes.NewReader(body))
+	if err != nil {
+		fmt.Fprintf(selfmetrics.Stdout, "%s CRITICAL: HTTP Status %v for %s, response is not valid XML: %v | %s\n", plugin.PluginConfig.Name, resp.StatusCode, plugin.URL, err, perfdata)
+		return sensu.CheckStateCritical, nil
+	}
+	if xmlquery.QuerySelector(doc, envelopeExpr) == nil {
+		fmt.Fprintf(selfmetrics.Stdout, "%s CRITICAL: HTTP Status %v for %s, response is not a SOAP envelope | %s\n", plugin.PluginConfig.Name, resp.StatusCode, plugin.URL, perfdata)
+		return sensu.CheckStateCritical, nil
+	}
+	stripPrefixes(doc)
+
+	// A fault is usually returned with a 500 status, check for it first so
+	// that the fault itself is reported.
+	if fault := xmlquery.QuerySelector(doc, faultExpr); fault != nil {
+		fmt.Fprintf(selfmetrics.Stdout, "%s CRITICAL: SOAP Fault from %s: %s | %s\n", plugin.PluginConfig.Name, plugin.URL, describeFault(fault), perfdata)
+		return sensu.CheckStateCritical, nil
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		fmt.Fprintf(selfmetrics.Stdout, "%s CRITICAL: HTTP Status %v for %s | %s\n", plugin.PluginConfig.Name, resp.StatusCode, plugin.URL, perfdata)
+		return sensu.CheckStateCritical, nil
+	}
+
+	failed := []string{}
+	for _, a := range assertions {
+		if !evaluate(doc, a.expr) {
+			failed = append(failed, a.text)
+		}
+	}
+	if len(failed) > 0 {
+		fmt.Fprintf(selfmetrics.Stdout, "%s CRITICAL: XPath assertion(s) failed for %s: %s | %s\n", plugin.PluginConfig.Name, plugin.URL, strings.Join(failed, ", "), perfdata)
+		return sensu.CheckStateCritical, nil
+	}
+
+	fmt.Fprintf(selfmetrics.Stdout, "%s OK: HTTP Status %v for %s, %d XPath assertion(s) passed | %s\n", plugin.PluginConfig.Name, resp.StatusCode, plugin.URL, len(assertions), perfdata)
+	return sensu.CheckStateOK, nil
+}
+
+// stripPrefixes removes the namespace prefix from every element below node,
+// so that --xpath expressions can refer to elements by name without knowing
+// the prefixes chosen by the server.
+func stripPrefixes(node *xmlquery.Node) {
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		if child.Type != xmlquery.ElementNode {
+			continue
+		}
+		child.Prefix = ""
+		stripPrefixes(child)
+	}
+}
+
+// evaluate returns true if expr selects at least one node in doc, or
+// evaluates to true, a non-zero number or a non-empty string.
+func evaluate(doc *xmlquery.Node, expr *xpath.Expr) bool {
+	switch result := expr.Evaluate(xmlquery.CreateXPathNavigator(doc)).(type) {
+	case bool:
+		return result
+	case float64:
+		return result != 0
+	case string:
+		return len(result) > 0
+	case *xpath.NodeIterator:
+		return result.MoveNext()
+	}
+	return false
+}
+
+// describeFault returns the code and reason of a SOAP 1.1 or 1.2 Fault.
+func describeFault(fault *xmlquery.Node) string {
+	var code, reason string
+	for child := fault.FirstChild; child != nil; child = child.NextSibling {
+		if child.Type != xmlquery.ElementNode {
+			continue
+		}
+		switch child.Data {
+		case "faultcode":
+			code = strings.TrimSpace(child.InnerText())
+		case "faultstring":
+			reason = strings.TrimSpace(child.InnerText())
+		case "Code":
+			if value := xmlquery.FindOne(child, "./*[local-name()='Value']"); value != nil {
+				code = strings.TrimSpace(value.InnerText())
+			}
+		case "Reason":
+			if text := xmlquery.FindOne(child, "./*[local-name()='Text']"); text != nil {
+				reason = strings.TrimSpace(text.InnerText())
+			}
+		}
+	}
+	switch {
+	case len(code) > 0 && len(reason) > 0:
+		return fmt.Sprintf("%s: %s", code, reason)
+	case len(code) > 0:
+		return code
+	case len(reason) > 0:
+		return reason
+	}
+	return "no fault code or reason provided"
+}
+
+// render expands {{ .name }} references to variables within text.
+func render(text string, variables map[string]string) ([]byte, error) {
+	tmpl, err := template.New("envelope").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	var output bytes.Buffer
+	if err := tmpl.Execute(&output, variables); err != nil {
+		return nil, err
+	}
+	return output.Bytes(), nil
+}
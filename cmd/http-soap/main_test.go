@@ -0,0 +1,164 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/antchfx/xmlquery"
+	corev2 "github.com/sensu/sensu-go/api/core/v2"
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	requestEnvelope = `<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/"><soap:Body><GetStatus><Merchant>{{ .merchant }}</Merchant></GetStatus></soap:Body></soap:Envelope>`
+
+	okResponse = `<?xml version="1.0"?>
+<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/">
+  <soap:Body>
+    <m:GetStatusResponse xmlns:m="urn:payments">
+      <m:Status>ACTIVE</m:Status>
+      <m:Balance>42</m:Balance>
+    </m:GetStatusResponse>
+  </soap:Body>
+</soap:Envelope>`
+
+	fault11Response = `<?xml version="1.0"?>
+<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/">
+  <soap:Body>
+    <soap:Fault>
+      <faultcode>soap:Server</faultcode>
+      <faultstring>Merchant not found</faultstring>
+    </soap:Fault>
+  </soap:Body>
+</soap:Envelope>`
+
+	fault12Response = `<?xml version="1.0"?>
+<env:Envelope xmlns:env="http://www.w3.org/2003/05/soap-envelope">
+  <env:Body>
+    <env:Fault>
+      <env:Code><env:Value>env:Receiver</env:Value></env:Code>
+      <env:Reason><env:Text xml:lang="en">Backend unavailable</env:Text></env:Reason>
+    </env:Fault>
+  </env:Body>
+</env:Envelope>`
+)
+
+func TestMain(t *testing.T) {
+}
+
+func TestExecuteCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "http-soap")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	envelopeFile := filepath.Join(dir, "envelope.xml")
+	require.NoError(t, ioutil.WriteFile(envelopeFile, []byte(requestEnvelope), 0644))
+
+	testCases := []struct {
+		returnStatus int
+		httpStatus   int
+		response     string
+		soapVersion  string
+		xpaths       []string
+	}{
+		{sensu.CheckStateOK, http.StatusOK, okResponse, "1.1", nil},
+		{sensu.CheckStateOK, http.StatusOK, okResponse, "1.2", []string{"//Status[text()='ACTIVE']", "//Balance > 10"}},
+		{sensu.CheckStateCritical, http.StatusOK, okResponse, "1.1", []string{"//Status = 'SUSPENDED'"}},
+		{sensu.CheckStateCritical, http.StatusOK, okResponse, "1.1", []string{"//Missing"}},
+		{sensu.CheckStateCritical, http.StatusInternalServerError, fault11Response, "1.1", nil},
+		{sensu.CheckStateCritical, http.StatusInternalServerError, fault12Response, "1.2", nil},
+		{sensu.CheckStateCritical, http.StatusServiceUnavailable, okResponse, "1.1", nil},
+		{sensu.CheckStateCritical, http.StatusOK, "not xml", "1.1", nil},
+	}
+
+	for _, tc := range testCases {
+		assert := assert.New(t)
+		event := corev2.FixtureEvent("entity1", "check")
+
+		var test = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			assert.Contains(string(body), "<Merchant>acme</Merchant>")
+			assert.Equal("POST", r.Method)
+			if tc.soapVersion == "1.2" {
+				assert.Equal("application/soap+xml; charset=utf-8; action=\"urn:GetStatus\"", r.Header.Get("Content-Type"))
+			} else {
+				assert.Equal("text/xml; charset=utf-8", r.Header.Get("Content-Type"))
+				assert.Equal("\"urn:GetStatus\"", r.Header.Get("SOAPAction"))
+			}
+			w.WriteHeader(tc.httpStatus)
+			_, _ = w.Write([]byte(tc.response))
+		}))
+		plugin.URL = test.URL
+		plugin.EnvelopeFile = envelopeFile
+		plugin.Variables = []string{"merchant=acme"}
+		plugin.SOAPAction = "urn:GetStatus"
+		plugin.SOAPVersion = tc.soapVersion
+		plugin.XPaths = tc.xpaths
+		status, err := checkArgs(event)
+		assert.NoError(err)
+		assert.Equal(sensu.CheckStateOK, status)
+		status, err = executeCheck(event)
+		assert.NoError(err)
+		assert.Equal(tc.returnStatus, status)
+		test.Close()
+	}
+}
+
+func TestCheckArgs(t *testing.T) {
+	assert := assert.New(t)
+	event := corev2.FixtureEvent("entity1", "check")
+
+	dir, err := ioutil.TempDir("", "http-soap")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	envelopeFile := filepath.Join(dir, "envelope.xml")
+	require.NoError(t, ioutil.WriteFile(envelopeFile, []byte(requestEnvelope), 0644))
+
+	plugin.URL = "http://localhost:80/"
+	plugin.EnvelopeFile = envelopeFile
+	plugin.SOAPVersion = "1.1"
+	plugin.XPaths = nil
+
+	// missing variable referenced by the envelope
+	plugin.Variables = nil
+	status, err := checkArgs(event)
+	assert.Error(err)
+	assert.Equal(sensu.CheckStateUnknown, status)
+
+	plugin.Variables = []string{"merchant"}
+	status, err = checkArgs(event)
+	assert.Error(err)
+	assert.Equal(sensu.CheckStateUnknown, status)
+
+	plugin.Variables = []string{"merchant=acme"}
+	plugin.XPaths = []string{"//Status["}
+	status, err = checkArgs(event)
+	assert.Error(err)
+	assert.Equal(sensu.CheckStateUnknown, status)
+
+	plugin.XPaths = nil
+	plugin.SOAPVersion = "2.0"
+	status, err = checkArgs(event)
+	assert.Error(err)
+	assert.Equal(sensu.CheckStateUnknown, status)
+	plugin.SOAPVersion = "1.1"
+}
+
+func TestDescribeFault(t *testing.T) {
+	for response, expected := range map[string]string{
+		fault11Response: "soap:Server: Merchant not found",
+		fault12Response: "env:Receiver: Backend unavailable",
+	} {
+		doc, err := xmlquery.Parse(strings.NewReader(response))
+		require.NoError(t, err)
+		fault := xmlquery.QuerySelector(doc, faultExpr)
+		require.NotNil(t, fault)
+		assert.Equal(t, expected, describeFault(fault))
+	}
+}
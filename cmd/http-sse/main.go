@@ -0,0 +1,517 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/itchyny/gojq"
+	"github.com/nixwiz/http-checks/internal/auth"
+	"github.com/nixwiz/http-checks/internal/buildinfo"
+	"github.com/nixwiz/http-checks/internal/exitstatus"
+	"github.com/nixwiz/http-checks/internal/httpclient"
+	"github.com/nixwiz/http-checks/internal/logging"
+	"github.com/nixwiz/http-checks/internal/overrides"
+	"github.com/nixwiz/http-checks/internal/selfmetrics"
+	corev2 "github.com/sensu/sensu-go/api/core/v2"
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+)
+
+// Config represents the check plugin config.
+type Config struct {
+	sensu.PluginConfig
+	URL                string
+	TrustedCAFile      string
+	UseSystemCAsPlus   bool
+	InsecureSkipVerify bool
+	Timeout            int
+	Warning            string
+	Critical           string
+	Event              string
+	Match              string
+	Query              string
+	Headers            []string
+	HeadersFile        httpclient.HeadersFileConfig
+	MTLSKeyFile        string
+	MTLSCertFile       string
+	Auth               auth.Config
+	Proxy              httpclient.ProxyConfig
+	Transport          httpclient.TransportConfig
+	Source             httpclient.SourceConfig
+	Resolver           httpclient.ResolverConfig
+	URLParsing         httpclient.URLConfig
+	Record             httpclient.RecordConfig
+	Log                logging.Config
+	Overrides          overrides.Config
+	Status             exitstatus.Config
+	Metrics            selfmetrics.Config
+}
+
+var (
+	tlsConfig tls.Config
+
+	// warning and critical are 0 if not set.
+	warning, critical time.Duration
+	matchRegexp       *regexp.Regexp
+	query             *gojq.Code
+
+	plugin = Config{
+		PluginConfig: sensu.PluginConfig{
+			Name:     "http-sse",
+			Short:    "HTTP Server-Sent Events Check",
+			Keyspace: "sensu.io/plugins/http-sse/config",
+		},
+	}
+
+	options = []*sensu.PluginConfigOption{
+		{
+			Path:      "url",
+			Env:       "CHECK_URL",
+			Argument:  "url",
+			Shorthand: "u",
+			Default:   "http://localhost:80/",
+			Usage:     "URL of the event stream to test",
+			Value:     &plugin.URL,
+		},
+		{
+			Path:      "insecure-skip-verify",
+			Env:       "",
+			Argument:  "insecure-skip-verify",
+			Shorthand: "i",
+			Default:   false,
+			Usage:     "Skip TLS certificate verification (not recommended!)",
+			Value:     &plugin.InsecureSkipVerify,
+		},
+		{
+			Path:      "trusted-ca-file",
+			Env:       "",
+			Argument:  "trusted-ca-file",
+			Shorthand: "t",
+			Default:   "",
+			Usage:     "TLS CA certificate bundle in PEM format, or a directory of them",
+			Value:     &plugin.TrustedCAFile,
+		},
+		{
+			Path:      "use-system-cas-plus",
+			Env:       "",
+			Argument:  "use-system-cas-plus",
+			Shorthand: "",
+			Default:   false,
+			Usage:     "Add the CA certificates from --trusted-ca-file to the system trust store rather than replacing it",
+			Value:     &plugin.UseSystemCAsPlus,
+		},
+		{
+			Path:      "timeout",
+			Env:       "",
+			Argument:  "timeout",
+			Shorthand: "T",
+			Default:   15,
+			Usage:     "Time in seconds to wait for the first matching event, including connecting",
+			Value:     &plugin.Timeout,
+		},
+		{
+			Path:      "warning",
+			Env:       "",
+			Argument:  "warning",
+			Shorthand: "w",
+			Default:   "",
+			Usage:     "Warning threshold for the time to the first matching event, can be expressed as seconds or milliseconds (1s = 1000ms)",
+			Value:     &plugin.Warning,
+		},
+		{
+			Path:      "critical",
+			Env:       "",
+			Argument:  "critical",
+			Shorthand: "c",
+			Default:   "",
+			Usage:     "Critical threshold for the time to the first matching event, can be expressed as seconds or milliseconds (1s = 1000ms)",
+			Value:     &plugin.Critical,
+		},
+		{
+			Path:      "event",
+			Env:       "",
+			Argument:  "event",
+			Shorthand: "e",
+			Default:   "",
+			Usage:     "Only count events of this type (the event field), \"message\" for events without one",
+			Value:     &plugin.Event,
+		},
+		{
+			Path:      "match",
+			Env:       "",
+			Argument:  "match",
+			Shorthand: "m",
+			Default:   "",
+			Usage:     "Only count events whose data matches this regular expression",
+			Value:     &plugin.Match,
+		},
+		{
+			Path:      "query",
+			Env:       "",
+			Argument:  "query",
+			Shorthand: "q",
+			Default:   "",
+			Usage:     "Only count events whose data is JSON for which this jq query returns a value other than false or null",
+			Value:     &plugin.Query,
+		},
+		{
+			Path:      "header",
+			Env:       "",
+			Argument:  "header",
+			Shorthand: "H",
+			Default:   []string{},
+			Usage:     "Additional header(s) to send in check request",
+			Value:     &plugin.Headers,
+		},
+		{
+			Path:      "mtls-key-file",
+			Env:       "",
+			Argument:  "mtls-key-file",
+			Shorthand: "K",
+			Default:   "",
+			Usage:     "Key file for mutual TLS auth in PEM format",
+			Value:     &plugin.MTLSKeyFile,
+		},
+		{
+			Path:      "mtls-cert-file",
+			Env:       "",
+			Argument:  "mtls-cert-file",
+			Shorthand: "C",
+			Default:   "",
+			Usage:     "Certificate file for mutual TLS auth in PEM format",
+			Value:     &plugin.MTLSCertFile,
+		},
+	}
+)
+
+func main() {
+	options = append(options, plugin.Auth.Options()...)
+	options = append(options, plugin.Proxy.Options()...)
+	options = append(options, plugin.Transport.Options()...)
+	options = append(options, plugin.Source.Options()...)
+	options = append(options, plugin.Resolver.Options()...)
+	options = append(options, plugin.URLParsing.Options()...)
+	options = append(options, plugin.HeadersFile.Options()...)
+	options = append(options, plugin.Record.Options()...)
+	options = append(options, plugin.Log.Options()...)
+	options = append(options, plugin.Overrides.Options()...)
+	options = append(options, plugin.Status.Options()...)
+	options = append(options, plugin.Metrics.Options()...)
+	buildinfo.Handle(plugin.PluginConfig.Name, options, os.Args[1:])
+	exitstatus.ParseFlags(plugin.PluginConfig.Name, options, os.Args[1:])
+	check := sensu.NewGoCheck(&plugin.PluginConfig, options, plugin.Status.Wrap(plugin.PluginConfig.Name, checkArgs), plugin.Record.Wrap(plugin.PluginConfig.Name, plugin.Metrics.Wrap(plugin.PluginConfig.Name, plugin.Status.Wrap(plugin.PluginConfig.Name, executeCheck))), overrides.Requested(os.Args[1:]))
+	check.Execute()
+}
+
+func checkArgs(event *corev2.Event) (int, error) {
+	if err := plugin.Log.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	if err := plugin.URLParsing.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+
+	var err error
+
+	if len(plugin.URL) == 0 {
+		return sensu.CheckStateUnknown, fmt.Errorf("--url or CHECK_URL environment variable is required")
+	}
+	if plugin.Timeout <= 0 {
+		return sensu.CheckStateUnknown, fmt.Errorf("--timeout must be greater than 0")
+	}
+	headers, err := plugin.HeadersFile.Headers(event)
+	if err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	plugin.Headers = append(headers, plugin.Headers...)
+	if len(plugin.Headers) > 0 {
+		for _, header := range plugin.Headers {
+			headerSplit := strings.SplitN(header, ":", 2)
+			if len(headerSplit) != 2 {
+				return sensu.CheckStateUnknown, fmt.Errorf("--header %q value malformed should be \"Header-Name: Header Value\"", header)
+			}
+		}
+	}
+	warning, critical = 0, 0
+	if len(plugin.Warning) > 0 {
+		if warning, err = time.ParseDuration(plugin.Warning); err != nil {
+			return sensu.CheckStateUnknown, err
+		}
+	}
+	if len(plugin.Critical) > 0 {
+		if critical, err = time.ParseDuration(plugin.Critical); err != nil {
+			return sensu.CheckStateUnknown, err
+		}
+	}
+
+	matchRegexp = nil
+	if len(plugin.Match) > 0 {
+		if matchRegexp, err = regexp.Compile(plugin.Match); err != nil {
+			return sensu.CheckStateUnknown, fmt.Errorf("--match %q is not a valid regular expression: %v", plugin.Match, err)
+		}
+	}
+	query = nil
+	if len(plugin.Query) > 0 {
+		parsed, err := gojq.Parse(plugin.Query)
+		if err != nil {
+			return sensu.CheckStateUnknown, fmt.Errorf("Failed to parse query %q: %v", plugin.Query, err)
+		}
+		if query, err = gojq.Compile(parsed); err != nil {
+			return sensu.CheckStateUnknown, fmt.Errorf("Failed to compile query %q: %v", plugin.Query, err)
+		}
+	}
+
+	if len(plugin.TrustedCAFile) > 0 {
+		caCertPool, err := httpclient.LoadCACerts(plugin.TrustedCAFile, plugin.UseSystemCAsPlus)
+		if err != nil {
+			return sensu.CheckStateUnknown, fmt.Errorf("Error loading specified CA file: %v", err)
+		}
+		tlsConfig.RootCAs = caCertPool
+	}
+	tlsConfig.InsecureSkipVerify = plugin.InsecureSkipVerify
+
+	if (len(plugin.MTLSKeyFile) > 0 && len(plugin.MTLSCertFile) == 0) || (len(plugin.MTLSCertFile) > 0 && len(plugin.MTLSKeyFile) == 0) {
+		return sensu.CheckStateUnknown, fmt.Errorf("mTLS auth requires both --mtls-key-file and --mtls-cert-file")
+	}
+	if len(plugin.MTLSKeyFile) > 0 && len(plugin.MTLSCertFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(plugin.MTLSCertFile, plugin.MTLSKeyFile)
+		if err != nil {
+			return sensu.CheckStateUnknown, fmt.Errorf("Failed to load mTLS key pair %s/%s: %v", plugin.MTLSCertFile, plugin.MTLSKeyFile, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if err := plugin.Auth.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	checkURL, err := httpclient.ParseURL("--url", plugin.URL)
+	if err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	if err := plugin.Auth.FromURL("--url", checkURL); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	plugin.URL = checkURL.String()
+
+	if err := plugin.Proxy.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	if err := plugin.Transport.Validate(&plugin.Proxy); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	if err := plugin.Source.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	if err := plugin.Resolver.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+
+	if err := plugin.Record.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+
+	return sensu.CheckStateOK, nil
+}
+
+func executeCheck(event *corev2.Event) (int, error) {
+
+	// The stream is read until the first matching event, so the deadline
+	// is set on the context rather than as a client timeout.
+	client := httpclient.New(&tlsConfig, 0, true, plugin.Proxy.Configure, plugin.Source.Configure, plugin.Resolver.Configure, plugin.Transport.Configure)
+	client.Transport = plugin.Auth.RoundTripper(client.Transport)
+
+	timeout := time.Duration(plugin.Timeout) * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	req, err := http.NewRequest("GET", plugin.URL, nil)
+	if err != nil {
+		fmt.Fprintf(selfmetrics.Stdout, "%s UNKNOWN: request creation error: %s\n", plugin.PluginConfig.Name, err)
+		return sensu.CheckStateUnknown, nil
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Cache-Control", "no-cache")
+	if len(plugin.Headers) > 0 {
+		for _, header := range plugin.Headers {
+			headerSplit := strings.SplitN(header, ":", 2)
+			headerKey := strings.TrimSpace(headerSplit[0])
+			headerValue := strings.TrimSpace(headerSplit[1])
+			if strings.EqualFold(headerKey, "host") {
+				req.Host = headerValue
+				continue
+			}
+			req.Header.Set(headerKey, headerValue)
+		}
+	}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		fmt.Fprintf(selfmetrics.Stdout, "%s CRITICAL: %s\n", plugin.PluginConfig.Name, httpclient.Describe(err))
+		return sensu.CheckStateCritical, nil
+	}
+	defer resp.Body.Close()
+	headers := time.Since(start)
+
+	if resp.StatusCode != http.StatusOK {
+		fmt.Fprintf(selfmetrics.Stdout, "%s CRITICAL: HTTP Status %v for %s\n", plugin.PluginConfig.Name, resp.StatusCode, plugin.URL)
+		return sensu.CheckStateCritical, nil
+	}
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType != "text/event-stream" {
+		fmt.Fprintf(selfmetrics.Stdout, "%s CRITICAL: Content-Type %q for %s is not text/event-stream\n", plugin.PluginConfig.Name, resp.Header.Get("Content-Type"), plugin.URL)
+		return sensu.CheckStateCritical, nil
+	}
+
+	skipped := 0
+	stream := newEventReader(resp.Body)
+	for {
+		e, err := stream.Next()
+		if err != nil {
+			perfdata := fmt.Sprintf("time_to_headers=%0.6f, events_skipped=%d", headers.Seconds(), skipped)
+			reason := httpclient.Describe(err)
+			switch {
+			case ctx.Err() != nil:
+				reason = fmt.Sprintf("none within %s", timeout)
+			case err == io.EOF:
+				reason = "stream closed by the server"
+			}
+			fmt.Fprintf(selfmetrics.Stdout, "%s CRITICAL: no %s from %s, %s | %s\n", plugin.PluginConfig.Name, describeFilter(), plugin.URL, reason, perfdata)
+			return sensu.CheckStateCritical, nil
+		}
+		elapsed := time.Since(start)
+		logging.Debug("event", "type", e.Type, "id", e.ID, "data", e.Data, "elapsed", elapsed)
+		if !matches(e) {
+			skipped++
+			continue
+		}
+
+		perfdata := fmt.Sprintf("time_to_first_event=%0.6f, time_to_headers=%0.6f, events_skipped=%d", elapsed.Seconds(), headers.Seconds(), skipped)
+		switch {
+		case critical > 0 && elapsed > critical:
+			fmt.Fprintf(selfmetrics.Stdout, "%s CRITICAL: first %s from %s after %s, above %s | %s\n", plugin.PluginConfig.Name, describeFilter(), plugin.URL, elapsed, critical, perfdata)
+			return sensu.CheckStateCritical, nil
+		case warning > 0 && elapsed > warning:
+			fmt.Fprintf(selfmetrics.Stdout, "%s WARNING: first %s from %s after %s, above %s | %s\n", plugin.PluginConfig.Name, describeFilter(), plugin.URL, elapsed, warning, perfdata)
+			return sensu.CheckStateWarning, nil
+		}
+		fmt.Fprintf(selfmetrics.Stdout, "%s OK: first %s from %s after %s | %s\n", plugin.PluginConfig.Name, describeFilter(), plugin.URL, elapsed, perfdata)
+		return sensu.CheckStateOK, nil
+	}
+}
+
+// sseEvent is an event of a Server-Sent Events stream.
+type sseEvent struct {
+	Type string
+	ID   string
+	Data string
+}
+
+// eventReader reads the events of a stream as specified by the HTML Living
+// Standard, "9.2 Server-sent events". Comments, used as keepalives, and
+// retry fields are ignored.
+type eventReader struct {
+	r *bufio.Reader
+}
+
+func newEventReader(r io.Reader) *eventReader {
+	return &eventReader{r: bufio.NewReader(r)}
+}
+
+// Next returns the next event of the stream, an event without data is not
+// dispatched. It returns io.EOF if the stream ends before the next event.
+func (er *eventReader) Next() (sseEvent, error) {
+	var e sseEvent
+	var data []string
+	for {
+		// An incomplete event at the end of the stream is discarded.
+		line, err := er.r.ReadString('\n')
+		if err != nil {
+			return sseEvent{}, err
+		}
+		line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+		if len(line) == 0 {
+			if data == nil {
+				e.Type = ""
+				continue
+			}
+			e.Data = strings.Join(data, "\n")
+			if len(e.Type) == 0 {
+				e.Type = "message"
+			}
+			return e, nil
+		}
+		if strings.HasPrefix(line, ":") {
+			continue
+		}
+		field, value := line, ""
+		if i := strings.Index(line, ":"); i >= 0 {
+			field, value = line[:i], strings.TrimPrefix(line[i+1:], " ")
+		}
+		switch field {
+		case "event":
+			e.Type = value
+		case "data":
+			data = append(data, value)
+		case "id":
+			if !strings.Contains(value, "\x00") {
+				e.ID = value
+			}
+		}
+	}
+}
+
+// matches reports whether e passes the --event, --match and --query filters.
+func matches(e sseEvent) bool {
+	if len(plugin.Event) > 0 && e.Type != plugin.Event {
+		return false
+	}
+	if matchRegexp != nil && !matchRegexp.MatchString(e.Data) {
+		return false
+	}
+	if query != nil {
+		var data interface{}
+		if err := json.Unmarshal([]byte(e.Data), &data); err != nil {
+			logging.Debug("event data is not JSON", "error", err)
+			return false
+		}
+		iter := query.Run(data)
+		for {
+			v, ok := iter.Next()
+			if !ok {
+				return false
+			}
+			if _, isErr := v.(error); isErr {
+				continue
+			}
+			if v != nil && v != false {
+				return true
+			}
+		}
+	}
+	return true
+}
+
+// describeFilter describes the events counted, for use in output.
+func describeFilter() string {
+	description := "event"
+	if len(plugin.Event) > 0 {
+		description += fmt.Sprintf(" of type %q", plugin.Event)
+	}
+	if len(plugin.Match) > 0 {
+		description += fmt.Sprintf(" matching %q", plugin.Match)
+	}
+	if len(plugin.Query) > 0 {
+		description += fmt.Sprintf(" where %q holds", plugin.Query)
+	}
+	return description
+}
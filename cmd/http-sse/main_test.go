@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	corev2 "github.com/sensu/sensu-go/api/core/v2"
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMain(t *testing.T) {
+}
+
+// streamServer returns a server sending events, each after delay, and then
+// keeping the stream open until the client goes away.
+func streamServer(delay time.Duration, events ...string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept") != "text/event-stream" {
+			w.WriteHeader(http.StatusNotAcceptable)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+		_, _ = fmt.Fprint(w, ": keepalive\n\n")
+		w.(http.Flusher).Flush()
+		for _, e := range events {
+			select {
+			case <-time.After(delay):
+			case <-r.Context().Done():
+				return
+			}
+			_, _ = fmt.Fprint(w, e)
+			w.(http.Flusher).Flush()
+		}
+		<-r.Context().Done()
+	}))
+}
+
+func TestExecuteCheck(t *testing.T) {
+	assert := assert.New(t)
+	event := corev2.FixtureEvent("entity1", "check")
+
+	events := []string{
+		"event: ping\ndata: {}\n\n",
+		"data: {\"status\": \"starting\"}\n\n",
+		"event: update\ndata: {\"status\":\n",
+		"data: \"ready\"}\n\n",
+	}
+	test := streamServer(50*time.Millisecond, events...)
+	defer test.Close()
+
+	testCases := []struct {
+		event, match, query string
+		warning             string
+		status              int
+	}{
+		{"", "", "", "", sensu.CheckStateOK},
+		{"update", "", "", "", sensu.CheckStateOK},
+		{"", "ready", "", "", sensu.CheckStateOK},
+		{"", "", `.status == "ready"`, "", sensu.CheckStateOK},
+		{"", "", `.status == "ready"`, "100ms", sensu.CheckStateWarning},
+		{"", "", `.status == "stopped"`, "", sensu.CheckStateCritical},
+		{"message", "ready", "", "", sensu.CheckStateCritical},
+	}
+	for _, tc := range testCases {
+		plugin.URL = test.URL
+		plugin.Timeout = 1
+		plugin.Event = tc.event
+		plugin.Match = tc.match
+		plugin.Query = tc.query
+		plugin.Warning = tc.warning
+		plugin.Critical = ""
+		status, err := checkArgs(event)
+		require.NoError(t, err)
+		require.Equal(t, sensu.CheckStateOK, status)
+		start := time.Now()
+		status, err = executeCheck(event)
+		assert.NoError(err)
+		assert.Equal(tc.status, status, tc)
+		if tc.status == sensu.CheckStateCritical {
+			assert.True(time.Since(start) >= time.Second, "the check waits for the timeout")
+		}
+	}
+	plugin.Event, plugin.Match, plugin.Query, plugin.Warning = "", "", "", ""
+}
+
+func TestExecuteCheckNotAStream(t *testing.T) {
+	assert := assert.New(t)
+	event := corev2.FixtureEvent("entity1", "check")
+
+	var test = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = fmt.Fprint(w, "{}")
+	}))
+	defer test.Close()
+
+	plugin.URL = test.URL
+	plugin.Timeout = 1
+	status, err := checkArgs(event)
+	assert.NoError(err)
+	assert.Equal(sensu.CheckStateOK, status)
+	status, err = executeCheck(event)
+	assert.NoError(err)
+	assert.Equal(sensu.CheckStateCritical, status)
+}
+
+func TestCheckArgs(t *testing.T) {
+	assert := assert.New(t)
+	event := corev2.FixtureEvent("entity1", "check")
+	plugin.URL = "http://localhost/events"
+	plugin.Timeout = 1
+
+	plugin.Match = "("
+	_, err := checkArgs(event)
+	assert.Error(err)
+	plugin.Match = ""
+	plugin.Query = ".status =="
+	_, err = checkArgs(event)
+	assert.Error(err)
+	plugin.Query = ""
+	plugin.Critical = "soon"
+	_, err = checkArgs(event)
+	assert.Error(err)
+	plugin.Critical = ""
+	status, err := checkArgs(event)
+	assert.NoError(err)
+	assert.Equal(sensu.CheckStateOK, status)
+}
+
+func TestEventReader(t *testing.T) {
+	assert := assert.New(t)
+	stream := newEventReader(strings.NewReader(": comment\r\n\r\nid: 1\r\nevent: update\r\ndata:a\r\ndata: b\r\nretry: 1000\r\n\r\nevent: lonely\n\ndata\n\ndata: incomplete"))
+
+	e, err := stream.Next()
+	assert.NoError(err)
+	assert.Equal(sseEvent{Type: "update", ID: "1", Data: "a\nb"}, e)
+	e, err = stream.Next()
+	assert.NoError(err)
+	assert.Equal(sseEvent{Type: "message", Data: ""}, e)
+	_, err = stream.Next()
+	assert.Equal(io.EOF, err)
+}
@@ -0,0 +1,509 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nixwiz/http-checks/internal/buildinfo"
+	"github.com/nixwiz/http-checks/internal/exitstatus"
+	"github.com/nixwiz/http-checks/internal/httpclient"
+	"github.com/nixwiz/http-checks/internal/logging"
+	"github.com/nixwiz/http-checks/internal/overrides"
+	"github.com/nixwiz/http-checks/internal/selfmetrics"
+	corev2 "github.com/sensu/sensu-go/api/core/v2"
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+)
+
+// Config represents the check plugin config.
+type Config struct {
+	sensu.PluginConfig
+	URL                string
+	API                string
+	Selector           string
+	Warning            int
+	Critical           int
+	TrustedCAFile      string
+	UseSystemCAsPlus   bool
+	InsecureSkipVerify bool
+	Timeout            int
+	Headers            []string
+	HeadersFile        httpclient.HeadersFileConfig
+	MTLSKeyFile        string
+	MTLSCertFile       string
+	Proxy              httpclient.ProxyConfig
+	Transport          httpclient.TransportConfig
+	Source             httpclient.SourceConfig
+	Resolver           httpclient.ResolverConfig
+	URLParsing         httpclient.URLConfig
+	Record             httpclient.RecordConfig
+	Log                logging.Config
+	Overrides          overrides.Config
+	Status             exitstatus.Config
+	Metrics            selfmetrics.Config
+}
+
+// matcher is a single label matcher from --selector, e.g. severity="page".
+type matcher struct {
+	Name  string
+	Op    string
+	Value string
+}
+
+func (m matcher) String() string {
+	return fmt.Sprintf("%s%s%q", m.Name, m.Op, m.Value)
+}
+
+// alert is a firing alert, as returned by either API.
+type alert struct {
+	Labels map[string]string
+}
+
+// queryResponse is the Prometheus query API envelope.
+type queryResponse struct {
+	Status    string `json:"status"`
+	ErrorType string `json:"errorType"`
+	Error     string `json:"error"`
+	Data      struct {
+		ResultType string `json:"resultType"`
+		Result     []struct {
+			Metric map[string]string `json:"metric"`
+		} `json:"result"`
+	} `json:"data"`
+}
+
+var (
+	tlsConfig tls.Config
+	matchers  []matcher
+
+	// matcherRegex matches a single PromQL label matcher.
+	matcherRegex = regexp.MustCompile(`^\s*([a-zA-Z_][a-zA-Z0-9_]*)\s*(=~|!~|!=|=)\s*"((?:[^"\\]|\\.)*)"\s*(?:,|$)`)
+
+	// maxAlertOutput is the number of alerts listed in the output.
+	maxAlertOutput = 10
+
+	plugin = Config{
+		PluginConfig: sensu.PluginConfig{
+			Name:     "prometheus-alert",
+			Short:    "Prometheus/Alertmanager Firing Alerts Check",
+			Keyspace: "sensu.io/plugins/prometheus-alert/config",
+		},
+	}
+
+	options = []*sensu.PluginConfigOption{
+		{
+			Path:      "url",
+			Env:       "CHECK_URL",
+			Argument:  "url",
+			Shorthand: "u",
+			Default:   "http://localhost:9090",
+			Usage:     "Base URL of the Prometheus or Alertmanager server",
+			Value:     &plugin.URL,
+		},
+		{
+			Path:      "api",
+			Env:       "",
+			Argument:  "api",
+			Shorthand: "a",
+			Default:   "prometheus",
+			Usage:     "API to query, either prometheus or alertmanager",
+			Value:     &plugin.API,
+		},
+		{
+			Path:      "selector",
+			Env:       "",
+			Argument:  "selector",
+			Shorthand: "s",
+			Default:   "",
+			Usage:     "Label selector for the alerts to count, e.g. 'severity=\"page\",team=~\"web|api\"'",
+			Value:     &plugin.Selector,
+		},
+		{
+			Path:      "warning",
+			Env:       "",
+			Argument:  "warning",
+			Shorthand: "w",
+			Default:   1,
+			Usage:     "Number of firing alerts at which to return a warning",
+			Value:     &plugin.Warning,
+		},
+		{
+			Path:      "critical",
+			Env:       "",
+			Argument:  "critical",
+			Shorthand: "c",
+			Default:   1,
+			Usage:     "Number of firing alerts at which to return a critical",
+			Value:     &plugin.Critical,
+		},
+		{
+			Path:      "insecure-skip-verify",
+			Env:       "",
+			Argument:  "insecure-skip-verify",
+			Shorthand: "i",
+			Default:   false,
+			Usage:     "Skip TLS certificate verification (not recommended!)",
+			Value:     &plugin.InsecureSkipVerify,
+		},
+		{
+			Path:      "trusted-ca-file",
+			Env:       "",
+			Argument:  "trusted-ca-file",
+			Shorthand: "t",
+			Default:   "",
+			Usage:     "TLS CA certificate bundle in PEM format, or a directory of them",
+			Value:     &plugin.TrustedCAFile,
+		},
+		{
+			Path:      "use-system-cas-plus",
+			Env:       "",
+			Argument:  "use-system-cas-plus",
+			Shorthand: "",
+			Default:   false,
+			Usage:     "Add the CA certificates from --trusted-ca-file to the system trust store rather than replacing it",
+			Value:     &plugin.UseSystemCAsPlus,
+		},
+		{
+			Path:      "timeout",
+			Env:       "",
+			Argument:  "timeout",
+			Shorthand: "T",
+			Default:   15,
+			Usage:     "Request timeout in seconds",
+			Value:     &plugin.Timeout,
+		},
+		{
+			Path:      "header",
+			Env:       "",
+			Argument:  "header",
+			Shorthand: "H",
+			Default:   []string{},
+			Usage:     "Additional header(s) to send in check request",
+			Value:     &plugin.Headers,
+		},
+		{
+			Path:      "mtls-key-file",
+			Env:       "",
+			Argument:  "mtls-key-file",
+			Shorthand: "K",
+			Default:   "",
+			Usage:     "Key file for mutual TLS auth in PEM format",
+			Value:     &plugin.MTLSKeyFile,
+		},
+		{
+			Path:      "mtls-cert-file",
+			Env:       "",
+			Argument:  "mtls-cert-file",
+			Shorthand: "C",
+			Default:   "",
+			Usage:     "Certificate file for mutual TLS auth in PEM format",
+			Value:     &plugin.MTLSCertFile,
+		},
+	}
+)
+
+func main() {
+	options = append(options, plugin.Proxy.Options()...)
+	options = append(options, plugin.Transport.Options()...)
+	options = append(options, plugin.Source.Options()...)
+	options = append(options, plugin.Resolver.Options()...)
+	options = append(options, plugin.URLParsing.Options()...)
+	options = append(options, plugin.HeadersFile.Options()...)
+	options = append(options, plugin.Record.Options()...)
+	options = append(options, plugin.Log.Options()...)
+	options = append(options, plugin.Overrides.Options()...)
+	options = append(options, plugin.Status.Options()...)
+	options = append(options, plugin.Metrics.Options()...)
+	buildinfo.Handle(plugin.PluginConfig.Name, options, os.Args[1:])
+	exitstatus.ParseFlags(plugin.PluginConfig.Name, options, os.Args[1:])
+	check := sensu.NewGoCheck(&plugin.PluginConfig, options, plugin.Status.Wrap(plugin.PluginConfig.Name, checkArgs), plugin.Record.Wrap(plugin.PluginConfig.Name, plugin.Metrics.Wrap(plugin.PluginConfig.Name, plugin.Status.Wrap(plugin.PluginConfig.Name, executeCheck))), overrides.Requested(os.Args[1:]))
+	check.Execute()
+}
+
+func checkArgs(event *corev2.Event) (int, error) {
+	if err := plugin.Log.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	if err := plugin.URLParsing.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+
+	var err error
+
+	if len(plugin.URL) == 0 {
+		return sensu.CheckStateUnknown, fmt.Errorf("--url or CHECK_URL environment variable is required")
+	}
+	checkURL, err := httpclient.ParseURL("--url", plugin.URL)
+	if err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	plugin.URL = checkURL.String()
+	if plugin.API != "prometheus" && plugin.API != "alertmanager" {
+		return sensu.CheckStateUnknown, fmt.Errorf("--api must be either prometheus or alertmanager")
+	}
+	if plugin.Warning < 1 || plugin.Critical < 1 {
+		return sensu.CheckStateUnknown, fmt.Errorf("--warning and --critical must be 1 or greater")
+	}
+	if plugin.Critical < plugin.Warning {
+		return sensu.CheckStateUnknown, fmt.Errorf("--critical must be greater than or equal to --warning")
+	}
+	matchers, err = parseSelector(plugin.Selector)
+	if err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	headers, err := plugin.HeadersFile.Headers(event)
+	if err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	plugin.Headers = append(headers, plugin.Headers...)
+	if len(plugin.Headers) > 0 {
+		for _, header := range plugin.Headers {
+			headerSplit := strings.SplitN(header, ":", 2)
+			if len(headerSplit) != 2 {
+				return sensu.CheckStateUnknown, fmt.Errorf("--header %q value malformed should be \"Header-Name: Header Value\"", header)
+			}
+		}
+	}
+	if len(plugin.TrustedCAFile) > 0 {
+		caCertPool, err := httpclient.LoadCACerts(plugin.TrustedCAFile, plugin.UseSystemCAsPlus)
+		if err != nil {
+			return sensu.CheckStateUnknown, fmt.Errorf("Error loading specified CA file: %v", err)
+		}
+		tlsConfig.RootCAs = caCertPool
+	}
+	tlsConfig.InsecureSkipVerify = plugin.InsecureSkipVerify
+
+	if (len(plugin.MTLSKeyFile) > 0 && len(plugin.MTLSCertFile) == 0) || (len(plugin.MTLSCertFile) > 0 && len(plugin.MTLSKeyFile) == 0) {
+		return sensu.CheckStateUnknown, fmt.Errorf("mTLS auth requires both --mtls-key-file and --mtls-cert-file")
+	}
+	if len(plugin.MTLSKeyFile) > 0 && len(plugin.MTLSCertFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(plugin.MTLSCertFile, plugin.MTLSKeyFile)
+		if err != nil {
+			return sensu.CheckStateUnknown, fmt.Errorf("Failed to load mTLS key pair %s/%s: %v", plugin.MTLSCertFile, plugin.MTLSKeyFile, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if err := plugin.Proxy.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	if err := plugin.Transport.Validate(&plugin.Proxy); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	if err := plugin.Source.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	if err := plugin.Resolver.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+
+	if err := plugin.Record.Validate(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+
+	return sensu.CheckStateOK, nil
+}
+
+func executeCheck(event *corev2.Event) (int, error) {
+
+	client := httpclient.New(&tlsConfig, time.Duration(plugin.Timeout)*time.Second, true, plugin.Proxy.Configure, plugin.Source.Configure, plugin.Resolver.Configure, plugin.Transport.Configure)
+
+	requestURL := alertsURL(plugin.URL)
+	body, err := get(client, requestURL)
+	if err != nil {
+		fmt.Fprintf(selfmetrics.Stdout, "%s CRITICAL: %v\n", plugin.PluginConfig.Name, err)
+		return sensu.CheckStateCritical, nil
+	}
+
+	var alerts []alert
+	if plugin.API == "alertmanager" {
+		alerts, err = parseAlertmanager(body)
+	} else {
+		alerts, err = parsePrometheus(body)
+	}
+	if err != nil {
+		fmt.Fprintf(selfmetrics.Stdout, "%s CRITICAL: invalid response from %s: %v\n", plugin.PluginConfig.Name, requestURL, err)
+		return sensu.CheckStateCritical, nil
+	}
+
+	perfdata := fmt.Sprintf("firing_alerts=%d", len(alerts))
+	summary := fmt.Sprintf("%d firing alerts matching {%s} at %s", len(alerts), selectorString(), plugin.URL)
+	if len(alerts) > 0 {
+		summary = fmt.Sprintf("%s: %s", summary, describeAlerts(alerts))
+	}
+
+	switch {
+	case len(alerts) >= plugin.Critical:
+		fmt.Fprintf(selfmetrics.Stdout, "%s CRITICAL: %s | %s\n", plugin.PluginConfig.Name, summary, perfdata)
+		return sensu.CheckStateCritical, nil
+	case len(alerts) >= plugin.Warning:
+		fmt.Fprintf(selfmetrics.Stdout, "%s WARNING: %s | %s\n", plugin.PluginConfig.Name, summary, perfdata)
+		return sensu.CheckStateWarning, nil
+	}
+
+	fmt.Fprintf(selfmetrics.Stdout, "%s OK: %s | %s\n", plugin.PluginConfig.Name, summary, perfdata)
+	return sensu.CheckStateOK, nil
+}
+
+// parseSelector parses a comma separated list of PromQL label matchers,
+// optionally enclosed in braces.
+func parseSelector(selector string) ([]matcher, error) {
+	parsed := []matcher{}
+	remaining := strings.TrimSpace(selector)
+	remaining = strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(remaining, "{"), "}"))
+	for len(remaining) > 0 {
+		match := matcherRegex.FindStringSubmatch(remaining)
+		if match == nil {
+			return nil, fmt.Errorf("--selector %q is malformed, should be a list of label matchers like 'severity=\"page\",team=~\"web|api\"'", selector)
+		}
+		value, err := unquote(match[3])
+		if err != nil {
+			return nil, fmt.Errorf("--selector %q is malformed: %v", selector, err)
+		}
+		if match[2] == "=~" || match[2] == "!~" {
+			if _, err := regexp.Compile(value); err != nil {
+				return nil, fmt.Errorf("--selector %q contains an invalid regular expression: %v", selector, err)
+			}
+		}
+		parsed = append(parsed, matcher{Name: match[1], Op: match[2], Value: value})
+		remaining = strings.TrimSpace(remaining[len(match[0]):])
+	}
+	return parsed, nil
+}
+
+func unquote(s string) (string, error) {
+	var value string
+	err := json.Unmarshal([]byte(`"`+s+`"`), &value)
+	return value, err
+}
+
+func selectorString() string {
+	parts := []string{}
+	for _, m := range matchers {
+		parts = append(parts, m.String())
+	}
+	return strings.Join(parts, ",")
+}
+
+// alertsURL returns the API URL listing the firing alerts matching the
+// selector.
+func alertsURL(base string) string {
+	base = strings.TrimSuffix(base, "/")
+	if plugin.API == "alertmanager" {
+		params := url.Values{}
+		params.Set("active", "true")
+		params.Set("silenced", "false")
+		params.Set("inhibited", "false")
+		for _, m := range matchers {
+			params.Add("filter", m.String())
+		}
+		return base + "/api/v2/alerts?" + params.Encode()
+	}
+	selector := `alertstate="firing"`
+	if len(matchers) > 0 {
+		selector = selector + "," + selectorString()
+	}
+	params := url.Values{}
+	params.Set("query", "ALERTS{"+selector+"}")
+	return base + "/api/v1/query?" + params.Encode()
+}
+
+func get(client *http.Client, requestURL string) ([]byte, error) {
+	req, err := http.NewRequest("GET", requestURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	for _, header := range plugin.Headers {
+		headerSplit := strings.SplitN(header, ":", 2)
+		headerKey := strings.TrimSpace(headerSplit[0])
+		headerValue := strings.TrimSpace(headerSplit[1])
+		if strings.EqualFold(headerKey, "host") {
+			req.Host = headerValue
+			continue
+		}
+		req.Header.Set(headerKey, headerValue)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("request error: %s", httpclient.Describe(err))
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("read response body error: %s", httpclient.Describe(err))
+	}
+	// The Prometheus API returns its error envelope with a 4xx/5xx status, so
+	// only fail here if the body cannot be the envelope.
+	if resp.StatusCode != http.StatusOK && (plugin.API == "alertmanager" || !json.Valid(body)) {
+		return nil, fmt.Errorf("HTTP Status %v for %s", resp.StatusCode, requestURL)
+	}
+	return body, nil
+}
+
+// parsePrometheus returns the alerts in the result of an ALERTS query.
+func parsePrometheus(body []byte) ([]alert, error) {
+	var resp queryResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, err
+	}
+	if resp.Status != "success" {
+		return nil, fmt.Errorf("query status %q: %s: %s", resp.Status, resp.ErrorType, resp.Error)
+	}
+	if resp.Data.ResultType != "vector" {
+		return nil, fmt.Errorf("unexpected result type %q", resp.Data.ResultType)
+	}
+	alerts := []alert{}
+	for _, result := range resp.Data.Result {
+		alerts = append(alerts, alert{Labels: result.Metric})
+	}
+	return alerts, nil
+}
+
+// parseAlertmanager returns the alerts listed by the Alertmanager v2 API.
+// Alertmanager has already applied the filters, only the state is checked.
+func parseAlertmanager(body []byte) ([]alert, error) {
+	var resp []struct {
+		Labels map[string]string `json:"labels"`
+		Status struct {
+			State string `json:"state"`
+		} `json:"status"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, err
+	}
+	alerts := []alert{}
+	for _, a := range resp {
+		if a.Status.State == "active" {
+			alerts = append(alerts, alert{Labels: a.Labels})
+		}
+	}
+	return alerts, nil
+}
+
+// describeAlerts summarizes up to maxAlertOutput alerts by name and instance.
+func describeAlerts(alerts []alert) string {
+	descriptions := []string{}
+	for _, a := range alerts {
+		description := a.Labels["alertname"]
+		if instance, ok := a.Labels["instance"]; ok {
+			description = fmt.Sprintf("%s (%s)", description, instance)
+		}
+		descriptions = append(descriptions, description)
+	}
+	sort.Strings(descriptions)
+	if len(descriptions) > maxAlertOutput {
+		descriptions = append(descriptions[:maxAlertOutput], fmt.Sprintf("and %d more", len(alerts)-maxAlertOutput))
+	}
+	return strings.Join(descriptions, ", ")
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	corev2 "github.com/sensu/sensu-go/api/core/v2"
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMain(t *testing.T) {
+}
+
+func TestExecuteCheck(t *testing.T) {
+	firing := `{"status": "success", "data": {"resultType": "vector", "result": [
+		{"metric": {"__name__": "ALERTS", "alertname": "HighLatency", "alertstate": "firing", "instance": "web-1", "severity": "page"}, "value": [1614000000, "1"]},
+		{"metric": {"__name__": "ALERTS", "alertname": "HighLatency", "alertstate": "firing", "instance": "web-2", "severity": "page"}, "value": [1614000000, "1"]}
+	]}}`
+	none := `{"status": "success", "data": {"resultType": "vector", "result": []}}`
+	badQuery := `{"status": "error", "errorType": "bad_data", "error": "parse error"}`
+	alertmanager := `[
+		{"labels": {"alertname": "DiskFull", "instance": "db-1", "severity": "page"}, "status": {"state": "active", "silencedBy": [], "inhibitedBy": []}},
+		{"labels": {"alertname": "DiskFull", "instance": "db-2", "severity": "page"}, "status": {"state": "suppressed", "silencedBy": ["abc"], "inhibitedBy": []}}
+	]`
+
+	testCases := []struct {
+		returnStatus int
+		api          string
+		httpStatus   int
+		response     string
+		warning      int
+		critical     int
+	}{
+		{sensu.CheckStateCritical, "prometheus", http.StatusOK, firing, 1, 1},
+		{sensu.CheckStateWarning, "prometheus", http.StatusOK, firing, 1, 3},
+		{sensu.CheckStateOK, "prometheus", http.StatusOK, firing, 3, 3},
+		{sensu.CheckStateOK, "prometheus", http.StatusOK, none, 1, 1},
+		{sensu.CheckStateCritical, "prometheus", http.StatusBadRequest, badQuery, 1, 1},
+		{sensu.CheckStateCritical, "prometheus", http.StatusBadGateway, "<html>bad gateway</html>", 1, 1},
+		{sensu.CheckStateWarning, "alertmanager", http.StatusOK, alertmanager, 1, 2},
+		{sensu.CheckStateCritical, "alertmanager", http.StatusInternalServerError, "", 1, 2},
+	}
+
+	for _, tc := range testCases {
+		assert := assert.New(t)
+		event := corev2.FixtureEvent("entity1", "check")
+
+		var test = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if tc.api == "alertmanager" {
+				assert.Equal("/api/v2/alerts", r.URL.Path)
+				assert.Equal([]string{`severity="page"`}, r.URL.Query()["filter"])
+				assert.Equal("false", r.URL.Query().Get("silenced"))
+			} else {
+				assert.Equal("/api/v1/query", r.URL.Path)
+				assert.Equal(`ALERTS{alertstate="firing",severity="page"}`, r.URL.Query().Get("query"))
+			}
+			w.WriteHeader(tc.httpStatus)
+			_, _ = w.Write([]byte(tc.response))
+		}))
+		plugin.URL = test.URL
+		plugin.API = tc.api
+		plugin.Selector = `severity="page"`
+		plugin.Warning = tc.warning
+		plugin.Critical = tc.critical
+		status, err := checkArgs(event)
+		assert.NoError(err)
+		assert.Equal(sensu.CheckStateOK, status)
+		status, err = executeCheck(event)
+		assert.NoError(err)
+		assert.Equal(tc.returnStatus, status)
+		test.Close()
+	}
+}
+
+func TestParseSelector(t *testing.T) {
+	assert := assert.New(t)
+
+	parsed, err := parseSelector(`{severity="page", team=~"web|api",env!="dev" , job!~"test.*"}`)
+	require.NoError(t, err)
+	assert.Equal([]matcher{
+		{Name: "severity", Op: "=", Value: "page"},
+		{Name: "team", Op: "=~", Value: "web|api"},
+		{Name: "env", Op: "!=", Value: "dev"},
+		{Name: "job", Op: "!~", Value: "test.*"},
+	}, parsed)
+
+	parsed, err = parseSelector(`summary="say \"hi\""`)
+	require.NoError(t, err)
+	assert.Equal("say \"hi\"", parsed[0].Value)
+	assert.Equal(`summary="say \"hi\""`, parsed[0].String())
+
+	parsed, err = parseSelector("")
+	require.NoError(t, err)
+	assert.Empty(parsed)
+
+	for _, selector := range []string{`severity=page`, `severity="page" team="web"`, `team=~"("`} {
+		_, err = parseSelector(selector)
+		assert.Error(err, selector)
+	}
+}
+
+func TestCheckArgs(t *testing.T) {
+	assert := assert.New(t)
+	event := corev2.FixtureEvent("entity1", "check")
+
+	plugin.URL = "http://localhost:9090"
+	plugin.API = "graphite"
+	plugin.Selector = ""
+	plugin.Warning = 1
+	plugin.Critical = 1
+	status, err := checkArgs(event)
+	assert.Error(err)
+	assert.Equal(sensu.CheckStateUnknown, status)
+
+	plugin.API = "prometheus"
+	plugin.Warning = 2
+	status, err = checkArgs(event)
+	assert.Error(err)
+	assert.Equal(sensu.CheckStateUnknown, status)
+	plugin.Warning = 1
+}
@@ -0,0 +1,283 @@
+// Package auth provides the authentication options shared by the checks.
+// Secrets (passwords, client secrets and tokens) are never passed as flags,
+// only the names of the environment variables or files holding them, so they
+// do not show up in process listings or check definitions.
+package auth
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/nixwiz/http-checks/internal/secret"
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+)
+
+// The supported authentication types.
+const (
+	TypeNone   = "none"
+	TypeBasic  = "basic"
+	TypeBearer = "bearer"
+	TypeDigest = "digest"
+	TypeOAuth2 = "oauth2"
+	TypeSigV4  = "sigv4"
+)
+
+var types = []string{TypeNone, TypeBasic, TypeBearer, TypeDigest, TypeOAuth2, TypeSigV4}
+
+// Config holds the authentication settings of a check.
+type Config struct {
+	Type         string
+	User         string
+	PasswordEnv  string
+	PasswordFile string
+	TokenEnv     string
+	TokenFile    string
+	TokenURL     string
+	Scopes       []string
+	Region       string
+	Service      string
+
+	password string
+	token    string
+	// userinfo holds the credentials taken from the URL of the check, see
+	// FromURL.
+	userinfo *url.Userinfo
+}
+
+// Options returns the plugin config options for c, to be appended to the
+// options of a check.
+func (c *Config) Options() []*sensu.PluginConfigOption {
+	return []*sensu.PluginConfigOption{
+		{
+			Path:     "auth-type",
+			Env:      "CHECK_AUTH_TYPE",
+			Argument: "auth-type",
+			Default:  TypeNone,
+			Usage:    "Authentication type, one of " + strings.Join(types, ", "),
+			Value:    &c.Type,
+		},
+		{
+			Path:     "auth-user",
+			Env:      "CHECK_AUTH_USER",
+			Argument: "auth-user",
+			Default:  "",
+			Usage:    "Username for basic and digest auth, client ID for oauth2 or access key ID for sigv4",
+			Value:    &c.User,
+		},
+		{
+			Path:     "auth-password-env",
+			Env:      "",
+			Argument: "auth-password-env",
+			Default:  "CHECK_AUTH_PASSWORD",
+			Usage:    "Environment variable holding the password, oauth2 client secret or sigv4 secret access key",
+			Value:    &c.PasswordEnv,
+		},
+		{
+			Path:     "auth-password-file",
+			Env:      "",
+			Argument: "auth-password-file",
+			Default:  "",
+			Usage:    "File holding the password, oauth2 client secret or sigv4 secret access key, used instead of --auth-password-env",
+			Value:    &c.PasswordFile,
+		},
+		{
+			Path:     "auth-token-env",
+			Env:      "",
+			Argument: "auth-token-env",
+			Default:  "CHECK_AUTH_TOKEN",
+			Usage:    "Environment variable holding the bearer token or sigv4 session token",
+			Value:    &c.TokenEnv,
+		},
+		{
+			Path:     "auth-token-file",
+			Env:      "",
+			Argument: "auth-token-file",
+			Default:  "",
+			Usage:    "File holding the bearer token or sigv4 session token, used instead of --auth-token-env",
+			Value:    &c.TokenFile,
+		},
+		{
+			Path:     "auth-token-url",
+			Env:      "",
+			Argument: "auth-token-url",
+			Default:  "",
+			Usage:    "Token endpoint for oauth2 client credentials grants",
+			Value:    &c.TokenURL,
+		},
+		{
+			Path:     "auth-scope",
+			Env:      "",
+			Argument: "auth-scope",
+			Default:  []string{},
+			Usage:    "Scope(s) to request for oauth2",
+			Value:    &c.Scopes,
+		},
+		{
+			Path:     "auth-region",
+			Env:      "",
+			Argument: "auth-region",
+			Default:  "",
+			Usage:    "Region for sigv4 request signing",
+			Value:    &c.Region,
+		},
+		{
+			Path:     "auth-service",
+			Env:      "",
+			Argument: "auth-service",
+			Default:  "",
+			Usage:    "Service name for sigv4 request signing",
+			Value:    &c.Service,
+		},
+	}
+}
+
+// Validate checks the settings of c and reads the secrets it needs from the
+// environment or files.
+func (c *Config) Validate() error {
+	if len(c.Type) == 0 {
+		c.Type = TypeNone
+	}
+	c.userinfo = nil
+	var err error
+	c.password, err = readSecret(c.PasswordEnv, c.PasswordFile)
+	if err != nil {
+		return fmt.Errorf("--auth-password-file: %v", err)
+	}
+	c.token, err = readSecret(c.TokenEnv, c.TokenFile)
+	if err != nil {
+		return fmt.Errorf("--auth-token-file: %v", err)
+	}
+	passwordSource := describeSource(c.PasswordEnv, c.PasswordFile)
+	tokenSource := describeSource(c.TokenEnv, c.TokenFile)
+
+	switch c.Type {
+	case TypeNone:
+		return nil
+	case TypeBasic, TypeDigest:
+		if len(c.User) == 0 || len(c.password) == 0 {
+			return fmt.Errorf("--auth-type %s requires --auth-user and a password in %s", c.Type, passwordSource)
+		}
+	case TypeBearer:
+		if len(c.token) == 0 {
+			return fmt.Errorf("--auth-type %s requires a token in %s", c.Type, tokenSource)
+		}
+	case TypeOAuth2:
+		if len(c.TokenURL) == 0 || len(c.User) == 0 || len(c.password) == 0 {
+			return fmt.Errorf("--auth-type %s requires --auth-token-url, --auth-user and a client secret in %s", c.Type, passwordSource)
+		}
+	case TypeSigV4:
+		if len(c.User) == 0 || len(c.password) == 0 {
+			return fmt.Errorf("--auth-type %s requires --auth-user and a secret access key in %s", c.Type, passwordSource)
+		}
+		if len(c.Region) == 0 || len(c.Service) == 0 {
+			return fmt.Errorf("--auth-type %s requires --auth-region and --auth-service", c.Type)
+		}
+	default:
+		return fmt.Errorf("--auth-type %q is not supported, must be one of %s", c.Type, strings.Join(types, ", "))
+	}
+	return nil
+}
+
+// readSecret returns the secret in file if it is set, otherwise the one in the
+// environment variable env.
+func readSecret(env, file string) (string, error) {
+	if len(file) > 0 {
+		return secret.ReadFile(file)
+	}
+	if len(env) > 0 {
+		return os.Getenv(env), nil
+	}
+	return "", nil
+}
+
+// describeSource describes where readSecret reads a secret from, for error
+// messages.
+func describeSource(env, file string) string {
+	if len(file) > 0 {
+		return file
+	}
+	return "$" + env
+}
+
+// FromURL removes the userinfo from u, the URL given with flag, and uses it
+// for basic auth instead, so that the credentials do not show up in the check
+// output. It is an error if another type of authentication is configured, or
+// if an earlier URL had different credentials. Validate must have been called
+// first.
+func (c *Config) FromURL(flag string, u *url.URL) error {
+	if u.User == nil {
+		return nil
+	}
+	userinfo := u.User
+	u.User = nil
+	if c.Type != TypeNone {
+		return fmt.Errorf("%s has credentials, which conflict with --auth-type %s", flag, c.Type)
+	}
+	if c.userinfo != nil && c.userinfo.String() != userinfo.String() {
+		return fmt.Errorf("%s has credentials that differ from those of an earlier URL", flag)
+	}
+	c.userinfo = userinfo
+	return nil
+}
+
+// RoundTripper wraps base so that requests are authenticated as configured.
+// Validate must have been called first. If no authentication is configured
+// base is returned as is.
+func (c *Config) RoundTripper(base http.RoundTripper) http.RoundTripper {
+	if c.userinfo != nil {
+		user := c.userinfo.Username()
+		password, _ := c.userinfo.Password()
+		return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			req = req.Clone(req.Context())
+			req.SetBasicAuth(user, password)
+			return base.RoundTrip(req)
+		})
+	}
+	switch c.Type {
+	case TypeBasic:
+		return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			req = req.Clone(req.Context())
+			req.SetBasicAuth(c.User, c.password)
+			return base.RoundTrip(req)
+		})
+	case TypeBearer:
+		return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			req = req.Clone(req.Context())
+			req.Header.Set("Authorization", "Bearer "+c.token)
+			return base.RoundTrip(req)
+		})
+	case TypeDigest:
+		return &digestTransport{base: base, user: c.User, password: c.password}
+	case TypeOAuth2:
+		return &oauth2Transport{base: base, tokenURL: c.TokenURL, clientID: c.User, clientSecret: c.password, scopes: c.Scopes}
+	case TypeSigV4:
+		return &sigV4Transport{base: base, accessKey: c.User, secretKey: c.password, sessionToken: c.token, region: c.Region, service: c.Service}
+	}
+	return base
+}
+
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// readBody returns the body of req and replaces it with a new reader, so the
+// body can be sent (again) afterwards.
+func readBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
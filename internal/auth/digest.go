@@ -0,0 +1,172 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// digestTransport implements HTTP digest authentication (RFC 7616). The
+// request is sent without credentials first, and repeated with them if the
+// server answers with a digest challenge.
+type digestTransport struct {
+	base     http.RoundTripper
+	user     string
+	password string
+}
+
+func (t *digestTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	body, err := readBody(req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	challenge, ok := parseChallenge(resp.Header[http.CanonicalHeaderKey("WWW-Authenticate")])
+	if !ok {
+		return resp, nil
+	}
+	authorization, err := t.authorization(req, challenge)
+	if err != nil {
+		return resp, nil
+	}
+	_, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	req = req.Clone(req.Context())
+	if body != nil {
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	req.Header.Set("Authorization", authorization)
+	return t.base.RoundTrip(req)
+}
+
+// authorization returns the Authorization header answering challenge.
+func (t *digestTransport) authorization(req *http.Request, challenge map[string]string) (string, error) {
+	algorithm := challenge["algorithm"]
+	var newHash func() hash.Hash
+	switch strings.TrimSuffix(strings.ToUpper(algorithm), "-SESS") {
+	case "", "MD5":
+		newHash = md5.New
+	case "SHA-256":
+		newHash = sha256.New
+	default:
+		return "", fmt.Errorf("unsupported digest algorithm %q", algorithm)
+	}
+	h := func(s string) string {
+		sum := newHash()
+		sum.Write([]byte(s))
+		return hex.EncodeToString(sum.Sum(nil))
+	}
+
+	qop := ""
+	if len(challenge["qop"]) > 0 {
+		for _, option := range strings.Split(challenge["qop"], ",") {
+			if strings.TrimSpace(option) == "auth" {
+				qop = "auth"
+			}
+		}
+		if len(qop) == 0 {
+			return "", fmt.Errorf("unsupported digest qop %q", challenge["qop"])
+		}
+	}
+
+	cnonceBytes := make([]byte, 16)
+	if _, err := rand.Read(cnonceBytes); err != nil {
+		return "", err
+	}
+	cnonce := hex.EncodeToString(cnonceBytes)
+	nc := "00000001"
+	uri := req.URL.RequestURI()
+
+	ha1 := h(t.user + ":" + challenge["realm"] + ":" + t.password)
+	if strings.HasSuffix(strings.ToUpper(algorithm), "-SESS") {
+		ha1 = h(ha1 + ":" + challenge["nonce"] + ":" + cnonce)
+	}
+	ha2 := h(req.Method + ":" + uri)
+	var response string
+	if len(qop) > 0 {
+		response = h(strings.Join([]string{ha1, challenge["nonce"], nc, cnonce, qop, ha2}, ":"))
+	} else {
+		response = h(ha1 + ":" + challenge["nonce"] + ":" + ha2)
+	}
+
+	parts := []string{
+		fmt.Sprintf("username=%q", t.user),
+		fmt.Sprintf("realm=%q", challenge["realm"]),
+		fmt.Sprintf("nonce=%q", challenge["nonce"]),
+		fmt.Sprintf("uri=%q", uri),
+		fmt.Sprintf("response=%q", response),
+	}
+	if len(algorithm) > 0 {
+		parts = append(parts, "algorithm="+algorithm)
+	}
+	if len(qop) > 0 {
+		parts = append(parts, "qop="+qop, "nc="+nc, fmt.Sprintf("cnonce=%q", cnonce))
+	}
+	if opaque, ok := challenge["opaque"]; ok {
+		parts = append(parts, fmt.Sprintf("opaque=%q", opaque))
+	}
+	return "Digest " + strings.Join(parts, ", "), nil
+}
+
+// parseChallenge returns the parameters of the first digest challenge in
+// headers.
+func parseChallenge(headers []string) (map[string]string, bool) {
+	for _, header := range headers {
+		fields := strings.SplitN(strings.TrimSpace(header), " ", 2)
+		if len(fields) != 2 || !strings.EqualFold(fields[0], "digest") {
+			continue
+		}
+		params := map[string]string{}
+		rest := fields[1]
+		for len(rest) > 0 {
+			rest = strings.TrimLeft(rest, " ,")
+			eq := strings.Index(rest, "=")
+			if eq < 0 {
+				break
+			}
+			key := strings.ToLower(strings.TrimSpace(rest[:eq]))
+			rest = rest[eq+1:]
+			var value string
+			if strings.HasPrefix(rest, `"`) {
+				end := 1
+				for end < len(rest) && rest[end] != '"' {
+					if rest[end] == '\\' {
+						end++
+					}
+					end++
+				}
+				if end > len(rest) {
+					end = len(rest)
+				}
+				value = strings.Replace(rest[1:end], `\`, "", -1)
+				if end < len(rest) {
+					end++
+				}
+				rest = rest[end:]
+			} else {
+				end := strings.Index(rest, ",")
+				if end < 0 {
+					end = len(rest)
+				}
+				value = strings.TrimSpace(rest[:end])
+				rest = rest[end:]
+			}
+			params[key] = value
+		}
+		return params, true
+	}
+	return nil, false
+}
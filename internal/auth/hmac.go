@@ -0,0 +1,211 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"text/template"
+	"time"
+
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+)
+
+// DefaultHMACTemplate is the default canonical form of a request signed with
+// HMAC: its method, path and body on separate lines.
+const DefaultHMACTemplate = "{{.Method}}\n{{.Path}}\n{{.Body}}"
+
+// HMACConfig holds the settings for signing requests with HMAC-SHA256, as
+// required by webhook-style APIs. It is separate from Config as it can be
+// combined with any type of authentication.
+type HMACConfig struct {
+	Header          string
+	SecretEnv       string
+	SecretFile      string
+	Template        string
+	Encoding        string
+	Prefix          string
+	TimestampHeader string
+
+	secret   string
+	template *template.Template
+}
+
+// hmacData is the data available to the canonicalization template.
+type hmacData struct {
+	Method    string
+	Host      string
+	Path      string
+	Query     string
+	Body      string
+	Timestamp string
+}
+
+// Options returns the plugin config options for c, to be appended to the
+// options of a check.
+func (c *HMACConfig) Options() []*sensu.PluginConfigOption {
+	return []*sensu.PluginConfigOption{
+		{
+			Path:     "hmac-header",
+			Env:      "",
+			Argument: "hmac-header",
+			Default:  "",
+			Usage:    "Header to send the HMAC-SHA256 signature of the request in (e.g. X-Signature), requests are not signed if not set",
+			Value:    &c.Header,
+		},
+		{
+			Path:     "hmac-secret-env",
+			Env:      "",
+			Argument: "hmac-secret-env",
+			Default:  "CHECK_HMAC_SECRET",
+			Usage:    "Environment variable holding the HMAC secret",
+			Value:    &c.SecretEnv,
+		},
+		{
+			Path:     "hmac-secret-file",
+			Env:      "",
+			Argument: "hmac-secret-file",
+			Default:  "",
+			Usage:    "File holding the HMAC secret, used instead of --hmac-secret-env",
+			Value:    &c.SecretFile,
+		},
+		{
+			Path:     "hmac-template",
+			Env:      "",
+			Argument: "hmac-template",
+			Default:  DefaultHMACTemplate,
+			Usage:    "Go text/template of the signed content, with .Method, .Host, .Path, .Query, .Body and .Timestamp",
+			Value:    &c.Template,
+		},
+		{
+			Path:     "hmac-encoding",
+			Env:      "",
+			Argument: "hmac-encoding",
+			Default:  "hex",
+			Usage:    "Encoding of the signature, hex or base64",
+			Value:    &c.Encoding,
+		},
+		{
+			Path:     "hmac-prefix",
+			Env:      "",
+			Argument: "hmac-prefix",
+			Default:  "",
+			Usage:    "Prefix of the signature in --hmac-header (e.g. sha256=)",
+			Value:    &c.Prefix,
+		},
+		{
+			Path:     "hmac-timestamp-header",
+			Env:      "",
+			Argument: "hmac-timestamp-header",
+			Default:  "",
+			Usage:    "Header to send the Unix time used as .Timestamp in (e.g. X-Timestamp)",
+			Value:    &c.TimestampHeader,
+		},
+	}
+}
+
+// Validate checks the settings of c and reads the secret from the
+// environment or file.
+func (c *HMACConfig) Validate() error {
+	c.secret, c.template = "", nil
+	if len(c.Header) == 0 {
+		return nil
+	}
+	var err error
+	c.secret, err = readSecret(c.SecretEnv, c.SecretFile)
+	if err != nil {
+		return fmt.Errorf("--hmac-secret-file: %v", err)
+	}
+	if len(c.secret) == 0 {
+		return fmt.Errorf("--hmac-header requires a secret in %s", describeSource(c.SecretEnv, c.SecretFile))
+	}
+	if len(c.Template) == 0 {
+		c.Template = DefaultHMACTemplate
+	}
+	c.template, err = template.New("hmac").Option("missingkey=error").Parse(c.Template)
+	if err != nil {
+		return fmt.Errorf("--hmac-template: %v", err)
+	}
+	switch c.Encoding {
+	case "":
+		c.Encoding = "hex"
+	case "hex", "base64":
+	default:
+		return fmt.Errorf("--hmac-encoding %q is not supported, must be hex or base64", c.Encoding)
+	}
+	return nil
+}
+
+// RoundTripper wraps base so that requests are signed as configured.
+// Validate must have been called first. If no signing is configured base is
+// returned as is.
+func (c *HMACConfig) RoundTripper(base http.RoundTripper) http.RoundTripper {
+	if c.template == nil {
+		return base
+	}
+	return &hmacTransport{base: base, config: c}
+}
+
+// hmacTransport signs requests with HMAC-SHA256.
+type hmacTransport struct {
+	base   http.RoundTripper
+	config *HMACConfig
+
+	// now is replaced in tests.
+	now func() time.Time
+}
+
+func (t *hmacTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	body, err := readBody(req)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now
+	if t.now != nil {
+		now = t.now
+	}
+	if err := t.sign(req, body, now()); err != nil {
+		return nil, err
+	}
+	return t.base.RoundTrip(req)
+}
+
+// sign adds the signature, and the timestamp if configured, to req.
+func (t *hmacTransport) sign(req *http.Request, body []byte, now time.Time) error {
+	host := req.Host
+	if len(host) == 0 {
+		host = req.URL.Host
+	}
+	path := req.URL.EscapedPath()
+	if len(path) == 0 {
+		path = "/"
+	}
+	data := hmacData{
+		Method:    req.Method,
+		Host:      host,
+		Path:      path,
+		Query:     req.URL.RawQuery,
+		Body:      string(body),
+		Timestamp: strconv.FormatInt(now.Unix(), 10),
+	}
+	var content bytes.Buffer
+	if err := t.config.template.Execute(&content, data); err != nil {
+		return fmt.Errorf("--hmac-template: %v", err)
+	}
+	mac := hmac.New(sha256.New, []byte(t.config.secret))
+	mac.Write(content.Bytes())
+	signature := hex.EncodeToString(mac.Sum(nil))
+	if t.config.Encoding == "base64" {
+		signature = base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	}
+	req.Header.Set(t.config.Header, t.config.Prefix+signature)
+	if len(t.config.TimestampHeader) > 0 {
+		req.Header.Set(t.config.TimestampHeader, data.Timestamp)
+	}
+	return nil
+}
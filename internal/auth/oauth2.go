@@ -0,0 +1,92 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// oauth2Transport fetches an access token with the OAuth2 client credentials
+// grant and sends it as a bearer token. The token is reused until shortly
+// before it expires.
+type oauth2Transport struct {
+	base         http.RoundTripper
+	tokenURL     string
+	clientID     string
+	clientSecret string
+	scopes       []string
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+func (t *oauth2Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := t.accessToken(req)
+	if err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+token)
+	return t.base.RoundTrip(req)
+}
+
+// accessToken returns the cached token, or requests a new one.
+func (t *oauth2Transport) accessToken(orig *http.Request) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.token) > 0 && time.Now().Before(t.expires) {
+		return t.token, nil
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	if len(t.scopes) > 0 {
+		form.Set("scope", strings.Join(t.scopes, " "))
+	}
+	req, err := http.NewRequest("POST", t.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", fmt.Errorf("oauth2 token request creation error: %v", err)
+	}
+	req = req.WithContext(orig.Context())
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(t.clientID), url.QueryEscape(t.clientSecret))
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return "", fmt.Errorf("oauth2 token request error: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("oauth2 token response read error: %v", err)
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+		Error       string `json:"error"`
+	}
+	if err := json.Unmarshal(body, &token); err != nil || resp.StatusCode != http.StatusOK || len(token.AccessToken) == 0 {
+		if len(token.Error) > 0 {
+			return "", fmt.Errorf("oauth2 token request failed with HTTP Status %v: %s", resp.StatusCode, token.Error)
+		}
+		return "", fmt.Errorf("oauth2 token request failed with HTTP Status %v", resp.StatusCode)
+	}
+
+	t.token = token.AccessToken
+	t.expires = time.Now().Add(time.Hour)
+	if token.ExpiresIn > 0 {
+		t.expires = time.Now().Add(time.Duration(token.ExpiresIn)*time.Second - 10*time.Second)
+	}
+	return t.token, nil
+}
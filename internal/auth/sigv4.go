@@ -0,0 +1,144 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// sigV4Transport signs requests with AWS Signature Version 4.
+type sigV4Transport struct {
+	base         http.RoundTripper
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	region       string
+	service      string
+
+	// now is replaced in tests.
+	now func() time.Time
+}
+
+func (t *sigV4Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	body, err := readBody(req)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now
+	if t.now != nil {
+		now = t.now
+	}
+	t.sign(req, body, now().UTC())
+	return t.base.RoundTrip(req)
+}
+
+// sign adds the X-Amz-* and Authorization headers to req.
+func (t *sigV4Transport) sign(req *http.Request, body []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	if len(t.sessionToken) > 0 {
+		req.Header.Set("X-Amz-Security-Token", t.sessionToken)
+	}
+	// Only S3 requires (and verifies) the payload hash header.
+	if t.service == "s3" {
+		req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	}
+
+	host := req.Host
+	if len(host) == 0 {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for key, values := range req.Header {
+		key = strings.ToLower(key)
+		if strings.HasPrefix(key, "x-amz-") || key == "content-type" {
+			headers[key] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if len(path) == 0 {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := strings.Join([]string{date, t.region, t.service, "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+t.secretKey), date)
+	key = hmacSHA256(key, t.region)
+	key = hmacSHA256(key, t.service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+t.accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+// canonicalQuery returns query sorted by key and value, encoded as required
+// for signing.
+func canonicalQuery(query url.Values) string {
+	var params [][2]string
+	for key, values := range query {
+		for _, value := range values {
+			params = append(params, [2]string{escape(key), escape(value)})
+		}
+	}
+	sort.Slice(params, func(i, j int) bool {
+		if params[i][0] != params[j][0] {
+			return params[i][0] < params[j][0]
+		}
+		return params[i][1] < params[j][1]
+	})
+	encoded := make([]string, len(params))
+	for i, param := range params {
+		encoded[i] = param[0] + "=" + param[1]
+	}
+	return strings.Join(encoded, "&")
+}
+
+func escape(s string) string {
+	return strings.Replace(url.QueryEscape(s), "+", "%20", -1)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,98 @@
+// Package buildinfo prints the build metadata of the checks as JSON, for
+// automation verifying which version, and which capabilities, of a check an
+// agent has after an asset upgrade. The plugin SDK only prints the version as
+// text with its version subcommand, which cannot be extended, so the JSON
+// variants are handled before the SDK parses the arguments.
+package buildinfo
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+	"github.com/sensu/sensu-plugin-sdk/version"
+)
+
+// exit and stdout are replaced in tests.
+var (
+	exit             = os.Exit
+	stdout io.Writer = os.Stdout
+)
+
+// Info is the build metadata of a check.
+type Info struct {
+	Name      string `json:"name"`
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	Date      string `json:"date"`
+	GoVersion string `json:"go_version"`
+	Platform  string `json:"platform"`
+	// Features are the flags of the check, every capability of a check
+	// comes with the flags to configure it.
+	Features []string `json:"features"`
+}
+
+// Get returns the build metadata of the check named name with options. The
+// version, commit and date are those set at build time in the plugin SDK,
+// see .goreleaser.yml.
+func Get(name string, options []*sensu.PluginConfigOption) Info {
+	info := Info{
+		Name:      name,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+		Features:  []string{},
+	}
+	// version.Version returns "<version>, commit <commit>, built at <date>".
+	info.Version = version.Version()
+	if i := strings.Index(info.Version, ", commit "); i >= 0 {
+		info.Commit = info.Version[i+len(", commit "):]
+		info.Version = info.Version[:i]
+		if i := strings.Index(info.Commit, ", built at "); i >= 0 {
+			info.Date = info.Commit[i+len(", built at "):]
+			info.Commit = info.Commit[:i]
+		}
+	}
+	for _, opt := range options {
+		if len(opt.Argument) > 0 {
+			info.Features = append(info.Features, opt.Argument)
+		}
+	}
+	sort.Strings(info.Features)
+	return info
+}
+
+// Requested reports whether the JSON build metadata was requested in args,
+// with `version --json` or `--version-json`.
+func Requested(args []string) bool {
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		}
+		if arg == "--version-json" || (arg == "--json" && i > 0 && args[0] == "version") {
+			return true
+		}
+	}
+	return false
+}
+
+// Handle prints the build metadata of the check named name with options as
+// JSON and exits if it was requested in args, see Requested. It is meant to
+// be called first in main.
+func Handle(name string, options []*sensu.PluginConfigOption, args []string) {
+	if !Requested(args) {
+		return
+	}
+	data, err := json.MarshalIndent(Get(name, options), "", "  ")
+	if err != nil {
+		fmt.Fprintf(stdout, "%s UNKNOWN: %v\n", name, err)
+		exit(sensu.CheckStateUnknown)
+		return
+	}
+	fmt.Fprintln(stdout, string(data))
+	exit(sensu.CheckStateOK)
+}
@@ -0,0 +1,55 @@
+package buildinfo
+
+import (
+	"bytes"
+	"encoding/json"
+	"runtime"
+	"testing"
+
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequested(t *testing.T) {
+	assert := assert.New(t)
+	assert.True(Requested([]string{"version", "--json"}))
+	assert.True(Requested([]string{"--version-json"}))
+	assert.False(Requested([]string{"version"}))
+	assert.False(Requested([]string{"--json"}))
+	assert.False(Requested([]string{"--url", "http://localhost/", "--json"}))
+	assert.False(Requested([]string{"--", "--version-json"}))
+}
+
+func TestHandle(t *testing.T) {
+	assert := assert.New(t)
+	var url, timeout string
+	options := []*sensu.PluginConfigOption{
+		{Argument: "url", Value: &url},
+		{Argument: "timeout", Value: &timeout},
+		{Path: "no-flag"},
+	}
+	var out bytes.Buffer
+	exited := -1
+	origStdout, origExit := stdout, exit
+	stdout = &out
+	exit = func(status int) { exited = status }
+	defer func() {
+		stdout, exit = origStdout, origExit
+	}()
+
+	Handle("test-check", options, []string{"--url", "http://localhost/"})
+	assert.Equal(-1, exited)
+	assert.Empty(out.String())
+
+	Handle("test-check", options, []string{"version", "--json"})
+	assert.Equal(sensu.CheckStateOK, exited)
+	var info Info
+	require.NoError(t, json.Unmarshal(out.Bytes(), &info))
+	assert.Equal("test-check", info.Name)
+	assert.Equal("dev", info.Version)
+	assert.Equal("none", info.Commit)
+	assert.Equal("unknown", info.Date)
+	assert.Equal(runtime.Version(), info.GoVersion)
+	assert.Equal([]string{"timeout", "url"}, info.Features)
+}
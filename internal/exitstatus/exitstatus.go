@@ -0,0 +1,154 @@
+// Package exitstatus implements the exit status contract of the checks. OK,
+// WARNING and CRITICAL report the state of the checked endpoint, UNKNOWN means
+// the check could not be run as configured: invalid flags, unparsable
+// thresholds, missing files and the like. With --unknown-as-critical UNKNOWN
+// is reported as CRITICAL, for alert routing that does not handle UNKNOWN.
+package exitstatus
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/nixwiz/http-checks/internal/selfmetrics"
+	corev2 "github.com/sensu/sensu-go/api/core/v2"
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+	"github.com/spf13/pflag"
+)
+
+const (
+	argument = "unknown-as-critical"
+	env      = "CHECK_UNKNOWN_AS_CRITICAL"
+)
+
+// exit is replaced in tests.
+var exit = os.Exit
+
+// Config holds the exit status settings of a check.
+type Config struct {
+	UnknownAsCritical bool
+
+	// failed is the status of a wrapped function that returned an error,
+	// 0 if none did.
+	failed int
+}
+
+// Options returns the plugin config options for c, to be appended to the
+// options of a check.
+func (c *Config) Options() []*sensu.PluginConfigOption {
+	return []*sensu.PluginConfigOption{
+		{
+			Path:     argument,
+			Env:      env,
+			Argument: argument,
+			Default:  false,
+			Usage:    "Exit with CRITICAL rather than UNKNOWN when the check is misconfigured or cannot be run",
+			Value:    &c.UnknownAsCritical,
+		},
+	}
+}
+
+// Unknown returns the exit status for a check that could not be run, UNKNOWN
+// or CRITICAL with --unknown-as-critical.
+func (c *Config) Unknown() int {
+	if c.UnknownAsCritical {
+		return sensu.CheckStateCritical
+	}
+	return sensu.CheckStateUnknown
+}
+
+// Wrap returns a check function for a check named name that calls f. If f
+// returns an error, e.g. from checkArgs for an invalid configuration, it is
+// printed as the UNKNOWN output of the check and not returned, as the plugin
+// SDK would print it again along with the usage of the check. The functions
+// wrapped by c after that one, the executeCheck of a failed checkArgs, are
+// not called. UNKNOWN results are mapped with Unknown.
+func (c *Config) Wrap(name string, f func(*corev2.Event) (int, error)) func(*corev2.Event) (int, error) {
+	return func(event *corev2.Event) (int, error) {
+		if c.failed > 0 {
+			return c.failed, nil
+		}
+		status, err := f(event)
+		if err != nil {
+			fmt.Fprintf(selfmetrics.Stdout, "%s UNKNOWN: %v\n", name, err)
+			status = sensu.CheckStateUnknown
+		}
+		if status == sensu.CheckStateUnknown {
+			status = c.Unknown()
+		}
+		if err != nil {
+			c.failed = status
+		}
+		return status, nil
+	}
+}
+
+// ParseFlags checks that args are valid for options, before they are parsed
+// by the plugin SDK, which exits with OK on invalid flags. If they are not the
+// error is printed as the UNKNOWN output of the check named name and the
+// process exits with UNKNOWN (or CRITICAL with --unknown-as-critical).
+func ParseFlags(name string, options []*sensu.PluginConfigOption, args []string) {
+	unknownAsCritical, err := parseFlags(options, args)
+	if err == nil {
+		return
+	}
+	fmt.Printf("%s UNKNOWN: %v, see %s --help\n", name, err, name)
+	config := Config{UnknownAsCritical: unknownAsCritical}
+	exit(config.Unknown())
+}
+
+// parseFlags parses args with flags for options, returning the value of
+// --unknown-as-critical (or its environment variable) and the parse error.
+func parseFlags(options []*sensu.PluginConfigOption, args []string) (bool, error) {
+	unknownAsCritical, _ := strconv.ParseBool(os.Getenv(env))
+	flags := pflag.NewFlagSet("check", pflag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	for _, opt := range options {
+		if len(opt.Argument) == 0 || opt.Value == nil {
+			continue
+		}
+		switch reflect.Indirect(reflect.ValueOf(opt.Value)).Kind() {
+		case reflect.Bool:
+			flags.BoolP(opt.Argument, opt.Shorthand, false, "")
+		case reflect.Int, reflect.Int32, reflect.Int64:
+			flags.Int64P(opt.Argument, opt.Shorthand, 0, "")
+		case reflect.Uint, reflect.Uint32, reflect.Uint64:
+			flags.Uint64P(opt.Argument, opt.Shorthand, 0, "")
+		case reflect.Float32, reflect.Float64:
+			flags.Float64P(opt.Argument, opt.Shorthand, 0, "")
+		case reflect.Map:
+			flags.StringToStringP(opt.Argument, opt.Shorthand, nil, "")
+		case reflect.Slice:
+			flags.StringSliceP(opt.Argument, opt.Shorthand, nil, "")
+		default:
+			flags.StringP(opt.Argument, opt.Shorthand, "", "")
+		}
+	}
+	// Like cobra, -h is only the shorthand for --help if it is not taken.
+	if flags.ShorthandLookup("h") == nil {
+		flags.BoolP("help", "h", false, "")
+	} else {
+		flags.Bool("help", false, "")
+	}
+
+	err := flags.Parse(args)
+	if err == pflag.ErrHelp {
+		return unknownAsCritical, nil
+	}
+	// Parsing stops at the first invalid flag, so --unknown-as-critical is
+	// looked for in the remaining arguments too.
+	for _, arg := range args {
+		switch {
+		case arg == "--":
+			return unknownAsCritical, err
+		case arg == "--"+argument:
+			unknownAsCritical = true
+		case strings.HasPrefix(arg, "--"+argument+"="):
+			unknownAsCritical, _ = strconv.ParseBool(strings.TrimPrefix(arg, "--"+argument+"="))
+		}
+	}
+	return unknownAsCritical, err
+}
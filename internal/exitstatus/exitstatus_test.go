@@ -0,0 +1,140 @@
+package exitstatus
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"testing"
+
+	corev2 "github.com/sensu/sensu-go/api/core/v2"
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWrap(t *testing.T) {
+	assert := assert.New(t)
+	event := corev2.FixtureEvent("entity1", "check")
+	check := func(status int, err error) func(*corev2.Event) (int, error) {
+		return func(*corev2.Event) (int, error) {
+			return status, err
+		}
+	}
+	called := false
+	execute := func(*corev2.Event) (int, error) {
+		called = true
+		return sensu.CheckStateOK, nil
+	}
+
+	var c Config
+	status, err := c.Wrap("test", check(sensu.CheckStateCritical, nil))(event)
+	assert.NoError(err)
+	assert.Equal(sensu.CheckStateCritical, status)
+	status, _ = c.Wrap("test", check(sensu.CheckStateUnknown, nil))(event)
+	assert.Equal(sensu.CheckStateUnknown, status)
+	status, err = c.Wrap("test", check(sensu.CheckStateWarning, fmt.Errorf("--url is required")))(event)
+	assert.NoError(err)
+	assert.Equal(sensu.CheckStateUnknown, status)
+	// Once a wrapped function failed the next ones are not called.
+	status, err = c.Wrap("test", execute)(event)
+	assert.NoError(err)
+	assert.Equal(sensu.CheckStateUnknown, status)
+	assert.False(called)
+
+	c = Config{UnknownAsCritical: true}
+	status, _ = c.Wrap("test", check(sensu.CheckStateUnknown, nil))(event)
+	assert.Equal(sensu.CheckStateCritical, status)
+	status, _ = c.Wrap("test", check(sensu.CheckStateWarning, nil))(event)
+	assert.Equal(sensu.CheckStateWarning, status)
+	status, err = c.Wrap("test", check(sensu.CheckStateWarning, fmt.Errorf("--url is required")))(event)
+	assert.NoError(err)
+	assert.Equal(sensu.CheckStateCritical, status)
+	status, _ = c.Wrap("test", execute)(event)
+	assert.Equal(sensu.CheckStateCritical, status)
+	assert.False(called)
+}
+
+// TestWrapOutput runs a check with an invalid configuration in a child
+// process, as the plugin SDK exits, and checks that its output is the single
+// UNKNOWN line, without the usage and error the SDK prints for errors.
+func TestWrapOutput(t *testing.T) {
+	if os.Getenv("EXITSTATUS_TEST_CHECK") == "1" {
+		var c Config
+		os.Args = []string{"test"}
+		checkArgs := func(*corev2.Event) (int, error) {
+			return sensu.CheckStateWarning, fmt.Errorf("--url is required")
+		}
+		executeCheck := func(*corev2.Event) (int, error) {
+			fmt.Println("test OK: executed")
+			return sensu.CheckStateOK, nil
+		}
+		sensu.NewGoCheck(&sensu.PluginConfig{Name: "test"}, nil, c.Wrap("test", checkArgs), c.Wrap("test", executeCheck), false).Execute()
+		return
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestWrapOutput$")
+	cmd.Env = append(os.Environ(), "EXITSTATUS_TEST_CHECK=1")
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err := cmd.Run()
+	exitErr, ok := err.(*exec.ExitError)
+	require.True(t, ok, err)
+	assert.Equal(t, sensu.CheckStateUnknown, exitErr.ExitCode())
+	assert.Equal(t, "test UNKNOWN: --url is required\n", stdout.String())
+	assert.Empty(t, stderr.String())
+}
+
+func TestParseFlags(t *testing.T) {
+	assert := assert.New(t)
+	os.Unsetenv(env)
+	var (
+		url     string
+		timeout int
+		headers []string
+		c       Config
+	)
+	options := []*sensu.PluginConfigOption{
+		{Argument: "url", Shorthand: "u", Default: "", Value: &url},
+		{Argument: "timeout", Shorthand: "T", Default: 15, Value: &timeout},
+		{Argument: "header", Shorthand: "H", Default: []string{}, Value: &headers},
+	}
+	options = append(options, c.Options()...)
+
+	_, err := parseFlags(options, []string{"-u", "http://localhost", "--timeout", "5", "-H", "A: b"})
+	assert.NoError(err)
+	_, err = parseFlags(options, []string{"--help"})
+	assert.NoError(err)
+	_, err = parseFlags(options, []string{"version"})
+	assert.NoError(err)
+
+	unknownAsCritical, err := parseFlags(options, []string{"--bogus"})
+	assert.Error(err)
+	assert.False(unknownAsCritical)
+	unknownAsCritical, err = parseFlags(options, []string{"--timeout", "x", "--unknown-as-critical"})
+	assert.Error(err)
+	assert.True(unknownAsCritical)
+	unknownAsCritical, err = parseFlags(options, []string{"--unknown-as-critical=false", "-x"})
+	assert.Error(err)
+	assert.False(unknownAsCritical)
+
+	os.Setenv(env, "true")
+	defer os.Unsetenv(env)
+	unknownAsCritical, err = parseFlags(options, []string{"--bogus"})
+	assert.Error(err)
+	assert.True(unknownAsCritical)
+}
+
+func TestParseFlagsExit(t *testing.T) {
+	os.Unsetenv(env)
+	defer func() { exit = os.Exit }()
+	var code int
+	exit = func(c int) { code = c }
+
+	var c Config
+	options := c.Options()
+	ParseFlags("test", options, []string{"--bogus"})
+	assert.Equal(t, sensu.CheckStateUnknown, code)
+	ParseFlags("test", options, []string{"--bogus", "--unknown-as-critical"})
+	assert.Equal(t, sensu.CheckStateCritical, code)
+}
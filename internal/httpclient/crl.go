@@ -0,0 +1,132 @@
+package httpclient
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/nixwiz/http-checks/internal/logging"
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+)
+
+// maxCRLSize is the largest CRL downloaded, CRLs of large public CAs are a
+// few megabytes.
+const maxCRLSize = 32 << 20
+
+// CRLConfig holds the settings for checking the certificate revocation lists
+// (CRL) referenced by the chain a server presents. With internal PKI an
+// expired or unreachable CRL makes clients checking revocation fail, while
+// the certificates themselves look fine.
+type CRLConfig struct {
+	Check bool
+}
+
+// Options returns the plugin config options for c, to be appended to the
+// options of a check.
+func (c *CRLConfig) Options() []*sensu.PluginConfigOption {
+	return []*sensu.PluginConfigOption{
+		{
+			Path:     "check-crl",
+			Env:      "",
+			Argument: "check-crl",
+			Default:  false,
+			Usage:    "Download the CRLs referenced by the certificate chain and alert if one is unreachable, expired, not signed by its issuer or revokes a certificate of the chain",
+			Value:    &c.Check,
+		},
+	}
+}
+
+// Enabled reports whether the CRLs are to be checked.
+func (c *CRLConfig) Enabled() bool {
+	return c.Check
+}
+
+// Problems downloads the CRLs of the http and https distribution points of
+// certs, the chain presented by a server, with client and returns the
+// problems found with them at now. The issuers of the CRLs are taken from the
+// chain verified with roots, or from certs if it does not verify, a CRL
+// without a known issuer is checked for all but its signature. Each CRL is
+// downloaded once even if referenced by several certificates.
+func (c *CRLConfig) Problems(client *http.Client, certs []*x509.Certificate, roots *x509.CertPool, now time.Time) []string {
+	if len(certs) == 0 {
+		return nil
+	}
+	chain := certs
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	if chains, err := certs[0].Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates, CurrentTime: now}); err == nil && len(chains) > 0 {
+		chain = chains[0]
+	}
+
+	problems := []string{}
+	crls := map[string]*pkix.CertificateList{}
+	for i, cert := range chain {
+		var issuer *x509.Certificate
+		if i+1 < len(chain) {
+			issuer = chain[i+1]
+		}
+		for _, point := range cert.CRLDistributionPoints {
+			if !strings.HasPrefix(point, "http://") && !strings.HasPrefix(point, "https://") {
+				logging.Debug("skipping CRL distribution point", "url", point, "certificate", cert.Subject.CommonName)
+				continue
+			}
+			crl, seen := crls[point]
+			if !seen {
+				var err error
+				crl, err = fetchCRL(client, point)
+				if err != nil {
+					problems = append(problems, fmt.Sprintf("CRL %s is unreachable: %s", point, err))
+				}
+				crls[point] = crl
+			}
+			if crl == nil {
+				continue
+			}
+			if issuer != nil && !seen {
+				if err := issuer.CheckCRLSignature(crl); err != nil {
+					problems = append(problems, fmt.Sprintf("CRL %s is not signed by %q: %v", point, issuer.Subject.CommonName, err))
+				}
+			}
+			if !seen && crl.HasExpired(now) {
+				problems = append(problems, fmt.Sprintf("CRL %s expired on %s", point, crl.TBSCertList.NextUpdate.UTC().Format(time.RFC3339)))
+			}
+			for _, revoked := range crl.TBSCertList.RevokedCertificates {
+				if revoked.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+					problems = append(problems, fmt.Sprintf("certificate %q is revoked since %s according to CRL %s", cert.Subject.CommonName, revoked.RevocationTime.UTC().Format(time.RFC3339), point))
+				}
+			}
+		}
+	}
+	return problems
+}
+
+// fetchCRL downloads and parses the CRL at rawURL, in DER or PEM format.
+func fetchCRL(client *http.Client, rawURL string) (*pkix.CertificateList, error) {
+	resp, err := client.Get(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("%s", Describe(err))
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP Status %d", resp.StatusCode)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxCRLSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxCRLSize {
+		return nil, fmt.Errorf("larger than %d MiB", maxCRLSize>>20)
+	}
+	crl, err := x509.ParseCRL(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CRL: %v", err)
+	}
+	return crl, nil
+}
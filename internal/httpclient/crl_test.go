@@ -0,0 +1,109 @@
+package httpclient
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCRLProblems(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Now()
+
+	newCA := func(name string) (*x509.Certificate, *ecdsa.PrivateKey) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.NoError(t, err)
+		template := &x509.Certificate{
+			SerialNumber:          big.NewInt(1),
+			Subject:               pkix.Name{CommonName: name},
+			NotBefore:             now.Add(-time.Hour),
+			NotAfter:              now.Add(24 * time.Hour),
+			IsCA:                  true,
+			BasicConstraintsValid: true,
+			KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+		require.NoError(t, err)
+		cert, err := x509.ParseCertificate(der)
+		require.NoError(t, err)
+		return cert, key
+	}
+	ca, caKey := newCA("Test CA")
+	other, otherKey := newCA("Other CA")
+
+	crls := map[string][]byte{}
+	var server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		crl, ok := crls[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write(crl)
+	}))
+	defer server.Close()
+
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber:          big.NewInt(42),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(24 * time.Hour),
+		CRLDistributionPoints: []string{server.URL + "/ca.crl", "ldap://ldap.example.com/cn=Test%20CA"},
+	}, ca, &leafKey.PublicKey, caKey)
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	newCRL := func(issuer *x509.Certificate, key *ecdsa.PrivateKey, nextUpdate time.Time, revoked ...int64) []byte {
+		entries := []pkix.RevokedCertificate{}
+		for _, serial := range revoked {
+			entries = append(entries, pkix.RevokedCertificate{SerialNumber: big.NewInt(serial), RevocationTime: now.Add(-time.Minute)})
+		}
+		crl, err := issuer.CreateCRL(rand.Reader, key, entries, now.Add(-time.Hour), nextUpdate)
+		require.NoError(t, err)
+		return crl
+	}
+
+	config := CRLConfig{Check: true}
+	client := New(&tls.Config{}, 5*time.Second, true)
+	for _, tc := range []struct {
+		name     string
+		crl      []byte
+		problems []string
+	}{
+		{"valid", newCRL(ca, caKey, now.Add(time.Hour), 7), []string{}},
+		{"revoked", newCRL(ca, caKey, now.Add(time.Hour), 42), []string{"certificate \"localhost\" is revoked since "}},
+		{"expired", newCRL(ca, caKey, now.Add(-time.Minute)), []string{"CRL " + server.URL + "/ca.crl expired on "}},
+		{"wrong issuer", newCRL(other, otherKey, now.Add(time.Hour)), []string{"CRL " + server.URL + "/ca.crl is not signed by \"Test CA\""}},
+		{"unreachable", nil, []string{"CRL " + server.URL + "/ca.crl is unreachable: HTTP Status 404"}},
+	} {
+		delete(crls, "/ca.crl")
+		if tc.crl != nil {
+			crls["/ca.crl"] = tc.crl
+		}
+		problems := config.Problems(client, []*x509.Certificate{leaf}, roots, now)
+		require.Len(t, problems, len(tc.problems), tc.name)
+		for i, problem := range tc.problems {
+			assert.Contains(problems[i], problem, tc.name)
+		}
+	}
+
+	// Without the issuer all but the signature is checked.
+	crls["/ca.crl"] = newCRL(ca, caKey, now.Add(time.Hour), 42)
+	problems := config.Problems(client, []*x509.Certificate{leaf}, x509.NewCertPool(), now)
+	assert.Len(problems, 1)
+}
@@ -0,0 +1,130 @@
+package httpclient
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"syscall"
+
+	"github.com/nixwiz/http-checks/internal/selfmetrics"
+)
+
+// Describe returns a single line, human readable reason for a failed request.
+// Timeouts, refused and reset connections, unreachable hosts, failed DNS
+// lookups and TLS certificate verification failures each get their own
+// message, anything else is returned as is. The error is also counted for
+// --error-metrics, see Classify.
+func Describe(err error) string {
+	if err == nil {
+		return ""
+	}
+	selfmetrics.AddError(Classify(err))
+
+	target := ""
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		target = urlErr.URL
+		if u, parseErr := url.Parse(urlErr.URL); parseErr == nil && len(u.Host) > 0 {
+			target = u.Host
+		}
+	}
+	on := func(format string) string {
+		if len(target) == 0 {
+			return format
+		}
+		return fmt.Sprintf("%s (%s)", format, target)
+	}
+
+	var deniedErr *DeniedAddressError
+	if errors.As(err, &deniedErr) {
+		return deniedErr.Error()
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		if dnsErr.IsNotFound || dnsErr.Err == "no such host" {
+			return fmt.Sprintf("DNS lookup failed: no such host %s", dnsErr.Name)
+		}
+		if dnsErr.IsTimeout {
+			return fmt.Sprintf("DNS lookup of %s timed out", dnsErr.Name)
+		}
+		return fmt.Sprintf("DNS lookup of %s failed: %s", dnsErr.Name, dnsErr.Err)
+	}
+
+	var unknownAuthority x509.UnknownAuthorityError
+	if errors.As(err, &unknownAuthority) {
+		return on("TLS verification failed: certificate signed by unknown authority")
+	}
+	var hostnameErr x509.HostnameError
+	if errors.As(err, &hostnameErr) {
+		return on(fmt.Sprintf("TLS verification failed: certificate is not valid for %s", hostnameErr.Host))
+	}
+	var invalidErr x509.CertificateInvalidError
+	if errors.As(err, &invalidErr) {
+		return on(fmt.Sprintf("TLS verification failed: %s", invalidErr.Error()))
+	}
+
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return on("connection refused")
+	}
+	if errors.Is(err, syscall.ECONNRESET) {
+		return on("connection reset by peer")
+	}
+	if errors.Is(err, syscall.EHOSTUNREACH) || errors.Is(err, syscall.ENETUNREACH) {
+		return on("host unreachable")
+	}
+
+	var netErr net.Error
+	var opErr *net.OpError
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		switch {
+		case errors.As(err, &opErr) && opErr.Op == "dial":
+			return on("connect timed out")
+		case strings.Contains(err.Error(), "TLS handshake timeout"):
+			return on("TLS handshake timed out")
+		case strings.Contains(err.Error(), "timeout awaiting response headers"):
+			return on("timed out awaiting response headers")
+		}
+	}
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return on("request timed out")
+	}
+
+	return err.Error()
+}
+
+// Classify returns the category of the transport error err, one of the
+// selfmetrics error categories, or "" if it is none of them.
+func Classify(err error) string {
+	if err == nil {
+		return ""
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return selfmetrics.DNSFailure
+	}
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	var recordErr tls.RecordHeaderError
+	if errors.As(err, &unknownAuthority) || errors.As(err, &hostnameErr) || errors.As(err, &invalidErr) ||
+		errors.As(err, &recordErr) || strings.Contains(err.Error(), "tls: ") {
+		return selfmetrics.TLSFailure
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return selfmetrics.ConnRefused
+	}
+	if errors.Is(err, syscall.EHOSTUNREACH) || errors.Is(err, syscall.ENETUNREACH) {
+		return selfmetrics.HostUnreachable
+	}
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return selfmetrics.Timeout
+	}
+	return ""
+}
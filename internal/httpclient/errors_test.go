@@ -0,0 +1,83 @@
+package httpclient
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/nixwiz/http-checks/internal/selfmetrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDescribe(t *testing.T) {
+	assert := assert.New(t)
+
+	var test = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(500 * time.Millisecond)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer test.Close()
+	host := strings.TrimPrefix(test.URL, "https://")
+
+	_, err := New(&tls.Config{}, 5*time.Second, true).Get(test.URL)
+	require.Error(t, err)
+	assert.Equal("TLS verification failed: certificate signed by unknown authority ("+host+")", Describe(err))
+
+	_, err = New(&tls.Config{InsecureSkipVerify: true}, 100*time.Millisecond, true).Get(test.URL + "/slow")
+	require.Error(t, err)
+	assert.Equal("request timed out ("+host+")", Describe(err))
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	closed := listener.Addr().String()
+	listener.Close()
+	_, err = New(&tls.Config{}, 5*time.Second, true).Get("http://" + closed)
+	require.Error(t, err)
+	assert.Equal("connection refused ("+closed+")", Describe(err))
+
+	err = &url.Error{Op: "Get", URL: "https://www.example.invalid/", Err: &net.OpError{Op: "dial", Net: "tcp",
+		Err: &net.DNSError{Err: "no such host", Name: "www.example.invalid", IsNotFound: true}}}
+	assert.Equal("DNS lookup failed: no such host www.example.invalid", Describe(err))
+
+	assert.Equal("something else", Describe(errors.New("something else")))
+	assert.Equal("", Describe(nil))
+}
+
+func TestClassify(t *testing.T) {
+	assert := assert.New(t)
+
+	var test = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(500 * time.Millisecond)
+	}))
+	defer test.Close()
+
+	_, err := New(&tls.Config{}, 5*time.Second, true).Get(test.URL)
+	assert.Equal(selfmetrics.TLSFailure, Classify(err))
+	_, err = New(&tls.Config{InsecureSkipVerify: true}, 100*time.Millisecond, true).Get(test.URL)
+	assert.Equal(selfmetrics.Timeout, Classify(err))
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	closed := listener.Addr().String()
+	listener.Close()
+	_, err = New(&tls.Config{}, 5*time.Second, true).Get("http://" + closed)
+	assert.Equal(selfmetrics.ConnRefused, Classify(err))
+
+	assert.Equal(selfmetrics.DNSFailure, Classify(&url.Error{Op: "Get", URL: "https://www.example.invalid/", Err: &net.OpError{Op: "dial", Net: "tcp",
+		Err: &net.DNSError{Err: "no such host", Name: "www.example.invalid", IsNotFound: true}}}))
+	assert.Equal(selfmetrics.HostUnreachable, Classify(&url.Error{Op: "Get", URL: "http://192.0.2.1/", Err: &net.OpError{Op: "dial", Net: "tcp",
+		Err: &os.SyscallError{Syscall: "connect", Err: syscall.EHOSTUNREACH}}}))
+	assert.Equal("", Classify(errors.New("something else")))
+	assert.Equal("", Classify(nil))
+}
@@ -0,0 +1,318 @@
+package httpclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RegisterFileSchemes makes transport fetch ftp, ftps and file URLs as well,
+// read only, it is meant to be passed as an option to New or NewTransport.
+// Their responses are made to look like those of an HTTP server: 200 with
+// Content-Length and Last-Modified when available, 304 for a conditional
+// request of a file not modified since, 404 for a missing file and 401 for a
+// failed login.
+//
+// ftps is implicit FTPS, TLS from the start on port 990 by default, as with
+// curl. FTP connections are made with the DialContext of transport, so the
+// source address and resolver settings apply, proxies are not used. file URLs
+// name absolute paths on the host the check runs on.
+func RegisterFileSchemes(transport *http.Transport) {
+	ftp := &ftpTransport{transport: transport}
+	transport.RegisterProtocol("ftp", ftp)
+	transport.RegisterProtocol("ftps", ftp)
+	transport.RegisterProtocol("file", http.NewFileTransport(http.Dir("/")))
+}
+
+type ftpTransport struct {
+	transport *http.Transport
+}
+
+func (t *ftpTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return nil, fmt.Errorf("%s requests are not supported for %s URLs", req.Method, req.URL.Scheme)
+	}
+	ctx := req.Context()
+	host := req.URL.Host
+	if len(req.URL.Port()) == 0 {
+		port := "21"
+		if req.URL.Scheme == "ftps" {
+			port = "990"
+		}
+		host = net.JoinHostPort(req.URL.Hostname(), port)
+	}
+
+	conn, err := t.dial(ctx, req, host)
+	if err != nil {
+		return nil, err
+	}
+	c := &ftpConn{conn: conn, text: textproto.NewConn(conn)}
+	// The connections are closed when the request is canceled or times
+	// out, which unblocks any read or write on them.
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.close()
+		case <-done:
+		}
+	}()
+	resp, err := t.retrieve(ctx, req, c, host)
+	if err != nil || c.data == nil {
+		close(done)
+		c.close()
+		if err != nil && ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return resp, err
+	}
+	resp.Body = &ftpBody{ReadCloser: resp.Body, conn: c, done: done}
+	return resp, nil
+}
+
+// dial connects to host, with TLS for ftps URLs.
+func (t *ftpTransport) dial(ctx context.Context, req *http.Request, host string) (net.Conn, error) {
+	dial := t.transport.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{Timeout: 30 * time.Second}).DialContext
+	}
+	conn, err := dial(ctx, "tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	if req.URL.Scheme != "ftps" {
+		return conn, nil
+	}
+	config := &tls.Config{}
+	if t.transport.TLSClientConfig != nil {
+		config = t.transport.TLSClientConfig.Clone()
+	}
+	if len(config.ServerName) == 0 {
+		config.ServerName = req.URL.Hostname()
+	}
+	// Servers commonly require the data connections to resume the TLS
+	// session of the control connection.
+	if config.ClientSessionCache == nil {
+		config.ClientSessionCache = tls.NewLRUClientSessionCache(1)
+	}
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// retrieve logs in and starts the transfer of the file of req.
+func (t *ftpTransport) retrieve(ctx context.Context, req *http.Request, c *ftpConn, host string) (*http.Response, error) {
+	if _, _, err := c.text.ReadResponse(220); err != nil {
+		return nil, err
+	}
+
+	user, password, ok := req.BasicAuth()
+	if !ok {
+		user, password = "anonymous", "anonymous@"
+	}
+	code, msg, err := c.cmd(0, "USER %s", user)
+	if err != nil {
+		return nil, err
+	}
+	if code == 331 {
+		code, msg, err = c.cmd(0, "PASS %s", password)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if code == 530 {
+		return response(req, http.StatusUnauthorized, msg), nil
+	}
+	if code != 230 {
+		return nil, fmt.Errorf("ftp login failed: %d %s", code, msg)
+	}
+	if req.URL.Scheme == "ftps" {
+		if _, _, err := c.cmd(200, "PBSZ 0"); err != nil {
+			return nil, err
+		}
+		if _, _, err := c.cmd(200, "PROT P"); err != nil {
+			return nil, err
+		}
+	}
+	if _, _, err := c.cmd(200, "TYPE I"); err != nil {
+		return nil, err
+	}
+
+	path := req.URL.Path
+	header := http.Header{}
+	var size int64 = -1
+	if code, msg, err := c.cmd(0, "SIZE %s", path); err != nil {
+		return nil, err
+	} else if code == 213 {
+		size, _ = strconv.ParseInt(strings.TrimSpace(msg), 10, 64)
+	} else if code == 550 {
+		return response(req, http.StatusNotFound, msg), nil
+	}
+	if size >= 0 {
+		header.Set("Content-Length", strconv.FormatInt(size, 10))
+	}
+	if code, msg, err := c.cmd(0, "MDTM %s", path); err != nil {
+		return nil, err
+	} else if msg = strings.TrimSpace(msg); code == 213 && len(msg) >= 14 {
+		// Fractions of a second, as in 20201231235959.123, are ignored.
+		if modified, err := time.Parse("20060102150405", msg[:14]); err == nil {
+			header.Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+			if since, err := http.ParseTime(req.Header.Get("If-Modified-Since")); err == nil && !modified.Truncate(time.Second).After(since) {
+				resp := response(req, http.StatusNotModified, "")
+				resp.Header = header
+				return resp, nil
+			}
+		}
+	}
+	if req.Method == http.MethodHead {
+		resp := response(req, http.StatusOK, "")
+		resp.Header = header
+		resp.ContentLength = size
+		return resp, nil
+	}
+
+	data, err := c.passive(ctx, t, req, host)
+	if err != nil {
+		return nil, err
+	}
+	code, msg, err = c.cmd(0, "RETR %s", path)
+	if err != nil {
+		data.Close()
+		return nil, err
+	}
+	switch {
+	case code == 550:
+		data.Close()
+		return response(req, http.StatusNotFound, msg), nil
+	case code != 125 && code != 150:
+		data.Close()
+		return nil, fmt.Errorf("ftp RETR failed: %d %s", code, msg)
+	}
+	c.data = data
+	resp := response(req, http.StatusOK, "")
+	resp.Header = header
+	resp.ContentLength = size
+	resp.Body = data
+	return resp, nil
+}
+
+// response returns a response to req with status and body.
+func response(req *http.Request, status int, body string) *http.Response {
+	resp := &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{},
+		Body:          http.NoBody,
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+	if len(body) > 0 {
+		resp.Header.Set("Content-Type", "text/plain; charset=utf-8")
+		resp.Body = ioutil.NopCloser(bytes.NewReader([]byte(body)))
+	}
+	return resp
+}
+
+// ftpConn is the control connection of an FTP session, and its data
+// connection once a transfer started.
+type ftpConn struct {
+	conn net.Conn
+	text *textproto.Conn
+	data net.Conn
+}
+
+// cmd sends a command and reads its reply, which must have code expect
+// unless expect is 0.
+func (c *ftpConn) cmd(expect int, format string, args ...interface{}) (int, string, error) {
+	if err := c.text.PrintfLine(format, args...); err != nil {
+		return 0, "", err
+	}
+	code, msg, err := c.text.ReadResponse(expect)
+	if err != nil {
+		return code, msg, fmt.Errorf("ftp %s: %v", strings.Fields(format)[0], err)
+	}
+	return code, msg, nil
+}
+
+// passive opens a data connection, with EPSV or, if the server does not
+// support it, PASV. The address in the PASV reply is ignored in favor of
+// that of the control connection, as it is often wrong behind NAT.
+func (c *ftpConn) passive(ctx context.Context, t *ftpTransport, req *http.Request, host string) (net.Conn, error) {
+	var port string
+	code, msg, err := c.cmd(0, "EPSV")
+	if err != nil {
+		return nil, err
+	}
+	if code == 229 {
+		start, end := strings.Index(msg, "(|||"), strings.LastIndex(msg, "|)")
+		if start < 0 || end < start {
+			return nil, fmt.Errorf("ftp EPSV: malformed reply %q", msg)
+		}
+		port = msg[start+len("(|||") : end]
+	} else {
+		code, msg, err = c.cmd(227, "PASV")
+		if err != nil {
+			return nil, err
+		}
+		start, end := strings.Index(msg, "("), strings.LastIndex(msg, ")")
+		fields := []string{}
+		if start >= 0 && end > start {
+			fields = strings.Split(msg[start+1:end], ",")
+		}
+		if len(fields) != 6 {
+			return nil, fmt.Errorf("ftp PASV: malformed reply %q", msg)
+		}
+		p1, err1 := strconv.Atoi(strings.TrimSpace(fields[4]))
+		p2, err2 := strconv.Atoi(strings.TrimSpace(fields[5]))
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("ftp PASV: malformed reply %q", msg)
+		}
+		port = strconv.Itoa(p1<<8 | p2)
+	}
+	controlHost, _, _ := net.SplitHostPort(host)
+	return t.dial(ctx, req, net.JoinHostPort(controlHost, port))
+}
+
+func (c *ftpConn) close() {
+	if c.data != nil {
+		c.data.Close()
+	}
+	c.conn.Close()
+}
+
+// ftpBody is the body of a file being retrieved, closing it ends the
+// session.
+type ftpBody struct {
+	io.ReadCloser
+	conn *ftpConn
+	done chan struct{}
+}
+
+func (b *ftpBody) Close() error {
+	b.ReadCloser.Close()
+	// The transfer complete reply and QUIT are a courtesy to the server,
+	// their errors do not matter once the body was read.
+	_, _, _ = b.conn.text.ReadResponse(0)
+	_ = b.conn.text.PrintfLine("QUIT")
+	close(b.done)
+	b.conn.close()
+	return nil
+}
@@ -0,0 +1,184 @@
+package httpclient
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// ftpServer is a minimal FTP server serving files from memory, with passive
+// mode only.
+type ftpServer struct {
+	listener net.Listener
+	files    map[string]string
+	modified time.Time
+	epsv     bool
+}
+
+func newFTPServer(t *testing.T, files map[string]string, epsv bool) *ftpServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := &ftpServer{listener: listener, files: files, modified: time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC), epsv: epsv}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *ftpServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(format string, args ...interface{}) {
+		_, _ = fmt.Fprintf(conn, format+"\r\n", args...)
+	}
+	var data net.Listener
+	reply("220-test server\r\n220 ready")
+	user := ""
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.SplitN(strings.TrimSpace(line), " ", 2)
+		arg := ""
+		if len(fields) > 1 {
+			arg = fields[1]
+		}
+		switch fields[0] {
+		case "USER":
+			user = arg
+			reply("331 password required")
+		case "PASS":
+			if user == "sensu" && arg != "s3cret" {
+				reply("530 login incorrect")
+				continue
+			}
+			reply("230 logged in")
+		case "TYPE":
+			reply("200 binary")
+		case "SIZE", "MDTM", "RETR":
+			content, ok := s.files[arg]
+			if !ok {
+				reply("550 %s: no such file", arg)
+				continue
+			}
+			switch fields[0] {
+			case "SIZE":
+				reply("213 %d", len(content))
+			case "MDTM":
+				reply("213 %s", s.modified.Format("20060102150405"))
+			case "RETR":
+				reply("150 opening data connection")
+				dataConn, err := data.Accept()
+				if err != nil {
+					return
+				}
+				_, _ = dataConn.Write([]byte(content))
+				dataConn.Close()
+				data.Close()
+				reply("226 transfer complete")
+			}
+		case "EPSV", "PASV":
+			if fields[0] == "EPSV" && !s.epsv {
+				reply("500 not understood")
+				continue
+			}
+			data, _ = net.Listen("tcp", "127.0.0.1:0")
+			port := data.Addr().(*net.TCPAddr).Port
+			if fields[0] == "EPSV" {
+				reply("229 entering extended passive mode (|||%d|)", port)
+			} else {
+				// A wrong address, as sent by servers behind NAT.
+				reply("227 entering passive mode (10,0,0,1,%d,%d)", port>>8, port&0xff)
+			}
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 not implemented")
+		}
+	}
+}
+
+func TestFTP(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, epsv := range []bool{true, false} {
+		server := newFTPServer(t, map[string]string{"/feeds/prices.csv": "sku,price\nA1,9.99\n"}, epsv)
+		defer server.listener.Close()
+		client := New(&tls.Config{}, 5*time.Second, true, RegisterFileSchemes)
+		base := "ftp://" + server.listener.Addr().String()
+
+		resp, err := client.Get(base + "/feeds/prices.csv")
+		require.NoError(t, err)
+		body, err := ioutil.ReadAll(resp.Body)
+		assert.NoError(err)
+		resp.Body.Close()
+		assert.Equal(http.StatusOK, resp.StatusCode)
+		assert.Equal("sku,price\nA1,9.99\n", string(body))
+		assert.Equal("Thu, 04 Mar 2021 05:06:07 GMT", resp.Header.Get("Last-Modified"))
+		assert.Equal(int64(len(body)), resp.ContentLength)
+
+		req, _ := http.NewRequest(http.MethodGet, base+"/feeds/prices.csv", nil)
+		req.Header.Set("If-Modified-Since", "Thu, 04 Mar 2021 05:06:07 GMT")
+		resp, err = client.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(http.StatusNotModified, resp.StatusCode)
+
+		resp, err = client.Get(base + "/feeds/missing.csv")
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(http.StatusNotFound, resp.StatusCode)
+
+		req, _ = http.NewRequest(http.MethodGet, base+"/feeds/prices.csv", nil)
+		req.SetBasicAuth("sensu", "wrong")
+		resp, err = client.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(http.StatusUnauthorized, resp.StatusCode)
+
+		_, err = client.Post(base+"/feeds/prices.csv", "text/plain", strings.NewReader("x"))
+		assert.Error(err)
+	}
+}
+
+func TestFileScheme(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "httpclient-file")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "status.txt")
+	require.NoError(t, ioutil.WriteFile(path, []byte("ok\n"), 0644))
+
+	client := New(&tls.Config{}, 5*time.Second, true, RegisterFileSchemes)
+	resp, err := client.Get("file://" + filepath.ToSlash(path))
+	require.NoError(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.Equal("ok\n", string(body))
+	assert.NotEmpty(resp.Header.Get("Last-Modified"))
+
+	resp, err = client.Get("file://" + filepath.ToSlash(filepath.Join(dir, "missing.txt")))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(http.StatusNotFound, resp.StatusCode)
+}
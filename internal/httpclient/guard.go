@@ -0,0 +1,250 @@
+package httpclient
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+)
+
+// privateNetworks are the networks refused by --deny-private-networks:
+// loopback, link-local (including the 169.254.169.254 metadata service of
+// most clouds), RFC 1918, shared address space (including the 100.100.100.200
+// metadata service of Alibaba Cloud), unique local and unspecified addresses.
+var privateNetworks = func() []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range []string{
+		"0.0.0.0/8",
+		"10.0.0.0/8",
+		"100.64.0.0/10",
+		"127.0.0.0/8",
+		"169.254.0.0/16",
+		"172.16.0.0/12",
+		"192.168.0.0/16",
+		"::/128",
+		"::1/128",
+		"fc00::/7",
+		"fe80::/10",
+	} {
+		_, network, _ := net.ParseCIDR(cidr)
+		networks = append(networks, network)
+	}
+	return networks
+}()
+
+// GuardConfig holds the settings for refusing requests to private network
+// addresses, a safety net for checks of URLs from lists maintained by others
+// against entries such as http://169.254.169.254/.
+type GuardConfig struct {
+	DenyPrivateNetworks bool
+	AllowHostPatterns   []string
+	// Resolver is the resolver of the check, the hosts of requests sent
+	// through a proxy are resolved with it to be checked. The system resolver
+	// is used if nil.
+	Resolver *ResolverConfig
+
+	allowedNetworks []*net.IPNet
+}
+
+// Options returns the plugin config options for c, to be appended to the
+// options of a check.
+func (c *GuardConfig) Options() []*sensu.PluginConfigOption {
+	return []*sensu.PluginConfigOption{
+		{
+			Path:     "deny-private-networks",
+			Env:      "",
+			Argument: "deny-private-networks",
+			Default:  false,
+			Usage:    "Refuse to connect to loopback, link-local (e.g. cloud metadata), RFC 1918 and other private network addresses",
+			Value:    &c.DenyPrivateNetworks,
+		},
+		{
+			Path:     "allow-host-pattern",
+			Env:      "",
+			Argument: "allow-host-pattern",
+			Default:  []string{},
+			Usage:    "Host name glob (e.g. *.internal.example.com) or CIDR (e.g. 10.1.0.0/16) to allow despite --deny-private-networks, can be repeated",
+			Value:    &c.AllowHostPatterns,
+		},
+	}
+}
+
+// Validate checks the settings of c.
+func (c *GuardConfig) Validate() error {
+	c.allowedNetworks = nil
+	if len(c.AllowHostPatterns) > 0 && !c.DenyPrivateNetworks {
+		return fmt.Errorf("--allow-host-pattern requires --deny-private-networks")
+	}
+	for _, pattern := range c.AllowHostPatterns {
+		if strings.Contains(pattern, "/") {
+			_, network, err := net.ParseCIDR(pattern)
+			if err != nil {
+				return fmt.Errorf("--allow-host-pattern %q is not a valid CIDR", pattern)
+			}
+			c.allowedNetworks = append(c.allowedNetworks, network)
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil || len(pattern) == 0 {
+			return fmt.Errorf("--allow-host-pattern %q is not a valid pattern", pattern)
+		}
+	}
+	return nil
+}
+
+// Configure makes transport refuse connections to private network addresses
+// of hosts that are not allowed, it is meant to be passed as an option to New
+// or NewTransport after those setting its DialContext and proxy. Validate
+// must have been called first.
+//
+// IP addresses are checked before connecting to them. The address of a host
+// name is checked once connected, so that it is the one actually connected to
+// whatever the name resolves to, and the connection closed before anything is
+// sent over it. Through a proxy the host of each request is resolved with
+// Resolver and checked instead, and connections to the proxy itself are
+// allowed whatever its address, the proxy being configured by the check.
+func (c *GuardConfig) Configure(transport *http.Transport) {
+	if !c.DenyPrivateNetworks {
+		return
+	}
+	// The addresses of the proxies of the requests, recorded by the proxy
+	// function of transport before they are dialed.
+	var proxies sync.Map
+	if dial := transport.DialContext; dial != nil {
+		transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil || c.allowedHost(host) {
+				return dial(ctx, network, address)
+			}
+			if _, proxy := proxies.Load(address); proxy {
+				return dial(ctx, network, address)
+			}
+			if ip := net.ParseIP(host); ip != nil {
+				if err := c.check(host, ip); err != nil {
+					return nil, err
+				}
+				return dial(ctx, network, address)
+			}
+			conn, err := dial(ctx, network, address)
+			if err != nil {
+				return nil, err
+			}
+			if tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+				if err := c.check(host, tcpAddr.IP); err != nil {
+					conn.Close()
+					return nil, err
+				}
+			}
+			return conn, nil
+		}
+	}
+	if proxy := transport.Proxy; proxy != nil {
+		transport.Proxy = func(req *http.Request) (*url.URL, error) {
+			proxyURL, err := proxy(req)
+			if err != nil || proxyURL == nil {
+				return proxyURL, err
+			}
+			proxies.Store(proxyAddress(proxyURL), true)
+			host := req.URL.Hostname()
+			if c.allowedHost(host) {
+				return proxyURL, nil
+			}
+			ips, err := c.lookup(req.Context(), host)
+			if err != nil {
+				return nil, err
+			}
+			for _, ip := range ips {
+				if err := c.check(host, ip); err != nil {
+					return nil, err
+				}
+			}
+			return proxyURL, nil
+		}
+	}
+}
+
+// lookup returns the addresses of host, resolved with Resolver.
+func (c *GuardConfig) lookup(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	if c.Resolver == nil || c.Resolver.resolver == nil {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		ips := make([]net.IP, len(addrs))
+		for i, addr := range addrs {
+			ips[i] = addr.IP
+		}
+		return ips, err
+	}
+	addrs, err := c.Resolver.lookup(ctx, host)
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		if ip := net.ParseIP(addr); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips, err
+}
+
+// proxyAddress returns the address the transport dials for proxyURL, with
+// the default port of its scheme if it has none.
+func proxyAddress(proxyURL *url.URL) string {
+	if len(proxyURL.Port()) > 0 {
+		return proxyURL.Host
+	}
+	port := "80"
+	switch proxyURL.Scheme {
+	case "https":
+		port = "443"
+	case "socks5", "socks5h":
+		port = "1080"
+	}
+	return net.JoinHostPort(proxyURL.Hostname(), port)
+}
+
+// allowedHost returns whether host matches a host name pattern of
+// --allow-host-pattern.
+func (c *GuardConfig) allowedHost(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, pattern := range c.AllowHostPatterns {
+		if matched, _ := path.Match(strings.ToLower(pattern), host); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// check returns an error if ip, an address of host, is in a private network
+// and not in a network of --allow-host-pattern.
+func (c *GuardConfig) check(host string, ip net.IP) error {
+	for _, network := range c.allowedNetworks {
+		if network.Contains(ip) {
+			return nil
+		}
+	}
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return &DeniedAddressError{Host: host, IP: ip}
+		}
+	}
+	return nil
+}
+
+// DeniedAddressError is the error of a connection refused by
+// --deny-private-networks.
+type DeniedAddressError struct {
+	Host string
+	IP   net.IP
+}
+
+func (e *DeniedAddressError) Error() string {
+	if e.Host == e.IP.String() {
+		return fmt.Sprintf("refusing to connect to private network address %s, allow it with --allow-host-pattern", e.IP)
+	}
+	return fmt.Sprintf("refusing to connect to %s, private network address %s, allow it with --allow-host-pattern", e.Host, e.IP)
+}
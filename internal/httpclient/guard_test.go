@@ -0,0 +1,123 @@
+package httpclient
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGuardConfigValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	testCases := []struct {
+		config GuardConfig
+		valid  bool
+	}{
+		{GuardConfig{}, true},
+		{GuardConfig{DenyPrivateNetworks: true}, true},
+		{GuardConfig{DenyPrivateNetworks: true, AllowHostPatterns: []string{"*.internal.example.com", "10.1.0.0/16"}}, true},
+		{GuardConfig{AllowHostPatterns: []string{"localhost"}}, false},
+		{GuardConfig{DenyPrivateNetworks: true, AllowHostPatterns: []string{"10.1.0.0/33"}}, false},
+		{GuardConfig{DenyPrivateNetworks: true, AllowHostPatterns: []string{"[a-"}}, false},
+	}
+
+	for _, tc := range testCases {
+		err := tc.config.Validate()
+		if tc.valid {
+			assert.NoError(err, tc.config)
+		} else {
+			assert.Error(err, tc.config)
+		}
+	}
+}
+
+func TestGuardConfigConfigure(t *testing.T) {
+	assert := assert.New(t)
+
+	var test = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer test.Close()
+	u, err := url.Parse(test.URL)
+	require.NoError(t, err)
+	localhostURL := "http://localhost:" + u.Port() + "/"
+
+	get := func(config GuardConfig, target string) error {
+		require.NoError(t, config.Validate())
+		resp, err := New(nil, 5*time.Second, true, config.Configure).Get(target)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	assert.NoError(get(GuardConfig{}, test.URL))
+	err = get(GuardConfig{DenyPrivateNetworks: true}, test.URL)
+	var deniedErr *DeniedAddressError
+	require.True(t, errors.As(err, &deniedErr), err)
+	assert.Equal("refusing to connect to private network address 127.0.0.1, allow it with --allow-host-pattern", Describe(err))
+	err = get(GuardConfig{DenyPrivateNetworks: true}, localhostURL)
+	assert.True(errors.As(err, &deniedErr), err)
+	assert.True(strings.HasPrefix(Describe(err), "refusing to connect to localhost, private network address "), Describe(err))
+
+	assert.NoError(get(GuardConfig{DenyPrivateNetworks: true, AllowHostPatterns: []string{"127.0.0.0/8"}}, test.URL))
+	assert.NoError(get(GuardConfig{DenyPrivateNetworks: true, AllowHostPatterns: []string{"LOCAL*"}}, localhostURL))
+	assert.Error(get(GuardConfig{DenyPrivateNetworks: true, AllowHostPatterns: []string{"*.example.com"}}, localhostURL))
+
+	// Through a proxy the host of the request is checked.
+	proxy := GuardConfig{DenyPrivateNetworks: true}
+	require.NoError(t, proxy.Validate())
+	transport := NewTransport(nil, func(transport *http.Transport) {
+		transport.Proxy = http.ProxyURL(&url.URL{Scheme: "http", Host: u.Host})
+	}, proxy.Configure)
+	_, err = (&http.Client{Transport: transport}).Get("http://169.254.169.254/latest/meta-data/")
+	assert.True(errors.As(err, &deniedErr), err)
+
+	// While the proxy itself may be on a private network, and the host of the
+	// request is resolved with the resolver of the check.
+	var proxied string
+	var proxyServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = r.URL.String()
+	}))
+	defer proxyServer.Close()
+	proxyURL, err := url.Parse(proxyServer.URL)
+	require.NoError(t, err)
+	resolver := ResolverConfig{Server: "127.0.0.1:1"}
+	require.NoError(t, resolver.Validate())
+	proxy = GuardConfig{DenyPrivateNetworks: true, Resolver: &resolver}
+	require.NoError(t, proxy.Validate())
+	transport = NewTransport(nil, func(transport *http.Transport) {
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}, proxy.Configure)
+	client := &http.Client{Transport: transport, Timeout: 5 * time.Second}
+	resp, err := client.Get("http://93.184.216.34/status")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal("http://93.184.216.34/status", proxied)
+	_, err = client.Get("http://127.0.0.2/status")
+	assert.True(errors.As(err, &deniedErr), err)
+	_, err = client.Get("http://unresolvable.example.com/status")
+	assert.Error(err)
+	assert.False(errors.As(err, &deniedErr), err)
+	assert.Contains(err.Error(), "127.0.0.1:1")
+}
+
+func TestProxyAddress(t *testing.T) {
+	assert := assert.New(t)
+	for proxyURL, expected := range map[string]string{
+		"http://proxy.example.com":      "proxy.example.com:80",
+		"https://proxy.example.com":     "proxy.example.com:443",
+		"socks5://proxy.example.com":    "proxy.example.com:1080",
+		"http://proxy.example.com:3128": "proxy.example.com:3128",
+		"http://[::1]":                  "[::1]:80",
+	} {
+		u, err := url.Parse(proxyURL)
+		assert.NoError(err)
+		assert.Equal(expected, proxyAddress(u), proxyURL)
+	}
+}
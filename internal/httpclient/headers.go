@@ -0,0 +1,96 @@
+package httpclient
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/nixwiz/http-checks/internal/overrides"
+	corev2 "github.com/sensu/sensu-go/api/core/v2"
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+)
+
+// envReference is a ${NAME} reference to an environment variable in a
+// headers file.
+var envReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// HeadersFileConfig holds the settings for reading the headers of a check
+// from a file, for checks needing more headers (tracing, authentication,
+// tenancy) than are readable in a check definition.
+type HeadersFileConfig struct {
+	File string
+}
+
+// Options returns the plugin config options for c, to be appended to the
+// options of a check.
+func (c *HeadersFileConfig) Options() []*sensu.PluginConfigOption {
+	return []*sensu.PluginConfigOption{
+		{
+			Path:     "headers-file",
+			Env:      "",
+			Argument: "headers-file",
+			Default:  "",
+			Usage:    "File of additional headers to send, one \"Header-Name: Header Value\" per line, values may reference ${ENV_VARS} and entity tokens",
+			Value:    &c.File,
+		},
+	}
+}
+
+// Headers returns the headers of the file, as "Name: value" like those of
+// --header, with the ${NAME} environment variable references and entity
+// tokens (see overrides.SubstituteTokens) of their values substituted. Empty
+// lines and lines starting with # are skipped. They are meant to come before
+// those of --header, so that --header can override them.
+func (c *HeadersFileConfig) Headers(event *corev2.Event) ([]string, error) {
+	if len(c.File) == 0 {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(c.File)
+	if err != nil {
+		return nil, fmt.Errorf("--headers-file: %v", err)
+	}
+	headers := []string{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || len(strings.TrimSpace(parts[0])) == 0 {
+			return nil, fmt.Errorf("--headers-file %s line %d malformed should be \"Header-Name: Header Value\"", c.File, n)
+		}
+		flag := fmt.Sprintf("--headers-file %s line %d", c.File, n)
+		value, err := expandEnv(flag, parts[1])
+		if err != nil {
+			return nil, err
+		}
+		if value, err = overrides.SubstituteTokens(flag, value, event); err != nil {
+			return nil, err
+		}
+		headers = append(headers, strings.TrimSpace(parts[0])+": "+strings.TrimSpace(value))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("--headers-file: %v", err)
+	}
+	return headers, nil
+}
+
+// expandEnv substitutes the ${NAME} references of value, which must all be
+// set in the environment.
+func expandEnv(flag, value string) (string, error) {
+	var err error
+	expanded := envReference.ReplaceAllStringFunc(value, func(reference string) string {
+		name := envReference.FindStringSubmatch(reference)[1]
+		v, ok := os.LookupEnv(name)
+		if !ok && err == nil {
+			err = fmt.Errorf("%s references %s, which is not set", flag, name)
+		}
+		return v
+	})
+	return expanded, err
+}
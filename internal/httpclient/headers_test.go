@@ -0,0 +1,56 @@
+package httpclient
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	corev2 "github.com/sensu/sensu-go/api/core/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHeadersFile(t *testing.T) {
+	assert := assert.New(t)
+	event := corev2.FixtureEvent("entity1", "check")
+	event.Entity.Labels = map[string]string{"tenant": "acme"}
+	os.Setenv("HEADERS_TEST_TOKEN", "s3cret")
+	defer os.Unsetenv("HEADERS_TEST_TOKEN")
+
+	file, err := ioutil.TempFile("", "http-checks-headers")
+	require.NoError(t, err)
+	defer os.Remove(file.Name())
+	_, err = file.WriteString(`# Tracing
+X-B3-Sampled: 1
+
+Authorization: Bearer ${HEADERS_TEST_TOKEN}
+X-Tenant: {{ .labels.tenant }}
+X-Region: {{ .labels.region | default "global" }}
+X-Query: a:b
+`)
+	require.NoError(t, err)
+	file.Close()
+
+	config := HeadersFileConfig{File: file.Name()}
+	headers, err := config.Headers(event)
+	require.NoError(t, err)
+	assert.Equal([]string{"X-B3-Sampled: 1", "Authorization: Bearer s3cret", "X-Tenant: acme", "X-Region: global", "X-Query: a:b"}, headers)
+
+	// The entity tokens require the event.
+	_, err = config.Headers(nil)
+	assert.Error(err)
+
+	for _, content := range []string{"X-Missing: ${HEADERS_TEST_UNSET}\n", "not a header\n", ": no name\n"} {
+		require.NoError(t, ioutil.WriteFile(file.Name(), []byte(content), 0600))
+		_, err = config.Headers(event)
+		assert.Error(err, content)
+	}
+
+	config.File = ""
+	headers, err = config.Headers(event)
+	assert.NoError(err)
+	assert.Empty(headers)
+	config.File = file.Name() + ".missing"
+	_, err = config.Headers(event)
+	assert.Error(err)
+}
@@ -0,0 +1,55 @@
+// Package httpclient builds the HTTP clients used by the checks. Every check
+// gets its own client and transport, so settings such as TLS configuration,
+// timeouts and redirect handling never leak into (or from) http.DefaultClient
+// and http.DefaultTransport.
+package httpclient
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/nixwiz/http-checks/internal/selfmetrics"
+)
+
+// NewTransport returns a new transport with the same defaults as
+// http.DefaultTransport, using tlsConfig for TLS connections, and applies
+// options to it. Unlike http.DefaultTransport no proxy is used unless one is
+// configured by an option, see ProxyConfig. The transport is built from
+// scratch rather than cloned, as cloning http.DefaultTransport initializes
+// (and so modifies) its TLS configuration.
+func NewTransport(tlsConfig *tls.Config, options ...func(*http.Transport)) *http.Transport {
+	transport := &http.Transport{
+		DialContext: selfmetrics.Dial((&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext),
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		TLSClientConfig:       tlsConfig,
+	}
+	for _, option := range options {
+		option(transport)
+	}
+	return transport
+}
+
+// New returns a new client with its own transport, see NewTransport, wrapped
+// by Logging and Recording. If followRedirects is false the client returns
+// redirect responses rather than following them.
+func New(tlsConfig *tls.Config, timeout time.Duration, followRedirects bool, options ...func(*http.Transport)) *http.Client {
+	client := &http.Client{
+		Transport: Recording(Logging(NewTransport(tlsConfig, options...))),
+		Timeout:   timeout,
+	}
+	if !followRedirects {
+		client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+	}
+	return client
+}
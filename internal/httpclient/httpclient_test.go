@@ -0,0 +1,52 @@
+package httpclient
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNew(t *testing.T) {
+	assert := assert.New(t)
+
+	var test = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, "/", http.StatusFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer test.Close()
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: true}
+	client := New(tlsConfig, 5*time.Second, false)
+	assert.Equal(5*time.Second, client.Timeout)
+	assert.NotSame(http.DefaultTransport, client.Transport)
+	assert.Same(tlsConfig, client.Transport.(*http.Transport).TLSClientConfig)
+
+	resp, err := client.Get(test.URL + "/redirect")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(http.StatusFound, resp.StatusCode)
+
+	client = New(tlsConfig, 5*time.Second, true)
+	resp, err = client.Get(test.URL + "/redirect")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(http.StatusOK, resp.StatusCode)
+
+	// None of the above may modify the shared defaults.
+	// httptest.Server.Close may initialise the default TLS config itself, so
+	// only check that ours was not installed.
+	if defaultTLS := http.DefaultTransport.(*http.Transport).TLSClientConfig; defaultTLS != nil {
+		assert.False(defaultTLS.InsecureSkipVerify)
+	}
+	assert.Nil(http.DefaultClient.Transport)
+	assert.Nil(http.DefaultClient.CheckRedirect)
+	assert.Zero(http.DefaultClient.Timeout)
+}
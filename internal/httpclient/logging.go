@@ -0,0 +1,94 @@
+package httpclient
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"time"
+
+	"github.com/nixwiz/http-checks/internal/logging"
+)
+
+var tlsVersions = map[uint16]string{
+	tls.VersionTLS10: "TLS 1.0",
+	tls.VersionTLS11: "TLS 1.1",
+	tls.VersionTLS12: "TLS 1.2",
+	tls.VersionTLS13: "TLS 1.3",
+}
+
+// TLSVersionName returns the name of TLS version v, e.g. "TLS 1.3".
+func TLSVersionName(v uint16) string {
+	if name, ok := tlsVersions[v]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%04x", v)
+}
+
+// Logging wraps rt so that requests, responses, resolved addresses and TLS
+// details are logged at debug level. If debug logging is disabled rt is
+// returned as is.
+func Logging(rt http.RoundTripper) http.RoundTripper {
+	if !logging.Enabled(logging.LevelDebug) {
+		return rt
+	}
+	return &loggingTransport{base: rt}
+}
+
+type loggingTransport struct {
+	base http.RoundTripper
+}
+
+func (t *loggingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	elapsed := func() string {
+		return time.Since(start).String()
+	}
+	trace := &httptrace.ClientTrace{
+		DNSStart: func(info httptrace.DNSStartInfo) {
+			logging.Debug("dns lookup", "host", info.Host)
+		},
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			addrs := make([]string, len(info.Addrs))
+			for i, addr := range info.Addrs {
+				addrs[i] = addr.String()
+			}
+			logging.Debug("dns lookup done", "addrs", strings.Join(addrs, ","), "error", info.Err, "elapsed", elapsed())
+		},
+		ConnectDone: func(network, addr string, err error) {
+			logging.Debug("connect done", "network", network, "addr", addr, "error", err, "elapsed", elapsed())
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			keyvals := []interface{}{
+				"version", tlsVersions[state.Version],
+				"cipher_suite", fmt.Sprintf("0x%04x", state.CipherSuite),
+				"alpn", state.NegotiatedProtocol,
+				"server_name", state.ServerName,
+			}
+			if len(state.PeerCertificates) > 0 {
+				leaf := state.PeerCertificates[0]
+				keyvals = append(keyvals, "subject", leaf.Subject.String(), "issuer", leaf.Issuer.String(), "not_after", leaf.NotAfter.UTC().Format(time.RFC3339))
+			}
+			keyvals = append(keyvals, "error", err, "elapsed", elapsed())
+			logging.Debug("tls handshake done", keyvals...)
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			logging.Debug("got connection", "local", info.Conn.LocalAddr(), "remote", info.Conn.RemoteAddr(), "reused", info.Reused, "elapsed", elapsed())
+		},
+		GotFirstResponseByte: func() {
+			logging.Debug("first response byte", "elapsed", elapsed())
+		},
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+
+	logging.Debug("request", "method", req.Method, "url", req.URL, "host", req.Host)
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		logging.Debug("request failed", "method", req.Method, "url", req.URL, "error", err, "elapsed", elapsed())
+		return resp, err
+	}
+	logging.Debug("response", "method", req.Method, "url", req.URL, "status", resp.Status, "proto", resp.Proto,
+		"content_length", resp.ContentLength, "elapsed", elapsed())
+	return resp, nil
+}
@@ -0,0 +1,40 @@
+package httpclient
+
+import (
+	"bytes"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nixwiz/http-checks/internal/logging"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogging(t *testing.T) {
+	assert := assert.New(t)
+	var buf bytes.Buffer
+	logging.SetOutput(&buf)
+	defer logging.SetOutput(os.Stderr)
+
+	var test = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	defer test.Close()
+
+	transport := NewTransport(&tls.Config{InsecureSkipVerify: true})
+	assert.Same(transport, Logging(transport))
+
+	logging.SetLevel(logging.LevelDebug)
+	defer logging.SetLevel(logging.LevelWarn)
+	resp, err := New(&tls.Config{InsecureSkipVerify: true}, 5*time.Second, true).Get(test.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Contains(buf.String(), `msg=request method=GET url=`+test.URL)
+	assert.Contains(buf.String(), `msg="connect done" network=tcp addr=`+test.Listener.Addr().String())
+	assert.Contains(buf.String(), `msg="tls handshake done" version="TLS 1.3"`)
+	assert.Contains(buf.String(), `msg=response method=GET url=`+test.URL+` status="418 I'm a teapot"`)
+}
@@ -0,0 +1,125 @@
+package httpclient
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/nixwiz/http-checks/internal/secret"
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+)
+
+// ProxyConfig holds the proxy settings of a check. HTTP and HTTPS proxies are
+// used with CONNECT for https URLs, SOCKS5 proxies for everything.
+type ProxyConfig struct {
+	URL          string
+	User         string
+	PasswordEnv  string
+	PasswordFile string
+	FromEnv      bool
+
+	proxyURL *url.URL
+}
+
+// Options returns the plugin config options for c, to be appended to the
+// options of a check.
+func (c *ProxyConfig) Options() []*sensu.PluginConfigOption {
+	return []*sensu.PluginConfigOption{
+		{
+			Path:     "proxy-url",
+			Env:      "",
+			Argument: "proxy-url",
+			Default:  "",
+			Usage:    "Proxy to send requests through, with an http, https or socks5 scheme",
+			Value:    &c.URL,
+		},
+		{
+			Path:     "proxy-user",
+			Env:      "",
+			Argument: "proxy-user",
+			Default:  "",
+			Usage:    "Username for proxy authentication",
+			Value:    &c.User,
+		},
+		{
+			Path:     "proxy-password-env",
+			Env:      "",
+			Argument: "proxy-password-env",
+			Default:  "CHECK_PROXY_PASSWORD",
+			Usage:    "Environment variable holding the password for proxy authentication",
+			Value:    &c.PasswordEnv,
+		},
+		{
+			Path:     "proxy-password-file",
+			Env:      "",
+			Argument: "proxy-password-file",
+			Default:  "",
+			Usage:    "File holding the password for proxy authentication, used instead of --proxy-password-env",
+			Value:    &c.PasswordFile,
+		},
+		{
+			Path:     "proxy-from-env",
+			Env:      "",
+			Argument: "proxy-from-env",
+			Default:  false,
+			Usage:    "Use the proxy set by the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables",
+			Value:    &c.FromEnv,
+		},
+	}
+}
+
+// Validate checks the settings of c and reads the proxy password from the
+// environment or a file.
+func (c *ProxyConfig) Validate() error {
+	c.proxyURL = nil
+	if len(c.URL) == 0 {
+		if len(c.User) > 0 {
+			return fmt.Errorf("--proxy-user requires --proxy-url")
+		}
+		return nil
+	}
+	if c.FromEnv {
+		return fmt.Errorf("--proxy-url and --proxy-from-env are mutually exclusive")
+	}
+
+	proxyURL, err := url.Parse(c.URL)
+	if err != nil {
+		return fmt.Errorf("--proxy-url %q is not a valid URL: %v", c.URL, err)
+	}
+	switch proxyURL.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return fmt.Errorf("--proxy-url %q must use the http, https or socks5 scheme", c.URL)
+	}
+	if len(proxyURL.Host) == 0 {
+		return fmt.Errorf("--proxy-url %q has no host", c.URL)
+	}
+	if len(c.User) > 0 {
+		password := ""
+		if len(c.PasswordFile) > 0 {
+			var err error
+			password, err = secret.ReadFile(c.PasswordFile)
+			if err != nil {
+				return fmt.Errorf("--proxy-password-file: %v", err)
+			}
+		} else if len(c.PasswordEnv) > 0 {
+			password = os.Getenv(c.PasswordEnv)
+		}
+		proxyURL.User = url.UserPassword(c.User, password)
+	}
+	c.proxyURL = proxyURL
+	return nil
+}
+
+// Configure sets the proxy of transport, it is meant to be passed as an
+// option to New or NewTransport. Validate must have been called first.
+func (c *ProxyConfig) Configure(transport *http.Transport) {
+	if c.proxyURL != nil {
+		// Credentials in the proxy URL are sent as a Proxy-Authorization
+		// header for HTTP(S) proxies and used for SOCKS5 authentication.
+		transport.Proxy = http.ProxyURL(c.proxyURL)
+	} else if c.FromEnv {
+		transport.Proxy = http.ProxyFromEnvironment
+	}
+}
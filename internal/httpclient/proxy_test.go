@@ -0,0 +1,72 @@
+package httpclient
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxyConfigValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	testCases := []struct {
+		config ProxyConfig
+		valid  bool
+	}{
+		{ProxyConfig{}, true},
+		{ProxyConfig{FromEnv: true}, true},
+		{ProxyConfig{URL: "http://proxy:3128"}, true},
+		{ProxyConfig{URL: "https://proxy:3129", User: "sensu"}, true},
+		{ProxyConfig{URL: "socks5://127.0.0.1:1080"}, true},
+		{ProxyConfig{URL: "ftp://proxy:21"}, false},
+		{ProxyConfig{URL: "proxy:3128"}, false},
+		{ProxyConfig{URL: "http://proxy:3128", FromEnv: true}, false},
+		{ProxyConfig{User: "sensu"}, false},
+		{ProxyConfig{URL: "http://proxy:3128", User: "sensu", PasswordFile: "/nonexistent/password"}, false},
+	}
+
+	for _, tc := range testCases {
+		err := tc.config.Validate()
+		if tc.valid {
+			assert.NoError(err, tc.config.URL)
+		} else {
+			assert.Error(err, tc.config.URL)
+		}
+	}
+}
+
+func TestProxyConfigConfigure(t *testing.T) {
+	assert := assert.New(t)
+	os.Setenv("TEST_PROXY_PASSWORD", "s3cret")
+	defer os.Unsetenv("TEST_PROXY_PASSWORD")
+
+	var proxy = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal("http://backend.example.com/health", r.RequestURI)
+		if r.Header.Get("Proxy-Authorization") != "Basic c2Vuc3U6czNjcmV0" {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer proxy.Close()
+
+	config := ProxyConfig{URL: proxy.URL, User: "sensu", PasswordEnv: "TEST_PROXY_PASSWORD"}
+	require.NoError(t, config.Validate())
+	client := New(nil, 5*time.Second, true, config.Configure)
+	resp, err := client.Get("http://backend.example.com/health")
+	require.NoError(t, err)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+
+	// Without a proxy configured the environment is ignored.
+	config = ProxyConfig{}
+	require.NoError(t, config.Validate())
+	assert.Nil(NewTransport(nil, config.Configure).Proxy)
+	config.FromEnv = true
+	require.NoError(t, config.Validate())
+	assert.NotNil(NewTransport(nil, config.Configure).Proxy)
+}
@@ -0,0 +1,331 @@
+package httpclient
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nixwiz/http-checks/internal/logging"
+	corev2 "github.com/sensu/sensu-go/api/core/v2"
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+)
+
+// recordBodyLimit is the number of bytes of each request and response body
+// kept in a transcript.
+const recordBodyLimit = 4096
+
+var (
+	// sensitiveName matches the names of headers, query parameters and body
+	// fields whose values are redacted in transcripts.
+	sensitiveName = regexp.MustCompile(`(?i)(auth|token|secret|password|passwd|api[-_]?key|cookie|session|signature|credential)`)
+
+	// sensitiveJSON matches string values of sensitive fields in JSON bodies.
+	sensitiveJSON = regexp.MustCompile(`(?i)("[^"]*(?:auth|token|secret|password|passwd|api[-_]?key|session|signature|credential)[^"]*"\s*:\s*)"(?:[^"\\]|\\.)*"`)
+
+	recordMu  sync.Mutex
+	recording bool
+	exchanges []*exchange
+)
+
+// RecordConfig holds the transcript recording settings of a check.
+type RecordConfig struct {
+	Dir string
+}
+
+// Options returns the plugin config options for c, to be appended to the
+// options of a check.
+func (c *RecordConfig) Options() []*sensu.PluginConfigOption {
+	return []*sensu.PluginConfigOption{
+		{
+			Path:     "record-dir",
+			Env:      "",
+			Argument: "record-dir",
+			Default:  "",
+			Usage:    "Directory to write a redacted request/response transcript to when the check is not OK",
+			Value:    &c.Dir,
+		},
+	}
+}
+
+// Validate checks the settings of c, creating the record directory if needed,
+// and enables recording of the requests made by clients from New.
+func (c *RecordConfig) Validate() error {
+	recordMu.Lock()
+	defer recordMu.Unlock()
+	recording = false
+	exchanges = nil
+	if len(c.Dir) == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(c.Dir, 0750); err != nil {
+		return fmt.Errorf("--record-dir %s could not be created: %v", c.Dir, err)
+	}
+	recording = true
+	return nil
+}
+
+// Wrap returns an execute function for a check named name that calls execute
+// and, if the result is not OK and requests were recorded, writes their
+// transcript to the record directory and adds its path to the check output.
+func (c *RecordConfig) Wrap(name string, execute func(*corev2.Event) (int, error)) func(*corev2.Event) (int, error) {
+	return func(event *corev2.Event) (int, error) {
+		status, err := execute(event)
+		if status == sensu.CheckStateOK {
+			return status, err
+		}
+		path, writeErr := c.write(name, status)
+		if writeErr != nil {
+			logging.Error("failed to write transcript", "dir", c.Dir, "error", writeErr)
+		} else if len(path) > 0 {
+			fmt.Printf("Transcript written to %s\n", path)
+		}
+		return status, err
+	}
+}
+
+// write writes the recorded exchanges to a new, timestamped file in the
+// record directory and returns its path.
+func (c *RecordConfig) write(name string, status int) (string, error) {
+	recordMu.Lock()
+	defer recordMu.Unlock()
+	if !recording || len(exchanges) == 0 {
+		return "", nil
+	}
+
+	now := time.Now().UTC()
+	var transcript bytes.Buffer
+	fmt.Fprintf(&transcript, "# %s transcript, %s, status %s\n", name, now.Format(time.RFC3339), stateNames[status])
+	for i, e := range exchanges {
+		fmt.Fprintf(&transcript, "\n== Request %d: %s %s\n", i+1, e.method, e.url)
+		fmt.Fprintf(&transcript, "> %s %s %s\n", e.method, e.requestURI, e.proto)
+		writeHeader(&transcript, "> ", e.requestHeader)
+		writeBody(&transcript, "> ", e.requestBody.Bytes(), e.requestBody.total, e.requestHeader.Get("Content-Type"))
+		if e.err != nil {
+			fmt.Fprintf(&transcript, "error: %s\n", e.err)
+		} else {
+			fmt.Fprintf(&transcript, "< %s %s\n", e.responseProto, e.status)
+			writeHeader(&transcript, "< ", e.responseHeader)
+			writeBody(&transcript, "< ", e.responseBody.Bytes(), e.responseBody.total, e.responseHeader.Get("Content-Type"))
+		}
+		fmt.Fprintf(&transcript, "timings: %s\n", strings.Join(append(e.timings, "total="+e.duration.String()), ", "))
+	}
+
+	path := filepath.Join(c.Dir, fmt.Sprintf("%s-%s.txt", name, now.Format("20060102T150405.000000000Z")))
+	if err := ioutil.WriteFile(path, transcript.Bytes(), 0600); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+var stateNames = map[int]string{
+	sensu.CheckStateOK:       "OK",
+	sensu.CheckStateWarning:  "WARNING",
+	sensu.CheckStateCritical: "CRITICAL",
+	sensu.CheckStateUnknown:  "UNKNOWN",
+}
+
+// Recording wraps rt so that requests and responses are recorded for a
+// transcript, see RecordConfig. If recording is disabled rt is returned as
+// is.
+func Recording(rt http.RoundTripper) http.RoundTripper {
+	recordMu.Lock()
+	defer recordMu.Unlock()
+	if !recording {
+		return rt
+	}
+	return &recordingTransport{base: rt}
+}
+
+// exchange is a recorded request and its response.
+type exchange struct {
+	method         string
+	url            string
+	requestURI     string
+	proto          string
+	requestHeader  http.Header
+	requestBody    *limitedBuffer
+	responseProto  string
+	status         string
+	responseHeader http.Header
+	responseBody   *limitedBuffer
+	timings        []string
+	duration       time.Duration
+	err            error
+}
+
+type recordingTransport struct {
+	base http.RoundTripper
+}
+
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	e := &exchange{
+		method:        req.Method,
+		url:           redactURL(req.URL),
+		requestURI:    redactURL(&url.URL{Path: req.URL.Path, RawPath: req.URL.RawPath, RawQuery: req.URL.RawQuery}),
+		proto:         req.Proto,
+		requestHeader: req.Header.Clone(),
+		requestBody:   &limitedBuffer{},
+		responseBody:  &limitedBuffer{},
+	}
+	if len(e.requestURI) == 0 {
+		e.requestURI = "/"
+	}
+	e.requestHeader.Set("Host", req.Host)
+	if len(req.Host) == 0 {
+		e.requestHeader.Set("Host", req.URL.Host)
+	}
+	if req.GetBody != nil {
+		if body, err := req.GetBody(); err == nil {
+			_, _ = io.Copy(e.requestBody, body)
+			body.Close()
+		}
+	}
+
+	start := time.Now()
+	timing := func(name string) {
+		recordMu.Lock()
+		defer recordMu.Unlock()
+		e.timings = append(e.timings, name+"="+time.Since(start).String())
+	}
+	trace := &httptrace.ClientTrace{
+		DNSDone:              func(httptrace.DNSDoneInfo) { timing("dns") },
+		ConnectDone:          func(string, string, error) { timing("connect") },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { timing("tls") },
+		GotFirstResponseByte: func() { timing("first_byte") },
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+
+	recordMu.Lock()
+	exchanges = append(exchanges, e)
+	recordMu.Unlock()
+
+	resp, err := t.base.RoundTrip(req)
+	recordMu.Lock()
+	defer recordMu.Unlock()
+	e.duration = time.Since(start)
+	if err != nil {
+		e.err = err
+		return resp, err
+	}
+	e.responseProto = resp.Proto
+	e.status = resp.Status
+	e.responseHeader = resp.Header.Clone()
+	resp.Body = &recordingBody{ReadCloser: resp.Body, buffer: e.responseBody}
+	return resp, nil
+}
+
+// recordingBody copies what is read from a response body to a buffer.
+type recordingBody struct {
+	io.ReadCloser
+	buffer *limitedBuffer
+}
+
+func (b *recordingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	recordMu.Lock()
+	_, _ = b.buffer.Write(p[:n])
+	recordMu.Unlock()
+	return n, err
+}
+
+// limitedBuffer keeps the first recordBodyLimit bytes written to it, and
+// counts the rest.
+type limitedBuffer struct {
+	buffer bytes.Buffer
+	total  int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	b.total += len(p)
+	if room := recordBodyLimit - b.buffer.Len(); room > 0 {
+		if len(p) > room {
+			b.buffer.Write(p[:room])
+		} else {
+			b.buffer.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+// Bytes returns the bytes kept.
+func (b *limitedBuffer) Bytes() []byte {
+	return b.buffer.Bytes()
+}
+
+func writeHeader(w io.Writer, prefix string, header http.Header) {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range header[name] {
+			if sensitiveName.MatchString(name) {
+				value = "[REDACTED]"
+			}
+			fmt.Fprintf(w, "%s%s: %s\n", prefix, name, value)
+		}
+	}
+	fmt.Fprintln(w, strings.TrimSpace(prefix))
+}
+
+func writeBody(w io.Writer, prefix string, body []byte, total int, contentType string) {
+	if total == 0 {
+		return
+	}
+	for _, line := range strings.Split(string(redactBody(body, contentType)), "\n") {
+		fmt.Fprintf(w, "%s%s\n", prefix, line)
+	}
+	if total > len(body) {
+		fmt.Fprintf(w, "%s[truncated, %d of %d bytes shown]\n", prefix, len(body), total)
+	}
+}
+
+// redactURL returns u with the password and sensitive query parameters
+// redacted.
+func redactURL(u *url.URL) string {
+	redacted := *u
+	if _, ok := redacted.User.Password(); ok {
+		redacted.User = url.UserPassword(redacted.User.Username(), "REDACTED")
+	}
+	query := redacted.Query()
+	changed := false
+	for name := range query {
+		if sensitiveName.MatchString(name) {
+			query.Set(name, "REDACTED")
+			changed = true
+		}
+	}
+	if changed {
+		redacted.RawQuery = query.Encode()
+	}
+	return redacted.String()
+}
+
+// redactBody redacts sensitive fields of form and JSON bodies.
+func redactBody(body []byte, contentType string) []byte {
+	if strings.HasPrefix(contentType, "application/x-www-form-urlencoded") {
+		form, err := url.ParseQuery(string(body))
+		if err == nil {
+			for name := range form {
+				if sensitiveName.MatchString(name) {
+					form.Set(name, "REDACTED")
+				}
+			}
+			return []byte(form.Encode())
+		}
+	}
+	return sensitiveJSON.ReplaceAll(body, []byte(`$1"REDACTED"`))
+}
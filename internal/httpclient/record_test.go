@@ -0,0 +1,80 @@
+package httpclient
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	corev2 "github.com/sensu/sensu-go/api/core/v2"
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecording(t *testing.T) {
+	assert := assert.New(t)
+
+	var test = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Set-Cookie", "session=abc123")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte(`{"error": "boom", "access_token": "abc123", "padding": "` + strings.Repeat("x", recordBodyLimit) + `"}`))
+	}))
+	defer test.Close()
+
+	dir, err := ioutil.TempDir("", "http-checks-record")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	config := RecordConfig{Dir: filepath.Join(dir, "transcripts")}
+	require.NoError(t, config.Validate())
+	defer func() {
+		config.Dir = ""
+		_ = config.Validate()
+	}()
+
+	status := sensu.CheckStateOK
+	execute := config.Wrap("http-test", func(event *corev2.Event) (int, error) {
+		client := New(nil, 5*time.Second, true)
+		req, _ := http.NewRequest("POST", test.URL+"/login?api_key=s3cret&page=1", strings.NewReader("user=sensu&password=s3cret"))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Authorization", "Bearer s3cret")
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		_, _ = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return status, nil
+	})
+
+	_, err = execute(nil)
+	require.NoError(t, err)
+	files, err := ioutil.ReadDir(config.Dir)
+	require.NoError(t, err)
+	assert.Empty(files)
+
+	require.NoError(t, config.Validate())
+	status = sensu.CheckStateCritical
+	_, err = execute(nil)
+	require.NoError(t, err)
+	files, err = ioutil.ReadDir(config.Dir)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	assert.True(strings.HasPrefix(files[0].Name(), "http-test-"))
+
+	transcript, err := ioutil.ReadFile(filepath.Join(config.Dir, files[0].Name()))
+	require.NoError(t, err)
+	assert.Contains(string(transcript), "status CRITICAL")
+	assert.Contains(string(transcript), "> POST /login?api_key=REDACTED&page=1 HTTP/1.1\n")
+	assert.Contains(string(transcript), "> Authorization: [REDACTED]\n")
+	assert.Contains(string(transcript), "> password=REDACTED&user=sensu\n")
+	assert.Contains(string(transcript), "< HTTP/1.1 500 Internal Server Error\n")
+	assert.Contains(string(transcript), "< Set-Cookie: [REDACTED]\n")
+	assert.Contains(string(transcript), `"error": "boom", "access_token": "REDACTED"`)
+	assert.Contains(string(transcript), "[truncated, 4096 of ")
+	assert.NotContains(string(transcript), "s3cret")
+	assert.NotContains(string(transcript), "abc123")
+}
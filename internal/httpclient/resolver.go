@@ -0,0 +1,227 @@
+package httpclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/nixwiz/http-checks/internal/logging"
+	"github.com/nixwiz/http-checks/internal/selfmetrics"
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+)
+
+// ResolverConfig holds the DNS settings of a check. As every check runs in
+// its own process, resolved addresses are cached in a file shared by all
+// checks on the host.
+type ResolverConfig struct {
+	Server    string
+	CacheTTL  string
+	CacheFile string
+
+	server   string
+	cacheTTL time.Duration
+	resolver *net.Resolver
+}
+
+// Options returns the plugin config options for c, to be appended to the
+// options of a check.
+func (c *ResolverConfig) Options() []*sensu.PluginConfigOption {
+	return []*sensu.PluginConfigOption{
+		{
+			Path:     "resolver",
+			Env:      "",
+			Argument: "resolver",
+			Default:  "",
+			Usage:    "DNS server to resolve host names with in host[:port] form, if not provided the system resolver is used",
+			Value:    &c.Server,
+		},
+		{
+			Path:     "dns-cache-ttl",
+			Env:      "CHECK_DNS_CACHE_TTL",
+			Argument: "dns-cache-ttl",
+			Default:  "",
+			Usage:    "Duration to cache resolved addresses for (e.g. 30s), shared by all checks on the host, if not provided addresses are not cached",
+			Value:    &c.CacheTTL,
+		},
+		{
+			Path:     "dns-cache-file",
+			Env:      "CHECK_DNS_CACHE_FILE",
+			Argument: "dns-cache-file",
+			Default:  "",
+			Usage:    "File to cache resolved addresses in, http-checks-dns-cache.json in the temporary directory by default",
+			Value:    &c.CacheFile,
+		},
+	}
+}
+
+// Validate checks the settings of c.
+func (c *ResolverConfig) Validate() error {
+	c.server = ""
+	c.cacheTTL = 0
+	c.resolver = net.DefaultResolver
+	if len(c.CacheTTL) > 0 {
+		ttl, err := time.ParseDuration(c.CacheTTL)
+		if err != nil || ttl < 0 {
+			return fmt.Errorf("--dns-cache-ttl %q is not a valid duration", c.CacheTTL)
+		}
+		c.cacheTTL = ttl
+	}
+	if len(c.CacheFile) == 0 {
+		c.CacheFile = filepath.Join(os.TempDir(), "http-checks-dns-cache.json")
+	}
+	if len(c.Server) > 0 {
+		c.server = c.Server
+		if _, _, err := net.SplitHostPort(c.server); err != nil {
+			c.server = net.JoinHostPort(c.server, "53")
+		}
+		if _, _, err := net.SplitHostPort(c.server); err != nil {
+			return fmt.Errorf("--resolver %q is not a valid address: %v", c.Server, err)
+		}
+		c.resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, network, c.server)
+			},
+		}
+	}
+	return nil
+}
+
+// Configure makes transport resolve host names with the configured server
+// and cache, it is meant to be passed as an option to New or NewTransport.
+// Validate must have been called first.
+func (c *ResolverConfig) Configure(transport *http.Transport) {
+	if len(c.server) == 0 && c.cacheTTL == 0 {
+		return
+	}
+	dial := transport.DialContext
+	transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil || net.ParseIP(host) != nil {
+			return dial(ctx, network, address)
+		}
+		addrs, err := c.lookup(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			var conn net.Conn
+			conn, err = dial(ctx, network, net.JoinHostPort(addr, port))
+			if err == nil {
+				return conn, nil
+			}
+		}
+		return nil, err
+	}
+}
+
+// lookup returns the addresses of host, from the cache if they are in it and
+// not expired. The DNS hooks of the client trace of ctx are called like they
+// are for lookups by the transport.
+func (c *ResolverConfig) lookup(ctx context.Context, host string) ([]string, error) {
+	trace := httptrace.ContextClientTrace(ctx)
+	if trace != nil && trace.DNSStart != nil {
+		trace.DNSStart(httptrace.DNSStartInfo{Host: host})
+	}
+	key := host + "@" + c.server
+	addrs, cached := c.cached(key)
+	var err error
+	if !cached {
+		var ipAddrs []net.IPAddr
+		selfmetrics.AddDNSLookup()
+		ipAddrs, err = c.resolver.LookupIPAddr(ctx, host)
+		addrs = make([]string, len(ipAddrs))
+		for i, ipAddr := range ipAddrs {
+			addrs[i] = ipAddr.String()
+		}
+		if err == nil && c.cacheTTL > 0 {
+			c.store(key, addrs)
+		}
+	}
+	logging.Debug("resolved", "host", host, "resolver", c.server, "addrs", addrs, "cached", cached, "error", err)
+	if trace != nil && trace.DNSDone != nil {
+		info := httptrace.DNSDoneInfo{Err: err}
+		for _, addr := range addrs {
+			info.Addrs = append(info.Addrs, net.IPAddr{IP: net.ParseIP(addr)})
+		}
+		trace.DNSDone(info)
+	}
+	return addrs, err
+}
+
+// dnsCacheEntry is a cached lookup result.
+type dnsCacheEntry struct {
+	Addrs   []string  `json:"addrs"`
+	Expires time.Time `json:"expires"`
+}
+
+func (c *ResolverConfig) readCache() map[string]dnsCacheEntry {
+	cache := map[string]dnsCacheEntry{}
+	data, err := ioutil.ReadFile(c.CacheFile)
+	if err != nil {
+		return cache
+	}
+	if err := json.Unmarshal(data, &cache); err != nil {
+		logging.Warn("ignoring invalid dns cache", "file", c.CacheFile, "error", err)
+		return map[string]dnsCacheEntry{}
+	}
+	return cache
+}
+
+func (c *ResolverConfig) cached(key string) ([]string, bool) {
+	if c.cacheTTL == 0 {
+		return nil, false
+	}
+	entry, ok := c.readCache()[key]
+	if !ok || time.Now().After(entry.Expires) || len(entry.Addrs) == 0 {
+		return nil, false
+	}
+	return entry.Addrs, true
+}
+
+// store adds addrs to the cache file, dropping expired entries. The file is
+// replaced rather than written in place, so concurrent checks never read a
+// partial file, at worst an entry written by another check is lost.
+func (c *ResolverConfig) store(key string, addrs []string) {
+	now := time.Now()
+	cache := c.readCache()
+	for k, entry := range cache {
+		if now.After(entry.Expires) {
+			delete(cache, k)
+		}
+	}
+	cache[key] = dnsCacheEntry{Addrs: addrs, Expires: now.Add(c.cacheTTL)}
+	data, err := json.Marshal(cache)
+	if err == nil {
+		err = writeFileAtomic(c.CacheFile, data)
+	}
+	if err != nil {
+		logging.Warn("failed to write dns cache", "file", c.CacheFile, "error", err)
+	}
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames it
+// to path.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
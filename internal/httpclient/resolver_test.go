@@ -0,0 +1,130 @@
+package httpclient
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// serveDNS answers A queries for backend.test. with 127.0.0.1 and every other
+// query with NXDOMAIN, counting the queries.
+func serveDNS(t *testing.T, queries *int32) net.PacketConn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var msg dnsmessage.Message
+			if err := msg.Unpack(buf[:n]); err != nil || len(msg.Questions) == 0 {
+				continue
+			}
+			atomic.AddInt32(queries, 1)
+			q := msg.Questions[0]
+			msg.Header.Response = true
+			msg.Header.Authoritative = true
+			if q.Name.String() != "backend.test." {
+				msg.Header.RCode = dnsmessage.RCodeNameError
+			} else if q.Type == dnsmessage.TypeA {
+				msg.Answers = append(msg.Answers, dnsmessage.Resource{
+					Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+					Body:   &dnsmessage.AResource{A: [4]byte{127, 0, 0, 1}},
+				})
+			}
+			packed, err := msg.Pack()
+			if err != nil {
+				continue
+			}
+			_, _ = conn.WriteTo(packed, addr)
+		}
+	}()
+	return conn
+}
+
+func TestResolverConfigValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	testCases := []struct {
+		config ResolverConfig
+		valid  bool
+	}{
+		{ResolverConfig{}, true},
+		{ResolverConfig{Server: "10.0.0.53"}, true},
+		{ResolverConfig{Server: "10.0.0.53:5353", CacheTTL: "30s"}, true},
+		{ResolverConfig{Server: "[::1]:53"}, true},
+		{ResolverConfig{CacheTTL: "30"}, false},
+		{ResolverConfig{CacheTTL: "-1s"}, false},
+	}
+
+	for _, tc := range testCases {
+		err := tc.config.Validate()
+		if tc.valid {
+			assert.NoError(err, tc.config)
+		} else {
+			assert.Error(err, tc.config)
+		}
+	}
+}
+
+func TestResolverConfigConfigure(t *testing.T) {
+	assert := assert.New(t)
+
+	var queries int32
+	dns := serveDNS(t, &queries)
+	defer dns.Close()
+
+	var test = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer test.Close()
+	testURL, err := url.Parse(test.URL)
+	require.NoError(t, err)
+	backendURL := "http://backend.test:" + testURL.Port() + "/health"
+
+	dir, err := ioutil.TempDir("", "http-checks-dns")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	get := func(config ResolverConfig) error {
+		require.NoError(t, config.Validate())
+		// Keep-alives are disabled so every request dials.
+		resp, err := New(nil, 5*time.Second, true, config.Configure, func(transport *http.Transport) {
+			transport.DisableKeepAlives = true
+		}).Get(backendURL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	config := ResolverConfig{Server: dns.LocalAddr().String()}
+	assert.NoError(get(config))
+	assert.NoError(get(config))
+	assert.True(atomic.LoadInt32(&queries) >= 2)
+
+	config.CacheTTL = "1m"
+	config.CacheFile = filepath.Join(dir, "cache.json")
+	assert.NoError(get(config))
+	atomic.StoreInt32(&queries, 0)
+	assert.NoError(get(config))
+	assert.Equal(int32(0), atomic.LoadInt32(&queries))
+	assert.FileExists(config.CacheFile)
+
+	// A cache entry is only used for the resolver it came from.
+	config.Server = ""
+	assert.Error(get(config))
+}
@@ -0,0 +1,135 @@
+package httpclient
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/nixwiz/http-checks/internal/selfmetrics"
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+)
+
+// SourceConfig holds the source address settings of a check, for binding its
+// outgoing connections to a local interface or IP address on multi-homed
+// hosts. Unlike the other settings in this package it applies to all checks,
+// including those that do not use HTTP.
+type SourceConfig struct {
+	Interface string
+	IP        string
+
+	ip net.IP
+}
+
+// Options returns the plugin config options for c, to be appended to the
+// options of a check.
+func (c *SourceConfig) Options() []*sensu.PluginConfigOption {
+	return []*sensu.PluginConfigOption{
+		{
+			Path:     "source-interface",
+			Env:      "",
+			Argument: "source-interface",
+			Default:  "",
+			Usage:    "Local interface to connect from, using its first IPv4 address (or first global IPv6 address if it has none)",
+			Value:    &c.Interface,
+		},
+		{
+			Path:     "source-ip",
+			Env:      "",
+			Argument: "source-ip",
+			Default:  "",
+			Usage:    "Local IP address to connect from",
+			Value:    &c.IP,
+		},
+	}
+}
+
+// Validate checks the settings of c and looks up the address of the source
+// interface.
+func (c *SourceConfig) Validate() error {
+	c.ip = nil
+	switch {
+	case len(c.Interface) > 0 && len(c.IP) > 0:
+		return fmt.Errorf("--source-interface and --source-ip are mutually exclusive")
+	case len(c.IP) > 0:
+		c.ip = net.ParseIP(c.IP)
+		if c.ip == nil {
+			return fmt.Errorf("--source-ip %q is not a valid IP address", c.IP)
+		}
+	case len(c.Interface) > 0:
+		ip, err := interfaceIP(c.Interface)
+		if err != nil {
+			return fmt.Errorf("--source-interface %s: %v", c.Interface, err)
+		}
+		c.ip = ip
+	}
+	return nil
+}
+
+// interfaceIP returns the first IPv4 address of the named interface, or its
+// first global IPv6 address if it has none.
+func interfaceIP(name string) (net.IP, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var ipv6 net.IP
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if ipNet.IP.To4() != nil {
+			return ipNet.IP, nil
+		}
+		// Link-local addresses would need a zone to be usable.
+		if ipv6 == nil && !ipNet.IP.IsLinkLocalUnicast() {
+			ipv6 = ipNet.IP
+		}
+	}
+	if ipv6 == nil {
+		return nil, fmt.Errorf("no usable address")
+	}
+	return ipv6, nil
+}
+
+// LocalAddr returns the local address to use for connections over network
+// (tcp or udp), or nil if no source is configured. Validate must have been
+// called first.
+func (c *SourceConfig) LocalAddr(network string) net.Addr {
+	if c.ip == nil {
+		return nil
+	}
+	switch network {
+	case "udp", "udp4", "udp6":
+		return &net.UDPAddr{IP: c.ip}
+	default:
+		return &net.TCPAddr{IP: c.ip}
+	}
+}
+
+// DialContext connects to address on network from the configured source
+// address. Only remote addresses of the same IP version as the source are
+// tried.
+func (c *SourceConfig) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		LocalAddr: c.LocalAddr(network),
+	}
+	return selfmetrics.Dial(dialer.DialContext)(ctx, network, address)
+}
+
+// Configure makes transport connect from the configured source address, it
+// is meant to be passed as an option to New or NewTransport. Validate must
+// have been called first.
+func (c *SourceConfig) Configure(transport *http.Transport) {
+	if c.ip != nil {
+		transport.DialContext = c.DialContext
+	}
+}
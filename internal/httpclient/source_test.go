@@ -0,0 +1,69 @@
+package httpclient
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSourceConfigValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	testCases := []struct {
+		config SourceConfig
+		valid  bool
+	}{
+		{SourceConfig{}, true},
+		{SourceConfig{IP: "127.0.0.1"}, true},
+		{SourceConfig{IP: "::1"}, true},
+		{SourceConfig{Interface: "lo"}, true},
+		{SourceConfig{IP: "localhost"}, false},
+		{SourceConfig{Interface: "no-such-interface0"}, false},
+		{SourceConfig{Interface: "lo", IP: "127.0.0.1"}, false},
+	}
+
+	for _, tc := range testCases {
+		err := tc.config.Validate()
+		if tc.valid {
+			assert.NoError(err, tc.config)
+		} else {
+			assert.Error(err, tc.config)
+		}
+	}
+
+	config := SourceConfig{}
+	require.NoError(t, config.Validate())
+	assert.Nil(config.LocalAddr("tcp"))
+	config.IP = "127.0.0.1"
+	require.NoError(t, config.Validate())
+	assert.IsType(&net.TCPAddr{}, config.LocalAddr("tcp"))
+	assert.IsType(&net.UDPAddr{}, config.LocalAddr("udp"))
+}
+
+func TestSourceConfigConfigure(t *testing.T) {
+	assert := assert.New(t)
+
+	var remoteAddr string
+	var test = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		remoteAddr = r.RemoteAddr
+	}))
+	defer test.Close()
+
+	// All of 127.0.0.0/8 is local on Linux, elsewhere the test may be
+	// skipped.
+	config := SourceConfig{IP: "127.0.0.2"}
+	require.NoError(t, config.Validate())
+	resp, err := New(nil, 5*time.Second, true, config.Configure).Get(test.URL)
+	if err != nil {
+		t.Skipf("cannot connect from 127.0.0.2: %v", err)
+	}
+	resp.Body.Close()
+	host, _, err := net.SplitHostPort(remoteAddr)
+	require.NoError(t, err)
+	assert.Equal("127.0.0.2", host)
+}
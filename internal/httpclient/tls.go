@@ -0,0 +1,58 @@
+package httpclient
+
+import (
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// LoadCACerts returns a certificate pool with the PEM encoded certificates in
+// path, which is either a bundle file or a directory of them. Files in a
+// directory without any certificates are skipped. If withSystem is true the
+// certificates are added to (a copy of) the system pool instead of an empty
+// one.
+func LoadCACerts(path string, withSystem bool) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	if withSystem {
+		systemPool, err := x509.SystemCertPool()
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the system trust store: %v", err)
+		}
+		pool = systemPool
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	files := []string{path}
+	if info.IsDir() {
+		entries, err := ioutil.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		files = files[:0]
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				files = append(files, filepath.Join(path, entry.Name()))
+			}
+		}
+	}
+
+	found := false
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if pool.AppendCertsFromPEM(data) {
+			found = true
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("no PEM encoded certificates found in %s", path)
+	}
+	return pool, nil
+}
@@ -0,0 +1,57 @@
+package httpclient
+
+import (
+	"crypto/tls"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadCACerts(t *testing.T) {
+	assert := assert.New(t)
+
+	var test = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer test.Close()
+
+	dir, err := ioutil.TempDir("", "http-checks-ca")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: test.Certificate().Raw})
+	require.NoError(t, ioutil.WriteFile(caFile, certPEM, 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "README"), []byte("not a certificate"), 0644))
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "old"), 0755))
+
+	get := func(path string, withSystem bool) error {
+		pool, err := LoadCACerts(path, withSystem)
+		if err != nil {
+			return err
+		}
+		resp, err := New(&tls.Config{RootCAs: pool}, 5*time.Second, true).Get(test.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	assert.NoError(get(caFile, false))
+	assert.NoError(get(dir, false))
+	assert.NoError(get(dir, true))
+
+	_, err = LoadCACerts(filepath.Join(dir, "README"), false)
+	assert.Error(err)
+	_, err = LoadCACerts(filepath.Join(dir, "old"), false)
+	assert.Error(err)
+	_, err = LoadCACerts(filepath.Join(dir, "missing.pem"), false)
+	assert.Error(err)
+}
@@ -0,0 +1,191 @@
+package httpclient
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+	"golang.org/x/net/http2"
+)
+
+// TransportConfig holds the connection settings of a check that apply to the
+// transport rather than to the requests.
+type TransportConfig struct {
+	HTTPVersion           string
+	ConnectTimeout        string
+	TLSTimeout            string
+	ResponseHeaderTimeout string
+
+	connectTimeout        time.Duration
+	tlsTimeout            time.Duration
+	responseHeaderTimeout time.Duration
+}
+
+// Options returns the plugin config options for c, to be appended to the
+// options of a check.
+func (c *TransportConfig) Options() []*sensu.PluginConfigOption {
+	return []*sensu.PluginConfigOption{
+		{
+			Path:     "http-version",
+			Env:      "",
+			Argument: "http-version",
+			Default:  "",
+			Usage:    "HTTP version to require, 1.1 or 2 (2 uses h2c for http URLs), by default it is negotiated",
+			Value:    &c.HTTPVersion,
+		},
+		{
+			Path:     "connect-timeout",
+			Env:      "",
+			Argument: "connect-timeout",
+			Default:  "",
+			Usage:    "Timeout of establishing each connection, including DNS lookups, as a duration (e.g. 3s), by default 30s",
+			Value:    &c.ConnectTimeout,
+		},
+		{
+			Path:     "tls-timeout",
+			Env:      "",
+			Argument: "tls-timeout",
+			Default:  "",
+			Usage:    "Timeout of each TLS handshake as a duration (e.g. 5s), by default 10s",
+			Value:    &c.TLSTimeout,
+		},
+		{
+			Path:     "response-header-timeout",
+			Env:      "",
+			Argument: "response-header-timeout",
+			Default:  "",
+			Usage:    "Timeout of waiting for the response headers once a request is sent as a duration (e.g. 10s), by default only --timeout applies",
+			Value:    &c.ResponseHeaderTimeout,
+		},
+	}
+}
+
+// Validate checks the settings of c, and that they can be combined with
+// proxy, the proxy settings of the check (nil if it has none): HTTP version 2
+// is sent without a proxy.
+func (c *TransportConfig) Validate(proxy *ProxyConfig) error {
+	switch c.HTTPVersion {
+	case "", "1.1":
+	case "2":
+		if proxy != nil && (len(proxy.URL) > 0 || proxy.FromEnv) {
+			return fmt.Errorf("--http-version 2 cannot be used with --proxy-url or --proxy-from-env, HTTP/2 requests are sent without a proxy")
+		}
+	case "1", "1.0":
+		c.HTTPVersion = "1.1"
+	case "3":
+		// quic-go needs a much newer Go (and golang.org/x/net) than this
+		// module is built with.
+		return fmt.Errorf("--http-version 3 (HTTP/3 over QUIC) is not supported by this build")
+	default:
+		return fmt.Errorf("--http-version %q is not valid, must be 1.1 or 2", c.HTTPVersion)
+	}
+	for _, timeout := range []struct {
+		flag     string
+		value    string
+		duration *time.Duration
+	}{
+		{"--connect-timeout", c.ConnectTimeout, &c.connectTimeout},
+		{"--tls-timeout", c.TLSTimeout, &c.tlsTimeout},
+		{"--response-header-timeout", c.ResponseHeaderTimeout, &c.responseHeaderTimeout},
+	} {
+		*timeout.duration = 0
+		if len(timeout.value) == 0 {
+			continue
+		}
+		duration, err := time.ParseDuration(timeout.value)
+		if err != nil {
+			return fmt.Errorf("%s: %v", timeout.flag, err)
+		}
+		if duration <= 0 {
+			return fmt.Errorf("%s must be greater than 0", timeout.flag)
+		}
+		*timeout.duration = duration
+	}
+	return nil
+}
+
+// Configure applies the settings of c to transport, it is meant to be passed
+// as the last option to New or NewTransport. Validate must have been called
+// first.
+//
+// With HTTP version 2 requests are sent by an HTTP/2 transport registered for
+// the http and https schemes, which fails if the server does not negotiate h2
+// rather than falling back to HTTP/1.1 like the default transport. It dials
+// the server with the DialContext of transport, set by the options before it
+// (source address, resolver, private networks), but not through a proxy,
+// which Validate refuses.
+//
+// The connect timeout bounds each dial, wrapping the DialContext set by the
+// options before it, while the TLS and response header timeouts are those of
+// transport, the latter not applying to --http-version 2. All of them are
+// within the overall timeout of the client.
+func (c *TransportConfig) Configure(transport *http.Transport) {
+	if c.connectTimeout > 0 && transport.DialContext != nil {
+		dialContext := transport.DialContext
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			ctx, cancel := context.WithTimeout(ctx, c.connectTimeout)
+			defer cancel()
+			return dialContext(ctx, network, addr)
+		}
+	}
+	if c.tlsTimeout > 0 {
+		transport.TLSHandshakeTimeout = c.tlsTimeout
+	}
+	if c.responseHeaderTimeout > 0 {
+		transport.ResponseHeaderTimeout = c.responseHeaderTimeout
+	}
+
+	switch c.HTTPVersion {
+	case "1.1":
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	case "2":
+		// The bundled HTTP/2 support of transport is disabled, as it would
+		// register itself for https as well.
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+		dial := func(network, addr string) (net.Conn, error) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			return transport.DialContext(ctx, network, addr)
+		}
+		tlsConfig := &tls.Config{}
+		if transport.TLSClientConfig != nil {
+			tlsConfig = transport.TLSClientConfig.Clone()
+		}
+		tlsConfig.NextProtos = []string{http2.NextProtoTLS}
+		transport.RegisterProtocol("https", &http2.Transport{
+			TLSClientConfig: tlsConfig,
+			DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+				conn, err := dial(network, addr)
+				if err != nil {
+					return nil, err
+				}
+				if transport.TLSHandshakeTimeout > 0 {
+					_ = conn.SetDeadline(time.Now().Add(transport.TLSHandshakeTimeout))
+				}
+				tlsConn := tls.Client(conn, cfg)
+				if err := tlsConn.Handshake(); err != nil {
+					conn.Close()
+					return nil, err
+				}
+				_ = conn.SetDeadline(time.Time{})
+				if p := tlsConn.ConnectionState().NegotiatedProtocol; p != http2.NextProtoTLS {
+					conn.Close()
+					return nil, fmt.Errorf("server does not support HTTP/2, negotiated protocol %q", p)
+				}
+				return tlsConn, nil
+			},
+		})
+		transport.RegisterProtocol("http", &http2.Transport{
+			AllowHTTP: true,
+			DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+				return dial(network, addr)
+			},
+		})
+	}
+}
@@ -0,0 +1,167 @@
+package httpclient
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func TestTransportConfigValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	testCases := []struct {
+		version string
+		valid   bool
+	}{
+		{"", true},
+		{"1.1", true},
+		{"1.0", true},
+		{"2", true},
+		{"3", false},
+		{"2.5", false},
+	}
+
+	for _, tc := range testCases {
+		config := TransportConfig{HTTPVersion: tc.version}
+		err := config.Validate(nil)
+		if tc.valid {
+			assert.NoError(err, tc.version)
+		} else {
+			assert.Error(err, tc.version)
+		}
+	}
+
+	config := TransportConfig{HTTPVersion: "2"}
+	assert.NoError(config.Validate(&ProxyConfig{}))
+	assert.Error(config.Validate(&ProxyConfig{URL: "http://proxy.example.com:3128"}))
+	assert.Error(config.Validate(&ProxyConfig{FromEnv: true}))
+	config.HTTPVersion = "1.1"
+	assert.NoError(config.Validate(&ProxyConfig{URL: "http://proxy.example.com:3128"}))
+}
+
+func TestTransportConfigHTTPVersion(t *testing.T) {
+	assert := assert.New(t)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	h2Server := httptest.NewUnstartedServer(handler)
+	h2Server.EnableHTTP2 = true
+	h2Server.StartTLS()
+	defer h2Server.Close()
+	h1Server := httptest.NewTLSServer(handler)
+	defer h1Server.Close()
+	h2cServer := httptest.NewServer(h2c.NewHandler(handler, &http2.Server{}))
+	defer h2cServer.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(h2Server.Certificate())
+	pool.AddCert(h1Server.Certificate())
+
+	get := func(version, url string) (string, error) {
+		config := TransportConfig{HTTPVersion: version}
+		require.NoError(t, config.Validate(nil))
+		resp, err := New(&tls.Config{RootCAs: pool}, 5*time.Second, true, config.Configure).Get(url)
+		if err != nil {
+			return "", err
+		}
+		resp.Body.Close()
+		return resp.Proto, nil
+	}
+
+	proto, err := get("", h2Server.URL)
+	assert.NoError(err)
+	assert.Equal("HTTP/2.0", proto)
+	proto, err = get("1.1", h2Server.URL)
+	assert.NoError(err)
+	assert.Equal("HTTP/1.1", proto)
+	proto, err = get("2", h2Server.URL)
+	assert.NoError(err)
+	assert.Equal("HTTP/2.0", proto)
+	proto, err = get("2", h2cServer.URL)
+	assert.NoError(err)
+	assert.Equal("HTTP/2.0", proto)
+
+	proto, err = get("", h1Server.URL)
+	assert.NoError(err)
+	assert.Equal("HTTP/1.1", proto)
+	_, err = get("2", h1Server.URL)
+	assert.Error(err)
+
+	// The dialer set by the options before it is used.
+	config := TransportConfig{HTTPVersion: "2"}
+	require.NoError(t, config.Validate(nil))
+	guard := GuardConfig{DenyPrivateNetworks: true}
+	require.NoError(t, guard.Validate())
+	for _, url := range []string{h2Server.URL, h2cServer.URL} {
+		_, err = New(&tls.Config{RootCAs: pool}, 5*time.Second, true, guard.Configure, config.Configure).Get(url)
+		var deniedErr *DeniedAddressError
+		assert.True(errors.As(err, &deniedErr), err)
+	}
+}
+
+func TestTransportConfigTimeouts(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, config := range []TransportConfig{{ConnectTimeout: "soon"}, {TLSTimeout: "0s"}, {ResponseHeaderTimeout: "-1s"}} {
+		assert.Error(config.Validate(nil), config)
+	}
+
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(500 * time.Millisecond)
+	}))
+	defer slow.Close()
+	// A listener that accepts connections but never completes a handshake.
+	silent, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer silent.Close()
+	go func() {
+		for {
+			conn, err := silent.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	// A dialer that never connects.
+	hang := func(transport *http.Transport) {
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			<-ctx.Done()
+			return nil, &net.OpError{Op: "dial", Net: network, Err: ctx.Err()}
+		}
+	}
+
+	get := func(config TransportConfig, url string, options ...func(*http.Transport)) error {
+		require.NoError(t, config.Validate(nil))
+		start := time.Now()
+		resp, err := New(&tls.Config{}, 5*time.Second, true, append(options, config.Configure)...).Get(url)
+		if err == nil {
+			resp.Body.Close()
+		}
+		assert.True(time.Since(start) < 2*time.Second, url)
+		return err
+	}
+
+	err = get(TransportConfig{ConnectTimeout: "100ms"}, slow.URL, hang)
+	require.Error(t, err)
+	assert.Contains(Describe(err), "connect timed out")
+	err = get(TransportConfig{TLSTimeout: "100ms"}, "https://"+silent.Addr().String())
+	require.Error(t, err)
+	assert.Contains(Describe(err), "TLS handshake timed out")
+	err = get(TransportConfig{ResponseHeaderTimeout: "100ms"}, slow.URL)
+	require.Error(t, err)
+	assert.Contains(Describe(err), "timed out awaiting response headers")
+	assert.NoError(get(TransportConfig{ConnectTimeout: "1s", ResponseHeaderTimeout: "1s"}, slow.URL))
+}
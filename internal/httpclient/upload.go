@@ -0,0 +1,246 @@
+package httpclient
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+)
+
+// UploadConfig holds the settings for sending a file as the body of the
+// request of a check, to probe upload paths such as artifact registries and
+// log ingestion endpoints.
+type UploadConfig struct {
+	File           string
+	Method         string
+	ExpectContinue bool
+
+	size int64
+}
+
+// Options returns the plugin config options for c, to be appended to the
+// options of a check.
+func (c *UploadConfig) Options() []*sensu.PluginConfigOption {
+	return []*sensu.PluginConfigOption{
+		{
+			Path:     "upload-file",
+			Env:      "",
+			Argument: "upload-file",
+			Default:  "",
+			Usage:    "File to send as the request body, reporting the upload throughput",
+			Value:    &c.File,
+		},
+		{
+			Path:     "upload-method",
+			Env:      "",
+			Argument: "upload-method",
+			Default:  "PUT",
+			Usage:    "Method to send --upload-file with, PUT or POST",
+			Value:    &c.Method,
+		},
+		{
+			Path:     "expect-100-continue",
+			Env:      "",
+			Argument: "expect-100-continue",
+			Default:  false,
+			Usage:    "Send --upload-file with Expect: 100-continue, waiting for the server to accept the request before sending the body",
+			Value:    &c.ExpectContinue,
+		},
+	}
+}
+
+// Validate checks the settings of c and the size of the file.
+func (c *UploadConfig) Validate() error {
+	c.size = 0
+	if len(c.File) == 0 {
+		if c.ExpectContinue {
+			return fmt.Errorf("--expect-100-continue requires --upload-file")
+		}
+		return nil
+	}
+	c.Method = strings.ToUpper(c.Method)
+	switch c.Method {
+	case "":
+		c.Method = http.MethodPut
+	case http.MethodPut, http.MethodPost:
+	default:
+		return fmt.Errorf("--upload-method %q is not valid, must be PUT or POST", c.Method)
+	}
+	info, err := os.Stat(c.File)
+	if err != nil {
+		return fmt.Errorf("--upload-file: %v", err)
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("--upload-file %s is not a regular file", c.File)
+	}
+	c.size = info.Size()
+	return nil
+}
+
+// Enabled returns whether a file is uploaded.
+func (c *UploadConfig) Enabled() bool {
+	return len(c.File) > 0
+}
+
+// Prepare returns req sending the file with the upload method, with the
+// Expect: 100-continue header if configured, and the Upload recording how it
+// is sent. Validate must have been called first.
+func (c *UploadConfig) Prepare(req *http.Request) (*http.Request, *Upload, error) {
+	upload := &Upload{Size: c.size, ExpectContinue: c.ExpectContinue}
+	body := func() (io.ReadCloser, error) {
+		file, err := os.Open(c.File)
+		if err != nil {
+			return nil, fmt.Errorf("--upload-file: %v", err)
+		}
+		return &countingReader{ReadCloser: file, upload: upload}, nil
+	}
+	if c.size == 0 {
+		// A body of length 0 would be sent chunked.
+		body = func() (io.ReadCloser, error) {
+			return http.NoBody, nil
+		}
+	}
+	reqBody, err := body()
+	if err != nil {
+		return nil, nil, err
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), upload.trace()))
+	req.Method = c.Method
+	req.Body = reqBody
+	req.GetBody = body
+	req.ContentLength = c.size
+	if c.ExpectContinue {
+		req.Header.Set("Expect", "100-continue")
+	}
+	return req, upload, nil
+}
+
+// Upload records how the file of an UploadConfig is sent: whether and when
+// the server answered 100 Continue, and the bytes of the body sent and how
+// long sending them took.
+type Upload struct {
+	Size           int64
+	ExpectContinue bool
+
+	mu          sync.Mutex
+	wroteHeader time.Time
+	continued   time.Time
+	bodyStart   time.Time
+	bodyEnd     time.Time
+	sent        int64
+}
+
+// trace returns the client trace recording u.
+func (u *Upload) trace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		WroteHeaders: func() {
+			u.mu.Lock()
+			defer u.mu.Unlock()
+			u.wroteHeader = time.Now()
+			u.sent = 0
+			u.continued, u.bodyStart, u.bodyEnd = time.Time{}, time.Time{}, time.Time{}
+		},
+		Got100Continue: func() {
+			u.mu.Lock()
+			defer u.mu.Unlock()
+			u.continued = time.Now()
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			u.mu.Lock()
+			defer u.mu.Unlock()
+			u.bodyEnd = time.Now()
+		},
+	}
+}
+
+// countingReader counts the bytes of the body of an Upload read by the
+// transport to send.
+type countingReader struct {
+	io.ReadCloser
+	upload *Upload
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.upload.mu.Lock()
+	defer r.upload.mu.Unlock()
+	if r.upload.bodyStart.IsZero() {
+		r.upload.bodyStart = time.Now()
+	}
+	r.upload.sent += int64(n)
+	return n, err
+}
+
+// Continued returns whether the server answered 100 Continue, and how long
+// after the request headers were sent.
+func (u *Upload) Continued() (bool, time.Duration) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.continued.IsZero() {
+		return false, 0
+	}
+	return true, u.continued.Sub(u.wroteHeader)
+}
+
+// Sent returns the bytes of the body sent, and how long sending them took,
+// from the first read of the body to the request being written.
+func (u *Upload) Sent() (int64, time.Duration) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.bodyStart.IsZero() || u.bodyEnd.Before(u.bodyStart) {
+		return u.sent, 0
+	}
+	return u.sent, u.bodyEnd.Sub(u.bodyStart)
+}
+
+// Throughput returns the upload throughput in bytes per second, 0 if the
+// body was not sent.
+func (u *Upload) Throughput() float64 {
+	sent, duration := u.Sent()
+	if sent == 0 || duration <= 0 {
+		return 0
+	}
+	return float64(sent) / duration.Seconds()
+}
+
+// Output returns a description of the upload for the check output, e.g.
+// "uploaded 10485760 bytes at 20.97 MB/s, 100 Continue after 0.003s".
+func (u *Upload) Output() string {
+	sent, _ := u.Sent()
+	var output string
+	if sent < u.Size {
+		output = fmt.Sprintf("uploaded %d of %d bytes", sent, u.Size)
+	} else {
+		output = fmt.Sprintf("uploaded %d bytes at %.2f MB/s", sent, u.Throughput()/1e6)
+	}
+	if u.ExpectContinue {
+		if continued, after := u.Continued(); continued {
+			output += fmt.Sprintf(", 100 Continue after %.3fs", after.Seconds())
+		} else {
+			output += ", no 100 Continue"
+		}
+	}
+	return output
+}
+
+// Perfdata returns the metrics of the upload as perfdata: the bytes sent,
+// the duration and throughput of sending them and, with Expect:
+// 100-continue, the time to the 100 Continue (-1 without one).
+func (u *Upload) Perfdata() string {
+	sent, duration := u.Sent()
+	perfdata := fmt.Sprintf("upload_bytes=%d, upload_duration=%f, upload_throughput=%.0f", sent, duration.Seconds(), u.Throughput())
+	if u.ExpectContinue {
+		continueDuration := -1.0
+		if continued, after := u.Continued(); continued {
+			continueDuration = after.Seconds()
+		}
+		perfdata += fmt.Sprintf(", continue_duration=%f", continueDuration)
+	}
+	return perfdata
+}
@@ -0,0 +1,112 @@
+package httpclient
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUploadConfigValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "httpclient-upload")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "upload.bin")
+	require.NoError(t, ioutil.WriteFile(file, []byte("data"), 0644))
+
+	testCases := []struct {
+		config UploadConfig
+		valid  bool
+	}{
+		{UploadConfig{}, true},
+		{UploadConfig{File: file}, true},
+		{UploadConfig{File: file, Method: "post", ExpectContinue: true}, true},
+		{UploadConfig{ExpectContinue: true}, false},
+		{UploadConfig{File: file, Method: "GET"}, false},
+		{UploadConfig{File: dir}, false},
+		{UploadConfig{File: filepath.Join(dir, "missing.bin")}, false},
+	}
+
+	for _, tc := range testCases {
+		err := tc.config.Validate()
+		if tc.valid {
+			assert.NoError(err, tc.config)
+		} else {
+			assert.Error(err, tc.config)
+		}
+	}
+}
+
+func TestUploadConfigPrepare(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "httpclient-upload")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "upload.bin")
+	data := strings.Repeat("x", 1<<20)
+	require.NoError(t, ioutil.WriteFile(file, []byte(data), 0644))
+
+	var received, expect string
+	var test = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		expect = r.Header.Get("Expect")
+		if r.URL.Path == "/full" {
+			// Answered without reading the body, so without 100 Continue.
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		received = r.Method + " " + string(body)
+	}))
+	defer test.Close()
+
+	client := New(nil, 5*time.Second, true)
+	upload := func(config UploadConfig, path string) (*http.Response, *Upload) {
+		require.NoError(t, config.Validate())
+		req, err := http.NewRequest("GET", test.URL+path, nil)
+		require.NoError(t, err)
+		req, upload, err := config.Prepare(req)
+		require.NoError(t, err)
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp, upload
+	}
+
+	resp, u := upload(UploadConfig{File: file}, "/")
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.Equal("PUT "+data, received)
+	assert.Empty(expect)
+	sent, _ := u.Sent()
+	assert.Equal(int64(len(data)), sent)
+	assert.True(u.Throughput() > 0)
+	assert.Regexp(`^uploaded 1048576 bytes at [0-9.]+ MB/s$`, u.Output())
+	assert.Regexp(`^upload_bytes=1048576, upload_duration=[0-9.]+, upload_throughput=[0-9]+$`, u.Perfdata())
+
+	received = ""
+	resp, u = upload(UploadConfig{File: file, Method: "POST", ExpectContinue: true}, "/")
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.Equal("POST "+data, received)
+	assert.Equal("100-continue", expect)
+	continued, _ := u.Continued()
+	assert.True(continued)
+	assert.Regexp(`^uploaded 1048576 bytes at [0-9.]+ MB/s, 100 Continue after [0-9.]+s$`, u.Output())
+	assert.Regexp(`, continue_duration=[0-9.]+$`, u.Perfdata())
+
+	// The body is not sent when the server answers before 100 Continue.
+	resp, u = upload(UploadConfig{File: file, ExpectContinue: true}, "/full")
+	assert.Equal(http.StatusRequestEntityTooLarge, resp.StatusCode)
+	sent, _ = u.Sent()
+	assert.True(sent < int64(len(data)), sent)
+	assert.Regexp(`^uploaded [0-9]+ of 1048576 bytes, no 100 Continue$`, u.Output())
+	assert.Regexp(`, continue_duration=-1\.000000$`, u.Perfdata())
+}
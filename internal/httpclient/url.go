@@ -0,0 +1,248 @@
+package httpclient
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/nixwiz/http-checks/internal/logging"
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+	"golang.org/x/net/idna"
+)
+
+// strictURLs is set by URLConfig.Validate, with it ParseURL rejects rather
+// than normalizes URLs with internationalized host names or unencoded
+// characters.
+var strictURLs bool
+
+// URLConfig holds the URL parsing settings of a check.
+type URLConfig struct {
+	Strict bool
+}
+
+// Options returns the plugin config options for c, to be appended to the
+// options of a check.
+func (c *URLConfig) Options() []*sensu.PluginConfigOption {
+	return []*sensu.PluginConfigOption{
+		{
+			Path:     "strict-url",
+			Env:      "",
+			Argument: "strict-url",
+			Default:  false,
+			Usage:    "Reject URLs with internationalized host names or unencoded spaces and unicode rather than converting them to punycode and percent-encoding",
+			Value:    &c.Strict,
+		},
+	}
+}
+
+// Validate applies the settings of c to ParseURL, it must be called before
+// the URLs of the check are parsed.
+func (c *URLConfig) Validate() error {
+	strictURLs = c.Strict
+	return nil
+}
+
+// ParseURL parses rawURL, the value of flag (e.g. "--url"), as the http or
+// https URL of a check. Surrounding whitespace is removed and a URL without a
+// scheme is assumed to be http, with a warning. IPv6 literals must be in
+// brackets, zone identifiers may be given without escaping their "%". Any
+// userinfo is kept, see auth.Config.FromURL. The errors returned name flag
+// and say how to fix the URL, rather than the cryptic errors a request with
+// it would fail with, with any password in the URL redacted.
+//
+// Internationalized host names are converted to punycode, and spaces,
+// unicode and stray "%" in the path and query are percent-encoded, unless
+// --strict-url is set, see URLConfig.
+//
+// Schemes other than http and https are rejected unless listed in schemes,
+// see RegisterFileSchemes. file URLs have no host.
+func ParseURL(flag, rawURL string, schemes ...string) (*url.URL, error) {
+	rawURL = strings.TrimSpace(rawURL)
+	if len(rawURL) == 0 {
+		return nil, fmt.Errorf("%s is empty", flag)
+	}
+	if !strings.Contains(rawURL, "://") {
+		logging.Warn("URL has no scheme, assuming http", "flag", flag, "url", redactRawURL(rawURL))
+		rawURL = "http://" + rawURL
+	}
+	rawURL = escapeZone(rawURL)
+	if !strictURLs {
+		rawURL = escapePercents(rawURL)
+	}
+	u, err := parseURL(rawURL, schemes)
+	if err == nil {
+		err = normalizeURL(u, rawURL)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s %q %v", flag, redactRawURL(rawURL), err)
+	}
+	if normalized := u.String(); normalized != rawURL {
+		logging.Debug("normalized URL", "flag", flag, "url", redactRawURL(rawURL), "normalized", redactRawURL(normalized))
+	}
+	return u, nil
+}
+
+// normalizeURL converts the internationalized host name of u, parsed from
+// rawURL, to punycode and percent-encodes the characters of its query that
+// must not be sent unencoded, the path is encoded by url.URL itself. With
+// --strict-url such URLs are an error instead.
+func normalizeURL(u *url.URL, rawURL string) error {
+	host := u.Hostname()
+	if !isASCII(host) {
+		ascii, err := idna.Lookup.ToASCII(host)
+		if err != nil {
+			return fmt.Errorf("has an invalid internationalized host name: %v", err)
+		}
+		if strictURLs {
+			return fmt.Errorf("has an internationalized host name, use its punycode form %s with --strict-url", ascii)
+		}
+		if port := u.Port(); len(port) > 0 {
+			ascii = net.JoinHostPort(ascii, port)
+		}
+		u.Host = ascii
+	}
+	if strictURLs {
+		rest := rawURL[strings.Index(rawURL, "://")+len("://"):]
+		if i := strings.IndexAny(rest, "/?#"); i >= 0 && escapeQuery(rest[i:]) != rest[i:] {
+			return fmt.Errorf("has unencoded characters, percent-encode them (e.g. %%20 for a space) with --strict-url")
+		}
+		return nil
+	}
+	u.RawQuery = escapeQuery(u.RawQuery)
+	return nil
+}
+
+// escapeQuery percent-encodes the spaces, control characters, unicode and
+// other characters of query that are not valid in a request line.
+func escapeQuery(query string) string {
+	var b strings.Builder
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		if c <= ' ' || c >= 0x7f || strings.IndexByte("\"<>\\^`{|}", c) >= 0 {
+			fmt.Fprintf(&b, "%%%02X", c)
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// escapePercents escapes the "%" of rawURL that do not start a percent
+// escape, e.g. in http://example.com/100%, as url.Parse requires.
+func escapePercents(rawURL string) string {
+	var b strings.Builder
+	for i := 0; i < len(rawURL); i++ {
+		if rawURL[i] == '%' && (i+2 >= len(rawURL) || !isHex(rawURL[i+1]) || !isHex(rawURL[i+2])) {
+			b.WriteString("%25")
+			continue
+		}
+		b.WriteByte(rawURL[i])
+	}
+	return b.String()
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+// parseURL parses and checks rawURL, its errors are completed by ParseURL.
+func parseURL(rawURL string, schemes []string) (*url.URL, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		if urlErr, ok := err.(*url.Error); ok {
+			err = urlErr.Err
+		}
+		return nil, fmt.Errorf("is not a valid URL: %v", err)
+	}
+	allowed := append([]string{"http", "https"}, schemes...)
+	found := false
+	for _, scheme := range allowed {
+		found = found || u.Scheme == scheme
+	}
+	if !found {
+		return nil, fmt.Errorf("has scheme %q, must be %s or %s", u.Scheme, strings.Join(allowed[:len(allowed)-1], ", "), allowed[len(allowed)-1])
+	}
+	if u.Scheme == "file" {
+		if len(u.Host) > 0 && u.Host != "localhost" {
+			return nil, fmt.Errorf("has host %q, file URLs must name a local path as in file:///path", u.Host)
+		}
+		if len(u.Path) == 0 {
+			return nil, fmt.Errorf("has no path")
+		}
+		return u, nil
+	}
+	if len(u.Host) == 0 {
+		return nil, fmt.Errorf("has no host")
+	}
+	if !strings.HasPrefix(u.Host, "[") && strings.Count(u.Host, ":") > 1 {
+		example := "[" + u.Host + "]"
+		if i := strings.LastIndex(u.Host, ":"); net.ParseIP(u.Host) == nil && net.ParseIP(u.Host[:i]) != nil {
+			example = "[" + u.Host[:i] + "]" + u.Host[i:]
+		}
+		return nil, fmt.Errorf("has an IPv6 address that is not in brackets, use %s://%s%s", u.Scheme, example, u.EscapedPath())
+	}
+	if port := u.Port(); len(port) > 0 {
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return nil, fmt.Errorf("has port %s, must be between 1 and 65535", port)
+		}
+	}
+	if len(u.Hostname()) == 0 {
+		return nil, fmt.Errorf("has no host")
+	}
+	return u, nil
+}
+
+// escapeZone escapes the "%" of the zone identifier of an IPv6 literal in
+// rawURL, e.g. http://[fe80::1%eth0]/ as http://[fe80::1%25eth0]/, as
+// url.Parse requires.
+func escapeZone(rawURL string) string {
+	start := strings.Index(rawURL, "://[")
+	if start < 0 {
+		return rawURL
+	}
+	start += len("://[")
+	end := strings.Index(rawURL[start:], "]")
+	if end < 0 {
+		return rawURL
+	}
+	host := rawURL[start : start+end]
+	i := strings.Index(host, "%")
+	if i < 0 || strings.HasPrefix(host[i:], "%25") {
+		return rawURL
+	}
+	return rawURL[:start] + host[:i] + "%25" + host[i+1:] + rawURL[start+end:]
+}
+
+// redactRawURL returns rawURL with the password of its userinfo, if any,
+// redacted. Unlike redactURL it works on URLs that do not parse.
+func redactRawURL(rawURL string) string {
+	i := strings.Index(rawURL, "://")
+	if i < 0 {
+		i = -len("://")
+	}
+	authority := rawURL[i+len("://"):]
+	if end := strings.IndexAny(authority, "/?#"); end >= 0 {
+		authority = authority[:end]
+	}
+	at := strings.LastIndex(authority, "@")
+	if at < 0 {
+		return rawURL
+	}
+	colon := strings.Index(authority[:at], ":")
+	if colon < 0 {
+		return rawURL
+	}
+	start := i + len("://")
+	return rawURL[:start+colon+1] + "REDACTED" + rawURL[start+at:]
+}
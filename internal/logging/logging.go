@@ -0,0 +1,168 @@
+// Package logging provides leveled, structured logging for the checks. Log
+// lines are written to stderr in logfmt style (key=value pairs), so stdout is
+// kept for the check output and metrics.
+package logging
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+)
+
+// Level is a log level, messages below the configured level are discarded.
+type Level int
+
+// The log levels, from least to most verbose.
+const (
+	LevelError Level = iota
+	LevelWarn
+	LevelInfo
+	LevelDebug
+)
+
+var levelNames = []string{"error", "warn", "info", "debug"}
+
+func (l Level) String() string {
+	if l < LevelError || l > LevelDebug {
+		return strconv.Itoa(int(l))
+	}
+	return levelNames[l]
+}
+
+var (
+	mu     sync.Mutex
+	level            = LevelWarn
+	output io.Writer = os.Stderr
+)
+
+// Config holds the logging settings of a check.
+type Config struct {
+	Debug bool
+	Level string
+}
+
+// Options returns the plugin config options for c, to be appended to the
+// options of a check.
+func (c *Config) Options() []*sensu.PluginConfigOption {
+	return []*sensu.PluginConfigOption{
+		{
+			Path:     "debug",
+			Env:      "",
+			Argument: "debug",
+			Default:  false,
+			Usage:    "Log requests, responses, connection details and timings to stderr, same as --log-level debug",
+			Value:    &c.Debug,
+		},
+		{
+			Path:     "log-level",
+			Env:      "CHECK_LOG_LEVEL",
+			Argument: "log-level",
+			Default:  LevelWarn.String(),
+			Usage:    "Level of the messages logged to stderr, one of " + strings.Join(levelNames, ", "),
+			Value:    &c.Level,
+		},
+	}
+}
+
+// Validate checks the settings of c and applies them.
+func (c *Config) Validate() error {
+	configured := LevelWarn
+	if len(c.Level) > 0 {
+		found := false
+		for i, name := range levelNames {
+			if strings.EqualFold(c.Level, name) {
+				configured = Level(i)
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("--log-level %q is not valid, must be one of %s", c.Level, strings.Join(levelNames, ", "))
+		}
+	}
+	if c.Debug {
+		configured = LevelDebug
+	}
+	SetLevel(configured)
+	return nil
+}
+
+// SetLevel sets the level of the messages that are logged.
+func SetLevel(l Level) {
+	mu.Lock()
+	defer mu.Unlock()
+	level = l
+}
+
+// SetOutput sets the destination of the log, stderr by default.
+func SetOutput(w io.Writer) {
+	mu.Lock()
+	defer mu.Unlock()
+	output = w
+}
+
+// Enabled reports whether messages at level l are logged.
+func Enabled(l Level) bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return l <= level
+}
+
+// Error logs msg with the key/value pairs in keyvals at error level.
+func Error(msg string, keyvals ...interface{}) {
+	log(LevelError, msg, keyvals)
+}
+
+// Warn logs msg with the key/value pairs in keyvals at warn level.
+func Warn(msg string, keyvals ...interface{}) {
+	log(LevelWarn, msg, keyvals)
+}
+
+// Info logs msg with the key/value pairs in keyvals at info level.
+func Info(msg string, keyvals ...interface{}) {
+	log(LevelInfo, msg, keyvals)
+}
+
+// Debug logs msg with the key/value pairs in keyvals at debug level.
+func Debug(msg string, keyvals ...interface{}) {
+	log(LevelDebug, msg, keyvals)
+}
+
+func log(l Level, msg string, keyvals []interface{}) {
+	mu.Lock()
+	defer mu.Unlock()
+	if l > level {
+		return
+	}
+
+	var line strings.Builder
+	line.WriteString("time=" + time.Now().UTC().Format(time.RFC3339Nano))
+	line.WriteString(" level=" + l.String())
+	line.WriteString(" msg=" + quote(msg))
+	for i := 0; i < len(keyvals); i += 2 {
+		key := fmt.Sprint(keyvals[i])
+		var value interface{} = "(missing)"
+		if i+1 < len(keyvals) {
+			value = keyvals[i+1]
+		}
+		if value == nil {
+			continue
+		}
+		line.WriteString(" " + key + "=" + quote(fmt.Sprint(value)))
+	}
+	line.WriteString("\n")
+	_, _ = io.WriteString(output, line.String())
+}
+
+// quote quotes s if it is empty or contains spaces, quotes or equal signs.
+func quote(s string) string {
+	if len(s) == 0 || strings.ContainsAny(s, " \t\r\n\"=") {
+		return strconv.Quote(s)
+	}
+	return s
+}
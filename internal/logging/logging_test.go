@@ -0,0 +1,37 @@
+package logging
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLog(t *testing.T) {
+	assert := assert.New(t)
+	var buf bytes.Buffer
+	SetOutput(&buf)
+	defer SetOutput(os.Stderr)
+
+	config := Config{Level: "info"}
+	assert.NoError(config.Validate())
+	Debug("hidden")
+	Info("request failed", "url", "http://localhost/", "attempt", 2, "error", errors.New("connection refused"), "skipped", nil)
+	assert.NotContains(buf.String(), "hidden")
+	assert.Contains(buf.String(), ` level=info msg="request failed" url=http://localhost/ attempt=2 error="connection refused"`+"\n")
+	assert.NotContains(buf.String(), "skipped")
+
+	config = Config{Level: "error", Debug: true}
+	assert.NoError(config.Validate())
+	assert.True(Enabled(LevelDebug))
+
+	config = Config{Level: "verbose"}
+	assert.Error(config.Validate())
+
+	config = Config{}
+	assert.NoError(config.Validate())
+	assert.True(Enabled(LevelWarn))
+	assert.False(Enabled(LevelInfo))
+}
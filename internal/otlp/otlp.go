@@ -0,0 +1,277 @@
+// Package otlp exports the timings of a check as an OpenTelemetry trace, sent
+// to a collector with OTLP over HTTP in its JSON encoding. It implements only
+// what the checks need, a single trace of spans with string and integer
+// attributes, rather than depending on the OpenTelemetry SDK.
+package otlp
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+)
+
+// Span kinds, see the OTLP trace protocol.
+const (
+	KindInternal = 1
+	KindClient   = 3
+)
+
+// Config holds the trace export settings of a check.
+type Config struct {
+	Endpoint    string
+	ServiceName string
+	Headers     []string
+
+	url string
+}
+
+// Options returns the plugin config options for c, to be appended to the
+// options of a check.
+func (c *Config) Options() []*sensu.PluginConfigOption {
+	return []*sensu.PluginConfigOption{
+		{
+			Path:     "otel-endpoint",
+			Env:      "OTEL_EXPORTER_OTLP_ENDPOINT",
+			Argument: "otel-endpoint",
+			Default:  "",
+			Usage:    "OTLP/HTTP endpoint of an OpenTelemetry collector to export a trace of each run to (e.g. http://localhost:4318), traces are sent to its /v1/traces path",
+			Value:    &c.Endpoint,
+		},
+		{
+			Path:     "otel-service-name",
+			Env:      "OTEL_SERVICE_NAME",
+			Argument: "otel-service-name",
+			Default:  "",
+			Usage:    "Service name of exported traces, the name of the command by default",
+			Value:    &c.ServiceName,
+		},
+		{
+			Path:     "otel-header",
+			Env:      "",
+			Argument: "otel-header",
+			Default:  []string{},
+			Usage:    "Additional header(s) to send with exported traces, e.g. for authentication with the collector",
+			Value:    &c.Headers,
+		},
+	}
+}
+
+// Validate checks the settings of c.
+func (c *Config) Validate() error {
+	c.url = ""
+	for _, header := range c.Headers {
+		if len(strings.SplitN(header, ":", 2)) != 2 {
+			return fmt.Errorf("--otel-header %q value malformed should be \"Header-Name: Header Value\"", header)
+		}
+	}
+	if len(c.Endpoint) == 0 {
+		return nil
+	}
+	u, err := url.Parse(c.Endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		return fmt.Errorf("--otel-endpoint %q is not a valid http or https URL", c.Endpoint)
+	}
+	if !strings.HasSuffix(u.Path, "/v1/traces") {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/v1/traces"
+	}
+	c.url = u.String()
+	return nil
+}
+
+// Enabled reports whether traces are exported. Validate must have been
+// called first.
+func (c *Config) Enabled() bool {
+	return len(c.url) > 0
+}
+
+// Trace is a trace of spans.
+type Trace struct {
+	ID    [16]byte
+	Spans []*Span
+}
+
+// Span is a timed operation of a trace.
+type Span struct {
+	ID         [8]byte
+	Parent     *Span
+	Name       string
+	Kind       int
+	Start, End time.Time
+	Attributes map[string]interface{}
+	// Error marks the span as failed, with Error as the status message.
+	Error string
+}
+
+// NewTrace returns a new, empty trace with a random ID.
+func NewTrace() *Trace {
+	t := &Trace{}
+	_, _ = io.ReadFull(rand.Reader, t.ID[:])
+	return t
+}
+
+// Span adds a span to t and returns it, parent is nil for the root span.
+func (t *Trace) Span(parent *Span, name string, kind int, start, end time.Time) *Span {
+	s := &Span{Parent: parent, Name: name, Kind: kind, Start: start, End: end, Attributes: map[string]interface{}{}}
+	_, _ = io.ReadFull(rand.Reader, s.ID[:])
+	t.Spans = append(t.Spans, s)
+	return s
+}
+
+// TraceParent returns the W3C traceparent header value for span s of t, for
+// propagating the trace to the server.
+func (t *Trace) TraceParent(s *Span) string {
+	return fmt.Sprintf("00-%s-%s-01", hex.EncodeToString(t.ID[:]), hex.EncodeToString(s.ID[:]))
+}
+
+// Export sends t with client to the collector, for a check named name.
+// Validate must have been called first.
+func (c *Config) Export(ctx context.Context, client *http.Client, name string, t *Trace) error {
+	serviceName := c.ServiceName
+	if len(serviceName) == 0 {
+		serviceName = name
+	}
+	body, err := json.Marshal(t.request(serviceName))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	for _, header := range c.Headers {
+		headerSplit := strings.SplitN(header, ":", 2)
+		req.Header.Set(strings.TrimSpace(headerSplit[0]), strings.TrimSpace(headerSplit[1]))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("collector returned HTTP Status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// The types below are the JSON encoding of an OTLP ExportTraceServiceRequest.
+// IDs are hex encoded and 64 bit integers are strings, as in the protobuf JSON
+// mapping.
+
+type exportRequest struct {
+	ResourceSpans []resourceSpans `json:"resourceSpans"`
+}
+
+type resourceSpans struct {
+	Resource   resource     `json:"resource"`
+	ScopeSpans []scopeSpans `json:"scopeSpans"`
+}
+
+type resource struct {
+	Attributes []keyValue `json:"attributes"`
+}
+
+type scopeSpans struct {
+	Scope scope      `json:"scope"`
+	Spans []spanJSON `json:"spans"`
+}
+
+type scope struct {
+	Name string `json:"name"`
+}
+
+type spanJSON struct {
+	TraceID           string     `json:"traceId"`
+	SpanID            string     `json:"spanId"`
+	ParentSpanID      string     `json:"parentSpanId,omitempty"`
+	Name              string     `json:"name"`
+	Kind              int        `json:"kind"`
+	StartTimeUnixNano string     `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+	Attributes        []keyValue `json:"attributes,omitempty"`
+	Status            *status    `json:"status,omitempty"`
+}
+
+type status struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type keyValue struct {
+	Key   string   `json:"key"`
+	Value anyValue `json:"value"`
+}
+
+type anyValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+}
+
+func attributes(values map[string]interface{}) []keyValue {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var kvs []keyValue
+	for _, key := range keys {
+		var v anyValue
+		switch value := values[key].(type) {
+		case int:
+			s := strconv.Itoa(value)
+			v.IntValue = &s
+		case int64:
+			s := strconv.FormatInt(value, 10)
+			v.IntValue = &s
+		default:
+			s := fmt.Sprint(value)
+			v.StringValue = &s
+		}
+		kvs = append(kvs, keyValue{Key: key, Value: v})
+	}
+	return kvs
+}
+
+func (t *Trace) request(serviceName string) exportRequest {
+	var spans []spanJSON
+	for _, s := range t.Spans {
+		span := spanJSON{
+			TraceID:           hex.EncodeToString(t.ID[:]),
+			SpanID:            hex.EncodeToString(s.ID[:]),
+			Name:              s.Name,
+			Kind:              s.Kind,
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+			Attributes:        attributes(s.Attributes),
+		}
+		if s.Parent != nil {
+			span.ParentSpanID = hex.EncodeToString(s.Parent.ID[:])
+		}
+		if len(s.Error) > 0 {
+			// STATUS_CODE_ERROR
+			span.Status = &status{Code: 2, Message: s.Error}
+		}
+		spans = append(spans, span)
+	}
+	return exportRequest{
+		ResourceSpans: []resourceSpans{{
+			Resource:   resource{Attributes: attributes(map[string]interface{}{"service.name": serviceName})},
+			ScopeSpans: []scopeSpans{{Scope: scope{Name: "github.com/nixwiz/http-checks"}, Spans: spans}},
+		}},
+	}
+}
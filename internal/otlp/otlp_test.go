@@ -0,0 +1,93 @@
+package otlp
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidate(t *testing.T) {
+	assert := assert.New(t)
+	testCases := []struct {
+		endpoint string
+		url      string
+	}{
+		{"http://localhost:4318", "http://localhost:4318/v1/traces"},
+		{"http://localhost:4318/", "http://localhost:4318/v1/traces"},
+		{"https://otel.example.com/otlp", "https://otel.example.com/otlp/v1/traces"},
+		{"https://otel.example.com/v1/traces", "https://otel.example.com/v1/traces"},
+	}
+	for _, tc := range testCases {
+		c := Config{Endpoint: tc.endpoint}
+		assert.NoError(c.Validate())
+		assert.True(c.Enabled())
+		assert.Equal(tc.url, c.url)
+	}
+
+	c := Config{}
+	assert.NoError(c.Validate())
+	assert.False(c.Enabled())
+	c = Config{Endpoint: "localhost:4318"}
+	assert.Error(c.Validate())
+	c = Config{Endpoint: "http://localhost:4318", Headers: []string{"no colon"}}
+	assert.Error(c.Validate())
+}
+
+func TestExport(t *testing.T) {
+	assert := assert.New(t)
+	var (
+		request exportRequest
+		apiKey  string
+	)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal("/v1/traces", r.URL.Path)
+		assert.Equal("application/json", r.Header.Get("Content-Type"))
+		apiKey = r.Header.Get("X-Api-Key")
+		body, _ := ioutil.ReadAll(r.Body)
+		assert.NoError(json.Unmarshal(body, &request))
+	}))
+	defer collector.Close()
+
+	c := Config{Endpoint: collector.URL, Headers: []string{"X-Api-Key: s3cret"}}
+	require.NoError(t, c.Validate())
+	start := time.Unix(1600000000, 0)
+	trace := NewTrace()
+	root := trace.Span(nil, "GET", KindClient, start, start.Add(time.Second))
+	root.Attributes["http.status_code"] = 503
+	root.Error = "503 Service Unavailable"
+	trace.Span(root, "dns", KindInternal, start, start.Add(time.Millisecond))
+	assert.Regexp(`^00-[0-9a-f]{32}-[0-9a-f]{16}-01$`, trace.TraceParent(root))
+
+	require.NoError(t, c.Export(context.Background(), collector.Client(), "http-perf", trace))
+	assert.Equal("s3cret", apiKey)
+	require.Len(t, request.ResourceSpans, 1)
+	assert.Equal("service.name", request.ResourceSpans[0].Resource.Attributes[0].Key)
+	assert.Equal("http-perf", *request.ResourceSpans[0].Resource.Attributes[0].Value.StringValue)
+	spans := request.ResourceSpans[0].ScopeSpans[0].Spans
+	require.Len(t, spans, 2)
+	assert.Equal(hex.EncodeToString(trace.ID[:]), spans[0].TraceID)
+	assert.Equal(hex.EncodeToString(root.ID[:]), spans[0].SpanID)
+	assert.Empty(spans[0].ParentSpanID)
+	assert.Equal(KindClient, spans[0].Kind)
+	assert.Equal("1600000000000000000", spans[0].StartTimeUnixNano)
+	assert.Equal("1600000001000000000", spans[0].EndTimeUnixNano)
+	assert.Equal("503", *spans[0].Attributes[0].Value.IntValue)
+	assert.Equal(2, spans[0].Status.Code)
+	assert.Equal(spans[0].SpanID, spans[1].ParentSpanID)
+	assert.Equal("dns", spans[1].Name)
+	assert.Nil(spans[1].Status)
+
+	c.ServiceName = "probes"
+	collector.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	})
+	assert.Error(c.Export(context.Background(), collector.Client(), "http-perf", trace))
+}
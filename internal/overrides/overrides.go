@@ -0,0 +1,61 @@
+// Package overrides enables Sensu annotation based configuration overrides
+// for the checks. The plugin SDK applies overrides from the check and entity
+// annotations under the keyspace of a check (e.g.
+// sensu.io/plugins/http-check/config/timeout), but only when it reads an event
+// from stdin, which the Sensu agent provides for checks with stdin enabled.
+// Reading it is opt-in, as a check run without an event on stdin would
+// otherwise fail.
+package overrides
+
+import (
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+)
+
+const (
+	argument = "event-stdin"
+	env      = "CHECK_EVENT_STDIN"
+)
+
+// Config holds the override settings of a check.
+type Config struct {
+	EventStdin bool
+}
+
+// Options returns the plugin config options for c, to be appended to the
+// options of a check.
+func (c *Config) Options() []*sensu.PluginConfigOption {
+	return []*sensu.PluginConfigOption{
+		{
+			Path:     argument,
+			Env:      env,
+			Argument: argument,
+			Default:  false,
+			Usage:    "Read the Sensu event from stdin (requires stdin: true in the check definition) to apply annotation overrides",
+			Value:    &c.EventStdin,
+		},
+	}
+}
+
+// Requested reports whether reading the event from stdin was requested in
+// args or the environment. It is meant for the readEvent argument of
+// sensu.NewGoCheck, which is needed before the arguments are parsed.
+func Requested(args []string) bool {
+	for _, arg := range args {
+		if arg == "--" {
+			break
+		}
+		if arg == "--"+argument {
+			return true
+		}
+		if strings.HasPrefix(arg, "--"+argument+"=") {
+			enabled, _ := strconv.ParseBool(strings.TrimPrefix(arg, "--"+argument+"="))
+			return enabled
+		}
+	}
+	enabled, _ := strconv.ParseBool(os.Getenv(env))
+	return enabled
+}
@@ -0,0 +1,23 @@
+package overrides
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequested(t *testing.T) {
+	assert := assert.New(t)
+	os.Unsetenv(env)
+
+	assert.False(Requested([]string{"--url", "http://localhost"}))
+	assert.True(Requested([]string{"--url", "http://localhost", "--event-stdin"}))
+	assert.True(Requested([]string{"--event-stdin=true"}))
+	assert.False(Requested([]string{"--event-stdin=false"}))
+	assert.False(Requested([]string{"--", "--event-stdin"}))
+
+	os.Setenv(env, "true")
+	defer os.Unsetenv(env)
+	assert.True(Requested(nil))
+}
@@ -0,0 +1,77 @@
+package overrides
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/template"
+
+	corev2 "github.com/sensu/sensu-go/api/core/v2"
+)
+
+// ParseTokens parses text, the value of flag, with entity tokens as in Sensu
+// token substitution, e.g. {{ .labels.region | default "unknown" }}.
+func ParseTokens(flag, text string) (*template.Template, error) {
+	tmpl, err := template.New(flag).Funcs(template.FuncMap{"default": defaultToken}).Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", flag, err)
+	}
+	return tmpl, nil
+}
+
+// SubstituteTokens returns text, the value of flag, with its entity tokens
+// substituted from the entity of event. The entity is only known with
+// --event-stdin, without it text must not have any tokens. Tokens without a
+// value in the entity and no default are an error.
+func SubstituteTokens(flag, text string, event *corev2.Event) (string, error) {
+	if !strings.Contains(text, "{{") {
+		return text, nil
+	}
+	tmpl, err := ParseTokens(flag, text)
+	if err != nil {
+		return "", err
+	}
+	if event == nil || event.Entity == nil {
+		return "", fmt.Errorf("%s uses entity tokens, which require --%s", flag, argument)
+	}
+	tokens, err := entityTokens(event.Entity)
+	if err != nil {
+		return "", err
+	}
+	var substituted bytes.Buffer
+	if err := tmpl.Execute(&substituted, tokens); err != nil {
+		return "", fmt.Errorf("%s: %v", flag, err)
+	}
+	if strings.Contains(substituted.String(), "<no value>") {
+		return "", fmt.Errorf("%s: the entity has no value for a token of %q, give a default with | default", flag, text)
+	}
+	return substituted.String(), nil
+}
+
+// defaultToken is the default function of entity tokens.
+func defaultToken(def, value interface{}) interface{} {
+	if value == nil || value == "" {
+		return def
+	}
+	return value
+}
+
+// entityTokens returns the data of the entity tokens of entity, the entity as
+// JSON with its metadata at the top level as in Sensu token substitution.
+func entityTokens(entity *corev2.Entity) (map[string]interface{}, error) {
+	data, err := json.Marshal(entity)
+	if err != nil {
+		return nil, err
+	}
+	tokens := map[string]interface{}{}
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return nil, err
+	}
+	if metadata, ok := tokens["metadata"].(map[string]interface{}); ok {
+		for k, v := range metadata {
+			tokens[k] = v
+		}
+	}
+	return tokens, nil
+}
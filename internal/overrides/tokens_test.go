@@ -0,0 +1,38 @@
+package overrides
+
+import (
+	"testing"
+
+	corev2 "github.com/sensu/sensu-go/api/core/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubstituteTokens(t *testing.T) {
+	assert := assert.New(t)
+	event := corev2.FixtureEvent("entity1", "check")
+	event.Entity.Labels = map[string]string{"region": "eu-west"}
+
+	for _, tc := range []struct {
+		text, expected string
+	}{
+		{"plain", "plain"},
+		{"{{ .name }}", "entity1"},
+		{"{{ .namespace }}/{{ .labels.region }}", "default/eu-west"},
+		{`{{ .labels.team | default "sre" }}`, "sre"},
+		{`{{ .labels.region | default "global" }}`, "eu-west"},
+	} {
+		substituted, err := SubstituteTokens("--flag", tc.text, event)
+		assert.NoError(err, tc.text)
+		assert.Equal(tc.expected, substituted, tc.text)
+	}
+
+	_, err := SubstituteTokens("--flag", "{{ .labels.team }}", event)
+	assert.Error(err)
+	_, err = SubstituteTokens("--flag", "{{ .name }}", nil)
+	assert.Error(err)
+	substituted, err := SubstituteTokens("--flag", "plain", nil)
+	assert.NoError(err)
+	assert.Equal("plain", substituted)
+	_, err = ParseTokens("--flag", "{{ .name ")
+	assert.Error(err)
+}
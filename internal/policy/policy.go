@@ -0,0 +1,163 @@
+// Package policy evaluates a policy file of status rules, gval expressions
+// over the values a check measured and the values of its previous run, so
+// that status logic combining several conditions ("critical if the value is
+// above X and rising") can be version controlled separately from the check
+// definitions.
+package policy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/PaesslerAG/gval"
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+	"gopkg.in/yaml.v2"
+)
+
+// Config holds the policy settings of a check.
+type Config struct {
+	File      string
+	StateFile string
+
+	rules []rule
+}
+
+// rule is a rule of the policy file, rules are evaluated in order and the
+// first one that matches sets the status.
+type rule struct {
+	Status  string `yaml:"status"`
+	When    string `yaml:"when"`
+	Message string `yaml:"message"`
+
+	status int
+	eval   gval.Evaluable
+}
+
+// policyFile is the format of a policy file.
+type policyFile struct {
+	Rules []rule `yaml:"rules"`
+}
+
+// Options returns the plugin config options for c, to be appended to the
+// options of a check.
+func (c *Config) Options() []*sensu.PluginConfigOption {
+	return []*sensu.PluginConfigOption{
+		{
+			Path:     "policy-file",
+			Env:      "",
+			Argument: "policy-file",
+			Default:  "",
+			Usage:    "YAML file of status rules to evaluate instead of the thresholds of the check",
+			Value:    &c.File,
+		},
+		{
+			Path:     "policy-state-file",
+			Env:      "",
+			Argument: "policy-state-file",
+			Default:  "",
+			Usage:    "File to keep the values of the previous run in, available to --policy-file rules as previous",
+			Value:    &c.StateFile,
+		},
+	}
+}
+
+// Validate checks the settings of c and loads the policy file.
+func (c *Config) Validate() error {
+	c.rules = nil
+	if len(c.File) == 0 {
+		if len(c.StateFile) > 0 {
+			return fmt.Errorf("--policy-state-file requires --policy-file")
+		}
+		return nil
+	}
+	data, err := ioutil.ReadFile(c.File)
+	if err != nil {
+		return fmt.Errorf("Error reading --policy-file: %v", err)
+	}
+	var policy policyFile
+	if err := yaml.UnmarshalStrict(data, &policy); err != nil {
+		return fmt.Errorf("Error decoding --policy-file %s: %v", c.File, err)
+	}
+	if len(policy.Rules) == 0 {
+		return fmt.Errorf("--policy-file %s has no rules", c.File)
+	}
+	for i := range policy.Rules {
+		r := &policy.Rules[i]
+		switch strings.ToLower(r.Status) {
+		case "ok":
+			r.status = sensu.CheckStateOK
+		case "warning":
+			r.status = sensu.CheckStateWarning
+		case "critical":
+			r.status = sensu.CheckStateCritical
+		case "unknown":
+			r.status = sensu.CheckStateUnknown
+		default:
+			return fmt.Errorf("--policy-file %s rule %d: status %q must be ok, warning, critical or unknown", c.File, i+1, r.Status)
+		}
+		if len(strings.TrimSpace(r.When)) == 0 {
+			return fmt.Errorf("--policy-file %s rule %d: when is required", c.File, i+1)
+		}
+		if r.eval, err = gval.Full().NewEvaluable(r.When); err != nil {
+			return fmt.Errorf("--policy-file %s rule %d: %v", c.File, i+1, err)
+		}
+	}
+	c.rules = policy.Rules
+	return nil
+}
+
+// Enabled reports whether a policy file is used. Validate must have been
+// called first.
+func (c *Config) Enabled() bool {
+	return len(c.rules) > 0
+}
+
+// Evaluate evaluates the rules against values and returns the status of the
+// first rule that matches, OK if none does, and a description of the match.
+// The values of the previous run are available as previous, an empty object
+// on the first run or without a state file, e.g. previous.value ?? 0.
+func (c *Config) Evaluate(values map[string]interface{}) (int, string, error) {
+	previous := map[string]interface{}{}
+	if len(c.StateFile) > 0 {
+		if data, err := ioutil.ReadFile(c.StateFile); err == nil {
+			// A corrupt state file is treated as a first run.
+			_ = json.Unmarshal(data, &previous)
+		} else if !os.IsNotExist(err) {
+			return 0, "", err
+		}
+	}
+	parameters := map[string]interface{}{"previous": previous}
+	for name, value := range values {
+		parameters[name] = value
+	}
+
+	status, description := sensu.CheckStateOK, "no policy rule matched"
+	for i, r := range c.rules {
+		matched, err := r.eval.EvalBool(context.Background(), parameters)
+		if err != nil {
+			return 0, "", fmt.Errorf("rule %d %q: %v", i+1, r.When, err)
+		}
+		if matched {
+			status, description = r.status, r.Message
+			if len(description) == 0 {
+				description = fmt.Sprintf("policy rule %q matched", r.When)
+			}
+			break
+		}
+	}
+
+	if len(c.StateFile) > 0 {
+		data, err := json.Marshal(values)
+		if err != nil {
+			return 0, "", err
+		}
+		if err := ioutil.WriteFile(c.StateFile, data, 0600); err != nil {
+			return 0, "", err
+		}
+	}
+	return status, description, nil
+}
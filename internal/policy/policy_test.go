@@ -0,0 +1,88 @@
+package policy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEvaluate(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "http-checks-policy")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	policyFile := filepath.Join(dir, "policy.yml")
+	require.NoError(t, ioutil.WriteFile(policyFile, []byte(`
+rules:
+  - status: critical
+    when: value > 100 && value > (previous.value ?? value)
+    message: value above 100 and rising
+  - status: warning
+    when: value > 100
+`), 0644))
+
+	c := Config{File: policyFile, StateFile: filepath.Join(dir, "state.json")}
+	require.NoError(t, c.Validate())
+	assert.True(c.Enabled())
+
+	testCases := []struct {
+		value       float64
+		status      int
+		description string
+	}{
+		{50, sensu.CheckStateOK, "no policy rule matched"},
+		{150, sensu.CheckStateCritical, "value above 100 and rising"},
+		{120, sensu.CheckStateWarning, `policy rule "value > 100" matched`},
+		{120, sensu.CheckStateWarning, `policy rule "value > 100" matched`},
+		{130, sensu.CheckStateCritical, "value above 100 and rising"},
+	}
+	for _, tc := range testCases {
+		status, description, err := c.Evaluate(map[string]interface{}{"value": tc.value})
+		assert.NoError(err)
+		assert.Equal(tc.status, status, tc.value)
+		assert.Equal(tc.description, description)
+	}
+
+	// Without a state file every run is a first run.
+	c.StateFile = ""
+	status, _, err := c.Evaluate(map[string]interface{}{"value": 150})
+	assert.NoError(err)
+	assert.Equal(sensu.CheckStateWarning, status)
+
+	_, _, err = c.Evaluate(map[string]interface{}{"other": 150})
+	assert.Error(err)
+}
+
+func TestValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "http-checks-policy")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var c Config
+	assert.NoError(c.Validate())
+	assert.False(c.Enabled())
+	c.StateFile = filepath.Join(dir, "state.json")
+	assert.Error(c.Validate())
+
+	for _, policy := range []string{
+		"rules: []",
+		"rules:\n  - status: bad\n    when: value > 1",
+		"rules:\n  - status: critical",
+		"rules:\n  - status: critical\n    when: value >",
+		"rules:\n  - status: critical\n    when: value > 1\n    unless: value > 2",
+	} {
+		c.File = filepath.Join(dir, "policy.yml")
+		require.NoError(t, ioutil.WriteFile(c.File, []byte(policy), 0644))
+		assert.Error(c.Validate(), policy)
+	}
+	c.File = filepath.Join(dir, "missing.yml")
+	assert.Error(c.Validate())
+}
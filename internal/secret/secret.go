@@ -0,0 +1,40 @@
+// Package secret reads secrets such as passwords and tokens from files, e.g.
+// Kubernetes secret mounts or files rendered by vault-agent, so they do not
+// show up in process listings or check definitions.
+package secret
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strings"
+)
+
+// maxSize is the maximum size of a secret file.
+const maxSize = 64 * 1024
+
+// ReadFile returns the contents of the secret file at path, without a
+// trailing newline. The file must be a regular file (symbolic links are
+// followed) that is neither writable by its group nor accessible by other
+// users, file permissions are not checked on Windows.
+func ReadFile(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if !info.Mode().IsRegular() {
+		return "", fmt.Errorf("%s is not a regular file", path)
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0027 != 0 {
+		return "", fmt.Errorf("%s has mode %04o, it must not be group writable or accessible by others", path, info.Mode().Perm())
+	}
+	if info.Size() > maxSize {
+		return "", fmt.Errorf("%s is larger than %d bytes", path, maxSize)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
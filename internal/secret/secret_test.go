@@ -0,0 +1,48 @@
+package secret
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadFile(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "http-checks-secret")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	write := func(name, contents string, mode os.FileMode) string {
+		path := filepath.Join(dir, name)
+		require.NoError(t, ioutil.WriteFile(path, []byte(contents), mode))
+		require.NoError(t, os.Chmod(path, mode))
+		return path
+	}
+
+	value, err := ReadFile(write("token", "s3cret\n", 0600))
+	assert.NoError(err)
+	assert.Equal("s3cret", value)
+	value, err = ReadFile(write("group-readable", "s3cret\r\n", 0640))
+	assert.NoError(err)
+	assert.Equal("s3cret", value)
+
+	// Kubernetes mounts secrets as symbolic links.
+	require.NoError(t, os.Symlink(filepath.Join(dir, "token"), filepath.Join(dir, "link")))
+	value, err = ReadFile(filepath.Join(dir, "link"))
+	assert.NoError(err)
+	assert.Equal("s3cret", value)
+
+	_, err = ReadFile(write("world-readable", "s3cret", 0644))
+	assert.Error(err)
+	_, err = ReadFile(write("group-writable", "s3cret", 0660))
+	assert.Error(err)
+	_, err = ReadFile(dir)
+	assert.Error(err)
+	_, err = ReadFile(filepath.Join(dir, "missing"))
+	assert.Error(err)
+}
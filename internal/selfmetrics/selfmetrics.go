@@ -0,0 +1,279 @@
+// Package selfmetrics measures the checks themselves: how long they run, how
+// many requests they retried, how many bytes they received and how many DNS
+// lookups they performed. With --self-metrics these are appended to the
+// perfdata of the check output, for trending the monitoring overhead and
+// spotting checks that approach their Sensu timeout.
+//
+// With --error-metrics the check output also has a 0/1 metric for each
+// category of transport error, set if any request of the run failed with
+// such an error, so dashboards can tell a service that is down from a broken
+// name or a firewall change without parsing the output.
+package selfmetrics
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	corev2 "github.com/sensu/sensu-go/api/core/v2"
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+)
+
+var (
+	// start approximates the start of the process, package variables are
+	// initialized before main runs.
+	start = time.Now()
+
+	retries       int64
+	bytesReceived int64
+	dnsLookups    int64
+
+	errorsMu sync.Mutex
+	errors   = map[string]bool{}
+)
+
+// The categories of transport errors, the names of their metrics.
+const (
+	DNSFailure      = "dns_failure"
+	ConnRefused     = "conn_refused"
+	HostUnreachable = "host_unreachable"
+	TLSFailure      = "tls_failure"
+	Timeout         = "timeout"
+)
+
+var categories = []string{DNSFailure, ConnRefused, HostUnreachable, TLSFailure, Timeout}
+
+// Config holds the self metrics settings of a check.
+type Config struct {
+	Enabled bool
+	Errors  bool
+}
+
+// Options returns the plugin config options for c, to be appended to the
+// options of a check.
+func (c *Config) Options() []*sensu.PluginConfigOption {
+	return []*sensu.PluginConfigOption{
+		{
+			Path:     "self-metrics",
+			Env:      "CHECK_SELF_METRICS",
+			Argument: "self-metrics",
+			Default:  false,
+			Usage:    "Append the run time, retries, bytes received and DNS lookups of the check itself to the perfdata",
+			Value:    &c.Enabled,
+		},
+		{
+			Path:     "error-metrics",
+			Env:      "CHECK_ERROR_METRICS",
+			Argument: "error-metrics",
+			Default:  false,
+			Usage:    "Append 0/1 metrics of the transport errors of the check (dns_failure, conn_refused, host_unreachable, tls_failure, timeout) to the perfdata",
+			Value:    &c.Errors,
+		},
+	}
+}
+
+// AddRetry counts a retried request.
+func AddRetry() {
+	atomic.AddInt64(&retries, 1)
+}
+
+// AddDNSLookup counts a DNS lookup.
+func AddDNSLookup() {
+	atomic.AddInt64(&dnsLookups, 1)
+}
+
+// AddError records a transport error of category, one of the error
+// categories. Other categories, including "", are ignored.
+func AddError(category string) {
+	errorsMu.Lock()
+	defer errorsMu.Unlock()
+	for _, known := range categories {
+		if category == known {
+			errors[category] = true
+		}
+	}
+}
+
+// Dial wraps dial to count the bytes received on the connections it returns,
+// and a DNS lookup for every address that is a host name rather than an IP
+// address, as the dialer resolves those.
+func Dial(dial func(ctx context.Context, network, address string) (net.Conn, error)) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		if host, _, err := net.SplitHostPort(address); err == nil && net.ParseIP(host) == nil {
+			AddDNSLookup()
+		}
+		conn, err := dial(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		// UDP connections must remain a net.PacketConn, the Go resolver
+		// frames its messages differently otherwise.
+		if udpConn, ok := conn.(*net.UDPConn); ok {
+			return &countingUDPConn{UDPConn: udpConn}, nil
+		}
+		return &countingConn{Conn: conn}, nil
+	}
+}
+
+type countingConn struct {
+	net.Conn
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddInt64(&bytesReceived, int64(n))
+	return n, err
+}
+
+type countingUDPConn struct {
+	*net.UDPConn
+}
+
+func (c *countingUDPConn) Read(p []byte) (int, error) {
+	n, err := c.UDPConn.Read(p)
+	atomic.AddInt64(&bytesReceived, int64(n))
+	return n, err
+}
+
+// Perfdata returns the self metrics as perfdata.
+func Perfdata() string {
+	return fmt.Sprintf("check_duration=%0.6f, check_retries=%d, check_bytes_received=%d, check_dns_lookups=%d",
+		time.Since(start).Seconds(), atomic.LoadInt64(&retries), atomic.LoadInt64(&bytesReceived), atomic.LoadInt64(&dnsLookups))
+}
+
+// ErrorPerfdata returns the error metrics as perfdata.
+func ErrorPerfdata() string {
+	errorsMu.Lock()
+	defer errorsMu.Unlock()
+	perfdata := make([]string, len(categories))
+	for i, category := range categories {
+		value := 0
+		if errors[category] {
+			value = 1
+		}
+		perfdata[i] = fmt.Sprintf("%s=%d", category, value)
+	}
+	return strings.Join(perfdata, ", ")
+}
+
+// Stdout is the standard output of the checks, they print their output to it
+// so that Wrap can append the metrics to their status line.
+var Stdout io.Writer = &stdout
+
+var stdout writer
+
+// writer writes to os.Stdout, looked up on every write so that tests can
+// replace it. While a check wrapped by Wrap runs it holds back the first line
+// to append the metrics to it, if it is the status line of the check.
+type writer struct {
+	mu       sync.Mutex
+	status   *regexp.Regexp
+	perfdata func() string
+	line     []byte
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.perfdata == nil {
+		return os.Stdout.Write(p)
+	}
+	i := bytes.IndexByte(p, '\n')
+	if i < 0 {
+		w.line = append(w.line, p...)
+		return len(p), nil
+	}
+	w.line = append(w.line, p[:i]...)
+	if err := w.flush(); err != nil {
+		return 0, err
+	}
+	if _, err := os.Stdout.Write(p[i:]); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// flush writes the line held back, with the metrics appended if it is a
+// status line, and stops holding back output.
+func (w *writer) flush() error {
+	line := w.line
+	if w.status.Match(line) {
+		line = appendPerfdata(line, w.perfdata())
+	}
+	w.status, w.perfdata, w.line = nil, nil, nil
+	_, err := os.Stdout.Write(line)
+	return err
+}
+
+// start makes w hold back the first line printed, to append perfdata to it
+// if it is a status line of the check named name.
+func (w *writer) start(name string, perfdata func() string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.status = regexp.MustCompile(`^` + regexp.QuoteMeta(name) + ` (OK|WARNING|CRITICAL|UNKNOWN):`)
+	w.perfdata = perfdata
+	w.line = nil
+}
+
+// stop writes the first line if it is still held back, a status line without
+// its newline.
+func (w *writer) stop() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.perfdata == nil {
+		return
+	}
+	if len(w.line) == 0 {
+		w.status, w.perfdata = nil, nil
+		return
+	}
+	status := w.status.Match(w.line)
+	if err := w.flush(); err == nil && status {
+		_, _ = os.Stdout.Write([]byte("\n"))
+	}
+}
+
+// Wrap returns a check function for a check named name that calls execute
+// and, if enabled, appends the self metrics and error metrics to the perfdata
+// of its status line, the first line it prints to Stdout if that starts with
+// its name and state. Other output, such as a response body printed as is, is
+// left unchanged.
+func (c *Config) Wrap(name string, execute func(*corev2.Event) (int, error)) func(*corev2.Event) (int, error) {
+	return func(event *corev2.Event) (int, error) {
+		if !c.Enabled && !c.Errors {
+			return execute(event)
+		}
+		stdout.start(name, func() string {
+			var perfdata []string
+			if c.Enabled {
+				perfdata = append(perfdata, Perfdata())
+			}
+			if c.Errors {
+				perfdata = append(perfdata, ErrorPerfdata())
+			}
+			return strings.Join(perfdata, ", ")
+		})
+		defer stdout.stop()
+		return execute(event)
+	}
+}
+
+// appendPerfdata adds perfdata to line, after the perfdata already on it if
+// any.
+func appendPerfdata(line []byte, perfdata string) []byte {
+	separator := " | "
+	if bytes.Contains(line, []byte(" | ")) {
+		separator = ", "
+	}
+	result := append([]byte{}, line...)
+	result = append(result, separator...)
+	return append(result, perfdata...)
+}
@@ -0,0 +1,165 @@
+package selfmetrics
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	corev2 "github.com/sensu/sensu-go/api/core/v2"
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAppendPerfdata(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal("check OK: fine | a=1", string(appendPerfdata([]byte("check OK: fine"), "a=1")))
+	assert.Equal("check OK: fine | b=2, a=1", string(appendPerfdata([]byte("check OK: fine | b=2"), "a=1")))
+}
+
+func TestDial(t *testing.T) {
+	assert := assert.New(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			_, _ = conn.Write([]byte("hello"))
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	lookups, received := atomic.LoadInt64(&dnsLookups), atomic.LoadInt64(&bytesReceived)
+	var dialer net.Dialer
+	dial := Dial(dialer.DialContext)
+	for _, address := range []string{listener.Addr().String(), net.JoinHostPort("localhost", port)} {
+		conn, err := dial(context.Background(), "tcp", address)
+		if err != nil {
+			// localhost may resolve to ::1 first on some hosts.
+			continue
+		}
+		_, err = ioutil.ReadAll(conn)
+		assert.NoError(err)
+		conn.Close()
+	}
+	assert.Equal(lookups+1, atomic.LoadInt64(&dnsLookups))
+	assert.True(atomic.LoadInt64(&bytesReceived) >= received+5)
+}
+
+func TestWrap(t *testing.T) {
+	assert := assert.New(t)
+	event := corev2.FixtureEvent("entity1", "check")
+	execute := func(*corev2.Event) (int, error) {
+		AddRetry()
+		fmt.Fprint(Stdout, "check WARNING: ")
+		fmt.Fprintln(Stdout, "slow | duration=2")
+		fmt.Fprintln(Stdout, "Protocol: HTTP/2.0")
+		return sensu.CheckStateWarning, nil
+	}
+
+	run := func(c *Config) (int, string) {
+		return capture(t, func() (int, error) {
+			return c.Wrap("check", execute)(event)
+		})
+	}
+
+	status, output := run(&Config{})
+	assert.Equal(sensu.CheckStateWarning, status)
+	assert.Equal("check WARNING: slow | duration=2\nProtocol: HTTP/2.0\n", output)
+
+	status, output = run(&Config{Enabled: true})
+	assert.Equal(sensu.CheckStateWarning, status)
+	assert.Regexp(`^check WARNING: slow \| duration=2, check_duration=[0-9.]+, check_retries=`+strconv.FormatInt(atomic.LoadInt64(&retries), 10)+`, check_bytes_received=[0-9]+, check_dns_lookups=[0-9]+\nProtocol: HTTP/2.0\n$`, output)
+
+	errorsMu.Lock()
+	errors = map[string]bool{}
+	errorsMu.Unlock()
+	AddError(ConnRefused)
+	AddError(ConnRefused)
+	AddError("")
+	AddError("something else")
+	status, output = run(&Config{Errors: true})
+	assert.Equal(sensu.CheckStateWarning, status)
+	assert.Equal("check WARNING: slow | duration=2, dns_failure=0, conn_refused=1, host_unreachable=0, tls_failure=0, timeout=0\nProtocol: HTTP/2.0\n", output)
+
+	_, output = run(&Config{Enabled: true, Errors: true})
+	assert.Regexp(`^check WARNING: slow \| duration=2, check_duration=.*, check_dns_lookups=[0-9]+, dns_failure=0, conn_refused=1, `, output)
+}
+
+func TestWrapOtherOutput(t *testing.T) {
+	assert := assert.New(t)
+	event := corev2.FixtureEvent("entity1", "check")
+	c := &Config{Enabled: true}
+
+	// A response body printed as is is left unchanged.
+	status, output := capture(t, func() (int, error) {
+		return c.Wrap("check", func(*corev2.Event) (int, error) {
+			fmt.Fprint(Stdout, "m_total 1\nm_other 2\n")
+			return sensu.CheckStateOK, nil
+		})(event)
+	})
+	assert.Equal(sensu.CheckStateOK, status)
+	assert.Equal("m_total 1\nm_other 2\n", output)
+
+	// As is the status line of another check.
+	_, output = capture(t, func() (int, error) {
+		return c.Wrap("check", func(*corev2.Event) (int, error) {
+			fmt.Fprintln(Stdout, "checker OK: fine")
+			return sensu.CheckStateOK, nil
+		})(event)
+	})
+	assert.Equal("checker OK: fine\n", output)
+
+	// A status line without a newline gets one after the metrics.
+	_, output = capture(t, func() (int, error) {
+		return c.Wrap("check", func(*corev2.Event) (int, error) {
+			fmt.Fprint(Stdout, "check OK: fine")
+			return sensu.CheckStateOK, nil
+		})(event)
+	})
+	assert.Regexp(`^check OK: fine \| check_duration=.*, check_dns_lookups=[0-9]+\n$`, output)
+
+	// Output printed after a panic is not lost.
+	_, output = capture(t, func() (status int, err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("%v", r)
+			}
+		}()
+		return c.Wrap("check", func(*corev2.Event) (int, error) {
+			fmt.Fprint(Stdout, "check CRITICAL: partial")
+			panic("boom")
+		})(event)
+	})
+	assert.Regexp(`^check CRITICAL: partial \| check_duration=.*\n$`, output)
+
+	// Without a wrapped check running, output is written as is.
+	_, output = capture(t, func() (int, error) {
+		fmt.Fprint(Stdout, "check OK: fine")
+		return sensu.CheckStateOK, nil
+	})
+	assert.Equal("check OK: fine", output)
+}
+
+// capture returns the result of f and what it printed to os.Stdout.
+func capture(t *testing.T, f func() (int, error)) (int, string) {
+	stdout := os.Stdout
+	defer func() { os.Stdout = stdout }()
+	r, w, err := os.Pipe()
+	require.NoError(t, err)
+	os.Stdout = w
+	status, _ := f()
+	w.Close()
+	output, _ := ioutil.ReadAll(r)
+	return status, string(output)
+}